@@ -0,0 +1,356 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gambol99/rbd-fence/pkg/audit"
+	"github.com/gambol99/rbd-fence/pkg/fence"
+	"github.com/gambol99/rbd-fence/pkg/queue"
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// the scheme expected on the authorization header
+	apiAuthScheme = "Bearer "
+	// the maximum size of a request body we will read
+	apiMaxRequestSize = 64 * 1024
+)
+
+// apiHost ... a host as presented by the api
+type apiHost struct {
+	// the id of the node
+	ID string `json:"id"`
+	// the addresses of the node
+	Addresses []string `json:"addresses"`
+	// the state as reported by the event source
+	State string `json:"state,omitempty"`
+	// the node is in our hosts map
+	Tracked bool `json:"tracked"`
+	// the node is running according to the event source
+	Running bool `json:"running"`
+}
+
+// apiLock ... a lock on an image and the instance which holds it
+type apiLock struct {
+	rbd.ImageLock
+	// the instance the lock maps to, if known
+	InstanceID string `json:"instance_id,omitempty"`
+}
+
+// apiFences ... the pending and in-flight fence jobs
+type apiFences struct {
+	// the jobs waiting in the queue
+	Pending []*queue.FenceJob `json:"pending"`
+	// the jobs being processed
+	Inflight []queue.FenceJob `json:"inflight"`
+}
+
+// apiFenceRequest ... a request from an operator to fence an instance or address
+type apiFenceRequest struct {
+	// the instance to fence
+	InstanceID string `json:"instance_id"`
+	// the address to fence
+	Address string `json:"address"`
+	// fence even if the address belongs to a running node
+	Force bool `json:"force"`
+}
+
+// apiError ... the error response
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// adminAPI ... the http admin interface to the service
+type adminAPI struct {
+	// the token required to access the api
+	token string
+}
+
+// newAdminAPI ... creates the admin api handler
+//
+//	token:		the bearer token required on every request
+func newAdminAPI(token string) (http.Handler, error) {
+	if token == "" {
+		return nil, fmt.Errorf("you must specify a token for the admin api")
+	}
+	api := &adminAPI{token: token}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/hosts", api.authorize(api.hostsHandler))
+	mux.HandleFunc("/api/v1/locks", api.authorize(api.locksHandler))
+	mux.HandleFunc("/api/v1/fences", api.authorize(api.fencesHandler))
+	mux.HandleFunc("/api/v1/orphans", api.authorize(api.orphansHandler))
+
+	return mux, nil
+}
+
+// serveAPI ... serves the admin api on the interface
+func serveAPI(listen string, handler http.Handler) {
+	glog.Infof("Starting the admin api on: %s", listen)
+	if err := http.ListenAndServe(listen, handler); err != nil {
+		glog.Errorf("Failed to serve the admin api, error: %s", err)
+	}
+}
+
+// getAPIToken ... reads the api token from the configuration
+func getAPIToken() (string, error) {
+	if config.api_token_file == "" {
+		return config.api_token, nil
+	}
+	content, err := ioutil.ReadFile(config.api_token_file)
+	if err != nil {
+		return "", fmt.Errorf("unable to read the api token file, error: %s", err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// authorize ... wraps the handler, checking the bearer token on the request
+func (r *adminAPI) authorize(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		header := req.Header.Get("Authorization")
+		// step: a raw token without the scheme is refused
+		if !strings.HasPrefix(header, apiAuthScheme) ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, apiAuthScheme)), []byte(r.token)) != 1 {
+			glog.Warningf("Unauthorized request to the admin api from: %s, path: %s", req.RemoteAddr, req.URL.Path)
+			r.writeError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+			return
+		}
+		glog.V(4).Infof("Admin api request from: %s, method: %s, path: %s", req.RemoteAddr, req.Method, req.URL.Path)
+		handler(w, req)
+	}
+}
+
+// hostsHandler ... lists the hosts we are tracking and those the event source reports running
+func (r *adminAPI) hostsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		r.writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	list := make(map[string]*apiHost, 0)
+	for id, addresses := range orchestrator.Nodes() {
+		list[id] = &apiHost{ID: id, Addresses: addresses, Tracked: true}
+	}
+	for id, node := range eventsClient.GetRunningNodes() {
+		host, found := list[id]
+		if !found {
+			host = &apiHost{ID: id, Addresses: node.Addresses}
+			list[id] = host
+		}
+		host.State = node.State
+		host.Running = true
+	}
+
+	var ids []string
+	for id := range list {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	hosts := make([]*apiHost, 0)
+	for _, id := range ids {
+		hosts = append(hosts, list[id])
+	}
+
+	r.writeJSON(w, http.StatusOK, hosts)
+}
+
+// locksHandler ... lists the locks in the selected pools and the instances holding them
+func (r *adminAPI) locksHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		r.writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+	locks, err := rbdClient.ListLocks(getPoolSelector())
+	if err != nil {
+		r.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// step: map the addresses back to the instances
+	owners := make(map[string]string, 0)
+	for id, addresses := range orchestrator.Nodes() {
+		for _, address := range addresses {
+			owners[address] = id
+		}
+	}
+	list := make([]apiLock, 0)
+	for _, lock := range locks {
+		list = append(list, apiLock{ImageLock: lock, InstanceID: owners[lock.Owner.Address]})
+	}
+
+	r.writeJSON(w, http.StatusOK, list)
+}
+
+// fencesHandler ... lists the fence jobs or triggers a new fence
+func (r *adminAPI) fencesHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		r.listFences(w, req)
+	case "POST":
+		r.triggerFence(w, req)
+	default:
+		r.writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+	}
+}
+
+// listFences ... lists the pending and in-flight fence jobs
+func (r *adminAPI) listFences(w http.ResponseWriter, req *http.Request) {
+	jobs, err := fenceQueue.List()
+	if err != nil {
+		r.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	running := orchestrator.Running()
+
+	fences := apiFences{
+		Pending:  make([]*queue.FenceJob, 0),
+		Inflight: make([]queue.FenceJob, 0),
+	}
+	for _, job := range jobs {
+		if _, found := running[job.InstanceID]; !found {
+			fences.Pending = append(fences.Pending, job)
+		}
+	}
+	for _, job := range running {
+		fences.Inflight = append(fences.Inflight, job)
+	}
+
+	r.writeJSON(w, http.StatusOK, fences)
+}
+
+// triggerFence ... fences the instance or address requested by the operator
+func (r *adminAPI) triggerFence(w http.ResponseWriter, req *http.Request) {
+	request := new(apiFenceRequest)
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, apiMaxRequestSize)).Decode(request); err != nil {
+		r.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request, error: %s", err))
+		return
+	}
+	if !leaderElection.IsLeader() {
+		r.writeError(w, http.StatusServiceUnavailable, fmt.Errorf("we are not the leader, please use the leader"))
+		return
+	}
+
+	job := &queue.FenceJob{
+		Pools:   getPoolSelector(),
+		State:   "manual",
+		Trigger: audit.TriggerAPI,
+		Force:   request.Force,
+	}
+	switch {
+	case request.InstanceID != "" && request.Address == "":
+		addresses, found := orchestrator.GetNode(request.InstanceID)
+		if !found {
+			r.writeError(w, http.StatusNotFound, fmt.Errorf("the instance: %s is not known to us", request.InstanceID))
+			return
+		}
+		if _, running := eventsClient.GetRunningNodes()[request.InstanceID]; running && !request.Force {
+			r.writeError(w, http.StatusConflict, fmt.Errorf("the instance: %s is running, use force to fence it regardless", request.InstanceID))
+			return
+		}
+		job.InstanceID = request.InstanceID
+		job.Addresses = addresses
+	case request.Address != "" && request.InstanceID == "":
+		if id, found := orchestrator.AddressInUse(request.Address, ""); found && !request.Force {
+			r.writeError(w, http.StatusConflict, fmt.Errorf("the address: %s belongs to the running instance: %s, use force to fence it regardless", request.Address, id))
+			return
+		}
+		job.InstanceID = request.Address
+		job.Addresses = []string{request.Address}
+	default:
+		r.writeError(w, http.StatusBadRequest, fmt.Errorf("you must specify either the instance_id or the address"))
+		return
+	}
+	glog.Infof("Operator requested fence from: %s, %s", req.RemoteAddr, job)
+
+	// step: in dry-run we return the plans rather than fencing
+	if getConfig().dry_run {
+		plans := make([]*rbd.FencePlan, 0)
+		for _, address := range job.Addresses {
+			plan, err := rbdClient.PlanClient(address, job.Pools, getFenceOptions())
+			if err != nil {
+				r.writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			plans = append(plans, plan)
+		}
+		r.writeJSON(w, http.StatusOK, plans)
+		return
+	}
+
+	if orchestrator.Active(job.InstanceID) {
+		r.writeError(w, http.StatusConflict, fmt.Errorf("the instance: %s is presently being fenced", job.InstanceID))
+		return
+	}
+	if err := fenceQueue.Put(job); err != nil {
+		r.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	accepted := *job
+	if _, err := orchestrator.Submit(job); err != nil {
+		if err == fence.ErrShuttingDown {
+			r.writeError(w, http.StatusServiceUnavailable, fmt.Errorf("the service is shutting down, the job will be resumed on the next start"))
+			return
+		}
+		r.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	r.writeJSON(w, http.StatusAccepted, accepted)
+}
+
+// orphansHandler ... shows the orphaned and unknown locks found by the last reconcile scan
+func (r *adminAPI) orphansHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		r.writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+	if reconciler == nil {
+		r.writeError(w, http.StatusNotFound, fmt.Errorf("the reconciler is not enabled"))
+		return
+	}
+	report := reconciler.LastReport()
+	if report == nil {
+		r.writeError(w, http.StatusNotFound, fmt.Errorf("the reconciler has not completed a scan yet"))
+		return
+	}
+
+	r.writeJSON(w, http.StatusOK, report)
+}
+
+// writeJSON ... encodes the response as json
+func (r *adminAPI) writeJSON(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		glog.Errorf("Failed to encode the api response, error: %s", err)
+	}
+}
+
+// writeError ... encodes the error as a json response
+func (r *adminAPI) writeError(w http.ResponseWriter, code int, err error) {
+	r.writeJSON(w, code, apiError{Error: err.Error()})
+}
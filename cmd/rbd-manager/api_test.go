@@ -0,0 +1,158 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gambol99/rbd-fence/pkg/membership"
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+	"github.com/gambol99/rbd-fence/pkg/rbd/fake"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testAPIToken = "secret"
+
+// runningSource ... a event source reporting a fixed set of running nodes
+type runningSource struct {
+	// the running nodes
+	nodes map[string]membership.Node
+}
+
+func (r *runningSource) AddEventListener(int) membership.EventCh     { return nil }
+func (r *runningSource) GetRunningNodes() map[string]membership.Node { return r.nodes }
+
+// setupAPI ... sets up the service with a fake cluster and the admin api, i-running is reported running
+func setupAPI(t *testing.T) (http.Handler, *fake.FakeRBD) {
+	client := setupFence(t)
+	eventsClient = &runningSource{nodes: map[string]membership.Node{
+		"i-running": {ID: "i-running", Addresses: []string{"10.0.0.2"}, State: membership.StateRunning},
+	}}
+	handler, err := newAdminAPI(testAPIToken)
+	if err != nil {
+		t.Fatalf("unable to create the admin api, error: %s", err)
+	}
+
+	return handler, client
+}
+
+// apiRequest ... performs a request against the api with the authorization header
+func apiRequest(handler http.Handler, method, path, authorization, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	return recorder
+}
+
+func TestNewAdminAPI(t *testing.T) {
+	_, err := newAdminAPI("")
+	assert.Error(t, err)
+}
+
+func TestAPIAuthorize(t *testing.T) {
+	handler, _ := setupAPI(t)
+
+	cases := []struct {
+		Authorization string
+		Expected      int
+	}{
+		{Expected: http.StatusUnauthorized},
+		{Authorization: "Bearer wrong", Expected: http.StatusUnauthorized},
+		{Authorization: "Bearer ", Expected: http.StatusUnauthorized},
+		// step: the token without the scheme is refused
+		{Authorization: testAPIToken, Expected: http.StatusUnauthorized},
+		{Authorization: "Basic " + testAPIToken, Expected: http.StatusUnauthorized},
+		{Authorization: "Bearer " + testAPIToken, Expected: http.StatusOK},
+	}
+	for i, c := range cases {
+		resp := apiRequest(handler, "GET", "/api/v1/fences", c.Authorization, "")
+		assert.Equal(t, c.Expected, resp.Code, "case %d, authorization: %q", i, c.Authorization)
+	}
+}
+
+func TestAPIFenceRunningNode(t *testing.T) {
+	handler, client := setupAPI(t)
+
+	resp := apiRequest(handler, "POST", "/api/v1/fences", "Bearer "+testAPIToken, `{"instance_id": "i-running"}`)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	resp = apiRequest(handler, "POST", "/api/v1/fences", "Bearer "+testAPIToken, `{"address": "10.0.0.2"}`)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Equal(t, 0, len(client.CallsTo("UnlockClient")))
+	assert.Equal(t, 0, len(getQueuedJobs(t)))
+
+	// step: forcing the fence removes the locks regardless
+	resp = apiRequest(handler, "POST", "/api/v1/fences", "Bearer "+testAPIToken, `{"instance_id": "i-running", "force": true}`)
+	assert.Equal(t, http.StatusAccepted, resp.Code)
+	waitForFences(t)
+	assert.Equal(t, 1, len(client.CallsTo("UnlockClient")))
+	assert.Equal(t, 0, len(client.Locks("rbd", "vol2")))
+}
+
+func TestAPIFenceDryRun(t *testing.T) {
+	handler, client := setupAPI(t)
+	config.dry_run = true
+	defer func() { config.dry_run = false }()
+
+	resp := apiRequest(handler, "POST", "/api/v1/fences", "Bearer "+testAPIToken, `{"instance_id": "i-dead"}`)
+	if !assert.Equal(t, http.StatusOK, resp.Code) {
+		return
+	}
+	var plans []rbd.FencePlan
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&plans))
+	if assert.Equal(t, 1, len(plans)) {
+		assert.Equal(t, "10.0.0.1", plans[0].Address)
+		var images []string
+		for _, x := range plans[0].Actions {
+			if x.Image != "" {
+				images = append(images, x.Pool+"/"+x.Image)
+			}
+		}
+		assert.Equal(t, []string{"rbd/vol1", "volumes/data1"}, images)
+	}
+	// step: nothing is queued or unlocked
+	assert.Equal(t, 0, len(client.CallsTo("UnlockClient")))
+	assert.Equal(t, 0, len(getQueuedJobs(t)))
+}
+
+func TestAPIFenceFollower(t *testing.T) {
+	handler, client := setupAPI(t)
+	leaderElection = follower{}
+
+	resp := apiRequest(handler, "POST", "/api/v1/fences", "Bearer "+testAPIToken, `{"instance_id": "i-dead"}`)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Equal(t, 0, len(client.CallsTo("UnlockClient")))
+	assert.Equal(t, 0, len(getQueuedJobs(t)))
+}
+
+func TestAPIFenceRequestTooLarge(t *testing.T) {
+	handler, client := setupAPI(t)
+
+	body := `{"address": "` + string(bytes.Repeat([]byte("a"), apiMaxRequestSize)) + `"}`
+	resp := apiRequest(handler, "POST", "/api/v1/fences", "Bearer "+testAPIToken, body)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Equal(t, 0, len(client.CallsTo("UnlockClient")))
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/gambol99/rbd-fence/pkg/audit"
+	"github.com/gambol99/rbd-fence/pkg/membership"
+	"github.com/gambol99/rbd-fence/pkg/queue"
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+
+	"github.com/golang/glog"
+)
+
+// auditUnlock ... appends the audit record of the attempt to remove a lock for the fence job, a failure to
+// write the record is logged but does not stop the fence
+func auditUnlock(job *queue.FenceJob, event rbd.UnlockEvent) {
+	if auditLog == nil {
+		return
+	}
+	// step: the nodes we fence on an event were running when we last saw them
+	transition := job.State
+	if job.Trigger == audit.TriggerEvent {
+		transition = fmt.Sprintf("%s -> %s", membership.StateRunning, job.State)
+	}
+	if err := auditLog.Write(audit.NewRecord(job.Trigger, job.InstanceID, transition, event)); err != nil {
+		glog.Errorf("Failed to write the audit record for image: %s/%s, error: %s", event.Pool, event.Image, err)
+	}
+}
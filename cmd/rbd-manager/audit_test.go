@@ -0,0 +1,73 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/audit"
+	"github.com/gambol99/rbd-fence/pkg/membership"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditUnlock(t *testing.T) {
+	client := setupFence(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	var err error
+	auditLog, err = audit.NewFileLogger(path, 1024*1024, 1)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	removeRBDLocks(&membership.NodeEvent{
+		ID:   "i-dead",
+		Node: membership.Node{ID: "i-dead", State: membership.StateTerminated},
+	})
+	waitForFences(t)
+	assert.NoError(t, auditLog.Close())
+	assert.Equal(t, 2, len(client.CallsTo("UnlockImage")))
+
+	file, err := os.Open(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer file.Close()
+	var records []audit.Record
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record audit.Record
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	if assert.Equal(t, 2, len(records)) {
+		assert.Equal(t, audit.TriggerEvent, records[0].Trigger)
+		assert.Equal(t, "i-dead", records[0].InstanceID)
+		assert.Equal(t, "running -> terminated", records[0].Transition)
+		assert.Equal(t, "rbd", records[0].Pool)
+		assert.Equal(t, "vol1", records[0].Image)
+		assert.Equal(t, "client.4161", records[0].Owner.ClientID)
+		assert.True(t, records[0].Result.Success)
+		assert.Equal(t, "volumes", records[1].Pool)
+		assert.WithinDuration(t, time.Now(), records[1].Timestamp, time.Minute)
+	}
+}
@@ -18,33 +18,196 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/membership"
+	"github.com/gambol99/rbd-fence/pkg/notify"
+	"github.com/gambol99/rbd-fence/pkg/rbd"
 )
 
-var config struct {
+// configuration ... the options of the service, taken from the command line and the configuration file
+type configuration struct {
+	// the path to the configuration file
+	config_file string
 	// the location / path of the rbd command
 	rbd_path string
-	// the aws key - should never really be used
-	aws_api_key string
-	// the aws secret
-	aws_api_secret string
-	// the api region
-	aws_region string
+	// the event source to consume node events from
+	source string
 	// the rbd poll
 	rbd_pool string
-	// the vpc id
-	envTag string
+	// the glob patterns of pools to include
+	rbd_pool_include string
+	// the glob patterns of pools to exclude
+	rbd_pool_exclude string
+	// the directory to persist pending fence jobs
+	queue_dir string
+	// the age the jobs recorded while a follower are dropped rather than resumed at
+	follower_expiry time.Duration
+	// blacklist the client before removing the locks
+	blacklist bool
+	// refuse to remove the locks unless the blacklist succeeded
+	require_blacklist bool
+	// the expiry of the blacklist entry
+	blacklist_expiry time.Duration
+	// the number of attempts made to fence a node
+	fence_attempts int
+	// the delay between the attempts to fence a node
+	fence_retry_delay time.Duration
+	// the number of nodes fenced concurrently
+	fence_workers int
+	// the retrying of the images which failed to unlock
+	unlock_retry rbd.Backoff
+	// the time we wait for the running fence jobs on shutdown
+	shutdown_timeout time.Duration
+	// only log what would be done
+	dry_run bool
+	// the output format of the plan
+	output string
+	// the backend used for leader election, file or rados
+	election string
+	// the path to the lease file on shared storage
+	election_file string
+	// the pool containing the rados lease object
+	election_pool string
+	// the name of the rados lease object
+	election_object string
+	// the time to live on the leadership lease
+	election_ttl time.Duration
+	// our identity in the election
+	election_id string
+	// the interface to expose the metrics on
+	metrics_listen string
+	// the interval between the orphaned lock scans
+	reconcile_interval time.Duration
+	// the number of consecutive scans before an orphaned lock is fenced
+	reconcile_threshold int
+	// the interface to expose the admin api on
+	api_listen string
+	// the token required by the admin api
+	api_token string
+	// a file containing the token required by the admin api
+	api_token_file string
+	// the url of a webhook notified of the fence actions
+	webhook_url string
+	// the secret signing the webhook payloads
+	webhook_secret string
+	// a file containing the secret signing the webhook payloads
+	webhook_secret_file string
+	// the comma separated events sent to the webhook
+	webhook_events string
+	// the webhooks given in the configuration file
+	webhooks []notify.Webhook
+	// the retrying of the failed notifications
+	notify_retry rbd.Backoff
+	// the file the audit records are appended to, glog if empty
+	audit_log string
+	// the size in megabytes the audit log is rotated at
+	audit_max_size int
+	// the number of rotated audit logs kept
+	audit_max_backups int
 }
 
+var (
+	// the configuration of the service
+	config configuration
+	// the lock protecting the configuration and pool selector, both can be changed on reload
+	configLock sync.RWMutex
+)
+
 const (
 	DEFAULT_INTERVAL = time.Duration(1) * time.Minute
-	DEFAULT_REGION   = "eu-west-1"
+	DEFAULT_SOURCE   = "ec2"
+	DEFAULT_QUEUE    = "/var/lib/rbd-manager/queue"
+	DEFAULT_FOLLOWER = time.Duration(5) * time.Minute
+	DEFAULT_EXPIRY   = time.Duration(1) * time.Hour
+	DEFAULT_LEASE    = time.Duration(15) * time.Second
+	DEFAULT_ATTEMPTS = 3
+	DEFAULT_RETRY    = time.Duration(5) * time.Second
+	DEFAULT_SHUTDOWN = time.Duration(30) * time.Second
+	DEFAULT_WORKERS  = 4
+	// the size in megabytes the audit log is rotated at
+	DEFAULT_AUDIT_SIZE = 100
+	// the number of rotated audit logs kept
+	DEFAULT_AUDIT_BACKUPS = 5
 )
 
 func init() {
-	flag.StringVar(&config.aws_api_key, "key", "", "the aws api key to use (note: taken from env or iam is left empty)")
-	flag.StringVar(&config.aws_api_secret, "secret", "", "the aws api secret, (note: taken from env or iam is left empty)")
-	flag.StringVar(&config.aws_region, "region", DEFAULT_REGION, "the aws region we are speaking to")
-	flag.StringVar(&config.rbd_pool, "pool", "rbd", "the pool the images live, leave black to check all pools")
-	flag.StringVar(&config.envTag, "env", "", "the environment tag to filter out the instances, note any instance not tagged are ignored")
+	flag.StringVar(&config.config_file, "config", "", "the path to a yaml or json configuration file, re-read on SIGHUP, the options given in the file take precedence")
+	flag.StringVar(&config.source, "source", DEFAULT_SOURCE, "the event source used to watch the nodes, i.e. "+strings.Join(membership.Sources(), ", "))
+	flag.StringVar(&config.rbd_pool, "pool", "rbd", "a comma separated list of the pools the images live, use 'all' or leave blank to check all pools")
+	flag.StringVar(&config.rbd_pool_include, "pool-include", "", "a comma separated list of glob patterns for additional pools to check")
+	flag.StringVar(&config.rbd_pool_exclude, "pool-exclude", "", "a comma separated list of glob patterns for pools which should never be checked")
+	flag.StringVar(&config.queue_dir, "queue-dir", DEFAULT_QUEUE, "the directory used to persist pending fence jobs across restarts")
+	flag.DurationVar(&config.follower_expiry, "follower-job-expiry", DEFAULT_FOLLOWER, "the age the fence jobs recorded while a follower are dropped rather than resumed on taking over, the leader at the time is expected to have handled them, zero keeps them")
+	flag.BoolVar(&config.blacklist, "blacklist", false, "blacklist the client address in ceph before removing any locks")
+	flag.BoolVar(&config.require_blacklist, "require-blacklist", false, "refuse to remove any locks unless the client was successfully blacklisted")
+	flag.DurationVar(&config.blacklist_expiry, "blacklist-expiry", DEFAULT_EXPIRY, "the duration the client should remain blacklisted")
+	flag.IntVar(&config.fence_attempts, "fence-attempts", DEFAULT_ATTEMPTS, "the number of attempts made to fence a node before it's left to a restart")
+	flag.DurationVar(&config.fence_retry_delay, "fence-retry-delay", DEFAULT_RETRY, "the delay between the attempts to fence a node")
+	flag.IntVar(&config.unlock_retry.Attempts, "unlock-attempts", rbd.DefaultBackoff.Attempts, "the number of attempts made to unlock each image within a fence attempt")
+	flag.DurationVar(&config.unlock_retry.Delay, "unlock-backoff", rbd.DefaultBackoff.Delay, "the delay before retrying the images which failed to unlock, doubling on each attempt")
+	flag.DurationVar(&config.unlock_retry.MaxDelay, "unlock-backoff-max", rbd.DefaultBackoff.MaxDelay, "the maximum delay between the attempts to unlock an image")
+	flag.Float64Var(&config.unlock_retry.Jitter, "unlock-jitter", rbd.DefaultBackoff.Jitter, "the fraction of the unlock backoff randomly added or removed, between zero and one")
+	flag.IntVar(&config.fence_workers, "fence-workers", DEFAULT_WORKERS, "the number of nodes which can be fenced concurrently")
+	flag.DurationVar(&config.shutdown_timeout, "shutdown-timeout", DEFAULT_SHUTDOWN, "the time to wait for the running fence jobs on shutdown or losing the leadership, any left are resumed by the next leader")
+	flag.BoolVar(&config.dry_run, "dry-run", false, "log the plan of what would be unlocked for each instance event, without removing any locks")
+	flag.StringVar(&config.output, "output", rbd.FormatText, "the output format of the logged plans, text or json")
+	flag.StringVar(&config.election, "election", "", "enable leader election between replicas using a lease backend, file or rados")
+	flag.StringVar(&config.election_file, "election-file", "", "the path to the lease file on storage shared by all the replicas")
+	flag.StringVar(&config.election_pool, "election-pool", "rbd", "the pool containing the rados object used as the lease")
+	flag.StringVar(&config.election_object, "election-object", "rbd-manager-leader", "the name of the rados object used as the lease")
+	flag.DurationVar(&config.election_ttl, "election-ttl", DEFAULT_LEASE, "the time to live on the leadership lease, a dead leader is replaced within this time")
+	flag.StringVar(&config.election_id, "election-id", defaultElectionID(), "our unique identity in the leader election")
+	flag.DurationVar(&config.reconcile_interval, "reconcile-interval", 0, "the interval between scans for locks held by nodes no longer running, zero disables")
+	flag.IntVar(&config.reconcile_threshold, "reconcile-threshold", 3, "the number of consecutive scans a lock must be orphaned before it is fenced")
+	flag.StringVar(&config.api_listen, "api", "", "the interface to expose the admin api on, i.e. 127.0.0.1:9181, leave blank to disable")
+	flag.StringVar(&config.api_token, "api-token", "", "the bearer token required by the admin api")
+	flag.StringVar(&config.webhook_url, "webhook", "", "the url of a webhook notified of the fence actions and orphaned locks")
+	flag.StringVar(&config.webhook_secret, "webhook-secret", "", "the secret used to sign the webhook payloads, sent in the "+notify.SignatureHeader+" header")
+	flag.StringVar(&config.webhook_secret_file, "webhook-secret-file", "", "a file containing the secret used to sign the webhook payloads")
+	flag.StringVar(&config.webhook_events, "webhook-events", "", "a comma separated list of the events sent to the webhook, i.e. "+strings.Join(notify.Events(), ", ")+", defaults to all")
+	flag.IntVar(&config.notify_retry.Attempts, "webhook-attempts", rbd.DefaultBackoff.Attempts, "the number of attempts made to deliver each notification")
+	config.notify_retry.Delay = rbd.DefaultBackoff.Delay
+	config.notify_retry.MaxDelay = rbd.DefaultBackoff.MaxDelay
+	config.notify_retry.Jitter = rbd.DefaultBackoff.Jitter
+	flag.StringVar(&config.audit_log, "audit-log", "", "the file the json audit records of the lock removals are appended to, defaults to the log")
+	flag.IntVar(&config.audit_max_size, "audit-max-size", DEFAULT_AUDIT_SIZE, "the size in megabytes the audit log is rotated at")
+	flag.IntVar(&config.audit_max_backups, "audit-max-backups", DEFAULT_AUDIT_BACKUPS, "the number of rotated audit logs kept")
+	flag.StringVar(&config.api_token_file, "api-token-file", "", "a file containing the bearer token required by the admin api")
+	flag.StringVar(&config.metrics_listen, "metrics", "127.0.0.1:9180", "the interface to expose the prometheus metrics and health check on, i.e. 0.0.0.0:9180 to scrape from other hosts, leave blank to disable")
+}
+
+// getConfig ... returns a copy of the present configuration
+func getConfig() configuration {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return config
+}
+
+// getPoolSelector ... returns the selector for the pools we are checking
+func getPoolSelector() rbd.PoolSelector {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return poolSelector
+}
+
+// setConfig ... replaces the configuration and pool selector
+func setConfig(updated configuration, selector rbd.PoolSelector) {
+	configLock.Lock()
+	defer configLock.Unlock()
+	config = updated
+	poolSelector = selector
+}
+
+// defaultElectionID ... the default identity in the election, the hostname and process id
+func defaultElectionID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
 }
@@ -0,0 +1,389 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/aws"
+	"github.com/gambol99/rbd-fence/pkg/membership"
+	"github.com/gambol99/rbd-fence/pkg/notify"
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+	"github.com/gambol99/rbd-fence/pkg/reconcile"
+
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+)
+
+// configFile ... the structure of the configuration file, yaml or json. Any option not given keeps it's
+// present value, i.e. the command line option on start up, or the running value on a reload
+type configFile struct {
+	// the event source to consume node events from, only read on start up
+	Source string `yaml:"source"`
+	// the options for the ec2 source
+	AWS struct {
+		// the region, a comma separated list to watch several, only read on start up
+		Region string `yaml:"region"`
+		// a custom endpoint for the api, only read on start up
+		Endpoint string `yaml:"endpoint"`
+		// the environment tags the instances are filtered on
+		Env []string `yaml:"env"`
+		// the selector expression the instances are filtered on
+		Selector string `yaml:"selector"`
+		// the interval between the polls of the api
+		Interval time.Duration `yaml:"interval"`
+	} `yaml:"aws"`
+	// the pools we are checking for locks
+	Pools struct {
+		// the names of the pools, or 'all'
+		Names []string `yaml:"names"`
+		// the glob patterns of the pools to include
+		Include []string `yaml:"include"`
+		// the glob patterns of the pools to exclude
+		Exclude []string `yaml:"exclude"`
+	} `yaml:"pools"`
+	// the options used when fencing a node
+	Fencing struct {
+		// blacklist the client before removing the locks
+		Blacklist *bool `yaml:"blacklist"`
+		// refuse to remove the locks unless the blacklist succeeded
+		RequireBlacklist *bool `yaml:"require_blacklist"`
+		// the expiry of the blacklist entry
+		BlacklistExpiry time.Duration `yaml:"blacklist_expiry"`
+		// only log what would be done
+		DryRun *bool `yaml:"dry_run"`
+		// the output format of the plans
+		Output string `yaml:"output"`
+	} `yaml:"fencing"`
+	// the retry policy when fencing a node
+	Retry struct {
+		// the number of attempts
+		Attempts int `yaml:"attempts"`
+		// the delay between the attempts
+		Delay time.Duration `yaml:"delay"`
+		// the retrying of the images which failed to unlock within an attempt
+		Images struct {
+			// the number of attempts made to unlock each image
+			Attempts int `yaml:"attempts"`
+			// the delay before the first retry, doubling on each attempt
+			Delay time.Duration `yaml:"delay"`
+			// the maximum delay between the attempts
+			MaxDelay time.Duration `yaml:"max_delay"`
+			// the fraction of the delay randomly added or removed
+			Jitter *float64 `yaml:"jitter"`
+		} `yaml:"images"`
+	} `yaml:"retry"`
+	// the notifications of the fence actions
+	Notify struct {
+		// the webhooks the events are posted to, replacing any given in the file before
+		Webhooks []notify.Webhook `yaml:"webhooks"`
+		// the retrying of the failed deliveries
+		Retry struct {
+			// the number of attempts
+			Attempts int `yaml:"attempts"`
+			// the delay before the first retry, doubling on each attempt
+			Delay time.Duration `yaml:"delay"`
+			// the maximum delay between the attempts
+			MaxDelay time.Duration `yaml:"max_delay"`
+		} `yaml:"retry"`
+	} `yaml:"notify"`
+	// the orphaned lock reconciler
+	Reconcile struct {
+		// the interval between the scans, enabling or disabling the reconciler requires a restart
+		Interval time.Duration `yaml:"interval"`
+		// the number of consecutive scans before an orphaned lock is fenced
+		Threshold int `yaml:"threshold"`
+	} `yaml:"reconcile"`
+}
+
+// readConfigFile ... reads the configuration file, any option we do not know about is an error
+func readConfigFile(path string) (*configFile, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := new(configFile)
+	if err := yaml.UnmarshalStrict(content, file); err != nil {
+		return nil, fmt.Errorf("unable to parse the file, error: %s", err)
+	}
+	if file.AWS.Interval < 0 || file.Fencing.BlacklistExpiry < 0 || file.Retry.Delay < 0 || file.Reconcile.Interval < 0 {
+		return nil, fmt.Errorf("the durations cannot be negative")
+	}
+	if file.Retry.Images.Delay < 0 || file.Retry.Images.MaxDelay < 0 || file.Notify.Retry.Delay < 0 || file.Notify.Retry.MaxDelay < 0 {
+		return nil, fmt.Errorf("the durations cannot be negative")
+	}
+	if file.Retry.Attempts < 0 || file.Retry.Images.Attempts < 0 || file.Notify.Retry.Attempts < 0 || file.Reconcile.Threshold < 0 {
+		return nil, fmt.Errorf("the retry attempts and reconcile threshold cannot be negative")
+	}
+	for _, x := range file.AWS.Env {
+		if strings.TrimSpace(x) == "" || strings.Contains(x, ",") {
+			return nil, fmt.Errorf("invalid environment tag: '%s'", x)
+		}
+	}
+	if _, err := aws.ParseSelector(file.AWS.Selector); err != nil {
+		return nil, fmt.Errorf("invalid aws selector, error: %s", err)
+	}
+
+	return file, nil
+}
+
+// apply ... returns the configuration with the options given in the file applied
+func (r *configFile) apply(current configuration) configuration {
+	updated := current
+	if r.Source != "" {
+		updated.source = r.Source
+	}
+	if len(r.Pools.Names) > 0 {
+		updated.rbd_pool = strings.Join(r.Pools.Names, ",")
+	}
+	if r.Pools.Include != nil {
+		updated.rbd_pool_include = strings.Join(r.Pools.Include, ",")
+	}
+	if r.Pools.Exclude != nil {
+		updated.rbd_pool_exclude = strings.Join(r.Pools.Exclude, ",")
+	}
+	if r.Fencing.Blacklist != nil {
+		updated.blacklist = *r.Fencing.Blacklist
+	}
+	if r.Fencing.RequireBlacklist != nil {
+		updated.require_blacklist = *r.Fencing.RequireBlacklist
+	}
+	if r.Fencing.BlacklistExpiry > 0 {
+		updated.blacklist_expiry = r.Fencing.BlacklistExpiry
+	}
+	if r.Fencing.DryRun != nil {
+		updated.dry_run = *r.Fencing.DryRun
+	}
+	if r.Fencing.Output != "" {
+		updated.output = r.Fencing.Output
+	}
+	if r.Retry.Attempts > 0 {
+		updated.fence_attempts = r.Retry.Attempts
+	}
+	if r.Retry.Delay > 0 {
+		updated.fence_retry_delay = r.Retry.Delay
+	}
+	if r.Retry.Images.Attempts > 0 {
+		updated.unlock_retry.Attempts = r.Retry.Images.Attempts
+	}
+	if r.Retry.Images.Delay > 0 {
+		updated.unlock_retry.Delay = r.Retry.Images.Delay
+	}
+	if r.Retry.Images.MaxDelay > 0 {
+		updated.unlock_retry.MaxDelay = r.Retry.Images.MaxDelay
+	}
+	if r.Retry.Images.Jitter != nil {
+		updated.unlock_retry.Jitter = *r.Retry.Images.Jitter
+	}
+	if r.Notify.Webhooks != nil {
+		updated.webhooks = r.Notify.Webhooks
+	}
+	if r.Notify.Retry.Attempts > 0 {
+		updated.notify_retry.Attempts = r.Notify.Retry.Attempts
+	}
+	if r.Notify.Retry.Delay > 0 {
+		updated.notify_retry.Delay = r.Notify.Retry.Delay
+	}
+	if r.Notify.Retry.MaxDelay > 0 {
+		updated.notify_retry.MaxDelay = r.Notify.Retry.MaxDelay
+	}
+	if r.Reconcile.Interval > 0 {
+		updated.reconcile_interval = r.Reconcile.Interval
+	}
+	if r.Reconcile.Threshold > 0 {
+		updated.reconcile_threshold = r.Reconcile.Threshold
+	}
+
+	return updated
+}
+
+// sourceFlags ... the command line options of the ec2 source given in the file
+func (r *configFile) sourceFlags() map[string]string {
+	options := make(map[string]string, 0)
+	if r.AWS.Region != "" {
+		options["region"] = r.AWS.Region
+	}
+	if r.AWS.Endpoint != "" {
+		options["ec2-endpoint"] = r.AWS.Endpoint
+	}
+	if len(r.AWS.Env) > 0 {
+		options["env"] = strings.Join(r.AWS.Env, ",")
+	}
+	if r.AWS.Selector != "" {
+		options["selector"] = r.AWS.Selector
+	}
+	if r.AWS.Interval > 0 {
+		options["interval"] = r.AWS.Interval.String()
+	}
+	return options
+}
+
+// validate ... checks the configuration, returning the selector for the pools
+func (r configuration) validate() (rbd.PoolSelector, error) {
+	if !rbd.IsValidFormat(r.output) {
+		return rbd.PoolSelector{}, fmt.Errorf("invalid output format: %s, must be text or json", r.output)
+	}
+	if r.fence_attempts < 1 {
+		return rbd.PoolSelector{}, fmt.Errorf("the fence attempts must be at least one")
+	}
+	if r.fence_workers < 1 {
+		return rbd.PoolSelector{}, fmt.Errorf("the fence workers must be at least one")
+	}
+	if err := r.unlock_retry.Validate(); err != nil {
+		return rbd.PoolSelector{}, fmt.Errorf("invalid unlock backoff, error: %s", err)
+	}
+	if r.fence_retry_delay < 0 || r.blacklist_expiry < 0 || r.reconcile_interval < 0 || r.shutdown_timeout < 0 || r.follower_expiry < 0 {
+		return rbd.PoolSelector{}, fmt.Errorf("the durations cannot be negative")
+	}
+	if r.reconcile_threshold < 1 {
+		return rbd.PoolSelector{}, fmt.Errorf("the reconcile threshold must be at least one scan")
+	}
+	notifications, err := r.notifyConfig()
+	if err != nil {
+		return rbd.PoolSelector{}, err
+	}
+	if err := notify.Validate(notifications); err != nil {
+		return rbd.PoolSelector{}, fmt.Errorf("invalid notifications, error: %s", err)
+	}
+	selector, err := rbd.NewPoolSelector(r.rbd_pool, r.rbd_pool_include, r.rbd_pool_exclude)
+	if err != nil {
+		return rbd.PoolSelector{}, fmt.Errorf("invalid pool selection, error: %s", err)
+	}
+
+	return selector, nil
+}
+
+// loadConfig ... applies the configuration file over the command line options on start up
+func loadConfig(path string) error {
+	file, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	updated := file.apply(config)
+	if _, err := updated.validate(); err != nil {
+		return err
+	}
+	// step: the ec2 source reads it's own command line options when created
+	for name, value := range file.sourceFlags() {
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid aws option: %s, error: %s", name, err)
+		}
+	}
+	config = updated
+	glog.Infof("Loaded the configuration file: %s", path)
+
+	return nil
+}
+
+// reloadConfig ... re-reads the configuration file and applies the changes, the nodes we are tracking are
+// kept. Should the file be invalid, or a change fail to apply, the running configuration is kept
+func reloadConfig() error {
+	current := getConfig()
+	if current.config_file == "" {
+		return fmt.Errorf("no configuration file was given")
+	}
+	glog.Infof("Reloading the configuration file: %s", current.config_file)
+
+	file, err := readConfigFile(current.config_file)
+	if err != nil {
+		return err
+	}
+	updated := file.apply(current)
+	selector, err := updated.validate()
+	if err != nil {
+		return err
+	}
+
+	// step: warn about the options which are only read on start up
+	if updated.source != current.source {
+		glog.Warningf("Changing the event source requires a restart, keeping the source: %s", current.source)
+		updated.source = current.source
+	}
+	for _, name := range []string{"region", "ec2-endpoint"} {
+		if value, found := file.sourceFlags()[name]; found && value != flag.Lookup(name).Value.String() {
+			glog.Warningf("Changing the aws %s requires a restart, ignoring the value: %s", name, value)
+		}
+	}
+	if (updated.reconcile_interval > 0) != (reconciler != nil) {
+		glog.Warningf("Enabling or disabling the reconciler requires a restart, ignoring the reconcile interval")
+		updated.reconcile_interval = current.reconcile_interval
+	}
+
+	// step: everything has been validated above, the event source is applied last as it is the only change
+	// we cannot check beforehand, rolling back the reconciler and webhooks should it fail
+	if err := reconfigure(updated, selector); err != nil {
+		return err
+	}
+	options := membership.SourceConfig{Interval: file.AWS.Interval, Environments: file.AWS.Env, Selector: file.AWS.Selector}
+	if options.Interval > 0 || len(options.Environments) > 0 || options.Selector != "" {
+		if source, ok := eventsClient.(membership.Reconfigurable); ok {
+			if err := source.Reconfigure(options); err != nil {
+				if rerr := reconfigure(current, getPoolSelector()); rerr != nil {
+					glog.Errorf("Failed to restore the previous configuration, error: %s", rerr)
+				}
+				return fmt.Errorf("unable to reconfigure the event source, error: %s", err)
+			}
+		} else {
+			glog.Warningf("The event source: %s does not support changes while running, ignoring the aws options", current.source)
+		}
+	}
+	setConfig(updated, selector)
+	glog.Infof("Successfully reloaded the configuration, pools: %s, dry-run: %t, blacklist: %t, attempts: %d",
+		selector, updated.dry_run, updated.blacklist, updated.fence_attempts)
+
+	return nil
+}
+
+// reconfigure ... applies the configuration to the reconciler and the webhooks, restoring the previous
+// settings of the reconciler should the webhooks fail
+func reconfigure(updated configuration, selector rbd.PoolSelector) error {
+	// step: apply the changes to the reconciler
+	if reconciler != nil {
+		err := reconciler.Reconfigure(reconcile.Config{
+			Interval:  updated.reconcile_interval,
+			Threshold: updated.reconcile_threshold,
+			Pools:     selector,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to reconfigure the reconciler, error: %s", err)
+		}
+	}
+	// step: apply the changes to the webhooks
+	if notifier != nil {
+		notifications, _ := updated.notifyConfig()
+		if err := notifier.Reconfigure(notifications); err != nil {
+			if reconciler != nil {
+				current := getConfig()
+				rerr := reconciler.Reconfigure(reconcile.Config{
+					Interval:  current.reconcile_interval,
+					Threshold: current.reconcile_threshold,
+					Pools:     getPoolSelector(),
+				})
+				if rerr != nil {
+					glog.Errorf("Failed to restore the reconciler, error: %s", rerr)
+				}
+			}
+			return fmt.Errorf("unable to reconfigure the notifier, error: %s", err)
+		}
+	}
+
+	return nil
+}
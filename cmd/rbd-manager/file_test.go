@@ -0,0 +1,314 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/membership"
+	"github.com/gambol99/rbd-fence/pkg/notify"
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+	"github.com/gambol99/rbd-fence/pkg/reconcile"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// reconfigurableSource ... a event source recording the changes to it's options
+type reconfigurableSource struct {
+	// the options applied
+	applied []membership.SourceConfig
+	// the error to return
+	err error
+}
+
+func (r *reconfigurableSource) AddEventListener(int) membership.EventCh     { return nil }
+func (r *reconfigurableSource) GetRunningNodes() map[string]membership.Node { return nil }
+func (r *reconfigurableSource) Reconfigure(options membership.SourceConfig) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.applied = append(r.applied, options)
+	return nil
+}
+
+// reconfigurableReconciler ... a reconciler recording the changes to it's options
+type reconfigurableReconciler struct {
+	// the options applied
+	applied []reconcile.Config
+	// the error to return
+	err error
+}
+
+func (r *reconfigurableReconciler) Scan() (*reconcile.Report, error) { return nil, nil }
+func (r *reconfigurableReconciler) LastReport() *reconcile.Report    { return nil }
+func (r *reconfigurableReconciler) Stop()                            {}
+func (r *reconfigurableReconciler) Reconfigure(options reconcile.Config) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.applied = append(r.applied, options)
+	return nil
+}
+
+// reconfigurableNotifier ... a notifier which fails to be reconfigured
+type reconfigurableNotifier struct {
+	// the error to return
+	err error
+}
+
+func (r *reconfigurableNotifier) Notify(notify.Event)             {}
+func (r *reconfigurableNotifier) Stop(time.Duration)              {}
+func (r *reconfigurableNotifier) Reconfigure(notify.Config) error { return r.err }
+
+const testConfigYAML = `
+source: ec2
+aws:
+  env: [prod, staging]
+  selector: tag:Role!=db
+  interval: 30s
+pools:
+  names: [rbd, volumes]
+  exclude: ["*-backup"]
+fencing:
+  blacklist: true
+  blacklist_expiry: 2h
+  dry_run: false
+retry:
+  attempts: 5
+  delay: 1s
+  images:
+    attempts: 4
+    delay: 500ms
+    jitter: 0
+reconcile:
+  threshold: 4
+`
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("unable to write the configuration file, error: %s", err)
+	}
+	return path
+}
+
+// setupConfig ... sets the configuration to the defaults of the command line options
+func setupConfig(path string) *reconfigurableSource {
+	source := &reconfigurableSource{}
+	eventsClient = source
+	reconciler = nil
+	notifier = nil
+	config = configuration{
+		config_file:         path,
+		source:              DEFAULT_SOURCE,
+		rbd_pool:            "rbd",
+		blacklist_expiry:    DEFAULT_EXPIRY,
+		output:              "text",
+		fence_attempts:      DEFAULT_ATTEMPTS,
+		fence_workers:       DEFAULT_WORKERS,
+		unlock_retry:        rbd.DefaultBackoff,
+		fence_retry_delay:   DEFAULT_RETRY,
+		reconcile_threshold: 3,
+	}
+	poolSelector, _ = config.validate()
+
+	return source
+}
+
+func TestReadConfigFile(t *testing.T) {
+	file, err := readConfigFile(writeConfigFile(t, testConfigYAML))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"prod", "staging"}, file.AWS.Env)
+	assert.Equal(t, time.Duration(30)*time.Second, file.AWS.Interval)
+	assert.Equal(t, []string{"rbd", "volumes"}, file.Pools.Names)
+	assert.True(t, *file.Fencing.Blacklist)
+	assert.False(t, *file.Fencing.DryRun)
+	assert.Nil(t, file.Fencing.RequireBlacklist)
+	assert.Equal(t, time.Duration(2)*time.Hour, file.Fencing.BlacklistExpiry)
+	assert.Equal(t, 5, file.Retry.Attempts)
+	assert.Equal(t, 4, file.Retry.Images.Attempts)
+	assert.Equal(t, 0.0, *file.Retry.Images.Jitter)
+	assert.Equal(t, map[string]string{"env": "prod,staging", "selector": "tag:Role!=db", "interval": "30s"}, file.sourceFlags())
+}
+
+func TestReadConfigFileJSON(t *testing.T) {
+	file, err := readConfigFile(writeConfigFile(t, `{"pools": {"names": ["all"]}, "retry": {"attempts": 2, "delay": "250ms"}}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"all"}, file.Pools.Names)
+	assert.Equal(t, 2, file.Retry.Attempts)
+	assert.Equal(t, time.Duration(250)*time.Millisecond, file.Retry.Delay)
+}
+
+func TestReadConfigFileNotify(t *testing.T) {
+	content := "notify:\n  webhooks:\n    - url: https://hooks.example.com/rbd\n      secret: s3cret\n      events: [fence_failed]\n      timeout: 5s\n  retry:\n    attempts: 5\n"
+	file, err := readConfigFile(writeConfigFile(t, content))
+	if !assert.NoError(t, err) {
+		return
+	}
+	setupConfig("")
+	updated := file.apply(config)
+	if assert.Equal(t, 1, len(updated.webhooks)) {
+		assert.Equal(t, "https://hooks.example.com/rbd", updated.webhooks[0].URL)
+		assert.Equal(t, []string{"fence_failed"}, updated.webhooks[0].Events)
+		assert.Equal(t, time.Duration(5)*time.Second, updated.webhooks[0].Timeout)
+	}
+	assert.Equal(t, 5, updated.notify_retry.Attempts)
+	_, err = updated.validate()
+	assert.NoError(t, err)
+
+	updated.webhooks[0].Events = []string{"fence_exploded"}
+	_, err = updated.validate()
+	assert.Error(t, err)
+}
+
+func TestReadConfigFileInvalid(t *testing.T) {
+	for _, content := range []string{
+		"pools: [",
+		"pool: rbd",
+		"retry:\n  delay: soon",
+		"retry:\n  attempts: -1",
+		"fencing:\n  blacklist_expiry: -1h",
+		"retry:\n  images:\n    max_delay: -1s",
+		"aws:\n  env: ['prod,dev']",
+		"aws:\n  selector: Env=prod",
+	} {
+		_, err := readConfigFile(writeConfigFile(t, content))
+		assert.Error(t, err, "content: %s", content)
+	}
+	_, err := readConfigFile(filepath.Join(t.TempDir(), "missing.yml"))
+	assert.Error(t, err)
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	setupConfig("")
+	file, _ := readConfigFile(writeConfigFile(t, "fencing:\n  require_blacklist: true\nretry:\n  attempts: 7\n"))
+
+	updated := file.apply(config)
+	assert.True(t, updated.require_blacklist)
+	assert.Equal(t, 7, updated.fence_attempts)
+	// step: the options not given keep their value
+	assert.Equal(t, "rbd", updated.rbd_pool)
+	assert.Equal(t, DEFAULT_RETRY, updated.fence_retry_delay)
+	assert.Equal(t, DEFAULT_EXPIRY, updated.blacklist_expiry)
+}
+
+func TestReloadConfig(t *testing.T) {
+	path := writeConfigFile(t, testConfigYAML)
+	source := setupConfig(path)
+
+	assert.NoError(t, reloadConfig())
+	current := getConfig()
+	assert.Equal(t, "rbd,volumes", current.rbd_pool)
+	assert.Equal(t, "*-backup", current.rbd_pool_exclude)
+	assert.True(t, current.blacklist)
+	assert.Equal(t, 5, current.fence_attempts)
+	assert.Equal(t, time.Second, current.fence_retry_delay)
+	assert.Equal(t, rbd.Backoff{Attempts: 4, Delay: time.Duration(500) * time.Millisecond, MaxDelay: rbd.DefaultBackoff.MaxDelay}, current.unlock_retry)
+	assert.Equal(t, 4, current.reconcile_threshold)
+	assert.Equal(t, []string{"rbd", "volumes"}, getPoolSelector().Names)
+	assert.Equal(t, []membership.SourceConfig{{
+		Interval:     time.Duration(30) * time.Second,
+		Environments: []string{"prod", "staging"},
+		Selector:     "tag:Role!=db",
+	}}, source.applied)
+}
+
+func TestReloadConfigInvalid(t *testing.T) {
+	path := writeConfigFile(t, testConfigYAML)
+	source := setupConfig(path)
+	assert.NoError(t, reloadConfig())
+	running := getConfig()
+
+	for _, content := range []string{
+		"retry: [",
+		"fencing:\n  output: xml",
+		"pools:\n  include: ['[']",
+	} {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("unable to write the configuration file, error: %s", err)
+		}
+		assert.Error(t, reloadConfig(), "content: %s", content)
+		assert.Equal(t, running, getConfig())
+	}
+	assert.Equal(t, 1, len(source.applied))
+}
+
+func TestReloadConfigSourceFailure(t *testing.T) {
+	source := setupConfig(writeConfigFile(t, testConfigYAML))
+	source.err = fmt.Errorf("invalid region")
+	config.reconcile_interval = time.Minute
+	fake := &reconfigurableReconciler{}
+	reconciler = fake
+	defer func() { reconciler = nil }()
+	running := getConfig()
+
+	assert.Error(t, reloadConfig())
+	assert.Equal(t, running, getConfig())
+	// step: the reconciler was changed before the source and must be restored
+	if assert.Equal(t, 2, len(fake.applied)) {
+		assert.Equal(t, 4, fake.applied[0].Threshold)
+		assert.Equal(t, reconcile.Config{Interval: time.Minute, Threshold: 3, Pools: getPoolSelector()}, fake.applied[1])
+	}
+}
+
+func TestReloadConfigReconcilerFailure(t *testing.T) {
+	source := setupConfig(writeConfigFile(t, testConfigYAML))
+	config.reconcile_interval = time.Minute
+	reconciler = &reconfigurableReconciler{err: fmt.Errorf("invalid interval")}
+	defer func() { reconciler = nil }()
+	running := getConfig()
+
+	assert.Error(t, reloadConfig())
+	assert.Equal(t, running, getConfig())
+	assert.Empty(t, source.applied)
+}
+
+func TestReloadConfigNotifierFailure(t *testing.T) {
+	source := setupConfig(writeConfigFile(t, testConfigYAML))
+	config.reconcile_interval = time.Minute
+	fake := &reconfigurableReconciler{}
+	reconciler = fake
+	defer func() { reconciler = nil }()
+	notifier = &reconfigurableNotifier{err: fmt.Errorf("invalid webhook")}
+	defer func() { notifier = nil }()
+	running := getConfig()
+
+	assert.Error(t, reloadConfig())
+	assert.Equal(t, running, getConfig())
+	assert.Empty(t, source.applied)
+	if assert.Equal(t, 2, len(fake.applied)) {
+		assert.Equal(t, 3, fake.applied[1].Threshold)
+		assert.Equal(t, []string{"rbd"}, fake.applied[1].Pools.Names)
+	}
+}
+
+func TestReloadConfigStartupOptions(t *testing.T) {
+	setupConfig(writeConfigFile(t, "source: kubernetes\nreconcile:\n  interval: 1m\n"))
+
+	// step: the source and enabling the reconciler require a restart
+	assert.NoError(t, reloadConfig())
+	assert.Equal(t, DEFAULT_SOURCE, getConfig().source)
+	assert.Equal(t, time.Duration(0), getConfig().reconcile_interval)
+}
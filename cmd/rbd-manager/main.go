@@ -17,27 +17,49 @@ limitations under the License.
 package main
 
 import (
-	"fmt"
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/gambol99/rbd-fence/pkg/aws"
+	"github.com/gambol99/rbd-fence/pkg/audit"
+	"github.com/gambol99/rbd-fence/pkg/election"
+	"github.com/gambol99/rbd-fence/pkg/fence"
+	"github.com/gambol99/rbd-fence/pkg/membership"
+	"github.com/gambol99/rbd-fence/pkg/metrics"
+	"github.com/gambol99/rbd-fence/pkg/notify"
+	"github.com/gambol99/rbd-fence/pkg/queue"
 	"github.com/gambol99/rbd-fence/pkg/rbd"
+	"github.com/gambol99/rbd-fence/pkg/reconcile"
 
 	"github.com/golang/glog"
-	"github.com/mitchellh/goamz/ec2"
 )
 
 var (
 	// the rbd interface
 	rbdClient rbd.RBDInterface
-	// the aws events interface
-	eventsClient aws.EC2EventsInterface
-	// the hosts map
-	hosts map[string]string
+	// the node events interface
+	eventsClient membership.EventSource
+	// the queue of pending fence jobs
+	fenceQueue queue.QueueInterface
+	// the fence orchestrator, owning the addresses of the running nodes and the fence jobs
+	orchestrator fence.OrchestratorInterface
+	// the notifier sending the fence actions to the webhooks
+	notifier notify.NotifierInterface
+	// the audit log of the lock removals
+	auditLog audit.LoggerInterface
+	// the pools we are checking for locks
+	poolSelector rbd.PoolSelector
+	// the leader election, only the leader fences nodes
+	leaderElection election.ElectionInterface
+	// the orphaned lock reconciler
+	reconciler reconcile.ReconcilerInterface
 )
 
 func main() {
@@ -47,22 +69,55 @@ func main() {
 	glog.Infof("Starting the %s Service, version: %s, git+sha: %s", Prog, Version, GitSha)
 
 	// step: create the channel to termination requests
-	signalChannel := make(chan os.Signal)
+	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
-	if config.envTag == "" {
-		fmt.Printf("[error] you need to specify the environment tag for the instances are interested in")
+	// step: apply the configuration file over the command line options
+	if config.config_file != "" {
+		if err := loadConfig(config.config_file); err != nil {
+			glog.Errorf("Invalid configuration file: %s, error: %s", config.config_file, err)
+			os.Exit(1)
+		}
+	}
+
+	poolSelector, err = config.validate()
+	if err != nil {
+		glog.Errorf("Invalid configuration, error: %s", err)
+		os.Exit(1)
+	}
+	if config.dry_run {
+		glog.Infof("Running in dry-run mode, no locks will be removed")
+	}
+
+	// step: open the audit log
+	auditLog, err = audit.NewLogger(config.audit_log, int64(config.audit_max_size)*1024*1024, config.audit_max_backups)
+	if err != nil {
+		glog.Errorf("Failed to open the audit log, error: %s", err)
+		os.Exit(1)
+	}
+
+	// step: create the notifier for the webhooks
+	notifications, err := config.notifyConfig()
+	if err == nil {
+		notifier, err = notify.NewNotifier(notifications)
+	}
+	if err != nil {
+		glog.Errorf("Failed to create the notifier, error: %s", err)
 		os.Exit(1)
 	}
 
 	// step: create a interface for events
-	eventsClient, err = aws.NewEC2EventsInterface(config.aws_api_key, config.aws_api_secret,
-		config.aws_region, config.envTag)
+	eventsClient, err = membership.NewEventSource(config.source)
 	if err != nil {
 		glog.Errorf("Failed to start service, error: %s", err)
 		os.Exit(1)
 	}
 
+	// step: expose the metrics and health of the event source
+	if config.metrics_listen != "" {
+		go serveMetrics(config.metrics_listen)
+	}
+
 	// step: create the rbd interface
 	rbdClient, err = rbd.NewRBDInterface()
 	if err != nil {
@@ -70,65 +125,458 @@ func main() {
 		os.Exit(1)
 	}
 
+	// step: create the fence queue
+	fenceQueue, err = queue.NewQueueInterface(config.queue_dir)
+	if err != nil {
+		glog.Errorf("Failed to create the fence queue, error: %s", err)
+		os.Exit(1)
+	}
+
 	// step: create the event channels
-	terminatedCh := eventsClient.AddEventListener(aws.STATUS_TERMINATED)
-	stoppedCh := eventsClient.AddEventListener(aws.STATUS_STOPPED)
-	runningCh := eventsClient.AddEventListener(aws.STATUS_RUNNING)
+	terminatedCh := eventsClient.AddEventListener(membership.STATUS_TERMINATED)
+	stoppedCh := eventsClient.AddEventListener(membership.STATUS_STOPPED)
+	runningCh := eventsClient.AddEventListener(membership.STATUS_RUNNING)
 	// step: get a list of running hosts and their ip addresses
-	hosts = eventsClient.GetRunningHosts()
+	orchestrator, err = fence.NewOrchestrator(fence.Config{
+		Workers: config.fence_workers,
+		Handler: processFenceJob,
+	})
+	if err != nil {
+		glog.Errorf("Failed to create the fence orchestrator, error: %s", err)
+		os.Exit(1)
+	}
+	for id, node := range eventsClient.GetRunningNodes() {
+		orchestrator.SetNode(id, node.Addresses)
+	}
+
+	// step: join the leader election
+	leaderElection, err = newElection()
+	if err != nil {
+		glog.Errorf("Failed to start the leader election, error: %s", err)
+		os.Exit(1)
+	}
+
+	// step: start the orphaned lock reconciler
+	if config.reconcile_interval > 0 {
+		reconciler, err = reconcile.NewReconciler(reconcile.Config{
+			Interval:  config.reconcile_interval,
+			Threshold: config.reconcile_threshold,
+			Pools:     poolSelector,
+			Client:    rbdClient,
+			Source:    eventsClient,
+			History:   nodeHistory,
+			Active:    isReconciling,
+			Fence:     fenceOrphan,
+			Orphaned:  notifyOrphan,
+		})
+		if err != nil {
+			glog.Errorf("Failed to start the reconciler, error: %s", err)
+			os.Exit(1)
+		}
+	}
+
+	// step: start the admin api
+	if config.api_listen != "" {
+		token, err := getAPIToken()
+		if err != nil {
+			glog.Errorf("Failed to start the admin api, error: %s", err)
+			os.Exit(1)
+		}
+		handler, err := newAdminAPI(token)
+		if err != nil {
+			glog.Errorf("Failed to start the admin api, error: %s", err)
+			os.Exit(1)
+		}
+		go serveAPI(config.api_listen, handler)
+	}
 
 	// step: enter the event loop: we are either listening to a termination signal, a terminated box
 	// or a box being added
 	for {
 		select {
-		// we have received a kill service signal
-		case <-signalChannel:
-			glog.Infof("Recieved a shutdown signal, exiting service")
-			os.Exit(0)
+		// we have received a reload or kill service signal
+		case sig := <-signalChannel:
+			if sig == syscall.SIGHUP {
+				if err := reloadConfig(); err != nil {
+					glog.Errorf("Failed to reload the configuration, keeping the running configuration, error: %s", err)
+				}
+				continue
+			}
+			glog.Infof("Recieved a shutdown signal, draining the fence jobs, deadline: %s", config.shutdown_timeout)
+			shutdown()
+
+		case leader := <-leaderElection.LeaderCh():
+			if !leader {
+				glog.Infof("We are now a follower, cancelling our fence jobs, nodes will be fenced by the leader")
+				cancelFences(config.shutdown_timeout)
+				continue
+			}
+			// step: resume any fence jobs left over from a previous run or recorded while a follower
+			if err := resumeFenceJobs(); err != nil {
+				glog.Errorf("Failed to resume the pending fence jobs, error: %s", err)
+			}
 
 		case event := <-runningCh:
-			ev := (*aws.InstanceEvent)(event)
-			glog.Infof("Region has a new instance running, instanceId: %s", ev.InstanceID)
-			// add to the hosts map
-			hosts[ev.Instance.InstanceId] = ev.Instance.PrivateIpAddress
+			glog.Infof("Source: %s has a new node running, %s", event.Source, event.Node)
+			// add to the nodes we are tracking
+			orchestrator.SetNode(event.ID, event.Node.Addresses)
 
 		case event := <-stoppedCh:
-			ev := (*aws.InstanceEvent)(event)
-			glog.Infof("Region instance stopped, instanceId: %s", ev.InstanceID)
-			go removeRBDLocks(&ev.Instance)
+			glog.Infof("Source: %s node stopped, %s", event.Source, event.Node)
+			removeRBDLocks(event)
 
 		case event := <-terminatedCh:
-			ev := (*aws.InstanceEvent)(event)
-			glog.Infof("Region instance terminated, instanceId: %s", ev.InstanceID)
-			go removeRBDLocks(&ev.Instance)
+			glog.Infof("Source: %s node terminated, %s", event.Source, event.Node)
+			removeRBDLocks(event)
 		}
 	}
 }
 
-// Checks to see if the instance has any locks and if so attempts to remove them
-func removeRBDLocks(instance *ec2.Instance) {
-	address, found := hosts[instance.InstanceId]
+// shutdown ... stops accepting events and waits for the running fence jobs up to the deadline, the exit
+// status is non-zero if any job was left incomplete
+func shutdown() {
+	if reconciler != nil {
+		reconciler.Stop()
+	}
+	finished := drainFences(config.shutdown_timeout)
+	// step: we only give up the leadership once we have stopped fencing
+	leaderElection.Stop()
+	notifier.Stop(notifyTimeout)
+	if err := auditLog.Close(); err != nil {
+		glog.Errorf("Failed to close the audit log, error: %s", err)
+	}
+	if !finished {
+		glog.Errorf("Exiting with incomplete fence jobs, they will be resumed on the next start")
+		glog.Flush()
+		os.Exit(1)
+	}
+	glog.Infof("All the fence jobs have finished, exiting service")
+	glog.Flush()
+	os.Exit(0)
+}
+
+// Checks to see if the node has any locks and if so hands the job to the orchestrator. The node is no longer
+// tracked once it's been handed off, so a stopped then terminated node is only fenced the once
+func removeRBDLocks(event *membership.NodeEvent) {
+	node := event.Node
+	addresses, found := orchestrator.GetNode(node.ID)
 	if !found {
-		glog.Errorf("The instance: %s was not found in the hosts map", instance.InstanceId)
+		glog.Infof("The node: %s is not being tracked, it has either been fenced or was never running", node.ID)
 		return
 	}
-	glog.Infof("Instance: %s, address: %s, state: %s, checking for locks", instance.InstanceId, address, instance.State.Name)
+	defer orchestrator.RemoveNode(node.ID)
+	glog.Infof("Node: %s, addresses: %v, state: %s, checking for locks", node.ID, addresses, node.State)
 
-	var deleted = false
+	job := &queue.FenceJob{
+		InstanceID: node.ID,
+		Addresses:  addresses,
+		Pools:      getPoolSelector(),
+		State:      node.State,
+		Trigger:    audit.TriggerEvent,
+		Detected:   event.Detected,
+	}
 
-	for i := 0; i < 3; i++ {
-		err := rbdClient.UnlockClient(address)
+	// step: if we are a follower we record the job, so it's picked up should we take over
+	if !leaderElection.IsLeader() {
+		glog.Infof("Not the leader, recording the fence job for node: %s until we take over", node.ID)
+		job.Follower = true
+		if err := fenceQueue.Put(job); err != nil {
+			glog.Errorf("Failed to persist the fence job for node: %s, error: %s", node.ID, err)
+		}
+		// step: the jobs are never fenced by us unless we take over, so drop those the leader has had time for
+		if jobs, err := fenceQueue.List(); err == nil {
+			expireFenceJobs(jobs)
+		}
+		return
+	}
+
+	// step: are we only logging what we would do?
+	if getConfig().dry_run {
+		planFenceJob(job)
+		return
+	}
+
+	if err := submitFenceJob(job); err != nil {
+		glog.Errorf("Failed to submit the fence job for node: %s, error: %s", node.ID, err)
+	}
+}
+
+// submitFenceJob ... persists the job, so a restart does not lose it, and hands it to the orchestrator. A node
+// with a job already pending or running is skipped
+func submitFenceJob(job *queue.FenceJob) error {
+	if orchestrator.Active(job.InstanceID) {
+		glog.Infof("The node: %s is presently being fenced, skipping the job, %s", job.InstanceID, job)
+		return nil
+	}
+	if err := fenceQueue.Put(job); err != nil {
+		glog.Errorf("Failed to persist the fence job for node: %s, error: %s", job.InstanceID, err)
+	}
+	if _, err := orchestrator.Submit(job); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// fenceOrphan ... fences an address holding locks after the node which owned it is no longer running
+func fenceOrphan(node membership.Node, address string) error {
+	if !leaderElection.IsLeader() {
+		return fmt.Errorf("we are not the leader")
+	}
+	job := &queue.FenceJob{
+		InstanceID: node.ID,
+		Addresses:  []string{address},
+		Pools:      getPoolSelector(),
+		State:      "orphaned",
+		Trigger:    audit.TriggerReconciler,
+	}
+	if getConfig().dry_run {
+		planFenceJob(job)
+		return nil
+	}
+
+	return submitFenceJob(job)
+}
+
+// nodeHistory ... returns the nodes no longer running, those the event source still lists as stopped or
+// terminated and those with a fence job in the queue
+func nodeHistory() []membership.Node {
+	nodes := make([]membership.Node, 0)
+	if history, ok := eventsClient.(membership.NodeHistory); ok {
+		for _, node := range history.GetStoppedNodes() {
+			nodes = append(nodes, node)
+		}
+	}
+	jobs, err := fenceQueue.List()
+	if err != nil {
+		glog.Errorf("Failed to list the fence jobs for the node history, error: %s", err)
+	}
+	for _, job := range jobs {
+		nodes = append(nodes, membership.Node{ID: job.InstanceID, Addresses: job.Addresses})
+	}
+
+	return nodes
+}
+
+// resumeFenceJobs ... picks up any jobs which were not completed by a previous run
+func resumeFenceJobs() error {
+	jobs, err := fenceQueue.List()
+	if err != nil {
+		return err
+	}
+	for _, job := range expireFenceJobs(jobs) {
+		job.Follower = false
+		if job.Incomplete {
+			glog.Warningf("Resuming the fence job left incomplete by a shutdown, %s, reason: %s", job, job.LastError)
+		} else {
+			glog.Infof("Resuming the pending fence job, %s", job)
+		}
+		if getConfig().dry_run {
+			planFenceJob(job)
+			continue
+		}
+		if orchestrator.Active(job.InstanceID) {
+			continue
+		}
+		if _, err := orchestrator.Submit(job); err != nil {
+			glog.Warningf("Not resuming the fence job for instance: %s, error: %s", job.InstanceID, err)
+		}
+	}
+
+	return nil
+}
+
+// expireFenceJobs ... removes the jobs recorded while a follower which are older than the expiry, the leader at
+// the time will have fenced the node and the addresses may since have been given to another, returning the rest
+func expireFenceJobs(jobs []*queue.FenceJob) []*queue.FenceJob {
+	expiry := getConfig().follower_expiry
+	list := make([]*queue.FenceJob, 0)
+	for _, job := range jobs {
+		if job.Follower && expiry > 0 && time.Since(job.Created) > expiry {
+			glog.Warningf("Dropping the fence job recorded while a follower, created: %s, %s", job.Created, job)
+			if err := fenceQueue.Remove(job.InstanceID); err != nil {
+				glog.Errorf("Failed to remove the expired fence job for node: %s, error: %s", job.InstanceID, err)
+			}
+			continue
+		}
+		list = append(list, job)
+	}
+	return list
+}
+
+// processFenceJob ... attempts to remove any locks held by the addresses in the job, the job is only
+// removed from the queue once all the addresses have been unlocked. Called by the orchestrator workers
+func processFenceJob(ctx context.Context, job *queue.FenceJob) error {
+	options := getConfig()
+	job.Incomplete = false
+	notifyFence(notify.EventFenceStarted, job, nil, nil)
+	var images []rbd.ImageResult
+	for i := 0; i < options.fence_attempts; i++ {
+		metrics.FenceAttempts.Inc()
+		var err error
+		images, err = unlockAddresses(ctx, job)
+		if err == nil {
+			glog.Infof("Successfully removed any locks held by instance: %s", job.InstanceID)
+			metrics.FenceSuccesses.Inc()
+			if !job.Detected.IsZero() {
+				metrics.FenceLatency.Observe(time.Since(job.Detected).Seconds())
+			}
+			if err := fenceQueue.Remove(job.InstanceID); err != nil {
+				glog.Errorf("Failed to remove the fence job for instance: %s, error: %s", job.InstanceID, err)
+			}
+			notifyFence(notify.EventFenceSucceeded, job, images, nil)
+			return nil
+		}
+
+		metrics.FenceFailures.Inc()
+		glog.Errorf("Failed to unlock the images held by instance: %s, error: %s, attempting again if possible", job.InstanceID, err)
+		job.Attempts++
+		job.LastError = err.Error()
+		orchestrator.Update(job)
+		if err := fenceQueue.Put(job); err != nil {
+			glog.Errorf("Failed to update the fence job for instance: %s, error: %s", job.InstanceID, err)
+		}
+		if i+1 >= options.fence_attempts {
+			break
+		}
+		// step: a shutdown or losing the leadership should not wait on the retry, we leave it for the next leader
+		select {
+		case <-ctx.Done():
+			glog.Warningf("Interrupting the retry of the fence job for instance: %s, we are shutting down or no longer the leader", job.InstanceID)
+			return fmt.Errorf("interrupted, error: %s", err)
+		case <-time.After(options.fence_retry_delay):
+		}
+	}
+
+	glog.Errorf("Failed to unlock any images that could have been held by instance: %s, the job will be retried on restart", job.InstanceID)
+	err := fmt.Errorf("failed to fence the instance: %s after %d attempts, error: %s", job.InstanceID, job.Attempts, job.LastError)
+	notifyFence(notify.EventFenceFailed, job, images, err)
+
+	return err
+}
+
+// planFenceJob ... logs the plan of what would be done to fence the instance
+func planFenceJob(job *queue.FenceJob) {
+	for _, address := range job.Addresses {
+		plan, err := rbdClient.PlanClient(address, job.Pools, getFenceOptions())
 		if err != nil {
-			glog.Errorf("Failed to unlock the images, attempting again if possible")
-			<-time.After(time.Duration(5) * time.Second)
+			glog.Errorf("Failed to plan the fencing of instance: %s, address: %s, error: %s", job.InstanceID, address, err)
+			continue
 		}
-		deleted = true
+		content, err := plan.Render(getConfig().output)
+		if err != nil {
+			glog.Errorf("Failed to render the plan for instance: %s, error: %s", job.InstanceID, err)
+			continue
+		}
+		glog.Infof("[dry-run] instance: %s, state: %s, plan: %s", job.InstanceID, job.State, content)
 	}
+}
 
-	if !deleted {
-		glog.Errorf("Failed to unlock any images that could have been held by client: %s", address)
+// unlockAddresses ... removes the locks held by each of the addresses in the job, returning the images examined
+func unlockAddresses(ctx context.Context, job *queue.FenceJob) ([]rbd.ImageResult, error) {
+	images := make([]rbd.ImageResult, 0)
+	for _, address := range job.Addresses {
+		if err := ctx.Err(); err != nil {
+			return images, fmt.Errorf("the fence was cancelled, error: %s", err)
+		}
+		// step: a job recorded some time ago could reference an address now reused by a running node
+		if id, found := orchestrator.AddressInUse(address, job.InstanceID); found && !job.Force {
+			glog.Warningf("Skipping the address: %s, it is presently in use by the running node: %s", address, id)
+			continue
+		}
+		options := getFenceOptions()
+		options.OnUnlock = func(event rbd.UnlockEvent) { auditUnlock(job, event) }
+		options.Context = ctx
+		result, err := rbdClient.UnlockClient(address, job.Pools, options)
+		// step: a failure can still have removed some of the locks
+		if result != nil {
+			if result.Blacklist != nil {
+				glog.Infof("Blacklisted the client, %s", result.Blacklist)
+			}
+			if len(result.Unlocked) > 0 {
+				glog.Infof("Removed the locks held by address: %s, images: %v", address, result.Unlocked)
+			}
+			for _, image := range result.Unlocked {
+				metrics.LocksRemoved.WithLabelValues(strings.SplitN(image, "/", 2)[0]).Inc()
+			}
+			for _, image := range result.Failed() {
+				glog.Errorf("The image held by address: %s may still be locked, %s", address, image)
+			}
+			images = append(images, result.Images...)
+		}
+		if err != nil {
+			return images, fmt.Errorf("address: %s, error: %s", address, err)
+		}
+	}
+	return images, nil
+}
+
+// serveMetrics ... exposes the prometheus metrics on the interface
+func serveMetrics(listen string) {
+	glog.Infof("Exposing the metrics on: %s/metrics", listen)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/health", healthHandler)
+	if err := http.ListenAndServe(listen, mux); err != nil {
+		glog.Errorf("Failed to serve the metrics, error: %s", err)
 	}
+}
 
-	// step: delete from the hosts map
-	delete(hosts, instance.InstanceId)
+// healthHandler ... reports the health of the event source, a degraded source is unavailable
+func healthHandler(w http.ResponseWriter, req *http.Request) {
+	health := getSourceHealth()
+	code := http.StatusOK
+	if !health.Healthy {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(health)
+}
+
+// getSourceHealth ... returns the health of the event source, sources unable to report are assumed healthy
+func getSourceHealth() membership.Health {
+	if reporter, ok := eventsClient.(membership.HealthReporter); ok {
+		return reporter.Health()
+	}
+	return membership.Health{Source: getConfig().source, Healthy: true}
+}
+
+// isReconciling ... the reconciler only scans on the leader and while the event source is healthy, as a
+// degraded source could be missing the nodes started since
+func isReconciling() bool {
+	return leaderElection.IsLeader() && getSourceHealth().Healthy
+}
+
+// newElection ... creates the leader election from the configuration
+func newElection() (election.ElectionInterface, error) {
+	var lease election.LeaseInterface
+	var err error
+
+	switch config.election {
+	case "":
+		return election.NewStandalone(), nil
+	case "file":
+		lease, err = election.NewFileLease(config.election_file)
+	case "rados":
+		lease, err = election.NewRadosLease(config.election_pool, config.election_object)
+	default:
+		return nil, fmt.Errorf("unknown election backend: %s, must be file or rados", config.election)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return election.NewElection(lease, config.election_id, config.election_ttl)
+}
+
+// getFenceOptions ... returns the options used when fencing a client
+func getFenceOptions() rbd.FenceOptions {
+	options := getConfig()
+	return rbd.FenceOptions{
+		Blacklist:        options.blacklist,
+		RequireBlacklist: options.require_blacklist,
+		BlacklistExpiry:  options.blacklist_expiry,
+		Retry:            options.unlock_retry,
+	}
 }
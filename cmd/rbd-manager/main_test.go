@@ -0,0 +1,286 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/election"
+	"github.com/gambol99/rbd-fence/pkg/fence"
+	"github.com/gambol99/rbd-fence/pkg/membership"
+	"github.com/gambol99/rbd-fence/pkg/queue"
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+	"github.com/gambol99/rbd-fence/pkg/rbd/fake"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// follower ... an election we never win
+type follower struct{}
+
+func (r follower) IsLeader() bool        { return false }
+func (r follower) LeaderCh() <-chan bool { return nil }
+func (r follower) Stop()                 {}
+
+// setupFence ... sets up the service with a fake cluster, the address 10.0.0.1 holds locks in two
+// pools and 10.0.0.2 belongs to the running instance i-running
+func setupFence(t *testing.T) *fake.FakeRBD {
+	cluster := fake.NewCluster("")
+	pool := cluster.AddPool("rbd")
+	pool.AddImage("vol1").Lock("auto 1", "client.4161", "10.0.0.1")
+	pool.AddImage("vol2").Lock("auto 2", "client.4162", "10.0.0.2")
+	cluster.AddPool("volumes").AddImage("data1").Lock("auto 3", "client.4161", "10.0.0.1")
+	client := fake.NewFakeRBD(cluster)
+
+	var err error
+	rbdClient = client
+	fenceQueue, err = queue.NewQueueInterface(t.TempDir())
+	if err != nil {
+		t.Fatalf("unable to create the queue, error: %s", err)
+	}
+	poolSelector, _ = rbd.NewPoolSelector("all", "", "")
+	leaderElection = election.NewStandalone()
+	config.fence_attempts = 3
+	config.fence_retry_delay = time.Duration(10) * time.Millisecond
+	config.dry_run = false
+	config.unlock_retry = rbd.Backoff{Attempts: 2, Delay: time.Millisecond}
+	notifier = nil
+	auditLog = nil
+	orchestrator, err = fence.NewOrchestrator(fence.Config{Workers: 2, Handler: processFenceJob})
+	if err != nil {
+		t.Fatalf("unable to create the orchestrator, error: %s", err)
+	}
+	service := orchestrator
+	t.Cleanup(func() { service.Drain(time.Duration(5) * time.Second) })
+	orchestrator.SetNode("i-dead", []string{"10.0.0.1"})
+	orchestrator.SetNode("i-running", []string{"10.0.0.2"})
+
+	return client
+}
+
+// waitForFences ... waits for the orchestrator to finish the jobs submitted
+func waitForFences(t *testing.T) {
+	timeout := time.After(time.Duration(5) * time.Second)
+	for len(orchestrator.Pending()) > 0 || len(orchestrator.Running()) > 0 {
+		select {
+		case <-timeout:
+			t.Fatalf("timed out waiting for the fence jobs to finish")
+		case <-time.After(time.Duration(10) * time.Millisecond):
+		}
+	}
+}
+
+func getQueuedJobs(t *testing.T) []*queue.FenceJob {
+	jobs, err := fenceQueue.List()
+	if err != nil {
+		t.Fatalf("unable to list the queue, error: %s", err)
+	}
+	return jobs
+}
+
+func TestRemoveRBDLocks(t *testing.T) {
+	client := setupFence(t)
+
+	removeRBDLocks(&membership.NodeEvent{
+		ID:        "i-dead",
+		EventType: membership.STATUS_TERMINATED,
+		Node:      membership.Node{ID: "i-dead", State: membership.StateTerminated},
+		Detected:  time.Now(),
+	})
+	waitForFences(t)
+
+	assert.Equal(t, 0, len(client.Locks("rbd", "vol1")))
+	assert.Equal(t, 0, len(client.Locks("volumes", "data1")))
+	assert.Equal(t, 1, len(client.Locks("rbd", "vol2")))
+	assert.Equal(t, 1, len(client.CallsTo("UnlockClient")))
+	assert.Equal(t, 0, len(getQueuedJobs(t)))
+	_, found := orchestrator.GetNode("i-dead")
+	assert.False(t, found)
+}
+
+func TestRemoveRBDLocksDuplicateEvents(t *testing.T) {
+	client := setupFence(t)
+	client.FailOn("UnlockClient", fmt.Errorf("connection timed out"))
+	config.fence_retry_delay = time.Duration(100) * time.Millisecond
+
+	// step: a stopped then terminated node should only be fenced the once
+	removeRBDLocks(&membership.NodeEvent{ID: "i-dead", Node: membership.Node{ID: "i-dead", State: membership.StateStopped}})
+	removeRBDLocks(&membership.NodeEvent{ID: "i-dead", Node: membership.Node{ID: "i-dead", State: membership.StateTerminated}})
+	waitForFences(t)
+
+	assert.Equal(t, 3, len(client.CallsTo("UnlockClient")))
+	jobs := getQueuedJobs(t)
+	if assert.Equal(t, 1, len(jobs)) {
+		assert.Equal(t, 3, jobs[0].Attempts)
+	}
+}
+
+func TestRemoveRBDLocksUnknownNode(t *testing.T) {
+	client := setupFence(t)
+
+	removeRBDLocks(&membership.NodeEvent{ID: "i-unknown", Node: membership.Node{ID: "i-unknown"}})
+
+	assert.Equal(t, 0, len(client.Calls()))
+	assert.Equal(t, 0, len(getQueuedJobs(t)))
+}
+
+func TestRemoveRBDLocksFollower(t *testing.T) {
+	client := setupFence(t)
+	leaderElection = follower{}
+
+	removeRBDLocks(&membership.NodeEvent{ID: "i-dead", Node: membership.Node{ID: "i-dead", State: membership.StateStopped}})
+
+	// step: the job is recorded for when we take over, but nothing is unlocked
+	assert.Equal(t, 0, len(client.Calls()))
+	jobs := getQueuedJobs(t)
+	if assert.Equal(t, 1, len(jobs)) {
+		assert.Equal(t, "i-dead", jobs[0].InstanceID)
+		assert.Equal(t, []string{"10.0.0.1"}, jobs[0].Addresses)
+	}
+	assert.Equal(t, 1, len(client.Locks("rbd", "vol1")))
+}
+
+func TestRemoveRBDLocksFollowerExpiry(t *testing.T) {
+	client := setupFence(t)
+	leaderElection = follower{}
+	config.follower_expiry = time.Minute
+	stale := &queue.FenceJob{
+		InstanceID: "i-stale",
+		Addresses:  []string{"10.0.0.3"},
+		Pools:      poolSelector,
+		Follower:   true,
+		Created:    time.Now().Add(-time.Hour),
+	}
+	assert.NoError(t, fenceQueue.Put(stale))
+
+	// step: recording a job as a follower drops those the leader has had time to handle
+	removeRBDLocks(&membership.NodeEvent{ID: "i-dead", Node: membership.Node{ID: "i-dead", State: membership.StateStopped}})
+	jobs := getQueuedJobs(t)
+	if assert.Equal(t, 1, len(jobs)) {
+		assert.Equal(t, "i-dead", jobs[0].InstanceID)
+		assert.True(t, jobs[0].Follower)
+	}
+
+	// step: on taking over only the recent jobs are resumed
+	assert.NoError(t, fenceQueue.Put(stale))
+	leaderElection = election.NewStandalone()
+	assert.NoError(t, resumeFenceJobs())
+	waitForFences(t)
+	assert.Equal(t, 0, len(client.Locks("rbd", "vol1")))
+	if calls := client.CallsTo("UnlockClient"); assert.Equal(t, 1, len(calls)) {
+		assert.Equal(t, "10.0.0.1", calls[0].Args[0])
+	}
+	assert.Equal(t, 0, len(getQueuedJobs(t)))
+}
+
+func TestRemoveRBDLocksDryRun(t *testing.T) {
+	client := setupFence(t)
+	config.dry_run = true
+	defer func() { config.dry_run = false }()
+
+	removeRBDLocks(&membership.NodeEvent{ID: "i-dead", Node: membership.Node{ID: "i-dead"}})
+
+	assert.Equal(t, 1, len(client.CallsTo("PlanClient")))
+	assert.Equal(t, 0, len(client.CallsTo("UnlockImage")))
+	assert.Equal(t, 1, len(client.Locks("rbd", "vol1")))
+}
+
+func TestProcessFenceJobAddressReused(t *testing.T) {
+	client := setupFence(t)
+
+	// step: the address of the job now belongs to a running instance
+	job := &queue.FenceJob{InstanceID: "i-old", Addresses: []string{"10.0.0.2"}, Pools: poolSelector}
+	assert.NoError(t, fenceQueue.Put(job))
+	assert.NoError(t, processFenceJob(context.Background(), job))
+
+	assert.Equal(t, 0, len(client.CallsTo("UnlockClient")))
+	assert.Equal(t, 1, len(client.Locks("rbd", "vol2")))
+	assert.Equal(t, 0, len(getQueuedJobs(t)))
+}
+
+func TestProcessFenceJobRetries(t *testing.T) {
+	client := setupFence(t)
+	client.FailOn("UnlockClient", fmt.Errorf("connection timed out"))
+
+	job := &queue.FenceJob{InstanceID: "i-dead", Addresses: []string{"10.0.0.1"}, Pools: poolSelector}
+	assert.NoError(t, fenceQueue.Put(job))
+	assert.Error(t, processFenceJob(context.Background(), job))
+
+	// step: the job should remain queued for a later attempt
+	assert.Equal(t, 3, len(client.CallsTo("UnlockClient")))
+	jobs := getQueuedJobs(t)
+	if assert.Equal(t, 1, len(jobs)) {
+		assert.Equal(t, 3, jobs[0].Attempts)
+		assert.Contains(t, jobs[0].LastError, "connection timed out")
+	}
+	assert.Equal(t, 1, len(client.Locks("rbd", "vol1")))
+}
+
+func TestProcessFenceJobImageFailures(t *testing.T) {
+	setupFence(t)
+	cluster := fake.NewCluster("")
+	pool := cluster.AddPool("rbd")
+	pool.AddImage("vol1").Lock("auto 1", "client.4161", "10.0.0.1").FailUnlock(100)
+	pool.AddImage("vol3").Lock("auto 3", "client.4161", "10.0.0.1")
+	client := fake.NewFakeRBD(cluster)
+	rbdClient = client
+
+	job := &queue.FenceJob{InstanceID: "i-dead", Addresses: []string{"10.0.0.1"}, Pools: poolSelector}
+	assert.NoError(t, fenceQueue.Put(job))
+	assert.Error(t, processFenceJob(context.Background(), job))
+
+	// step: the image left locked fails the job, the others are unlocked on the first attempt
+	assert.Equal(t, 0, len(client.Locks("rbd", "vol3")))
+	assert.Equal(t, 1, len(client.Locks("rbd", "vol1")))
+	// step: three fence attempts of two unlock attempts, plus the first unlock of vol3
+	assert.Equal(t, 7, len(client.CallsTo("UnlockImage")))
+	jobs := getQueuedJobs(t)
+	if assert.Equal(t, 1, len(jobs)) {
+		assert.Contains(t, jobs[0].LastError, "rbd/vol1")
+	}
+}
+
+// historySource ... a event source which also lists the nodes no longer running
+type historySource struct {
+	runningSource
+	// the stopped nodes
+	stopped map[string]membership.Node
+}
+
+func (r *historySource) GetStoppedNodes() map[string]membership.Node { return r.stopped }
+
+func TestNodeHistory(t *testing.T) {
+	setupFence(t)
+	eventsClient = &runningSource{}
+	assert.Equal(t, 0, len(nodeHistory()))
+
+	// step: the history is made of the stopped nodes of the source and the queued jobs
+	eventsClient = &historySource{stopped: map[string]membership.Node{
+		"i-stopped": {ID: "i-stopped", Addresses: []string{"10.0.0.5"}, State: membership.StateStopped},
+	}}
+	assert.NoError(t, fenceQueue.Put(&queue.FenceJob{InstanceID: "i-dead", Addresses: []string{"10.0.0.1"}, Pools: poolSelector}))
+	addresses := make(map[string]string, 0)
+	for _, node := range nodeHistory() {
+		for _, address := range node.Addresses {
+			addresses[address] = node.ID
+		}
+	}
+	assert.Equal(t, map[string]string{"10.0.0.5": "i-stopped", "10.0.0.1": "i-dead"}, addresses)
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/notify"
+	"github.com/gambol99/rbd-fence/pkg/queue"
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+	"github.com/gambol99/rbd-fence/pkg/reconcile"
+)
+
+// the time we wait for the notifications to be delivered on shutdown
+var notifyTimeout = time.Duration(5) * time.Second
+
+// notifyConfig ... returns the configuration of the notifier, the webhook given on the command line is
+// added to those in the configuration file
+func (r configuration) notifyConfig() (notify.Config, error) {
+	options := notify.Config{Webhooks: append([]notify.Webhook{}, r.webhooks...), Retry: r.notify_retry}
+	if r.webhook_url == "" {
+		return options, nil
+	}
+	hook := notify.Webhook{URL: r.webhook_url, Secret: r.webhook_secret}
+	if r.webhook_secret_file != "" {
+		content, err := ioutil.ReadFile(r.webhook_secret_file)
+		if err != nil {
+			return options, fmt.Errorf("unable to read the webhook secret, error: %s", err)
+		}
+		hook.Secret = strings.TrimSpace(string(content))
+	}
+	for _, x := range strings.Split(r.webhook_events, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			hook.Events = append(hook.Events, x)
+		}
+	}
+	options.Webhooks = append(options.Webhooks, hook)
+
+	return options, nil
+}
+
+// sendEvent ... queues the event for the webhooks
+func sendEvent(event notify.Event) {
+	if notifier != nil {
+		notifier.Notify(event)
+	}
+}
+
+// notifyFence ... sends the event for the fence job, along with the images examined and the error if failed
+func notifyFence(eventType string, job *queue.FenceJob, images []rbd.ImageResult, err error) {
+	event := notify.Event{
+		Type:       eventType,
+		InstanceID: job.InstanceID,
+		Addresses:  job.Addresses,
+		State:      job.State,
+		Attempts:   job.Attempts,
+		Images:     images,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	sendEvent(event)
+}
+
+// notifyOrphan ... sends the event for a lock found orphaned by the reconciler
+func notifyOrphan(orphan reconcile.Orphan) {
+	lock := orphan.Lock
+	sendEvent(notify.Event{
+		Type:       notify.EventOrphanFound,
+		InstanceID: orphan.NodeID,
+		Addresses:  []string{lock.Owner.Address},
+		Lock:       &lock,
+	})
+}
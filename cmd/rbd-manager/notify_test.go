@@ -0,0 +1,128 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/notify"
+	"github.com/gambol99/rbd-fence/pkg/queue"
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupNotifier ... points the notifier at a local receiver, returning the events received
+func setupNotifier(t *testing.T) func() []notify.Event {
+	var lock sync.Mutex
+	var events []notify.Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var event notify.Event
+		if err := json.NewDecoder(req.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+	}))
+	t.Cleanup(server.Close)
+
+	var err error
+	notifier, err = notify.NewNotifier(notify.Config{
+		Webhooks: []notify.Webhook{{URL: server.URL}},
+		Retry:    rbd.Backoff{Attempts: 1},
+	})
+	if err != nil {
+		t.Fatalf("unable to create the notifier, error: %s", err)
+	}
+
+	// step: stopping the notifier delivers the queued events
+	return func() []notify.Event {
+		notifier.Stop(time.Duration(5) * time.Second)
+		lock.Lock()
+		defer lock.Unlock()
+		return events
+	}
+}
+
+func TestFenceNotifications(t *testing.T) {
+	setupFence(t)
+	received := setupNotifier(t)
+
+	job := &queue.FenceJob{InstanceID: "i-dead", Addresses: []string{"10.0.0.1"}, Pools: poolSelector, State: "terminated"}
+	assert.NoError(t, fenceQueue.Put(job))
+	assert.NoError(t, processFenceJob(context.Background(), job))
+
+	events := received()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, notify.EventFenceStarted, events[0].Type)
+		assert.Equal(t, notify.EventFenceSucceeded, events[1].Type)
+		assert.Equal(t, "i-dead", events[1].InstanceID)
+		assert.Equal(t, "terminated", events[1].State)
+		assert.Equal(t, 2, len(events[1].Images))
+	}
+}
+
+func TestFenceFailedNotification(t *testing.T) {
+	client := setupFence(t)
+	client.FailOn("UnlockClient", fmt.Errorf("connection timed out"))
+	received := setupNotifier(t)
+
+	job := &queue.FenceJob{InstanceID: "i-dead", Addresses: []string{"10.0.0.1"}, Pools: poolSelector}
+	assert.NoError(t, fenceQueue.Put(job))
+	assert.Error(t, processFenceJob(context.Background(), job))
+
+	events := received()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, notify.EventFenceFailed, events[1].Type)
+		assert.Equal(t, 3, events[1].Attempts)
+		assert.Contains(t, events[1].Error, "connection timed out")
+	}
+}
+
+func TestNotifyConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("s3cret\n"), 0600))
+	options := configuration{
+		webhooks:            []notify.Webhook{{URL: "https://hooks.example.com/a"}},
+		webhook_url:         "https://hooks.example.com/b",
+		webhook_secret_file: path,
+		webhook_events:      "fence_failed, orphan_found",
+	}
+
+	notifications, err := options.notifyConfig()
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(notifications.Webhooks)) {
+		assert.Equal(t, "s3cret", notifications.Webhooks[1].Secret)
+		assert.Equal(t, []string{notify.EventFenceFailed, notify.EventOrphanFound}, notifications.Webhooks[1].Events)
+	}
+	assert.NoError(t, notify.Validate(notifications))
+
+	options.webhook_events = "fence_exploded"
+	notifications, _ = options.notifyConfig()
+	assert.Error(t, notify.Validate(notifications))
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/queue"
+
+	"github.com/golang/glog"
+)
+
+// drainFences ... stops the orchestrator accepting jobs and waits up to the timeout for those running to finish.
+// The jobs which did not finish are recorded in the queue as incomplete, returns true if everything finished
+func drainFences(timeout time.Duration) bool {
+	unfinished := orchestrator.Drain(timeout)
+	for i := range unfinished {
+		job := &unfinished[i]
+		reason := "the job did not finish before the shutdown deadline"
+		if job.LastError != "" {
+			reason = fmt.Sprintf("%s, last error: %s", reason, job.LastError)
+		}
+		markIncomplete(job, reason)
+	}
+
+	return len(unfinished) <= 0
+}
+
+// cancelFences ... cancels the pending and running fence jobs on losing the leadership, so we never fence
+// alongside the new leader. The jobs remain in the queue as incomplete for whoever leads next, returns true
+// if nothing was left unfinished
+func cancelFences(timeout time.Duration) bool {
+	unfinished := orchestrator.Cancel(timeout)
+	for i := range unfinished {
+		job := &unfinished[i]
+		reason := "the job was cancelled on losing the leadership"
+		if job.LastError != "" {
+			reason = fmt.Sprintf("%s, last error: %s", reason, job.LastError)
+		}
+		markIncomplete(job, reason)
+	}
+
+	return len(unfinished) <= 0
+}
+
+// markIncomplete ... records the job in the queue as incomplete, so it's visible and resumed on the next start
+func markIncomplete(job *queue.FenceJob, reason string) {
+	job.Incomplete = true
+	job.LastError = reason
+	if err := fenceQueue.Put(job); err != nil {
+		glog.Errorf("Failed to record the incomplete fence job for instance: %s, error: %s", job.InstanceID, err)
+	}
+}
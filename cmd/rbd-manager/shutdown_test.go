@@ -0,0 +1,173 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/fence"
+	"github.com/gambol99/rbd-fence/pkg/membership"
+	"github.com/gambol99/rbd-fence/pkg/queue"
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+	"github.com/gambol99/rbd-fence/pkg/rbd/fake"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrainFences(t *testing.T) {
+	client := setupFence(t)
+
+	removeRBDLocks(&membership.NodeEvent{ID: "i-dead", Node: membership.Node{ID: "i-dead"}})
+	// step: wait for a worker to take the job, the drain waits on those running
+	waitForPickup(t)
+	assert.True(t, drainFences(time.Duration(5)*time.Second))
+
+	assert.Equal(t, 0, len(client.Locks("rbd", "vol1")))
+	assert.Equal(t, 0, len(getQueuedJobs(t)))
+	// step: nothing new should be started once we are draining
+	_, err := orchestrator.Submit(&queue.FenceJob{InstanceID: "i-running", Addresses: []string{"10.0.0.2"}})
+	assert.Equal(t, fence.ErrShuttingDown, err)
+}
+
+func TestDrainFencesInterruptsRetries(t *testing.T) {
+	client := setupFence(t)
+	client.FailOn("UnlockClient", fmt.Errorf("connection timed out"))
+	config.fence_retry_delay = time.Hour
+
+	job := &queue.FenceJob{InstanceID: "i-dead", Addresses: []string{"10.0.0.1"}, Pools: poolSelector}
+	assert.NoError(t, submitFenceJob(job))
+	waitForCalls(t, client, "UnlockClient", 1)
+
+	started := time.Now()
+	assert.False(t, drainFences(time.Duration(5)*time.Second))
+	assert.True(t, time.Since(started) < time.Second, "the drain should not wait on the retry delay")
+
+	jobs := getQueuedJobs(t)
+	if assert.Equal(t, 1, len(jobs)) {
+		assert.True(t, jobs[0].Incomplete)
+		assert.Equal(t, 1, jobs[0].Attempts)
+		assert.Contains(t, jobs[0].LastError, "connection timed out")
+	}
+	assert.Equal(t, 1, len(client.CallsTo("UnlockClient")))
+}
+
+func TestDrainFencesDeadline(t *testing.T) {
+	setupFence(t)
+	releaseCh := make(chan struct{})
+	defer close(releaseCh)
+
+	// step: a fence job which does not finish before the deadline
+	var err error
+	orchestrator, err = fence.NewOrchestrator(fence.Config{
+		Workers: 1,
+		Handler: func(ctx context.Context, job *queue.FenceJob) error {
+			<-releaseCh
+			return nil
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	job := &queue.FenceJob{InstanceID: "i-dead", Addresses: []string{"10.0.0.1"}, Pools: poolSelector, Attempts: 2}
+	assert.NoError(t, submitFenceJob(job))
+	// step: and one which is never started
+	assert.NoError(t, submitFenceJob(&queue.FenceJob{InstanceID: "i-other", Addresses: []string{"10.0.0.3"}, Pools: poolSelector}))
+
+	assert.False(t, drainFences(time.Duration(50)*time.Millisecond))
+	jobs := getQueuedJobs(t)
+	if assert.Equal(t, 2, len(jobs)) {
+		for _, x := range jobs {
+			assert.True(t, x.Incomplete)
+			assert.Contains(t, x.LastError, "deadline")
+			if x.InstanceID == "i-dead" {
+				assert.Equal(t, 2, x.Attempts)
+			}
+		}
+	}
+}
+
+func TestResumeIncompleteJobs(t *testing.T) {
+	client := setupFence(t)
+	job := &queue.FenceJob{InstanceID: "i-dead", Addresses: []string{"10.0.0.1"}, Pools: poolSelector, Incomplete: true}
+	assert.NoError(t, fenceQueue.Put(job))
+
+	assert.NoError(t, resumeFenceJobs())
+	waitForFences(t)
+	assert.True(t, drainFences(time.Duration(5)*time.Second))
+	assert.Equal(t, 0, len(client.Locks("rbd", "vol1")))
+	assert.Equal(t, 0, len(getQueuedJobs(t)))
+}
+
+// waitForPickup ... waits for the workers to take the pending jobs
+func waitForPickup(t *testing.T) {
+	timeout := time.After(time.Duration(5) * time.Second)
+	for len(orchestrator.Pending()) > 0 {
+		select {
+		case <-timeout:
+			t.Fatalf("timed out waiting for the workers to take the jobs")
+		case <-time.After(time.Duration(5) * time.Millisecond):
+		}
+	}
+}
+
+// waitForCalls ... waits for the number of calls to the method
+func waitForCalls(t *testing.T, client *fake.FakeRBD, method string, count int) {
+	timeout := time.After(time.Duration(5) * time.Second)
+	for len(client.CallsTo(method)) < count {
+		select {
+		case <-timeout:
+			t.Fatalf("timed out waiting for %d calls to %s", count, method)
+		case <-time.After(time.Duration(10) * time.Millisecond):
+		}
+	}
+}
+
+func TestCancelFencesOnLosingLeadership(t *testing.T) {
+	client := setupFence(t)
+	client.FailOn("UnlockImage", fmt.Errorf("connection timed out"))
+	config.unlock_retry = rbd.Backoff{Attempts: 5, Delay: time.Hour}
+
+	job := &queue.FenceJob{InstanceID: "i-dead", Addresses: []string{"10.0.0.1"}, Pools: poolSelector}
+	assert.NoError(t, submitFenceJob(job))
+	waitForCalls(t, client, "UnlockImage", 1)
+
+	// step: the unlock is waiting on the retry, losing the leadership should cut it short
+	started := time.Now()
+	assert.False(t, cancelFences(time.Duration(5)*time.Second))
+	assert.True(t, time.Since(started) < time.Second, "the cancel should not wait on the retry delay")
+	assert.Equal(t, 0, len(orchestrator.Running()))
+
+	jobs := getQueuedJobs(t)
+	if assert.Equal(t, 1, len(jobs)) {
+		assert.True(t, jobs[0].Incomplete)
+		assert.Contains(t, jobs[0].LastError, "losing the leadership")
+	}
+	// step: the locks are left for the next leader and nothing further is removed
+	calls := len(client.CallsTo("UnlockImage"))
+	time.Sleep(time.Duration(50) * time.Millisecond)
+	assert.Equal(t, calls, len(client.CallsTo("UnlockImage")))
+	assert.Equal(t, 1, len(client.Locks("rbd", "vol1")))
+
+	// step: unlike a drain, the orchestrator still accepts jobs once we lead again
+	client.FailOn("UnlockImage", nil)
+	assert.NoError(t, submitFenceJob(&queue.FenceJob{InstanceID: "i-dead", Addresses: []string{"10.0.0.1"}, Pools: poolSelector}))
+	waitForFences(t)
+	assert.Equal(t, 0, len(client.Locks("rbd", "vol1")))
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gambol99/rbd-fence/pkg/aws"
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+
+	"github.com/golang/glog"
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// the additional output format of the inventory
+const formatCSV = "csv"
+
+// inventoryEntry ... a lock in the cluster and the instance which owns it
+type inventoryEntry struct {
+	// the pool the image resides in
+	Pool string `json:"pool"`
+	// the name of the image
+	Image string `json:"image"`
+	// the lock id
+	LockID string `json:"lock_id"`
+	// the client holding the lock
+	ClientID string `json:"client_id"`
+	// the address of the client
+	Address string `json:"address"`
+	// the session of the client
+	Session string `json:"session"`
+	// the type of lock
+	LockType string `json:"lock_type"`
+	// the instance id owning the address
+	InstanceID string `json:"instance_id"`
+	// the name tag of the instance
+	Name string `json:"name"`
+	// the state of the instance
+	State string `json:"state"`
+	// the availability zone of the instance
+	AvailZone string `json:"availability_zone"`
+}
+
+// getInventory ... retrieves every lock in the selected pools, joining the lockers to the ec2 instances
+//
+//	client:		the rbd interface
+//	pools:		the pools to inventory
+//	instances:	the ec2 interface, if nil the lockers are not joined
+func getInventory(client rbd.RBDInterface, pools rbd.PoolSelector, instances aws.EC2Interface) ([]inventoryEntry, error) {
+	locks, err := client.ListLocks(pools)
+	if err != nil {
+		return nil, err
+	}
+
+	// step: index the instances by their address
+	owners := make(map[string]ec2.Instance, 0)
+	if instances != nil {
+		list, err := instances.DescribeAll()
+		if err != nil {
+			glog.Warningf("Unable to retrieve the ec2 instances of every region, the locks of those missing will not be joined, error: %s", err)
+		}
+		for _, x := range list {
+			if x.PrivateIpAddress == "" {
+				continue
+			}
+			// choice: an address can be reused, we prefer the running instance
+			if current, found := owners[x.PrivateIpAddress]; found && current.State.Name == "running" {
+				continue
+			}
+			owners[x.PrivateIpAddress] = x
+		}
+	}
+
+	entries := make([]inventoryEntry, 0)
+	for _, lock := range locks {
+		entry := inventoryEntry{
+			Pool:     lock.Pool,
+			Image:    lock.Image,
+			LockID:   lock.Owner.LockID,
+			ClientID: lock.Owner.ClientID,
+			Address:  lock.Owner.Address,
+			Session:  lock.Owner.Session,
+			LockType: lock.Owner.LockType,
+		}
+		if instance, found := owners[lock.Owner.Address]; found {
+			entry.InstanceID = instance.InstanceId
+			entry.State = instance.State.Name
+			entry.AvailZone = instance.AvailZone
+			for _, tag := range instance.Tags {
+				if tag.Key == "Name" {
+					entry.Name = tag.Value
+				}
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// renderInventory ... renders the inventory as a table, json or csv
+func renderInventory(entries []inventoryEntry, format string) (string, error) {
+	b := new(bytes.Buffer)
+	header := []string{"POOL", "IMAGE", "LOCK ID", "CLIENT ID", "ADDRESS", "SESSION", "TYPE", "INSTANCE", "NAME", "STATE", "ZONE"}
+
+	switch format {
+	case rbd.FormatJSON:
+		content, err := json.Marshal(entries)
+		if err != nil {
+			return "", err
+		}
+		return string(content), nil
+	case formatCSV:
+		w := csv.NewWriter(b)
+		w.Write(header)
+		for _, x := range entries {
+			w.Write(x.fields())
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return "", err
+		}
+	case rbd.FormatText:
+		w := tabwriter.NewWriter(b, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, strings.Join(header, "\t"))
+		for _, x := range entries {
+			fmt.Fprintln(w, strings.Join(x.fields(), "\t"))
+		}
+		w.Flush()
+	default:
+		return "", fmt.Errorf("unsupported output format: %s", format)
+	}
+
+	return b.String(), nil
+}
+
+// fields ... returns the columns of the entry
+func (r inventoryEntry) fields() []string {
+	return []string{r.Pool, r.Image, r.LockID, r.ClientID, r.Address, r.Session, r.LockType,
+		r.InstanceID, r.Name, r.State, r.AvailZone}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gambol99/rbd-fence/pkg/aws"
+	awsfake "github.com/gambol99/rbd-fence/pkg/aws/fake"
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+	"github.com/gambol99/rbd-fence/pkg/rbd/fake"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupInventory ... creates a fake cluster and ec2 api, 10.0.0.1 belongs to a running instance, 10.0.0.2 was
+// reused by a running instance after a terminated one and 10.0.0.9 has no instance
+func setupInventory(t *testing.T) (rbd.RBDInterface, aws.EC2Interface, *awsfake.Server) {
+	cluster := fake.NewCluster("")
+	pool := cluster.AddPool("rbd")
+	pool.AddImage("vol1").Lock("auto 1", "client.4161", "10.0.0.1")
+	pool.AddImage("vol2").Lock("auto 2", "client.4162", "10.0.0.2")
+	pool.AddImage("vol3").Lock("auto 3", "client.4163", "10.0.0.9")
+
+	api := awsfake.NewServer()
+	t.Cleanup(api.Close)
+	api.AddInstance("i-web", "10.0.0.1", "running", "Name", `web, "primary"`)
+	api.AddInstance("i-new", "10.0.0.2", "running", "Name", "db")
+	api.AddInstance("i-old", "10.0.0.2", "terminated", "Name", "db-old")
+	instances, err := aws.NewEC2Interface("key", "secret", "eu-west-1", api.URL(), "")
+	if err != nil {
+		t.Fatalf("unable to create the ec2 interface, error: %s", err)
+	}
+
+	return fake.NewFakeRBD(cluster), instances, api
+}
+
+// allPools ... returns a selector for every pool
+func allPools(t *testing.T) rbd.PoolSelector {
+	selector, err := rbd.NewPoolSelector("all", "", "")
+	if err != nil {
+		t.Fatalf("unable to create the pool selector, error: %s", err)
+	}
+	return selector
+}
+
+// byImage ... indexes the entries by their image
+func byImage(entries []inventoryEntry) map[string]inventoryEntry {
+	list := make(map[string]inventoryEntry, 0)
+	for _, x := range entries {
+		list[x.Pool+"/"+x.Image] = x
+	}
+	return list
+}
+
+func TestGetInventory(t *testing.T) {
+	client, instances, _ := setupInventory(t)
+
+	entries, err := getInventory(client, allPools(t), instances)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 3, len(entries))
+	list := byImage(entries)
+
+	assert.Equal(t, inventoryEntry{
+		Pool: "rbd", Image: "vol1", LockID: "auto 1", ClientID: "client.4161", Address: "10.0.0.1",
+		Session: list["rbd/vol1"].Session, LockType: list["rbd/vol1"].LockType,
+		InstanceID: "i-web", Name: `web, "primary"`, State: "running", AvailZone: "eu-west-1a",
+	}, list["rbd/vol1"])
+	// step: a reused address is joined to the running instance
+	assert.Equal(t, "i-new", list["rbd/vol2"].InstanceID)
+	assert.Equal(t, "running", list["rbd/vol2"].State)
+	// step: a lock whose address has no instance is still listed
+	orphan := list["rbd/vol3"]
+	assert.Equal(t, "10.0.0.9", orphan.Address)
+	assert.Equal(t, "client.4163", orphan.ClientID)
+	assert.Empty(t, orphan.InstanceID)
+	assert.Empty(t, orphan.Name)
+	assert.Empty(t, orphan.State)
+}
+
+func TestGetInventoryWithoutInstances(t *testing.T) {
+	client, _, api := setupInventory(t)
+
+	// step: without the ec2 interface the locks are not joined
+	entries, err := getInventory(client, allPools(t), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(entries))
+	for _, x := range entries {
+		assert.Empty(t, x.InstanceID)
+	}
+
+	// step: and a failing api leaves them unjoined rather than failing the inventory
+	instances, err := aws.NewEC2Interface("key", "secret", "eu-west-1", api.URL(), "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	api.Fail(100)
+	entries, err = getInventory(client, allPools(t), instances)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(entries))
+	for _, x := range entries {
+		assert.Empty(t, x.InstanceID)
+	}
+}
+
+func TestRenderInventoryCSV(t *testing.T) {
+	entries := []inventoryEntry{
+		{Pool: "rbd", Image: "vol1", LockID: "auto 1", ClientID: "client.4161", Address: "10.0.0.1",
+			InstanceID: "i-web", Name: `web, "primary"`, State: "running", AvailZone: "eu-west-1a"},
+		{Pool: "rbd", Image: "vol3", LockID: "auto 3", ClientID: "client.4163", Address: "10.0.0.9"},
+	}
+	content, err := renderInventory(entries, formatCSV)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// step: the tags with commas and quotes are escaped
+	assert.Contains(t, content, `"web, ""primary"""`)
+
+	records, err := csv.NewReader(strings.NewReader(content)).ReadAll()
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Equal(t, 3, len(records)) {
+		assert.Equal(t, "POOL", records[0][0])
+		assert.Equal(t, entries[0].fields(), records[1])
+		assert.Equal(t, entries[1].fields(), records[2])
+		assert.Equal(t, "", records[2][7])
+	}
+}
+
+func TestRenderInventory(t *testing.T) {
+	entries := []inventoryEntry{
+		{Pool: "rbd", Image: "vol1", LockID: "auto 1", ClientID: "client.4161", Address: "10.0.0.1", InstanceID: "i-web"},
+	}
+
+	content, err := renderInventory(entries, rbd.FormatJSON)
+	if assert.NoError(t, err) {
+		var decoded []inventoryEntry
+		assert.NoError(t, json.Unmarshal([]byte(content), &decoded))
+		assert.Equal(t, entries, decoded)
+	}
+
+	content, err = renderInventory(entries, rbd.FormatText)
+	if assert.NoError(t, err) {
+		lines := strings.Split(strings.TrimSpace(content), "\n")
+		if assert.Equal(t, 2, len(lines)) {
+			assert.True(t, strings.HasPrefix(lines[0], "POOL"))
+			assert.Equal(t, []string{"rbd", "vol1", "auto", "1", "client.4161", "10.0.0.1", "i-web"}, strings.Fields(lines[1]))
+		}
+	}
+
+	_, err = renderInventory(entries, "yaml")
+	assert.Error(t, err)
+}
@@ -18,8 +18,12 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"time"
 
+	"github.com/gambol99/rbd-fence/pkg/audit"
+	"github.com/gambol99/rbd-fence/pkg/aws"
 	"github.com/gambol99/rbd-fence/pkg/rbd"
 
 	"github.com/golang/glog"
@@ -28,19 +32,87 @@ import (
 var config struct {
 	// the ip address of the client
 	address string
+	// the pools to check
+	pool string
+	// the glob patterns of pools to include
+	pool_include string
+	// the glob patterns of pools to exclude
+	pool_exclude string
+	// blacklist the client before removing the locks
+	blacklist bool
+	// refuse to remove the locks unless the blacklist succeeded
+	require_blacklist bool
+	// the expiry of the blacklist entry
+	blacklist_expiry time.Duration
+	// the retrying of the images which failed to unlock
+	retry rbd.Backoff
+	// only print what would be done
+	dry_run bool
+	// the output format of the plan
+	output string
+	// list the locks in the cluster rather than unlocking
+	list bool
+	// join the locks to the ec2 instances
+	lookup bool
+	// the instance the address belonged to, recorded in the audit log
+	instance string
+	// the file the audit records are appended to, glog if empty
+	audit_log string
+	// the size in megabytes the audit log is rotated at
+	audit_max_size int
+	// the number of rotated audit logs kept
+	audit_max_backups int
 }
 
 func init() {
 	flag.StringVar(&config.address, "ip", "", "the ip address of the client which you wish to unlock")
+	flag.StringVar(&config.pool, "pool", "", "a comma separated list of the pools to check, use 'all' or leave blank to check all pools")
+	flag.StringVar(&config.pool_include, "pool-include", "", "a comma separated list of glob patterns for additional pools to check")
+	flag.StringVar(&config.pool_exclude, "pool-exclude", "", "a comma separated list of glob patterns for pools which should never be checked")
+	flag.BoolVar(&config.blacklist, "blacklist", false, "blacklist the client address in ceph before removing any locks")
+	flag.BoolVar(&config.require_blacklist, "require-blacklist", false, "refuse to remove any locks unless the client was successfully blacklisted")
+	flag.DurationVar(&config.blacklist_expiry, "blacklist-expiry", time.Duration(1)*time.Hour, "the duration the client should remain blacklisted")
+	flag.IntVar(&config.retry.Attempts, "attempts", rbd.DefaultBackoff.Attempts, "the number of attempts made to unlock each image")
+	flag.DurationVar(&config.retry.Delay, "backoff", rbd.DefaultBackoff.Delay, "the delay before retrying the images which failed to unlock, doubling on each attempt")
+	flag.DurationVar(&config.retry.MaxDelay, "backoff-max", rbd.DefaultBackoff.MaxDelay, "the maximum delay between the attempts to unlock an image")
+	config.retry.Jitter = rbd.DefaultBackoff.Jitter
+	flag.BoolVar(&config.dry_run, "dry-run", false, "print the plan of what would be unlocked without removing any locks")
+	flag.StringVar(&config.output, "output", rbd.FormatText, "the output format of the plan or inventory, text or json, the inventory also supports csv")
+	flag.BoolVar(&config.list, "list", false, "list every lock in the selected pools and the instance which owns it, rather than unlocking")
+	flag.StringVar(&config.instance, "instance", "", "the instance the address belonged to, recorded in the audit log")
+	flag.StringVar(&config.audit_log, "audit-log", "", "the file the json audit records of the lock removals are appended to, defaults to the log")
+	flag.IntVar(&config.audit_max_size, "audit-max-size", 100, "the size in megabytes the audit log is rotated at")
+	flag.IntVar(&config.audit_max_backups, "audit-max-backups", 5, "the number of rotated audit logs kept")
+	flag.BoolVar(&config.lookup, "lookup", true, "join the locks in the inventory to the ec2 instances owning the address")
 }
 
 func main() {
 	flag.Parse()
+	if config.list {
+		listLocks()
+		return
+	}
 	if config.address == "" {
 		glog.Errorf("You have not specified the ip address of the client to remove lock ownership")
 		os.Exit(1)
 	}
 
+	if !rbd.IsValidFormat(config.output) {
+		glog.Errorf("Invalid output format: %s, must be text or json", config.output)
+		os.Exit(1)
+	}
+
+	if err := config.retry.Validate(); err != nil {
+		glog.Errorf("Invalid retry options, error: %s", err)
+		os.Exit(1)
+	}
+
+	pools, err := rbd.NewPoolSelector(config.pool, config.pool_include, config.pool_exclude)
+	if err != nil {
+		glog.Errorf("Invalid pool selection, error: %s", err)
+		os.Exit(1)
+	}
+
 	// step: grab a rbd interface
 	client, err := rbd.NewRBDInterface()
 	if err != nil {
@@ -48,11 +120,98 @@ func main() {
 		os.Exit(1)
 	}
 
-	err = client.UnlockClient(config.address)
+	options := rbd.FenceOptions{
+		Blacklist:        config.blacklist,
+		RequireBlacklist: config.require_blacklist,
+		BlacklistExpiry:  config.blacklist_expiry,
+		Retry:            config.retry,
+	}
+
+	// step: are we only printing the plan?
+	if config.dry_run {
+		plan, err := client.PlanClient(config.address, pools, options)
+		if err != nil {
+			glog.Errorf("Failed to plan the unlocking of images held by %s, error: %s", config.address, err)
+			os.Exit(1)
+		}
+		content, err := plan.Render(config.output)
+		if err != nil {
+			glog.Errorf("Failed to render the plan, error: %s", err)
+			os.Exit(1)
+		}
+		fmt.Println(content)
+		return
+	}
+
+	auditLog, err := audit.NewLogger(config.audit_log, int64(config.audit_max_size)*1024*1024, config.audit_max_backups)
+	if err != nil {
+		glog.Errorf("Failed to open the audit log, error: %s", err)
+		os.Exit(1)
+	}
+	options.OnUnlock = func(event rbd.UnlockEvent) {
+		if err := auditLog.Write(audit.NewRecord(audit.TriggerCLI, config.instance, "", event)); err != nil {
+			glog.Errorf("Failed to write the audit record for image: %s/%s, error: %s", event.Pool, event.Image, err)
+		}
+	}
+
+	result, err := client.UnlockClient(config.address, pools, options)
+	if err := auditLog.Close(); err != nil {
+		glog.Errorf("Failed to close the audit log, error: %s", err)
+	}
+	if result != nil {
+		if result.Blacklist != nil {
+			glog.Infof("Blacklisted the client, %s", result.Blacklist)
+		}
+		for _, image := range result.Images {
+			glog.Infof("Image %s", image)
+		}
+	}
+	if err != nil {
+		glog.Errorf("Failed to unlock the images held by %s, error: %s", config.address, err)
+		os.Exit(1)
+	}
+
+	glog.Infof("Successfully remove any locks, unlocked: %v", result.Unlocked)
+}
+
+// listLocks ... prints the inventory of locks in the selected pools
+func listLocks() {
+	if !rbd.IsValidFormat(config.output) && config.output != formatCSV {
+		glog.Errorf("Invalid output format: %s, must be text, json or csv", config.output)
+		os.Exit(1)
+	}
+	pools, err := rbd.NewPoolSelector(config.pool, config.pool_include, config.pool_exclude)
+	if err != nil {
+		glog.Errorf("Invalid pool selection, error: %s", err)
+		os.Exit(1)
+	}
+	client, err := rbd.NewRBDInterface()
 	if err != nil {
-		glog.Errorf("Failed to unlock the images held by %s", config.address)
+		glog.Errorf("Failed to create a client interface for rbd, error: %s", err)
 		os.Exit(1)
 	}
 
-	glog.Infof("Successfully remove any locks")
+	var instances aws.EC2Interface
+	if config.lookup {
+		instances, err = aws.NewDefaultEC2Interface()
+		if err != nil {
+			glog.Warningf("Unable to create the ec2 client, the locks will not be joined, error: %s", err)
+			instances = nil
+		}
+	}
+
+	entries, err := getInventory(client, pools, instances)
+	if err != nil {
+		glog.Errorf("Failed to retrieve the lock inventory, error: %s", err)
+		os.Exit(1)
+	}
+	content, err := renderInventory(entries, config.output)
+	if err != nil {
+		glog.Errorf("Failed to render the inventory, error: %s", err)
+		os.Exit(1)
+	}
+	fmt.Print(content)
+	if config.output == rbd.FormatJSON {
+		fmt.Println()
+	}
 }
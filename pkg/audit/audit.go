@@ -0,0 +1,234 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+	"github.com/gambol99/rbd-fence/pkg/utils"
+
+	"github.com/golang/glog"
+)
+
+// the hostname recorded in the records
+var hostname, _ = os.Hostname()
+
+// NewRecord ... creates the audit record for the attempt to remove a lock
+//
+//	trigger:	what triggered the removal
+//	instanceID:	the instance being fenced, if known
+//	transition:	the change in state of the instance
+//	event:		the attempt to remove the lock
+func NewRecord(trigger, instanceID, transition string, event rbd.UnlockEvent) Record {
+	record := Record{
+		Timestamp:  event.Started.UTC(),
+		Host:       hostname,
+		Trigger:    trigger,
+		InstanceID: instanceID,
+		Transition: transition,
+		Pool:       event.Pool,
+		Image:      event.Image,
+		Owner:      event.Owner,
+		Attempt:    event.Attempt,
+		Result: Result{
+			Command:    strings.Join(event.Command, " "),
+			Success:    event.Error == nil,
+			DurationMS: event.Duration.Nanoseconds() / 1e6,
+		},
+	}
+	if event.Error != nil {
+		record.Result.Error = event.Error.Error()
+		record.Result.ExitCode = -1
+		var execErr *utils.ExecError
+		if errors.As(event.Error, &execErr) {
+			record.Result.Command = execErr.Command
+			record.Result.ExitCode = execErr.ExitCode
+			record.Result.Stderr = execErr.Stderr
+			record.Result.TimedOut = execErr.TimedOut
+		}
+	}
+
+	return record
+}
+
+// NewLogger ... creates the audit log, the records are written to the file if given, else to glog
+//
+//	path:		the path of the file, empty to log to glog
+//	maxSize:	the size in bytes the file is rotated at
+//	maxBackups:	the number of rotated files kept
+func NewLogger(path string, maxSize int64, maxBackups int) (LoggerInterface, error) {
+	if path == "" {
+		return &glogLogger{}, nil
+	}
+	return NewFileLogger(path, maxSize, maxBackups)
+}
+
+// glogLogger ... writes the records to the log
+type glogLogger struct{}
+
+// Write ... writes the record to glog
+func (r *glogLogger) Write(record Record) error {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	glog.Infof("audit: %s", encoded)
+	return nil
+}
+
+// Close ... flushes the log
+func (r *glogLogger) Close() error {
+	glog.Flush()
+	return nil
+}
+
+// fileLogger ... appends the records as json lines to a file, rotating the file by size
+type fileLogger struct {
+	sync.Mutex
+	// the path of the file
+	path string
+	// the size in bytes the file is rotated at
+	maxSize int64
+	// the number of rotated files kept
+	maxBackups int
+	// the open file
+	file *os.File
+	// the present size of the file
+	size int64
+}
+
+// NewFileLogger ... opens the audit log file for appending
+func NewFileLogger(path string, maxSize int64, maxBackups int) (LoggerInterface, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("the maximum size of the audit log must be positive")
+	}
+	if maxBackups < 0 {
+		return nil, fmt.Errorf("the number of audit log backups cannot be negative")
+	}
+	service := &fileLogger{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := service.open(); err != nil {
+		return nil, err
+	}
+
+	return service, nil
+}
+
+// Write ... appends the record to the file, rotating the file first if it would exceed the maximum size
+func (r *fileLogger) Write(record Record) error {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	encoded = append(encoded, '\n')
+
+	r.Lock()
+	defer r.Unlock()
+	if r.file == nil {
+		return fmt.Errorf("the audit log is closed")
+	}
+	// step: a failed rotation keeps appending to the file, so the record is not lost
+	var rotateErr error
+	if r.size > 0 && r.size+int64(len(encoded)) > r.maxSize {
+		if rotateErr = r.rotate(); rotateErr != nil {
+			rotateErr = fmt.Errorf("unable to rotate the audit log, error: %s", rotateErr)
+			if r.file == nil {
+				return rotateErr
+			}
+		}
+	}
+	written, err := r.file.Write(encoded)
+	r.size += int64(written)
+	if err != nil {
+		return err
+	}
+	if err := r.file.Sync(); err != nil {
+		return err
+	}
+
+	return rotateErr
+}
+
+// Close ... closes the file
+func (r *fileLogger) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// open ... opens the file for appending, the lock must be held
+func (r *fileLogger) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open the audit log: %s, error: %s", r.path, err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = stat.Size()
+
+	return nil
+}
+
+// rotate ... shifts the rotated files along, i.e. audit.log.1 to audit.log.2, discarding the oldest, and
+// moves the file to audit.log.1. On a failure the file is reopened where it is. The lock must be held
+func (r *fileLogger) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.file = nil
+	if err := r.shift(); err != nil {
+		if rerr := r.open(); rerr != nil {
+			return fmt.Errorf("%s, %s", err, rerr)
+		}
+		return err
+	}
+	glog.Infof("Rotated the audit log: %s", r.path)
+
+	return r.open()
+}
+
+// shift ... moves the closed file and the rotated files along, removing the file when we keep no backups
+func (r *fileLogger) shift() error {
+	if r.maxBackups <= 0 {
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		source := fmt.Sprintf("%s.%d", r.path, i)
+		if err := os.Rename(source, fmt.Sprintf("%s.%d", r.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return os.Rename(r.path, r.path+".1")
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+	"github.com/gambol99/rbd-fence/pkg/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testOwner = rbd.RbdOwner{LockID: "auto 1", ClientID: "client.4161", Address: "10.0.0.1", LockType: rbd.LockExclusive}
+
+func newTestRecord(image string) Record {
+	return NewRecord(TriggerEvent, "i-dead", "running -> terminated", rbd.UnlockEvent{
+		Pool:     "rbd",
+		Image:    image,
+		Owner:    testOwner,
+		Command:  rbd.UnlockCommand("rbd", image, testOwner),
+		Attempt:  1,
+		Started:  time.Now(),
+		Duration: time.Duration(120) * time.Millisecond,
+	})
+}
+
+// readRecords ... reads the json lines in the file
+func readRecords(t *testing.T, path string) []Record {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unable to open the audit log, error: %s", err)
+	}
+	defer file.Close()
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid audit record: %s, error: %s", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestNewRecord(t *testing.T) {
+	record := newTestRecord("vol1")
+	assert.Equal(t, TriggerEvent, record.Trigger)
+	assert.Equal(t, "i-dead", record.InstanceID)
+	assert.Equal(t, "running -> terminated", record.Transition)
+	assert.Equal(t, testOwner, record.Owner)
+	assert.True(t, record.Result.Success)
+	assert.Equal(t, 0, record.Result.ExitCode)
+	assert.Equal(t, int64(120), record.Result.DurationMS)
+	assert.Equal(t, "rbd -p rbd lock remove vol1 auto 1 client.4161", record.Result.Command)
+}
+
+func TestNewRecordFailure(t *testing.T) {
+	record := NewRecord(TriggerCLI, "", "", rbd.UnlockEvent{
+		Pool:  "rbd",
+		Image: "vol1",
+		Owner: testOwner,
+		Error: fmt.Errorf("wrapped, error: %w", &utils.ExecError{
+			Command:  "rbd -p rbd lock remove vol1 'auto 1' client.4161",
+			ExitCode: 16,
+			Stderr:   "rbd: releasing lock failed: (16) Device or resource busy",
+		}),
+	})
+	assert.False(t, record.Result.Success)
+	assert.Equal(t, 16, record.Result.ExitCode)
+	assert.Equal(t, "rbd -p rbd lock remove vol1 'auto 1' client.4161", record.Result.Command)
+	assert.Contains(t, record.Result.Stderr, "Device or resource busy")
+	assert.Contains(t, record.Result.Error, "wrapped")
+
+	record = NewRecord(TriggerCLI, "", "", rbd.UnlockEvent{Error: fmt.Errorf("not an exec error")})
+	assert.Equal(t, -1, record.Result.ExitCode)
+}
+
+func TestFileLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	logger, err := NewFileLogger(path, 1024*1024, 3)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, logger.Write(newTestRecord("vol1")))
+	assert.NoError(t, logger.Write(newTestRecord("vol2")))
+	assert.NoError(t, logger.Close())
+
+	// step: reopening the log should append to it
+	logger, err = NewFileLogger(path, 1024*1024, 3)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, logger.Write(newTestRecord("vol3")))
+	assert.NoError(t, logger.Close())
+	assert.Error(t, logger.Write(newTestRecord("vol4")))
+
+	records := readRecords(t, path)
+	if assert.Equal(t, 3, len(records)) {
+		assert.Equal(t, "vol1", records[0].Image)
+		assert.Equal(t, "vol3", records[2].Image)
+	}
+	stat, _ := os.Stat(path)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+}
+
+func TestFileLoggerRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	encoded, _ := json.Marshal(newTestRecord("vol0"))
+	// step: room for two records per file
+	logger, err := NewFileLogger(path, int64(len(encoded)+1)*2+10, 2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer logger.Close()
+
+	for i := 0; i < 9; i++ {
+		assert.NoError(t, logger.Write(newTestRecord(fmt.Sprintf("vol%d", i))))
+	}
+
+	// step: the newest records are in the file, the older in the backups, anything beyond is discarded
+	assert.Equal(t, []string{"vol8"}, images(readRecords(t, path)))
+	assert.Equal(t, []string{"vol6", "vol7"}, images(readRecords(t, path+".1")))
+	assert.Equal(t, []string{"vol4", "vol5"}, images(readRecords(t, path+".2")))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileLoggerRotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	logger, err := NewFileLogger(path, 10, 1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer logger.Close()
+	assert.NoError(t, logger.Write(newTestRecord("vol1")))
+
+	// step: a directory in the place of the backup fails the rename, we keep appending to the file
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocked"), 0700); err != nil {
+		t.Fatalf("unable to create the directory, error: %s", err)
+	}
+	assert.Error(t, logger.Write(newTestRecord("vol2")))
+	assert.Equal(t, []string{"vol1", "vol2"}, images(readRecords(t, path)))
+
+	// step: the rotation succeeds once the cause is removed
+	assert.NoError(t, os.RemoveAll(path+".1"))
+	assert.NoError(t, logger.Write(newTestRecord("vol3")))
+	assert.Equal(t, []string{"vol3"}, images(readRecords(t, path)))
+	assert.Equal(t, []string{"vol1", "vol2"}, images(readRecords(t, path+".1")))
+}
+
+func TestFileLoggerNoBackups(t *testing.T) {
+	directory := t.TempDir()
+	path := filepath.Join(directory, "audit.log")
+	logger, err := NewFileLogger(path, 10, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer logger.Close()
+	assert.NoError(t, logger.Write(newTestRecord("vol1")))
+	assert.NoError(t, logger.Write(newTestRecord("vol2")))
+
+	assert.Equal(t, []string{"vol2"}, images(readRecords(t, path)))
+	files, _ := ioutil.ReadDir(directory)
+	assert.Equal(t, 1, len(files))
+}
+
+func TestNewLogger(t *testing.T) {
+	logger, err := NewLogger("", 0, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Write(newTestRecord("vol1")))
+
+	_, err = NewLogger(filepath.Join(t.TempDir(), "audit.log"), 0, 0)
+	assert.Error(t, err)
+	_, err = NewLogger(filepath.Join(t.TempDir(), "missing", "audit.log"), 1024, 0)
+	assert.Error(t, err)
+}
+
+func images(records []Record) []string {
+	var list []string
+	for _, x := range records {
+		list = append(list, x.Image)
+	}
+	return list
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+)
+
+// the triggers of a lock removal
+const (
+	// a change in the state of an instance reported by the event source
+	TriggerEvent = "instance_event"
+	// the rbd-unlock command line
+	TriggerCLI = "manual_cli"
+	// a fence requested through the admin api
+	TriggerAPI = "manual_api"
+	// an orphaned lock found by the reconciler
+	TriggerReconciler = "reconciler"
+)
+
+// Record ... an audit record of an attempt to remove a lock
+type Record struct {
+	// the time of the attempt
+	Timestamp time.Time `json:"timestamp"`
+	// the host which removed the lock
+	Host string `json:"host"`
+	// what triggered the removal, i.e. instance_event, manual_cli, manual_api or reconciler
+	Trigger string `json:"trigger"`
+	// the instance being fenced, if known
+	InstanceID string `json:"instance_id,omitempty"`
+	// the change in state of the instance, i.e. running -> terminated
+	Transition string `json:"transition,omitempty"`
+	// the pool the image lives in
+	Pool string `json:"pool"`
+	// the name of the image
+	Image string `json:"image"`
+	// the owner of the lock
+	Owner rbd.RbdOwner `json:"owner"`
+	// the attempt at removing the lock
+	Attempt int `json:"attempt"`
+	// the result of the ceph command
+	Result Result `json:"result"`
+}
+
+// Result ... the result of the ceph command removing the lock
+type Result struct {
+	// the command line
+	Command string `json:"command"`
+	// whether the lock was removed
+	Success bool `json:"success"`
+	// the exit code of the command, -1 if the command did not exit
+	ExitCode int `json:"exit_code"`
+	// the standard error of the command
+	Stderr string `json:"stderr,omitempty"`
+	// the error, if the lock was not removed
+	Error string `json:"error,omitempty"`
+	// whether the command was killed on reaching the deadline
+	TimedOut bool `json:"timed_out,omitempty"`
+	// the time taken in milliseconds
+	DurationMS int64 `json:"duration_ms"`
+}
+
+// LoggerInterface ... an append only log of the audit records
+type LoggerInterface interface {
+	// Append the record to the log
+	Write(Record) error
+	// Close the log
+	Close() error
+}
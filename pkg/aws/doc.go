@@ -18,6 +18,7 @@ package aws
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/mitchellh/goamz/ec2"
 )
@@ -37,19 +38,82 @@ const (
 type InstanceEvent struct {
 	// the instance id
 	InstanceID string
+	// the region the instance resides in
+	Region string
 	// the event type
 	EventType int
 	// the instance if required
 	Instance ec2.Instance
+	// the time the change was detected
+	Detected time.Time
 }
 
 func (r InstanceEvent) String() string {
-	return fmt.Sprintf("instanceId: %s, type: %d", r.InstanceID, r.EventType)
+	return fmt.Sprintf("instanceId: %s, region: %s, type: %d", r.InstanceID, r.Region, r.EventType)
 }
 
 // EventCh ... a channel to receive events upon
 type EventCh chan *InstanceEvent
 
+// HealthEvent ... the structure for a error encountered by the poller or a change in it's health
+type HealthEvent struct {
+	// the region of the poller
+	Region string
+	// whether the poller is able to retrieve the instances
+	Healthy bool
+	// the number of consecutive failures to poll the api
+	Failures int
+	// the error encountered, if any
+	Error error
+	// the time of the event
+	Time time.Time
+}
+
+func (r HealthEvent) String() string {
+	return fmt.Sprintf("region: %s, healthy: %t, failures: %d, error: %v", r.Region, r.Healthy, r.Failures, r.Error)
+}
+
+// HealthCh ... a channel to receive health events upon
+type HealthCh chan *HealthEvent
+
+// HealthStatus ... the present health of the poller
+type HealthStatus struct {
+	// the region of the poller, empty for the combined health of several regions
+	Region string
+	// whether the poller is able to retrieve the instances
+	Healthy bool
+	// the number of consecutive failures to poll the api
+	Failures int
+	// the last error encountered
+	LastError string
+	// the time the poller entered the present state
+	Since time.Time
+}
+
+// Selector ... the conditions an instance must all match to be considered, the conditions the api supports are
+// sent as filters and the remainder are matched on the instances returned
+type Selector struct {
+	// the conditions, all of which must match
+	Conditions []Condition
+}
+
+// Condition ... a single term of a selector, i.e. tag:Env=prod|staging, !tag:Ignore or state!=pending
+type Condition struct {
+	// the field the condition is on, i.e. tag:<key>, vpc, subnet or state
+	Field string
+	// the values the field is matched against, any of which match, empty when checking a tag is present
+	Values []string
+	// whether the condition is negated
+	Negate bool
+}
+
+// RegionsError ... the errors of the regions which failed a request spanning several regions, the results of
+// the other regions are still returned
+type RegionsError struct {
+	// the error of each region which failed
+	Errors map[string]error
+}
+
 // EC2Interface ... a helper interface to ec2 instances
 type EC2Interface interface {
 	// Get a complete list of instances
@@ -72,4 +136,18 @@ type EC2EventsInterface interface {
 	AddEventListener(int) EventCh
 	// Get running hosts
 	GetRunningHosts() map[string]string
+	// Get the running instances
+	GetRunningInstances() map[string]ec2.Instance
+	// Get the instances which are no longer running but still listed by the api, i.e. stopped or terminated
+	GetStoppedInstances() map[string]ec2.Instance
+	// Get the region of each of the instances we are tracking, keyed by the instance id
+	GetInstanceRegions() map[string]string
+	// Add a listener for the errors and changes in health of the poller
+	AddHealthListener() HealthCh
+	// Get the present health of the poller
+	Health() HealthStatus
+	// Get the present health of the poller in each region
+	RegionHealth() []HealthStatus
+	// Change the polling interval and the instance selector
+	Reconfigure(time.Duration, string) error
 }
@@ -20,62 +20,148 @@ import (
 	"flag"
 	"fmt"
 	"math/rand"
-	"os"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/gambol99/rbd-fence/pkg/metrics"
+
 	"github.com/golang/glog"
 	"github.com/mitchellh/goamz/ec2"
 	gocache "github.com/pmylund/go-cache"
 )
 
 const (
-	// the maximum amount of aws failure
+	// the number of consecutive aws failures before the poller is degraded
 	maxFailures = 5
+	// the number of attempts to bootstrap the instances
+	bootstrapAttempts = 3
 )
 
+// the delay between the attempts to bootstrap the instances
+var bootstrapRetryDelay = time.Duration(2) * time.Second
+
 var ec2Config struct {
 	// the interval we should point the instance
 	pollingInterval time.Duration
+	// the aws key - should never really be used
+	apiKey string
+	// the aws secret
+	apiSecret string
+	// the api regions, a comma separated list
+	region string
+	// a custom ec2 endpoint
+	endpoint string
+	// the environment tag, a shorthand for a selector on the Env tag
+	envTag string
+	// the selector expression the instances are filtered on
+	selector string
 }
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
 	flag.DurationVar(&ec2Config.pollingInterval, "interval", (time.Duration(1) * time.Minute), "the default interval for polling instances")
+	flag.StringVar(&ec2Config.apiKey, "key", "", "the aws api key to use (note: taken from env or iam is left empty)")
+	flag.StringVar(&ec2Config.apiSecret, "secret", "", "the aws api secret, (note: taken from env or iam is left empty)")
+	flag.StringVar(&ec2Config.region, "region", "eu-west-1", "the aws region we are speaking to, a comma separated list to watch several regions")
+	flag.StringVar(&ec2Config.endpoint, "ec2-endpoint", "", "a custom endpoint for the ec2 api, i.e. a proxy or a local stand-in, defaults to the endpoint of the region")
+	flag.StringVar(&ec2Config.envTag, "env", "", "the environment tag to filter out the instances, a comma separated list for multiple environments, note any instance not tagged are ignored, a shorthand for the selector tag:Env=<env>")
+	flag.StringVar(&ec2Config.selector, "selector", "", "a comma separated list of conditions the instances must match, i.e. tag:Env=prod|staging,tag:Role!=db,!tag:Ignore,vpc=<id>,subnet=<id>,state!=pending, the state conditions only decide the states an instance is first tracked in")
 }
 
 // the implementation of a EC2InstancesInterface
 type ec2Instances struct {
+	sync.RWMutex
+	// the region we are polling
+	region string
 	// our interface to the api
 	client EC2Interface
+	// creates a client to the api filtering on the selector
+	newClient func(string) (EC2Interface, error)
+	// the selector expression we are filtering on
+	selector string
+	// the parsed selector, deciding the states we start tracking an instance in
+	tracking *Selector
+	// the interval between the polls of the api
+	interval time.Duration
 	// a in-memory cache for termination instances
 	cache *gocache.Cache
 	// a list of listeners for running instances
-	listeners map[EventCh]int
+	listeners []*eventListener
 	// a map of instances we have the details on
 	hosts map[string]string
+	// the listeners for the health events
+	healthListeners []HealthCh
+	// the present health of the poller
+	health HealthStatus
+	// whether we have retrieved the instances at least once
+	bootstrapped bool
+	// the channel used to stop the synchronizing loop
+	stopCh chan struct{}
+}
+
+// eventListener ... a consumer of the events, the events are delivered in the order they occurred
+type eventListener struct {
+	sync.Mutex
+	// the filter on the events
+	filter int
+	// the channel the consumer receives on
+	ch EventCh
+	// the events waiting to be delivered
+	pending []*InstanceEvent
+	// signalled when events are added
+	notify chan struct{}
 }
 
 // NewEC2EventsInterface ... Creates a new EC2InstanceInterface to consume events from
-func NewEC2EventsInterface(awsKey, awsSecret, awsRegion, awsEnv string) (EC2EventsInterface, error) {
+//	awsEndpoint:	a custom endpoint for the ec2 api, if empty the endpoint of the region is used
+//	awsSelector:	the selector expression the instances are filtered on, see ParseSelector
+func NewEC2EventsInterface(awsKey, awsSecret, awsRegion, awsEndpoint, awsSelector string) (EC2EventsInterface, error) {
+	return newEC2Instances(awsKey, awsSecret, awsRegion, awsEndpoint, awsSelector, true)
+}
+
+// newEC2Instances ... creates the poller of the region, when the bootstrap is not required a region we cannot reach
+// is started degraded and the instances are taken from the first successful poll, without producing any events
+func newEC2Instances(awsKey, awsSecret, awsRegion, awsEndpoint, awsSelector string, required bool) (*ec2Instances, error) {
 	var err error
-	glog.Infof("Creating a new EC2 Instances Interface for events")
+	glog.Infof("Creating a new EC2 Instances Interface for events, region: %s", awsRegion)
 
 	// step: create a new api for the service
 	service := new(ec2Instances)
-	service.listeners = make(map[EventCh]int, 0)
+	service.listeners = make([]*eventListener, 0)
 	service.hosts = make(map[string]string, 0)
-	service.client, err = NewEC2Interface(awsKey, awsSecret, awsRegion, awsEnv)
+	service.healthListeners = make([]HealthCh, 0)
+	service.region = awsRegion
+	service.health = HealthStatus{Region: awsRegion, Healthy: true, Since: time.Now()}
+	service.stopCh = make(chan struct{})
+	service.selector = awsSelector
+	service.tracking, err = ParseSelector(awsSelector)
+	if err != nil {
+		return nil, err
+	}
+	service.interval = ec2Config.pollingInterval
+	service.newClient = func(selector string) (EC2Interface, error) {
+		return NewEC2Interface(awsKey, awsSecret, awsRegion, awsEndpoint, selector)
+	}
+	service.client, err = service.newClient(awsSelector)
 	if err != nil {
 		return nil, err
 	}
 	service.cache = gocache.New(1*time.Hour, 5*time.Minute)
 
 	// step: attempt to grab an initial state of running instances
-	err = service.bootstrapRunningInstances(3)
-	if err != nil {
-		return nil, fmt.Errorf("failed to bootstrap service, unable to retrieve runnings instance")
+	err = service.bootstrapRunningInstances(bootstrapAttempts)
+	switch {
+	case err != nil && required:
+		return nil, fmt.Errorf("failed to bootstrap service, unable to retrieve runnings instance in region: %s", awsRegion)
+	case err != nil:
+		glog.Errorf("Unable to bootstrap the instances in region: %s, starting degraded until the api is reachable", awsRegion)
+		service.health = HealthStatus{Region: awsRegion, Failures: bootstrapAttempts, LastError: err.Error(), Since: time.Now()}
+		metrics.EC2Degraded.WithLabelValues(awsRegion).Set(1)
+	default:
+		service.bootstrapped = true
 	}
+	service.updateTrackedMetrics()
 	// step: start the synchronizing loop
 	go service.synchronize()
 
@@ -91,20 +177,36 @@ func (r *ec2Instances) synchronize() {
 		hostsIds := make(map[string]*ec2.Instance, 0)
 
 		// step: grab all the statuses of the instances
-		runningNow, err := r.client.DescribeAll()
+		started := time.Now()
+		runningNow, err := r.getClient().DescribeAll()
+		metrics.EC2PollDuration.WithLabelValues(r.region).Observe(time.Since(started).Seconds())
 		if err != nil {
-			glog.Errorf("Failed to retrieve an updated list running instances, error: %s", err)
-			if failures > maxFailures {
-				glog.Fatalf("We've been unable to contact AWS for %d seconds, terminating service", (ec2Config.pollingInterval * maxFailures))
-			}
+			metrics.EC2Polls.WithLabelValues(r.region, "failure").Inc()
+			glog.Errorf("Failed to retrieve an updated list running instances in region: %s, error: %s", r.region, err)
 			failures++
+			r.pollFailed(failures, err)
 			// choice: we will continue and get them on the next run
 			goto NEXT_LOOP
 		}
 		failures = 0
+		metrics.EC2Polls.WithLabelValues(r.region, "success").Inc()
+		r.pollSucceeded()
 
 		glog.V(5).Infof("Found %d instances presently in the region", len(runningNow))
 
+		// step: a region started degraded takes the instances from the first poll, as a bootstrap would
+		if !r.isBootstrapped() {
+			glog.Infof("Bootstrapped the %d instances in region: %s", len(runningNow), r.region)
+			for _, x := range runningNow {
+				if r.tracks(x) {
+					r.setStatus(x)
+				}
+			}
+			r.setBootstrapped()
+			r.updateTrackedMetrics()
+			goto NEXT_LOOP
+		}
+
 		// step: construct a map of the hosts for quick reference
 		for _, x := range runningNow {
 			hostsIds[x.InstanceId] = &x
@@ -112,7 +214,7 @@ func (r *ec2Instances) synchronize() {
 
 		// step: remove any instances which are no longer running ... i.e they were probably in a terminated state and
 		// now aws has remove them
-		for id := range r.hosts {
+		for _, id := range r.getHostIDs() {
 			// step: is the hosts still in the list of instances?
 			if _, found := hostsIds[id]; found {
 				continue
@@ -120,9 +222,13 @@ func (r *ec2Instances) synchronize() {
 			// step: the instance seems to have been remove, lets ensure it was terminated beforehand
 			instance, found := r.getStatus(id)
 			if !found {
-				// choice: to dies as something very wrong has happened here
-				glog.Errorf("The instance: %s does not appear to be in the cache, killing myself", id)
-				os.Exit(1)
+				// choice: the hosts map and cache disagree, we drop the instance and carry on, if it's still
+				// around it will be picked up as a new instance
+				err := fmt.Errorf("the instance: %s does not appear to be in the cache", id)
+				glog.Errorf("Inconsistent state, %s, removing it from the hosts", err)
+				r.deleteStatus(id)
+				r.sendHealth(err)
+				continue
 			}
 
 			// step: check the instance was in a termination state before
@@ -142,6 +248,10 @@ func (r *ec2Instances) synchronize() {
 
 			// the instance was not in the previous list - assuming it's new
 			if !found {
+				if !r.tracks(x) {
+					glog.V(5).Infof("Ignoring the instance: %s, the selector does not track instances in the state: %s", x.InstanceId, x.State.Name)
+					continue
+				}
 				glog.V(2).Infof("Found a new instance: %s in the region, current status: %s", x.InstanceId, x.State.Name)
 				// step: send the event
 				r.sendEvent(&x, nil)
@@ -163,25 +273,225 @@ func (r *ec2Instances) synchronize() {
 			// else the state of the instance has not changed
 			glog.V(5).Infof("The instance: %s status remains the same, current status: %s", x.InstanceId, x.State.Name)
 		}
+		r.updateTrackedMetrics()
 
 	NEXT_LOOP:
 		// wait until the next polling
-		<-time.After(ec2Config.pollingInterval)
+		select {
+		case <-r.stopCh:
+			return
+		case <-time.After(r.getInterval()):
+		}
 	}
 }
 
+// stop ... stops the synchronizing loop
+func (r *ec2Instances) stop() {
+	close(r.stopCh)
+}
+
 // AddEventListener ... add a event listener to the list of consumers
 // 	filter:		an integer containing the bitwise filter
 func (r *ec2Instances) AddEventListener(filter int) EventCh {
 	// step: make a buffered channel for them
-	ch := make(EventCh, 10)
-	glog.V(4).Infof("Adding a event listner, channel: %v, filter: %d, filters: %s", ch, filter, r.filterToString(filter))
-	r.listeners[ch] = filter
+	listener := &eventListener{
+		filter:  filter,
+		ch:      make(EventCh, 10),
+		pending: make([]*InstanceEvent, 0),
+		notify:  make(chan struct{}, 1),
+	}
+	glog.V(4).Infof("Adding a event listner, channel: %v, filter: %d, filters: %s", listener.ch, filter, r.filterToString(filter))
+	go listener.forward()
+
+	r.Lock()
+	defer r.Unlock()
+	r.listeners = append(r.listeners, listener)
+
+	return listener.ch
+}
+
+// Reconfigure ... changes the polling interval and the selector, a zero interval or empty selector keeps the
+// present value. The instances we are tracking are kept, those no longer selected are dropped on the next poll
+func (r *ec2Instances) Reconfigure(interval time.Duration, selector string) error {
+	change, err := r.prepare(interval, selector)
+	if err != nil {
+		return err
+	}
+	r.apply(change)
+
+	return nil
+}
+
+// ec2Change ... a change to the options of a poller, prepared before it's applied
+type ec2Change struct {
+	// the polling interval
+	interval time.Duration
+	// the selector expression
+	selector string
+	// the parsed selector and the client filtering on it, nil if the selector is unchanged
+	tracking *Selector
+	client   EC2Interface
+}
+
+// prepare ... validates the options and creates the client for a changed selector, without altering the poller
+func (r *ec2Instances) prepare(interval time.Duration, selector string) (*ec2Change, error) {
+	if interval < 0 {
+		return nil, fmt.Errorf("the polling interval cannot be negative")
+	}
+	r.RLock()
+	if interval == 0 {
+		interval = r.interval
+	}
+	if selector == "" {
+		selector = r.selector
+	}
+	changed := selector != r.selector
+	r.RUnlock()
+
+	// step: we only need a new client if the selector has changed
+	change := &ec2Change{interval: interval, selector: selector}
+	if changed {
+		var err error
+		if change.tracking, err = ParseSelector(selector); err != nil {
+			return nil, err
+		}
+		if change.client, err = r.newClient(selector); err != nil {
+			return nil, err
+		}
+	}
+
+	return change, nil
+}
+
+// apply ... applies a change prepared for the poller
+func (r *ec2Instances) apply(change *ec2Change) {
+	r.Lock()
+	defer r.Unlock()
+	glog.Infof("Reconfiguring the ec2 poller, interval: %s, selector: %s", change.interval, change.selector)
+	r.interval = change.interval
+	if change.client != nil {
+		r.selector = change.selector
+		r.tracking = change.tracking
+		r.client = change.client
+	}
+}
+
+// getClient ... returns the client to the api
+func (r *ec2Instances) getClient() EC2Interface {
+	r.RLock()
+	defer r.RUnlock()
+	return r.client
+}
+
+// isBootstrapped ... checks we have retrieved the instances at least once
+func (r *ec2Instances) isBootstrapped() bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.bootstrapped
+}
+
+// setBootstrapped ... records we have retrieved the instances
+func (r *ec2Instances) setBootstrapped() {
+	r.Lock()
+	defer r.Unlock()
+	r.bootstrapped = true
+}
+
+// tracks ... checks the state of the new instance is one the selector starts tracking instances in
+func (r *ec2Instances) tracks(instance ec2.Instance) bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.tracking.Tracks(instance)
+}
+
+// getInterval ... returns the interval between the polls of the api
+func (r *ec2Instances) getInterval() time.Duration {
+	r.RLock()
+	defer r.RUnlock()
+	return r.interval
+}
+
+// AddHealthListener ... add a listener for the errors and changes in health of the poller
+func (r *ec2Instances) AddHealthListener() HealthCh {
+	ch := make(HealthCh, 10)
+	r.Lock()
+	defer r.Unlock()
+	r.healthListeners = append(r.healthListeners, ch)
+
 	return ch
 }
 
+// Health ... returns the present health of the poller
+func (r *ec2Instances) Health() HealthStatus {
+	r.RLock()
+	defer r.RUnlock()
+	return r.health
+}
+
+// RegionHealth ... returns the present health of the poller, there being the one region
+func (r *ec2Instances) RegionHealth() []HealthStatus {
+	return []HealthStatus{r.Health()}
+}
+
+// pollFailed ... records a failure to poll the api, entering the degraded state after too many
+func (r *ec2Instances) pollFailed(failures int, err error) {
+	r.Lock()
+	r.health.Failures = failures
+	r.health.LastError = err.Error()
+	if r.health.Healthy && failures >= maxFailures {
+		glog.Errorf("We've been unable to contact AWS in region: %s for %d attempts, entering a degraded state, no events will "+
+			"be produced until the api is reachable", r.region, failures)
+		r.health.Healthy = false
+		r.health.Since = time.Now()
+		metrics.EC2Degraded.WithLabelValues(r.region).Set(1)
+	}
+	r.Unlock()
+
+	r.sendHealth(err)
+}
+
+// pollSucceeded ... records a successful poll of the api, recovering from the degraded state
+func (r *ec2Instances) pollSucceeded() {
+	r.Lock()
+	recovered := !r.health.Healthy
+	r.health.Failures = 0
+	if recovered {
+		glog.Infof("Successfully contacted AWS in region: %s after %s, recovered from the degraded state", r.region, time.Since(r.health.Since))
+		r.health.Healthy = true
+		r.health.Since = time.Now()
+		metrics.EC2Degraded.WithLabelValues(r.region).Set(0)
+	}
+	r.Unlock()
+
+	if recovered {
+		r.sendHealth(nil)
+	}
+}
+
+// sendHealth ... sends a health event to the listeners, a listener not keeping up misses the event
+func (r *ec2Instances) sendHealth(err error) {
+	r.RLock()
+	defer r.RUnlock()
+	event := &HealthEvent{
+		Region:   r.region,
+		Healthy:  r.health.Healthy,
+		Failures: r.health.Failures,
+		Error:    err,
+		Time:     time.Now(),
+	}
+	for _, ch := range r.healthListeners {
+		select {
+		case ch <- event:
+		default:
+			glog.Warningf("The health listener: %v is not keeping up, dropping the event: %s", ch, event)
+		}
+	}
+}
+
 // GetRunningHosts ... returns a list of running hosts
 func (r *ec2Instances) GetRunningHosts() map[string]string {
+	r.RLock()
+	defer r.RUnlock()
 	list := make(map[string]string, 0)
 	for id, _ := range r.hosts {
 		if instance, found := r.getStatus(id); found {
@@ -193,23 +503,70 @@ func (r *ec2Instances) GetRunningHosts() map[string]string {
 	return list
 }
 
+// GetRunningInstances ... returns the running instances, keyed by the instance id
+func (r *ec2Instances) GetRunningInstances() map[string]ec2.Instance {
+	r.RLock()
+	defer r.RUnlock()
+	list := make(map[string]ec2.Instance, 0)
+	for id := range r.hosts {
+		if instance, found := r.getStatus(id); found {
+			if instance.State.Name == "running" {
+				list[instance.InstanceId] = instance
+			}
+		}
+	}
+	return list
+}
+
+// GetStoppedInstances ... returns the instances which are stopping, stopped, shutting down or terminated, keyed by
+// the instance id, the terminated instances remain until the api stops listing them
+func (r *ec2Instances) GetStoppedInstances() map[string]ec2.Instance {
+	r.RLock()
+	defer r.RUnlock()
+	list := make(map[string]ec2.Instance, 0)
+	for id := range r.hosts {
+		if instance, found := r.getStatus(id); found {
+			switch instance.State.Name {
+			case "stopping", "stopped", "shutting-down", "terminated":
+				list[instance.InstanceId] = instance
+			}
+		}
+	}
+	return list
+}
+
+// GetInstanceRegions ... returns the region of each of the instances we are tracking, keyed by the instance id
+func (r *ec2Instances) GetInstanceRegions() map[string]string {
+	r.RLock()
+	defer r.RUnlock()
+	list := make(map[string]string, 0)
+	for id := range r.hosts {
+		list[id] = r.region
+	}
+	return list
+}
+
 // Attempt to retrieve a list of running instances for bootstrapping purposes
 func (r *ec2Instances) bootstrapRunningInstances(maxAttempts int) error {
+	var err error
 	for i := 0; i < maxAttempts; i++ {
 		glog.V(4).Infof("Attempting to retrieve the current instances from api, attmept: %d", i)
-		instances, err := r.client.DescribeAll()
+		var instances []ec2.Instance
+		instances, err = r.client.DescribeAll()
 		if err != nil {
 			glog.Errorf("Failed to retrieve instance details, error: %s", err)
-			<-time.After(time.Duration(2) * time.Second)
+			<-time.After(bootstrapRetryDelay)
 			continue
 		}
 		// step: inject the instance statuses into the cache
 		for _, x := range instances {
-			r.setStatus(x)
+			if r.tracks(x) {
+				r.setStatus(x)
+			}
 		}
 		return nil
 	}
-	return fmt.Errorf("failed to retrieve running instances from ec2")
+	return fmt.Errorf("failed to retrieve running instances from ec2, error: %s", err)
 }
 
 // setStatus ... add the instance and status to the cache
@@ -219,6 +576,8 @@ func (r *ec2Instances) setStatus(instance ec2.Instance) {
 		instance.State.Name, cacheKey)
 	r.cache.Set(r.getStatusKey(instance.InstanceId), instance, gocache.NoExpiration)
 	// step: update the map of instance we have
+	r.Lock()
+	defer r.Unlock()
 	r.hosts[instance.InstanceId] = cacheKey
 }
 
@@ -239,16 +598,45 @@ func (r *ec2Instances) deleteStatus(id string) {
 	glog.V(4).Infof("Deleting the status on the instance: %s, key: %s", id, cacheKey)
 	// step: delete from cache
 	r.cache.Delete(cacheKey)
+	r.Lock()
+	defer r.Unlock()
 	delete(r.hosts, id)
 }
 
+// updateTrackedMetrics ... updates the number of instances we are tracking by state
+func (r *ec2Instances) updateTrackedMetrics() {
+	r.RLock()
+	defer r.RUnlock()
+	counts := make(map[string]int, 0)
+	for id := range r.hosts {
+		if instance, found := r.getStatus(id); found {
+			counts[instance.State.Name]++
+		}
+	}
+	// note: the other regions share the metric, so the states are set rather than the metric reset
+	for _, state := range instanceStates {
+		metrics.TrackedInstances.WithLabelValues(r.region, state).Set(float64(counts[state]))
+	}
+}
+
+// getHostIDs ... returns the ids of the instances we have the details on
+func (r *ec2Instances) getHostIDs() []string {
+	r.RLock()
+	defer r.RUnlock()
+	var list []string
+	for id := range r.hosts {
+		list = append(list, id)
+	}
+	return list
+}
+
 // getStatusKey ... construct a status key from the instance
-func (r ec2Instances) getStatusKey(id string) string {
+func (r *ec2Instances) getStatusKey(id string) string {
 	return fmt.Sprintf("status_%s", id)
 }
 
 // sendEvent ... iterated the listener, finds those whom match the filter and sends the event
-func (r ec2Instances) sendEvent(from, to *ec2.Instance) {
+func (r *ec2Instances) sendEvent(from, to *ec2.Instance) {
 	var state int
 	// step: if no to instance, it's because it's a new instance
 	if to == nil {
@@ -260,25 +648,58 @@ func (r ec2Instances) sendEvent(from, to *ec2.Instance) {
 	// step: construct the event
 	event := &InstanceEvent{
 		InstanceID: from.InstanceId,
+		Region:     r.region,
 		EventType:  state,
 		Instance:   *to,
+		Detected:   time.Now(),
 	}
 	// step: iterate the listeners and find consumer interested in this event
-	for ch, filter := range r.listeners {
+	r.RLock()
+	defer r.RUnlock()
+	for _, listener := range r.listeners {
+		filter := listener.filter
 		glog.V(4).Infof("Checking filter: %d (%s) <-> state: %d (%s|%s)", filter, r.filterToString(filter),
 			state, r.filterToString(state), to.State.Name)
 		if state&filter != 0 {
-			glog.V(4).Infof("Found match for state: %d, filter: %d, channel: %v", state, filter, ch)
-			// step: send the event upstream
-			go func(ln EventCh) {
-				glog.V(5).Infof("Sending the event: %s to consumer: %v", event, ln)
-				ln <- event
-			}(ch)
+			glog.V(4).Infof("Found match for state: %d, filter: %d, channel: %v", state, filter, listener.ch)
+			// step: queue the event for the consumer
+			listener.enqueue(event)
+			metrics.EventsDelivered.WithLabelValues(sourceName, r.filterToString(filter)).Inc()
+		}
+	}
+}
+
+// enqueue ... adds the event to the pending events, the poller never blocks on a slow consumer
+func (r *eventListener) enqueue(event *InstanceEvent) {
+	r.Lock()
+	r.pending = append(r.pending, event)
+	r.Unlock()
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// forward ... delivers the pending events to the consumer in order
+func (r *eventListener) forward() {
+	for range r.notify {
+		for {
+			r.Lock()
+			if len(r.pending) <= 0 {
+				r.Unlock()
+				break
+			}
+			event := r.pending[0]
+			r.pending = r.pending[1:]
+			r.Unlock()
+
+			glog.V(5).Infof("Sending the event: %s to consumer: %v", event, r.ch)
+			r.ch <- event
 		}
 	}
 }
 
-func (r ec2Instances) convertStatusToFilter(status string) int {
+func (r *ec2Instances) convertStatusToFilter(status string) int {
 	if status == "running" {
 		return STATUS_RUNNING
 	}
@@ -300,7 +721,7 @@ func (r ec2Instances) convertStatusToFilter(status string) int {
 	return STATUS_UNKNOWN
 }
 
-func (r ec2Instances) filterToString(filter int) string {
+func (r *ec2Instances) filterToString(filter int) string {
 	var filters []string
 	if (filter & STATUS_RUNNING) == STATUS_RUNNING {
 		filters = append(filters, "running")
@@ -0,0 +1,371 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/aws/fake"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testEnv      = "prod"
+	testSelector = "tag:Env=" + testEnv
+	testInterval = time.Duration(20) * time.Millisecond
+	testTimeout  = time.Duration(5) * time.Second
+)
+
+func init() {
+	ec2Config.pollingInterval = testInterval
+	bootstrapRetryDelay = testInterval
+}
+
+// expectedEvent ... the instance and event type a listener should receive
+type expectedEvent struct {
+	id        string
+	eventType int
+}
+
+func newTestService(t *testing.T, api *fake.Server) *ec2Instances {
+	service, err := NewEC2EventsInterface("key", "secret", "eu-west-1", api.URL(), testSelector)
+	if err != nil {
+		t.Fatalf("unable to create the events interface, error: %s", err)
+	}
+	return service.(*ec2Instances)
+}
+
+// waitForEvents ... waits for the expected events in order and checks nothing else is received
+func waitForEvents(t *testing.T, ch EventCh, expected ...expectedEvent) {
+	for i, x := range expected {
+		select {
+		case event := <-ch:
+			assert.Equal(t, x.id, event.InstanceID, "event %d has the wrong instance", i)
+			assert.Equal(t, x.eventType, event.EventType, "event %d for %s has the wrong type", i, event.InstanceID)
+			assert.Equal(t, event.InstanceID, event.Instance.InstanceId)
+			assert.False(t, event.Detected.IsZero())
+		case <-time.After(testTimeout):
+			t.Fatalf("timed out waiting for event %d, expected: %v", i, x)
+		}
+	}
+	select {
+	case event := <-ch:
+		t.Fatalf("received an unexpected event: %s", event)
+	case <-time.After(testInterval * 10):
+	}
+}
+
+func TestBootstrapInstances(t *testing.T) {
+	api := fake.NewServer()
+	defer api.Close()
+	api.AddInstance("i-00000001", "10.0.0.1", "running", "Env", testEnv)
+	api.AddInstance("i-00000002", "10.0.0.2", "stopped", "Env", testEnv)
+	api.AddInstance("i-00000003", "10.0.0.3", "running", "Env", "dev")
+	api.AddInstance("i-00000004", "10.0.0.4", "running")
+	service := newTestService(t, api)
+	defer service.stop()
+
+	assert.Equal(t, map[string]string{"i-00000001": "10.0.0.1"}, service.GetRunningHosts())
+	instances := service.GetRunningInstances()
+	assert.Equal(t, 1, len(instances))
+	assert.Equal(t, "eu-west-1a", instances["i-00000001"].AvailZone)
+	stopped := service.GetStoppedInstances()
+	if assert.Equal(t, 1, len(stopped)) {
+		assert.Equal(t, "10.0.0.2", stopped["i-00000002"].PrivateIpAddress)
+	}
+}
+
+func TestBootstrapFailure(t *testing.T) {
+	api := fake.NewServer()
+	defer api.Close()
+	api.Fail(3)
+	_, err := NewEC2EventsInterface("key", "secret", "eu-west-1", api.URL(), testSelector)
+	assert.Error(t, err)
+}
+
+func TestNewInstances(t *testing.T) {
+	api := fake.NewServer()
+	defer api.Close()
+	service := newTestService(t, api)
+	defer service.stop()
+	runningCh := service.AddEventListener(STATUS_RUNNING)
+	pendingCh := service.AddEventListener(STATUS_PENDING)
+
+	api.AddInstance("i-00000001", "10.0.0.1", "running", "Env", testEnv)
+	api.AddInstance("i-00000002", "10.0.0.2", "pending", "Env", testEnv)
+	api.AddInstance("i-00000003", "10.0.0.3", "running", "Env", "dev")
+
+	waitForEvents(t, runningCh, expectedEvent{"i-00000001", STATUS_RUNNING})
+	waitForEvents(t, pendingCh, expectedEvent{"i-00000002", STATUS_PENDING})
+	assert.Equal(t, map[string]string{"i-00000001": "10.0.0.1"}, service.GetRunningHosts())
+}
+
+func TestInstanceLifecycle(t *testing.T) {
+	api := fake.NewServer()
+	defer api.Close()
+	api.AddInstance("i-00000001", "10.0.0.1", "running", "Env", testEnv)
+	api.AddInstance("i-00000002", "10.0.0.2", "running", "Env", testEnv)
+	service := newTestService(t, api)
+	defer service.stop()
+	allCh := service.AddEventListener(STATUS_RUNNING | STATUS_STOPPING | STATUS_STOPPED |
+		STATUS_SHUTTING_DOWN | STATUS_TERMINATED | STATUS_PENDING | STATUS_UNKNOWN)
+	fencingCh := service.AddEventListener(STATUS_STOPPED | STATUS_TERMINATED)
+	runningCh := service.AddEventListener(STATUS_RUNNING)
+
+	api.Script("i-00000001", "stopping", "stopping", "stopped", "pending", "running")
+	api.Script("i-00000002", "shutting-down", "terminated")
+
+	// step: the instances are polled together, so the sequence is checked per instance
+	assert.Equal(t, map[string][]int{
+		"i-00000001": {STATUS_STOPPING, STATUS_STOPPED, STATUS_PENDING, STATUS_RUNNING},
+		"i-00000002": {STATUS_SHUTTING_DOWN, STATUS_TERMINATED},
+	}, collectEvents(t, allCh, 6))
+	assert.Equal(t, map[string][]int{
+		"i-00000001": {STATUS_STOPPED},
+		"i-00000002": {STATUS_TERMINATED},
+	}, collectEvents(t, fencingCh, 2))
+	waitForEvents(t, runningCh, expectedEvent{"i-00000001", STATUS_RUNNING})
+	assert.Equal(t, map[string]string{"i-00000001": "10.0.0.1"}, service.GetRunningHosts())
+}
+
+func TestStateSelector(t *testing.T) {
+	api := fake.NewServer()
+	defer api.Close()
+	api.AddInstance("i-00000001", "10.0.0.1", "running", "Env", testEnv)
+	api.AddInstance("i-00000002", "10.0.0.2", "stopped", "Env", testEnv)
+	api.AddInstance("i-00000003", "10.0.0.3", "pending", "Env", testEnv)
+	events, err := NewEC2EventsInterface("key", "secret", "eu-west-1", api.URL(), testSelector+",state=running")
+	if !assert.NoError(t, err) {
+		return
+	}
+	service := events.(*ec2Instances)
+	defer service.stop()
+	allCh := service.AddEventListener(STATUS_RUNNING | STATUS_STOPPING | STATUS_STOPPED |
+		STATUS_SHUTTING_DOWN | STATUS_TERMINATED | STATUS_PENDING | STATUS_UNKNOWN)
+
+	// step: the state is not sent to the api, only the running instances are tracked
+	assert.NotContains(t, api.Filters(), "instance-state-name")
+	assert.Equal(t, map[string]string{"i-00000001": "10.0.0.1"}, service.GetRunningHosts())
+	assert.Equal(t, 0, len(service.GetStoppedInstances()))
+
+	// step: a tracked instance leaving the selected state is still followed
+	api.SetState("i-00000001", "stopped")
+	api.SetState("i-00000003", "running")
+	assert.Equal(t, map[string][]int{
+		"i-00000001": {STATUS_STOPPED},
+		"i-00000003": {STATUS_RUNNING},
+	}, collectEvents(t, allCh, 2))
+	assert.Equal(t, map[string]string{"i-00000003": "10.0.0.3"}, service.GetRunningHosts())
+	stopped := service.GetStoppedInstances()
+	assert.Equal(t, 1, len(stopped))
+	assert.Contains(t, stopped, "i-00000001")
+
+	api.SetState("i-00000001", "terminated")
+	waitForEvents(t, allCh, expectedEvent{"i-00000001", STATUS_TERMINATED})
+}
+
+func TestTerminatedInstanceRemoved(t *testing.T) {
+	api := fake.NewServer()
+	defer api.Close()
+	api.AddInstance("i-00000001", "10.0.0.1", "running", "Env", testEnv)
+	service := newTestService(t, api)
+	defer service.stop()
+	terminatedCh := service.AddEventListener(STATUS_TERMINATED | STATUS_SHUTTING_DOWN)
+
+	client, err := NewEC2Interface("key", "secret", "eu-west-1", api.URL(), testSelector)
+	if err != nil {
+		t.Fatalf("unable to create the ec2 client, error: %s", err)
+	}
+	// note: the lifecycle advances on any describe call, so the unknown instance is checked first
+	assert.Error(t, client.TerminatedInstance("i-00000009"))
+	assert.NoError(t, client.TerminatedInstance("i-00000001"))
+
+	waitForEvents(t, terminatedCh,
+		expectedEvent{"i-00000001", STATUS_SHUTTING_DOWN},
+		expectedEvent{"i-00000001", STATUS_TERMINATED})
+
+	// step: aws eventually drops the terminated instance from the listing
+	api.SetState("i-00000001", fake.Gone)
+	waitFor(t, func() bool { return len(service.getHostIDs()) == 0 })
+	waitForEvents(t, terminatedCh)
+	assert.Equal(t, 0, len(service.GetRunningHosts()))
+}
+
+func TestPollingFailures(t *testing.T) {
+	api := fake.NewServer()
+	defer api.Close()
+	api.AddInstance("i-00000001", "10.0.0.1", "running", "Env", testEnv)
+	service := newTestService(t, api)
+	defer service.stop()
+	allCh := service.AddEventListener(STATUS_RUNNING | STATUS_STOPPED)
+
+	// step: the failed polls should not be mistaken for vanished instances
+	api.Fail(maxFailures)
+	waitFor(t, func() bool { return len(api.Requests()) >= maxFailures+2 })
+	waitForEvents(t, allCh)
+	assert.Equal(t, 1, len(service.GetRunningHosts()))
+
+	api.SetState("i-00000001", "stopped")
+	waitForEvents(t, allCh, expectedEvent{"i-00000001", STATUS_STOPPED})
+}
+
+func TestDegradedAndRecovered(t *testing.T) {
+	api := fake.NewServer()
+	defer api.Close()
+	api.AddInstance("i-00000001", "10.0.0.1", "running", "Env", testEnv)
+	service := newTestService(t, api)
+	defer service.stop()
+	healthCh := service.AddHealthListener()
+	stoppedCh := service.AddEventListener(STATUS_STOPPED)
+	assert.True(t, service.Health().Healthy)
+
+	api.Fail(maxFailures + 2)
+	for i := 1; i <= maxFailures+2; i++ {
+		event := waitForHealth(t, healthCh)
+		assert.Equal(t, i, event.Failures)
+		assert.Error(t, event.Error)
+		assert.Equal(t, i < maxFailures, event.Healthy, "health after %d failures", i)
+	}
+	health := service.Health()
+	assert.False(t, health.Healthy)
+	assert.Equal(t, maxFailures+2, health.Failures)
+	assert.NotEmpty(t, health.LastError)
+
+	// step: the instance stops while we are degraded, it should be picked up on recovery
+	api.SetState("i-00000001", "stopped")
+	event := waitForHealth(t, healthCh)
+	assert.True(t, event.Healthy)
+	assert.NoError(t, event.Error)
+	assert.Equal(t, 0, event.Failures)
+	assert.True(t, service.Health().Healthy)
+	waitForEvents(t, stoppedCh, expectedEvent{"i-00000001", STATUS_STOPPED})
+}
+
+func TestInconsistentCache(t *testing.T) {
+	api := fake.NewServer()
+	defer api.Close()
+	api.AddInstance("i-00000001", "10.0.0.1", "running", "Env", testEnv)
+	service := newTestService(t, api)
+	defer service.stop()
+	healthCh := service.AddHealthListener()
+	runningCh := service.AddEventListener(STATUS_RUNNING)
+
+	// step: we hold the poller on failures while the instance is dropped from the cache and the api
+	api.Fail(1000)
+	waitForHealth(t, healthCh)
+	api.SetState("i-00000001", fake.Gone)
+	service.cache.Delete(service.getStatusKey("i-00000001"))
+	api.Fail(0)
+
+	// step: the poller should carry on and pick the instance up again when it reappears
+	for {
+		event := waitForHealth(t, healthCh)
+		if event.Error != nil && strings.Contains(event.Error.Error(), "cache") {
+			break
+		}
+	}
+	waitFor(t, func() bool { return len(service.getHostIDs()) == 0 })
+
+	api.SetState("i-00000001", "running")
+	waitForEvents(t, runningCh, expectedEvent{"i-00000001", STATUS_RUNNING})
+	assert.Equal(t, map[string]string{"i-00000001": "10.0.0.1"}, service.GetRunningHosts())
+}
+
+func TestReconfigure(t *testing.T) {
+	api := fake.NewServer()
+	defer api.Close()
+	api.AddInstance("i-00000001", "10.0.0.1", "running", "Env", testEnv)
+	api.AddInstance("i-00000002", "10.0.0.2", "running", "Env", "staging")
+	service := newTestService(t, api)
+	defer service.stop()
+	runningCh := service.AddEventListener(STATUS_RUNNING)
+	assert.Error(t, service.Reconfigure(-time.Second, ""))
+	assert.Error(t, service.Reconfigure(0, "env=staging"))
+
+	// step: the instances in the added environment are new to us, those we track are kept
+	assert.NoError(t, service.Reconfigure(0, EnvSelector(testEnv+",staging")))
+	waitForEvents(t, runningCh, expectedEvent{"i-00000002", STATUS_RUNNING})
+	assert.Equal(t, map[string]string{"i-00000001": "10.0.0.1", "i-00000002": "10.0.0.2"}, service.GetRunningHosts())
+	assert.Equal(t, testInterval, service.getInterval())
+
+	// step: the instances no longer in the environment are dropped
+	assert.NoError(t, service.Reconfigure(testInterval*2, "tag:Env=staging"))
+	waitFor(t, func() bool { return len(service.GetRunningHosts()) == 1 })
+	assert.Equal(t, map[string]string{"i-00000002": "10.0.0.2"}, service.GetRunningHosts())
+	assert.Equal(t, testInterval*2, service.getInterval())
+	waitForEvents(t, runningCh)
+}
+
+func TestSlowConsumer(t *testing.T) {
+	api := fake.NewServer()
+	defer api.Close()
+	service := newTestService(t, api)
+	defer service.stop()
+	runningCh := service.AddEventListener(STATUS_RUNNING)
+
+	// step: more events than the channel buffers, the poller should not block
+	var expected []expectedEvent
+	for i := 0; i < 25; i++ {
+		id := fmt.Sprintf("i-%08d", i)
+		api.AddInstance(id, fmt.Sprintf("10.0.0.%d", i), "running", "Env", testEnv)
+		expected = append(expected, expectedEvent{id, STATUS_RUNNING})
+	}
+	waitFor(t, func() bool { return len(service.GetRunningHosts()) == 25 })
+	waitForEvents(t, runningCh, expected...)
+}
+
+// collectEvents ... receives the number of events, returning the event types by instance
+func collectEvents(t *testing.T, ch EventCh, count int) map[string][]int {
+	events := make(map[string][]int, 0)
+	for i := 0; i < count; i++ {
+		select {
+		case event := <-ch:
+			events[event.InstanceID] = append(events[event.InstanceID], event.EventType)
+		case <-time.After(testTimeout):
+			t.Fatalf("timed out waiting for event %d, received: %v", i, events)
+		}
+	}
+	waitForEvents(t, ch)
+	return events
+}
+
+// waitForHealth ... waits for the next health event
+func waitForHealth(t *testing.T, ch HealthCh) *HealthEvent {
+	select {
+	case event := <-ch:
+		return event
+	case <-time.After(testTimeout):
+		t.Fatalf("timed out waiting for a health event")
+	}
+	return nil
+}
+
+// waitFor ... waits for the condition to become true
+func waitFor(t *testing.T, condition func() bool) {
+	timeout := time.After(testTimeout)
+	for !condition() {
+		select {
+		case <-timeout:
+			t.Fatalf("timed out waiting for the condition")
+		case <-time.After(testInterval):
+		}
+	}
+}
@@ -0,0 +1,431 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package fake provides a local stand-in for the ec2 query api, serving DescribeInstances and
+TerminateInstances from instances which can be scripted through their lifecycle.
+*/
+package fake
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Gone ... a lifecycle state in which the instance is no longer returned by the api
+const Gone = "gone"
+
+// the ec2 codes for the instance states
+var stateCodes = map[string]int{
+	"pending":       0,
+	"running":       16,
+	"shutting-down": 32,
+	"terminated":    48,
+	"stopping":      64,
+	"stopped":       80,
+}
+
+// Instance ... an instance in the fake api
+type Instance struct {
+	// the instance id
+	ID string
+	// the private ip address
+	PrivateIP string
+	// the current state of the instance
+	State string
+	// the availability zone
+	AvailZone string
+	// the instance type
+	InstanceType string
+	// the vpc the instance resides in
+	VpcID string
+	// the subnet the instance resides in
+	SubnetID string
+	// the tags on the instance
+	Tags map[string]string
+	// the states the instance moves through, one per DescribeInstances call
+	lifecycle []string
+}
+
+// Server ... a local stand-in for the ec2 query api
+type Server struct {
+	sync.Mutex
+	// the instances, in the order they were added
+	instances []*Instance
+	// the number of requests to fail
+	failures int
+	// the actions requested
+	requests []string
+	// the filters of the last DescribeInstances request
+	filters map[string][]string
+	// the http server
+	server *httptest.Server
+}
+
+// NewServer ... creates and starts a fake ec2 api
+func NewServer() *Server {
+	service := &Server{instances: make([]*Instance, 0), requests: make([]string, 0)}
+	service.server = httptest.NewServer(http.HandlerFunc(service.handle))
+	return service
+}
+
+// URL ... returns the endpoint of the api
+func (r *Server) URL() string {
+	return r.server.URL
+}
+
+// Close ... shuts down the api
+func (r *Server) Close() {
+	r.server.Close()
+}
+
+// AddInstance ... adds an instance to the api
+//
+//	id:		the instance id
+//	address:	the private ip address
+//	state:		the current state of the instance
+//	tags:		the tags on the instance, as key and value pairs
+func (r *Server) AddInstance(id, address, state string, tags ...string) *Instance {
+	r.Lock()
+	defer r.Unlock()
+	instance := &Instance{
+		ID:           id,
+		PrivateIP:    address,
+		State:        state,
+		AvailZone:    "eu-west-1a",
+		InstanceType: "m3.medium",
+		VpcID:        "vpc-1a2b3c4d",
+		SubnetID:     "subnet-1a2b3c4d",
+		Tags:         make(map[string]string, 0),
+	}
+	for i := 0; i+1 < len(tags); i += 2 {
+		instance.Tags[tags[i]] = tags[i+1]
+	}
+	r.instances = append(r.instances, instance)
+
+	return instance
+}
+
+// SetState ... changes the state of the instance, clearing any lifecycle
+func (r *Server) SetState(id, state string) {
+	r.Lock()
+	defer r.Unlock()
+	if x, found := r.getInstance(id); found {
+		x.State = state
+		x.lifecycle = nil
+	}
+}
+
+// Script ... sets the states the instance moves through, the instance advances to the next state on each
+// DescribeInstances call and remains in the last state
+func (r *Server) Script(id string, states ...string) {
+	r.Lock()
+	defer r.Unlock()
+	if x, found := r.getInstance(id); found {
+		x.lifecycle = states
+	}
+}
+
+// Fail ... fails the next count requests with an internal error
+func (r *Server) Fail(count int) {
+	r.Lock()
+	defer r.Unlock()
+	r.failures = count
+}
+
+// Requests ... returns the actions requested of the api
+func (r *Server) Requests() []string {
+	r.Lock()
+	defer r.Unlock()
+	list := make([]string, len(r.requests))
+	copy(list, r.requests)
+	return list
+}
+
+// Filters ... returns the filters of the last DescribeInstances request
+func (r *Server) Filters() map[string][]string {
+	r.Lock()
+	defer r.Unlock()
+	filters := make(map[string][]string, 0)
+	for name, values := range r.filters {
+		filters[name] = append([]string{}, values...)
+	}
+	return filters
+}
+
+// handle ... handles the query api requests
+func (r *Server) handle(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		r.writeError(w, http.StatusBadRequest, "MalformedQueryString", err.Error())
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	action := req.Form.Get("Action")
+	r.requests = append(r.requests, action)
+	if r.failures > 0 {
+		r.failures--
+		r.writeError(w, http.StatusServiceUnavailable, "Unavailable", "The service is unavailable")
+		return
+	}
+
+	switch action {
+	case "DescribeInstances":
+		r.describeInstances(w, req)
+	case "TerminateInstances":
+		r.terminateInstances(w, req)
+	default:
+		r.writeError(w, http.StatusBadRequest, "InvalidAction", fmt.Sprintf("The action %s is not valid for this web service", action))
+	}
+}
+
+// describeInstances ... advances the lifecycles and returns the instances matching the filters
+func (r *Server) describeInstances(w http.ResponseWriter, req *http.Request) {
+	ids := listParams(req, "InstanceId")
+	filters := filterParams(req)
+	r.filters = filters
+
+	response := describeInstancesResponse{RequestID: "describe"}
+	for _, x := range r.instances {
+		if len(x.lifecycle) > 0 {
+			x.State = x.lifecycle[0]
+			x.lifecycle = x.lifecycle[1:]
+		}
+		if x.State == Gone {
+			continue
+		}
+		if len(ids) > 0 && !contains(ids, x.ID) {
+			continue
+		}
+		if !x.matches(filters) {
+			continue
+		}
+		response.Reservations = append(response.Reservations, reservation{
+			ReservationID: "r-" + strings.TrimPrefix(x.ID, "i-"),
+			OwnerID:       "123456789012",
+			Instances:     []instance{x.encode()},
+		})
+	}
+
+	r.writeResponse(w, response)
+}
+
+// terminateInstances ... moves the instances into shutting down
+func (r *Server) terminateInstances(w http.ResponseWriter, req *http.Request) {
+	response := terminateInstancesResponse{RequestID: "terminate"}
+	for _, id := range listParams(req, "InstanceId") {
+		x, found := r.getInstance(id)
+		if !found || x.State == Gone {
+			r.writeError(w, http.StatusBadRequest, "InvalidInstanceID.NotFound", fmt.Sprintf("The instance ID '%s' does not exist", id))
+			return
+		}
+		previous := x.State
+		if x.State != "terminated" {
+			x.State = "shutting-down"
+			x.lifecycle = []string{"shutting-down", "terminated"}
+		}
+		response.StateChanges = append(response.StateChanges, stateChange{
+			InstanceID:    id,
+			CurrentState:  instanceState{Code: stateCodes[x.State], Name: x.State},
+			PreviousState: instanceState{Code: stateCodes[previous], Name: previous},
+		})
+	}
+
+	r.writeResponse(w, response)
+}
+
+// getInstance ... retrieves the instance, the lock must be held
+func (r *Server) getInstance(id string) (*Instance, bool) {
+	for _, x := range r.instances {
+		if x.ID == id {
+			return x, true
+		}
+	}
+	return nil, false
+}
+
+func (r *Server) writeResponse(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "text/xml;charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(response)
+}
+
+func (r *Server) writeError(w http.ResponseWriter, code int, errorCode, message string) {
+	response := errorResponse{RequestID: "error"}
+	response.Errors.Error.Code = errorCode
+	response.Errors.Error.Message = message
+	w.Header().Set("Content-Type", "text/xml;charset=UTF-8")
+	w.WriteHeader(code)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(response)
+}
+
+// matches ... checks the instance matches all the filters, the values of a filter are or'd
+func (r *Instance) matches(filters map[string][]string) bool {
+	for name, values := range filters {
+		var value string
+		var found bool
+		switch {
+		case name == "instance-state-name":
+			value, found = r.State, true
+		case name == "instance-id":
+			value, found = r.ID, true
+		case name == "vpc-id":
+			value, found = r.VpcID, true
+		case name == "subnet-id":
+			value, found = r.SubnetID, true
+		case name == "availability-zone":
+			value, found = r.AvailZone, true
+		case name == "private-ip-address":
+			value, found = r.PrivateIP, true
+		case name == "tag-key":
+			for key := range r.Tags {
+				if contains(values, key) {
+					value, found = key, true
+					break
+				}
+			}
+		case strings.HasPrefix(name, "tag:"):
+			value, found = r.Tags[strings.TrimPrefix(name, "tag:")]
+		default:
+			return false
+		}
+		if !found || !contains(values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// encode ... converts the instance into the api representation
+func (r *Instance) encode() instance {
+	x := instance{
+		InstanceID:       r.ID,
+		InstanceType:     r.InstanceType,
+		State:            instanceState{Code: stateCodes[r.State], Name: r.State},
+		AvailZone:        r.AvailZone,
+		VpcID:            r.VpcID,
+		SubnetID:         r.SubnetID,
+		PrivateIPAddress: r.PrivateIP,
+	}
+	var keys []string
+	for key := range r.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		x.Tags = append(x.Tags, tag{Key: key, Value: r.Tags[key]})
+	}
+	return x
+}
+
+// listParams ... extracts a list parameter, i.e. InstanceId.1, InstanceId.2
+func listParams(req *http.Request, label string) []string {
+	var list []string
+	for i := 1; ; i++ {
+		value := req.Form.Get(label + "." + strconv.Itoa(i))
+		if value == "" {
+			return list
+		}
+		list = append(list, value)
+	}
+}
+
+// filterParams ... extracts the filters, i.e. Filter.1.Name, Filter.1.Value.1
+func filterParams(req *http.Request) map[string][]string {
+	filters := make(map[string][]string, 0)
+	for i := 1; ; i++ {
+		prefix := "Filter." + strconv.Itoa(i)
+		name := req.Form.Get(prefix + ".Name")
+		if name == "" {
+			return filters
+		}
+		filters[name] = append(filters[name], listParams(req, prefix+".Value")...)
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, x := range list {
+		if x == value {
+			return true
+		}
+	}
+	return false
+}
+
+type describeInstancesResponse struct {
+	XMLName      xml.Name      `xml:"DescribeInstancesResponse"`
+	RequestID    string        `xml:"requestId"`
+	Reservations []reservation `xml:"reservationSet>item"`
+}
+
+type reservation struct {
+	ReservationID string     `xml:"reservationId"`
+	OwnerID       string     `xml:"ownerId"`
+	Instances     []instance `xml:"instancesSet>item"`
+}
+
+type instance struct {
+	InstanceID       string        `xml:"instanceId"`
+	InstanceType     string        `xml:"instanceType"`
+	State            instanceState `xml:"instanceState"`
+	AvailZone        string        `xml:"placement>availabilityZone"`
+	Tags             []tag         `xml:"tagSet>item"`
+	VpcID            string        `xml:"vpcId"`
+	SubnetID         string        `xml:"subnetId"`
+	PrivateIPAddress string        `xml:"privateIpAddress"`
+}
+
+type instanceState struct {
+	Code int    `xml:"code"`
+	Name string `xml:"name"`
+}
+
+type tag struct {
+	Key   string `xml:"key"`
+	Value string `xml:"value"`
+}
+
+type terminateInstancesResponse struct {
+	XMLName      xml.Name      `xml:"TerminateInstancesResponse"`
+	RequestID    string        `xml:"requestId"`
+	StateChanges []stateChange `xml:"instancesSet>item"`
+}
+
+type stateChange struct {
+	InstanceID    string        `xml:"instanceId"`
+	CurrentState  instanceState `xml:"currentState"`
+	PreviousState instanceState `xml:"previousState"`
+}
+
+type errorResponse struct {
+	XMLName xml.Name `xml:"Response"`
+	Errors  struct {
+		Error struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		} `xml:"Error"`
+	} `xml:"Errors"`
+	RequestID string `xml:"RequestID"`
+}
@@ -18,6 +18,7 @@ package aws
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/golang/glog"
 	"github.com/mitchellh/goamz/aws"
@@ -34,20 +35,29 @@ type ec2Helper struct {
 	client *ec2.EC2
 	// the region
 	region string
-	// the vpcid
-	envTag string
+	// the selector the instances are filtered on
+	selector *Selector
 }
 
-// NewEC2Interface ... Creates a new EC2 Helper interface
-func NewEC2Interface(awsKey, awsSecret, awsRegion, envTag string) (EC2Interface, error) {
+// NewEC2Interface ... Creates a new EC2 Helper interface, a empty endpoint uses the endpoint of the region and
+// a empty selector expression selects every instance, see ParseSelector
+func NewEC2Interface(awsKey, awsSecret, awsRegion, awsEndpoint, selector string) (EC2Interface, error) {
+	var err error
 	glog.Infof("Create a new EC2 API client for region: %s", awsRegion)
 
 	service := new(ec2Helper)
 	service.region = awsRegion
-	service.envTag = envTag
+	if service.selector, err = ParseSelector(selector); err != nil {
+		return nil, fmt.Errorf("invalid instance selector, error: %s", err)
+	}
 	// step: check the region is valid
 	region, valid := service.isValidRegion(awsRegion)
-	if !valid {
+	switch {
+	case awsEndpoint != "":
+		glog.Infof("Using the custom ec2 endpoint: %s", awsEndpoint)
+		region.Name = awsRegion
+		region.EC2Endpoint = awsEndpoint
+	case !valid:
 		return nil, fmt.Errorf("invalid aws region specified, please check")
 	}
 
@@ -64,31 +74,42 @@ func NewEC2Interface(awsKey, awsSecret, awsRegion, envTag string) (EC2Interface,
 	return service, nil
 }
 
-// Get a complete list of instances
+// NewDefaultEC2Interface ... Creates a new EC2 Helper interface from the command line options, spanning each of
+// the regions given
+func NewDefaultEC2Interface() (EC2Interface, error) {
+	return newEC2RegionHelpers(ec2Config.apiKey, ec2Config.apiSecret, splitTags(ec2Config.region), ec2Config.endpoint, selectorExpression())
+}
+
+// selectorExpression ... returns the selector expression from the command line options, the environment tag
+// being a shorthand for a condition on the Env tag
+func selectorExpression() string {
+	return JoinSelectors(ec2Config.selector, EnvSelector(ec2Config.envTag))
+}
+
+// DescribeInstances ... Get a list of the instances matching the filter and the selector, the filter is extended
+// with the conditions of the selector the api supports
 func (r ec2Helper) DescribeInstances(filter *ec2.Filter) ([]ec2.Instance, error) {
+	r.selector.AddFilters(filter)
+	return r.describe(filter)
+}
+
+// describe ... retrieves the instances matching the filter, keeping those which match the selector
+func (r ec2Helper) describe(filter *ec2.Filter) ([]ec2.Instance, error) {
 	var hosts = make([]ec2.Instance, 0)
-	glog.V(5).Infof("Retreiving a list of instances from EC2, instance filter: %V", filter)
+	glog.V(5).Infof("Retreiving a list of instances from EC2, selector: %s", r.selector)
 
 	// step: call the api and retrieve the results
 	result, err := r.client.Instances([]string{}, filter)
 	if err != nil {
 		return hosts, err
 	}
-	glog.V(5).Infof("Found %d instances matching the filter %V", len(result.Reservations), filter)
-
-	// step: if we don't have any running instance, return empty
-	if len(result.Reservations) <= 0 || len(result.Reservations[0].Instances) <= 0 {
-		return hosts, nil
-	}
+	glog.V(5).Infof("Found %d reservations matching the filters", len(result.Reservations))
 
-	// step: extract and add hosts. Almost certainly a better way of doing this
+	// step: the conditions the api could not filter on are matched here
 	for _, instances := range result.Reservations {
 		for _, x := range instances.Instances {
-			// step: we filter out instance not tags with our environment
-			for _, tag := range x.Tags {
-				if tag.Key == "Env" && tag.Value == r.envTag {
-					hosts = append(hosts, x)
-				}
+			if r.selector.Matches(x) {
+				hosts = append(hosts, x)
 			}
 		}
 	}
@@ -131,24 +152,51 @@ func (r ec2Helper) Exists(id string) (bool, error) {
 
 // Get all instances
 func (r ec2Helper) DescribeAll() ([]ec2.Instance, error) {
-	return r.DescribeInstances(ec2.NewFilter())
+	return r.describeStates()
 }
 
 // Get running instances
 func (r ec2Helper) DescribeRunning() ([]ec2.Instance, error) {
-	filter := ec2.NewFilter()
-	filter.Add("instance-state-name", filterRunning)
-	return r.DescribeInstances(filter)
+	return r.describeStates(filterRunning)
 }
 
 // Get terminated instances
 func (r ec2Helper) DescribeTerminated() ([]ec2.Instance, error) {
+	return r.describeStates(fileerTerminated)
+}
+
+// describeStates ... retrieves the instances matching the selector in any of the states, no states being any. The
+// state conditions of the selector are not applied, an instance leaving the selected states must still be seen
+func (r ec2Helper) describeStates(states ...string) ([]ec2.Instance, error) {
 	filter := ec2.NewFilter()
-	filter.Add("instance-state-name", fileerTerminated)
-	return r.DescribeInstances(filter)
+	r.selector.AddFilters(filter)
+	if len(states) > 0 {
+		filter.Add("instance-state-name", states...)
+	}
+	return r.describe(filter)
 }
 
 func (r ec2Helper) isValidRegion(region string) (aws.Region, bool) {
 	x, found := aws.Regions[region]
 	return x, found
 }
+
+// splitTags ... splits a comma separated list of tags, ignoring any empty ones
+func splitTags(tags string) []string {
+	list := make([]string, 0)
+	for _, x := range strings.Split(tags, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			list = append(list, x)
+		}
+	}
+	return list
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, x := range tags {
+		if x == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,359 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// ec2Regions ... the implementation of a EC2EventsInterface merging the pollers of several regions, each
+// region is polled and tracks it's health independently, so a region we cannot reach leaves the instances
+// of the others untouched
+type ec2Regions struct {
+	// the pollers, in the order of the regions
+	regions []*ec2Instances
+}
+
+// NewEC2RegionsInterface ... Creates a EC2EventsInterface polling each of the regions, the events of which are
+// merged into one stream, a single region returns the poller of the region. A region we cannot reach is started
+// degraded and keeps retrying, we only fail if none of the regions are reachable
+//
+//	awsRegions:	the regions to poll, each at most once
+//	awsEndpoint:	a custom endpoint for the ec2 api used by every region, if empty the endpoint of each region is used
+//	awsSelector:	the selector expression the instances are filtered on, see ParseSelector
+func NewEC2RegionsInterface(awsKey, awsSecret string, awsRegions []string, awsEndpoint, awsSelector string) (EC2EventsInterface, error) {
+	if len(awsRegions) <= 0 {
+		return nil, fmt.Errorf("you need to specify at least one region")
+	}
+	seen := make(map[string]bool, 0)
+	for _, x := range awsRegions {
+		if seen[x] {
+			return nil, fmt.Errorf("the region: %s is given more than once", x)
+		}
+		seen[x] = true
+	}
+	if len(awsRegions) == 1 {
+		return NewEC2EventsInterface(awsKey, awsSecret, awsRegions[0], awsEndpoint, awsSelector)
+	}
+	glog.Infof("Creating the EC2 pollers for the regions: %s", strings.Join(awsRegions, ", "))
+
+	service, err := startEC2Regions(awsRegions, func(region string) (*ec2Instances, error) {
+		return newEC2Instances(awsKey, awsSecret, region, awsEndpoint, awsSelector, false)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return service, nil
+}
+
+// startEC2Regions ... starts the pollers of the regions, failing only if none of them could be bootstrapped
+func startEC2Regions(awsRegions []string, newPoller func(string) (*ec2Instances, error)) (*ec2Regions, error) {
+	pollers := make([]*ec2Instances, 0)
+	reachable := 0
+	for _, region := range awsRegions {
+		poller, err := newPoller(region)
+		if err != nil {
+			newEC2Regions(pollers...).stop()
+			return nil, err
+		}
+		if poller.isBootstrapped() {
+			reachable++
+		}
+		pollers = append(pollers, poller)
+	}
+	service := newEC2Regions(pollers...)
+	if reachable <= 0 {
+		service.stop()
+		return nil, fmt.Errorf("failed to bootstrap service, unable to retrieve the instances in any of the regions: %s",
+			strings.Join(awsRegions, ", "))
+	}
+
+	return service, nil
+}
+
+// newEC2Regions ... merges the pollers of the regions
+func newEC2Regions(pollers ...*ec2Instances) *ec2Regions {
+	return &ec2Regions{regions: pollers}
+}
+
+// AddEventListener ... add a event listener to the pollers of every region, the events of a region are
+// delivered in the order they occurred
+func (r *ec2Regions) AddEventListener(filter int) EventCh {
+	ch := make(EventCh, 10)
+	for _, x := range r.regions {
+		go func(events EventCh) {
+			for event := range events {
+				ch <- event
+			}
+		}(x.AddEventListener(filter))
+	}
+
+	return ch
+}
+
+// AddHealthListener ... add a listener for the errors and changes in health of the pollers of every region
+func (r *ec2Regions) AddHealthListener() HealthCh {
+	ch := make(HealthCh, 10)
+	for _, x := range r.regions {
+		go func(events HealthCh) {
+			for event := range events {
+				select {
+				case ch <- event:
+				default:
+					glog.Warningf("The health listener: %v is not keeping up, dropping the event: %s", ch, event)
+				}
+			}
+		}(x.AddHealthListener())
+	}
+
+	return ch
+}
+
+// GetRunningHosts ... returns the running hosts in every region
+func (r *ec2Regions) GetRunningHosts() map[string]string {
+	list := make(map[string]string, 0)
+	for _, x := range r.regions {
+		for id, address := range x.GetRunningHosts() {
+			list[id] = address
+		}
+	}
+	return list
+}
+
+// GetRunningInstances ... returns the running instances in every region, keyed by the instance id
+func (r *ec2Regions) GetRunningInstances() map[string]ec2.Instance {
+	list := make(map[string]ec2.Instance, 0)
+	for _, x := range r.regions {
+		for id, instance := range x.GetRunningInstances() {
+			list[id] = instance
+		}
+	}
+	return list
+}
+
+// GetStoppedInstances ... returns the stopped and terminated instances in every region, keyed by the instance id
+func (r *ec2Regions) GetStoppedInstances() map[string]ec2.Instance {
+	list := make(map[string]ec2.Instance, 0)
+	for _, x := range r.regions {
+		for id, instance := range x.GetStoppedInstances() {
+			list[id] = instance
+		}
+	}
+	return list
+}
+
+// GetInstanceRegions ... returns the region of each of the instances in every region, keyed by the instance id
+func (r *ec2Regions) GetInstanceRegions() map[string]string {
+	list := make(map[string]string, 0)
+	for _, x := range r.regions {
+		for id, region := range x.GetInstanceRegions() {
+			list[id] = region
+		}
+	}
+	return list
+}
+
+// Health ... returns the combined health of the regions, we are only healthy while every region is. The
+// failures are those of the worst region and the errors are prefixed with their region
+func (r *ec2Regions) Health() HealthStatus {
+	health := HealthStatus{Healthy: true}
+	var errors []string
+	for _, x := range r.RegionHealth() {
+		if x.Failures > health.Failures {
+			health.Failures = x.Failures
+		}
+		if x.LastError != "" {
+			errors = append(errors, fmt.Sprintf("%s: %s", x.Region, x.LastError))
+		}
+		switch {
+		case !x.Healthy && health.Healthy:
+			// step: the first degraded region sets when we became unhealthy
+			health.Healthy, health.Since = false, x.Since
+		case !x.Healthy && x.Since.Before(health.Since):
+			health.Since = x.Since
+		case x.Healthy && health.Healthy && x.Since.After(health.Since):
+			health.Since = x.Since
+		}
+	}
+	health.LastError = strings.Join(errors, "; ")
+
+	return health
+}
+
+// RegionHealth ... returns the present health of the poller in each region
+func (r *ec2Regions) RegionHealth() []HealthStatus {
+	list := make([]HealthStatus, 0)
+	for _, x := range r.regions {
+		list = append(list, x.RegionHealth()...)
+	}
+	return list
+}
+
+// Reconfigure ... changes the polling interval and the selector of the pollers in every region, the change is
+// prepared for every region before any of the pollers are altered, so a failure leaves them all untouched
+func (r *ec2Regions) Reconfigure(interval time.Duration, selector string) error {
+	changes := make([]*ec2Change, 0)
+	for _, x := range r.regions {
+		change, err := x.prepare(interval, selector)
+		if err != nil {
+			return fmt.Errorf("unable to reconfigure the region: %s, error: %s", x.region, err)
+		}
+		changes = append(changes, change)
+	}
+	for i, x := range r.regions {
+		x.apply(changes[i])
+	}
+
+	return nil
+}
+
+// stop ... stops the pollers of every region
+func (r *ec2Regions) stop() {
+	for _, x := range r.regions {
+		x.stop()
+	}
+}
+
+// ec2RegionHelper ... the interface to the api of a region
+type ec2RegionHelper struct {
+	EC2Interface
+	// the region of the interface
+	region string
+}
+
+// ec2RegionHelpers ... the implementation of a EC2Interface over several regions, a region which fails does not
+// fail the others, the results of those which succeeded are returned along with a RegionsError
+type ec2RegionHelpers []ec2RegionHelper
+
+// newEC2RegionHelpers ... creates a EC2Interface over each of the regions, a single region returns the
+// interface to the region
+func newEC2RegionHelpers(awsKey, awsSecret string, awsRegions []string, awsEndpoint, selector string) (EC2Interface, error) {
+	if len(awsRegions) <= 0 {
+		return nil, fmt.Errorf("you need to specify at least one region")
+	}
+	list := make(ec2RegionHelpers, 0)
+	for _, region := range awsRegions {
+		client, err := NewEC2Interface(awsKey, awsSecret, region, awsEndpoint, selector)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, ec2RegionHelper{EC2Interface: client, region: region})
+	}
+	if len(list) == 1 {
+		return list[0].EC2Interface, nil
+	}
+	return list, nil
+}
+
+// DescribeInstances ... Get a list of the instances matching the filter in every region
+func (r ec2RegionHelpers) DescribeInstances(filter *ec2.Filter) ([]ec2.Instance, error) {
+	return r.describe(func(x EC2Interface) ([]ec2.Instance, error) { return x.DescribeInstances(filter) })
+}
+
+// DescribeRunning ... Get the running instances in every region
+func (r ec2RegionHelpers) DescribeRunning() ([]ec2.Instance, error) {
+	return r.describe(EC2Interface.DescribeRunning)
+}
+
+// DescribeTerminated ... Get the terminated instances in every region
+func (r ec2RegionHelpers) DescribeTerminated() ([]ec2.Instance, error) {
+	return r.describe(EC2Interface.DescribeTerminated)
+}
+
+// DescribeAll ... Get all the instances in every region
+func (r ec2RegionHelpers) DescribeAll() ([]ec2.Instance, error) {
+	return r.describe(EC2Interface.DescribeAll)
+}
+
+// TerminatedInstance ... terminates the instance in the region it resides in
+func (r ec2RegionHelpers) TerminatedInstance(id string) error {
+	failed := make(map[string]error, 0)
+	for _, x := range r {
+		found, err := x.Exists(id)
+		if err != nil {
+			failed[x.region] = err
+			continue
+		}
+		if found {
+			return x.TerminatedInstance(id)
+		}
+	}
+	if len(failed) > 0 {
+		return &RegionsError{Errors: failed}
+	}
+	return fmt.Errorf("the instance: %s does not exist in any of the regions", id)
+}
+
+// Exists ... checks the instance exists in any of the regions, the regions which failed are only reported
+// when the instance was not found in the others
+func (r ec2RegionHelpers) Exists(id string) (bool, error) {
+	failed := make(map[string]error, 0)
+	for _, x := range r {
+		found, err := x.Exists(id)
+		if err != nil {
+			failed[x.region] = err
+			continue
+		}
+		if found {
+			return true, nil
+		}
+	}
+	if len(failed) > 0 {
+		return false, &RegionsError{Errors: failed}
+	}
+	return false, nil
+}
+
+// describe ... merges the instances of every region, the instances of the regions which succeeded are returned
+// even when others have failed
+func (r ec2RegionHelpers) describe(method func(EC2Interface) ([]ec2.Instance, error)) ([]ec2.Instance, error) {
+	list := make([]ec2.Instance, 0)
+	failed := make(map[string]error, 0)
+	for _, x := range r {
+		instances, err := method(x.EC2Interface)
+		if err != nil {
+			glog.Errorf("Failed to retrieve the instances in region: %s, error: %s", x.region, err)
+			failed[x.region] = err
+			continue
+		}
+		list = append(list, instances...)
+	}
+	if len(failed) > 0 {
+		return list, &RegionsError{Errors: failed}
+	}
+	return list, nil
+}
+
+func (r *RegionsError) Error() string {
+	var regions []string
+	for region := range r.Errors {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	list := make([]string, 0)
+	for _, region := range regions {
+		list = append(list, fmt.Sprintf("region: %s, error: %s", region, r.Errors[region]))
+	}
+	return strings.Join(list, "; ")
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/aws/fake"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestRegions ... creates the pollers of two regions, each with it's own api
+func newTestRegions(t *testing.T, west, east *fake.Server) *ec2Regions {
+	var pollers []*ec2Instances
+	for region, api := range map[string]*fake.Server{"eu-west-1": west, "us-east-1": east} {
+		poller, err := newEC2Instances("key", "secret", region, api.URL(), testSelector, true)
+		if err != nil {
+			t.Fatalf("unable to create the events interface, error: %s", err)
+		}
+		pollers = append(pollers, poller)
+	}
+	return newEC2Regions(pollers...)
+}
+
+func TestRegionsEvents(t *testing.T) {
+	west, east := fake.NewServer(), fake.NewServer()
+	defer west.Close()
+	defer east.Close()
+	west.AddInstance("i-00000001", "10.0.0.1", "running", "Env", testEnv)
+	east.AddInstance("i-00000002", "10.1.0.1", "running", "Env", testEnv)
+	service := newTestRegions(t, west, east)
+	defer service.stop()
+	stoppedCh := service.AddEventListener(STATUS_STOPPED)
+
+	assert.Equal(t, map[string]string{"i-00000001": "10.0.0.1", "i-00000002": "10.1.0.1"}, service.GetRunningHosts())
+	assert.Equal(t, 2, len(service.GetRunningInstances()))
+
+	// step: the events of either region are merged and tagged with their region
+	east.SetState("i-00000002", "stopped")
+	west.SetState("i-00000001", "stopped")
+	regions := make(map[string]string, 0)
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-stoppedCh:
+			regions[event.InstanceID] = event.Region
+		case <-time.After(testTimeout):
+			t.Fatalf("timed out waiting for event %d", i)
+		}
+	}
+	assert.Equal(t, map[string]string{"i-00000001": "eu-west-1", "i-00000002": "us-east-1"}, regions)
+	assert.Equal(t, 0, len(service.GetRunningInstances()))
+	assert.Equal(t, 2, len(service.GetStoppedInstances()))
+}
+
+func TestRegionsOutage(t *testing.T) {
+	west, east := fake.NewServer(), fake.NewServer()
+	defer west.Close()
+	defer east.Close()
+	west.AddInstance("i-00000001", "10.0.0.1", "running", "Env", testEnv)
+	east.AddInstance("i-00000002", "10.1.0.1", "running", "Env", testEnv)
+	service := newTestRegions(t, west, east)
+	defer service.stop()
+	healthCh := service.AddHealthListener()
+	terminatedCh := service.AddEventListener(STATUS_TERMINATED)
+
+	// step: the west region becomes unreachable
+	west.Fail(1000)
+	waitFor(t, func() bool { return !service.Health().Healthy })
+	event := waitForHealth(t, healthCh)
+	assert.Equal(t, "eu-west-1", event.Region)
+	health := service.Health()
+	assert.Contains(t, health.LastError, "eu-west-1: ")
+	assert.NotContains(t, health.LastError, "us-east-1")
+	for _, x := range service.RegionHealth() {
+		assert.Equal(t, x.Region == "us-east-1", x.Healthy, "region: %s", x.Region)
+	}
+
+	// step: the instances of the unreachable region are kept, while the other region carries on
+	east.SetState("i-00000002", "terminated")
+	waitForEvents(t, terminatedCh, expectedEvent{"i-00000002", STATUS_TERMINATED})
+	assert.Equal(t, map[string]string{"i-00000001": "10.0.0.1"}, service.GetRunningHosts())
+
+	west.Fail(0)
+	waitFor(t, func() bool { return service.Health().Healthy })
+}
+
+func TestRegionsReconfigure(t *testing.T) {
+	west, east := fake.NewServer(), fake.NewServer()
+	defer west.Close()
+	defer east.Close()
+	west.AddInstance("i-00000001", "10.0.0.1", "running", "Env", "staging")
+	east.AddInstance("i-00000002", "10.1.0.1", "running", "Env", "staging")
+	service := newTestRegions(t, west, east)
+	defer service.stop()
+	assert.Equal(t, 0, len(service.GetRunningHosts()))
+
+	assert.Error(t, service.Reconfigure(-testInterval, ""))
+	assert.Error(t, service.Reconfigure(0, "env=staging"))
+	assert.NoError(t, service.Reconfigure(0, "tag:Env=staging"))
+	waitFor(t, func() bool { return len(service.GetRunningHosts()) == 2 })
+
+	// step: a region which cannot take the change leaves every region untouched
+	for _, x := range service.regions {
+		if x.region == "us-east-1" {
+			x.newClient = func(string) (EC2Interface, error) { return nil, fmt.Errorf("invalid endpoint") }
+		}
+	}
+	assert.Error(t, service.Reconfigure(testInterval*2, "tag:Env=prod"))
+	for _, x := range service.regions {
+		x.RLock()
+		assert.Equal(t, "tag:Env=staging", x.selector, "region: %s", x.region)
+		assert.Equal(t, testInterval, x.interval, "region: %s", x.region)
+		x.RUnlock()
+	}
+	assert.Equal(t, 2, len(service.GetRunningHosts()))
+}
+
+func TestNewEC2RegionsInterface(t *testing.T) {
+	api := fake.NewServer()
+	defer api.Close()
+	api.AddInstance("i-00000001", "10.0.0.1", "running", "Env", testEnv)
+
+	_, err := NewEC2RegionsInterface("key", "secret", []string{}, api.URL(), testSelector)
+	assert.Error(t, err)
+	_, err = NewEC2RegionsInterface("key", "secret", []string{"eu-west-1", "eu-west-1"}, api.URL(), testSelector)
+	assert.Error(t, err)
+
+	service, err := NewEC2RegionsInterface("key", "secret", []string{"eu-west-1", "us-east-1"}, api.URL(), testSelector)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer service.(*ec2Regions).stop()
+	assert.Equal(t, 2, len(service.RegionHealth()))
+
+	// step: we only fail when none of the regions can be bootstrapped
+	api.Fail(1000)
+	_, err = NewEC2RegionsInterface("key", "secret", []string{"eu-west-1", "us-east-1"}, api.URL(), testSelector)
+	assert.Error(t, err)
+}
+
+func TestRegionsBootstrapFailure(t *testing.T) {
+	west, east := fake.NewServer(), fake.NewServer()
+	defer west.Close()
+	defer east.Close()
+	west.AddInstance("i-00000001", "10.0.0.1", "running", "Env", testEnv)
+	east.AddInstance("i-00000002", "10.1.0.1", "running", "Env", testEnv)
+	east.AddInstance("i-00000003", "10.1.0.2", "stopped", "Env", testEnv)
+	east.Fail(1000)
+
+	apis := map[string]*fake.Server{"eu-west-1": west, "us-east-1": east}
+	service, err := startEC2Regions([]string{"eu-west-1", "us-east-1"}, func(region string) (*ec2Instances, error) {
+		return newEC2Instances("key", "secret", region, apis[region].URL(), testSelector, false)
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer service.stop()
+	allCh := service.AddEventListener(STATUS_RUNNING | STATUS_STOPPING | STATUS_STOPPED |
+		STATUS_SHUTTING_DOWN | STATUS_TERMINATED | STATUS_PENDING | STATUS_UNKNOWN)
+
+	// step: the reachable region is started and the other is degraded
+	health := service.Health()
+	assert.False(t, health.Healthy)
+	assert.Contains(t, health.LastError, "us-east-1: ")
+	for _, x := range service.RegionHealth() {
+		assert.Equal(t, x.Region == "eu-west-1", x.Healthy, "region: %s", x.Region)
+	}
+	assert.Equal(t, map[string]string{"i-00000001": "10.0.0.1"}, service.GetRunningHosts())
+
+	// step: the region is retried, the instances found on recovery are taken as a bootstrap without any events
+	east.Fail(0)
+	waitFor(t, func() bool { return service.Health().Healthy })
+	waitFor(t, func() bool { return len(service.GetRunningHosts()) == 2 })
+	assert.Contains(t, service.GetStoppedInstances(), "i-00000003")
+	waitForEvents(t, allCh)
+
+	east.SetState("i-00000002", "stopped")
+	waitForEvents(t, allCh, expectedEvent{"i-00000002", STATUS_STOPPED})
+}
+
+func TestRegionHelpers(t *testing.T) {
+	west, east := fake.NewServer(), fake.NewServer()
+	defer west.Close()
+	defer east.Close()
+	west.AddInstance("i-00000001", "10.0.0.1", "running", "Env", testEnv)
+	east.AddInstance("i-00000002", "10.1.0.1", "stopped", "Env", testEnv)
+
+	var client ec2RegionHelpers
+	for region, api := range map[string]*fake.Server{"eu-west-1": west, "us-east-1": east} {
+		x, err := NewEC2Interface("key", "secret", region, api.URL(), testSelector)
+		if err != nil {
+			t.Fatalf("unable to create the ec2 client, error: %s", err)
+		}
+		client = append(client, ec2RegionHelper{EC2Interface: x, region: region})
+	}
+	instances, err := client.DescribeAll()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"i-00000001", "i-00000002"}, instanceIDs(instances))
+	instances, err = client.DescribeRunning()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"i-00000001"}, instanceIDs(instances))
+
+	found, err := client.Exists("i-00000002")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Error(t, client.TerminatedInstance("i-00000009"))
+	assert.NoError(t, client.TerminatedInstance("i-00000002"))
+
+	// step: a region failing does not fail the others, the instances found are returned with the error
+	east.Fail(1000)
+	instances, err = client.DescribeAll()
+	assert.Equal(t, []string{"i-00000001"}, instanceIDs(instances))
+	if assert.IsType(t, &RegionsError{}, err) {
+		regionsErr := err.(*RegionsError)
+		assert.Equal(t, 1, len(regionsErr.Errors))
+		assert.Contains(t, regionsErr.Errors, "us-east-1")
+		assert.Contains(t, err.Error(), "region: us-east-1, error: ")
+	}
+	found, err = client.Exists("i-00000001")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	found, err = client.Exists("i-00000002")
+	assert.IsType(t, &RegionsError{}, err)
+	assert.False(t, found)
+	assert.IsType(t, &RegionsError{}, client.TerminatedInstance("i-00000009"))
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+const (
+	// the prefix of a condition on a tag
+	selectorTag = "tag:"
+	// the field of a condition on the vpc
+	selectorVPC = "vpc"
+	// the field of a condition on the subnet
+	selectorSubnet = "subnet"
+	// the field of a condition on the instance state
+	selectorState = "state"
+	// the tag the environment shorthand selects on
+	envTagKey = "Env"
+)
+
+// the states an ec2 instance can be in
+var instanceStates = []string{"pending", "running", "shutting-down", "terminated", "stopping", "stopped"}
+
+// ParseSelector ... parses a comma separated list of conditions, all of which an instance must match, an empty
+// expression selects every instance. The values of a condition are separated by a '|', any of which match
+//
+//	tag:Key=a|b:	the tag has one of the values
+//	tag:Key!=a|b:	the tag is missing or has none of the values
+//	tag:Key:	the tag is present, !tag:Key is missing
+//	vpc=a|b:	the instance resides in one of the vpcs, likewise subnet and state, != for none of them
+//
+// The state conditions are never sent to the api, they only decide the states an instance is first tracked in,
+// once tracked an instance is followed through every state so a stop or termination is never missed
+func ParseSelector(expression string) (*Selector, error) {
+	selector := &Selector{Conditions: make([]Condition, 0)}
+	for _, term := range strings.Split(expression, ",") {
+		if term = strings.TrimSpace(term); term == "" {
+			continue
+		}
+		condition, err := parseCondition(term)
+		if err != nil {
+			return nil, fmt.Errorf("invalid condition: '%s', error: %s", term, err)
+		}
+		selector.Conditions = append(selector.Conditions, condition)
+	}
+
+	return selector, nil
+}
+
+// EnvSelector ... returns the selector expression of the environment shorthand, a comma separated list of
+// environments selects the instances with a Env tag of any of them
+func EnvSelector(envTag string) string {
+	envs := splitTags(envTag)
+	if len(envs) <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s%s=%s", selectorTag, envTagKey, strings.Join(envs, "|"))
+}
+
+// JoinSelectors ... joins the selector expressions into one, ignoring any empty expressions
+func JoinSelectors(expressions ...string) string {
+	list := make([]string, 0)
+	for _, x := range expressions {
+		if x = strings.Trim(strings.TrimSpace(x), ","); x != "" {
+			list = append(list, x)
+		}
+	}
+	return strings.Join(list, ",")
+}
+
+// parseCondition ... parses a single term of the selector
+func parseCondition(term string) (Condition, error) {
+	condition := Condition{}
+	switch {
+	case strings.Contains(term, "="):
+		items := strings.SplitN(term, "=", 2)
+		condition.Field = strings.TrimSpace(items[0])
+		condition.Values = splitValues(items[1])
+		if strings.HasSuffix(condition.Field, "!") {
+			condition.Field, condition.Negate = strings.TrimSpace(strings.TrimSuffix(condition.Field, "!")), true
+		}
+		if strings.HasPrefix(condition.Field, "!") {
+			return condition, fmt.Errorf("a condition with values is negated with !=")
+		}
+		if len(condition.Values) <= 0 {
+			return condition, fmt.Errorf("no values given")
+		}
+	default:
+		condition.Field = term
+		if strings.HasPrefix(term, "!") {
+			condition.Field, condition.Negate = strings.TrimSpace(term[1:]), true
+		}
+		if !strings.HasPrefix(condition.Field, selectorTag) {
+			return condition, fmt.Errorf("only the presence of a tag can be selected without a value")
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(condition.Field, selectorTag):
+		if strings.TrimSpace(strings.TrimPrefix(condition.Field, selectorTag)) == "" {
+			return condition, fmt.Errorf("no tag key given")
+		}
+	case condition.Field == selectorVPC || condition.Field == selectorSubnet:
+	case condition.Field == selectorState:
+		for _, x := range condition.Values {
+			if !containsTag(instanceStates, x) {
+				return condition, fmt.Errorf("unknown instance state: %s, must be one of %s", x, strings.Join(instanceStates, ", "))
+			}
+		}
+	default:
+		return condition, fmt.Errorf("unknown field: %s, must be tag:<key>, vpc, subnet or state", condition.Field)
+	}
+
+	return condition, nil
+}
+
+// splitValues ... splits the values of a condition, ignoring any empty ones
+func splitValues(values string) []string {
+	list := make([]string, 0)
+	for _, x := range strings.Split(values, "|") {
+		if x = strings.TrimSpace(x); x != "" {
+			list = append(list, x)
+		}
+	}
+	return list
+}
+
+// Matches ... checks the instance matches all the conditions of the selector, bar those on the state, see Tracks
+func (r *Selector) Matches(instance ec2.Instance) bool {
+	for _, x := range r.Conditions {
+		if x.Field == selectorState {
+			continue
+		}
+		if x.matches(instance) == x.Negate {
+			return false
+		}
+	}
+	return true
+}
+
+// Tracks ... checks the state of the instance matches the state conditions, i.e. we should start tracking it
+func (r *Selector) Tracks(instance ec2.Instance) bool {
+	for _, x := range r.Conditions {
+		if x.Field == selectorState && x.matches(instance) == x.Negate {
+			return false
+		}
+	}
+	return true
+}
+
+// AddFilters ... adds the api filters of the conditions the api supports, bar the instance state. A negated
+// condition cannot be expressed as a filter, nor can a second condition on the same field, as the values of a
+// filter are or'd, these are left to Matches
+func (r *Selector) AddFilters(filter *ec2.Filter) {
+	added := make(map[string]bool, 0)
+	for _, x := range r.Conditions {
+		if x.Negate {
+			continue
+		}
+		name, values := x.filter()
+		if name == "" || added[name] {
+			continue
+		}
+		added[name] = true
+		filter.Add(name, values...)
+	}
+}
+
+func (r *Selector) String() string {
+	list := make([]string, 0)
+	for _, x := range r.Conditions {
+		list = append(list, x.String())
+	}
+	return strings.Join(list, ",")
+}
+
+// filter ... returns the name and values of the api filter for the condition, the name is empty when the
+// condition is not a filter
+func (r Condition) filter() (string, []string) {
+	switch {
+	case strings.HasPrefix(r.Field, selectorTag) && len(r.Values) <= 0:
+		return "tag-key", []string{strings.TrimPrefix(r.Field, selectorTag)}
+	case strings.HasPrefix(r.Field, selectorTag):
+		return r.Field, r.Values
+	case r.Field == selectorVPC:
+		return "vpc-id", r.Values
+	case r.Field == selectorSubnet:
+		return "subnet-id", r.Values
+	}
+	return "", nil
+}
+
+// matches ... checks the instance matches the condition, ignoring the negation
+func (r Condition) matches(instance ec2.Instance) bool {
+	switch {
+	case strings.HasPrefix(r.Field, selectorTag):
+		key := strings.TrimPrefix(r.Field, selectorTag)
+		for _, tag := range instance.Tags {
+			if tag.Key == key && (len(r.Values) <= 0 || containsTag(r.Values, tag.Value)) {
+				return true
+			}
+		}
+		return false
+	case r.Field == selectorVPC:
+		return containsTag(r.Values, instance.VpcId)
+	case r.Field == selectorSubnet:
+		return containsTag(r.Values, instance.SubnetId)
+	case r.Field == selectorState:
+		return containsTag(r.Values, instance.State.Name)
+	}
+	return false
+}
+
+func (r Condition) String() string {
+	switch {
+	case len(r.Values) <= 0 && r.Negate:
+		return "!" + r.Field
+	case len(r.Values) <= 0:
+		return r.Field
+	case r.Negate:
+		return r.Field + "!=" + strings.Join(r.Values, "|")
+	}
+	return r.Field + "=" + strings.Join(r.Values, "|")
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/gambol99/rbd-fence/pkg/aws/fake"
+
+	"github.com/mitchellh/goamz/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestInstance ... creates a instance in the state with the tags, as key and value pairs
+func newTestInstance(id, state, vpc string, tags ...string) ec2.Instance {
+	instance := ec2.Instance{InstanceId: id, State: ec2.InstanceState{Name: state}, VpcId: vpc, SubnetId: "subnet-1"}
+	for i := 0; i+1 < len(tags); i += 2 {
+		instance.Tags = append(instance.Tags, ec2.Tag{Key: tags[i], Value: tags[i+1]})
+	}
+	return instance
+}
+
+func TestParseSelector(t *testing.T) {
+	selector, err := ParseSelector(" tag:Env=prod|staging, tag:Role!=db ,!tag:Ignore,tag:Team,vpc=vpc-1,subnet!=subnet-2,state=running|stopped,")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []Condition{
+		{Field: "tag:Env", Values: []string{"prod", "staging"}},
+		{Field: "tag:Role", Values: []string{"db"}, Negate: true},
+		{Field: "tag:Ignore", Negate: true},
+		{Field: "tag:Team"},
+		{Field: "vpc", Values: []string{"vpc-1"}},
+		{Field: "subnet", Values: []string{"subnet-2"}, Negate: true},
+		{Field: "state", Values: []string{"running", "stopped"}},
+	}, selector.Conditions)
+	assert.Equal(t, "tag:Env=prod|staging,tag:Role!=db,!tag:Ignore,tag:Team,vpc=vpc-1,subnet!=subnet-2,state=running|stopped", selector.String())
+
+	selector, err = ParseSelector("")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(selector.Conditions))
+}
+
+func TestParseSelectorInvalid(t *testing.T) {
+	for _, expression := range []string{
+		"prod",
+		"env=prod",
+		"tag:=prod",
+		"tag:Env=",
+		"tag:Env!=|",
+		"!tag:Env=prod",
+		"!vpc",
+		"state=sleeping",
+		"vpc",
+	} {
+		_, err := ParseSelector(expression)
+		assert.Error(t, err, "expression: %s", expression)
+	}
+}
+
+func TestEnvSelector(t *testing.T) {
+	assert.Equal(t, "tag:Env=prod|staging", EnvSelector("prod, staging,"))
+	assert.Equal(t, "", EnvSelector(""))
+	assert.Equal(t, "vpc=vpc-1,tag:Env=prod", JoinSelectors("vpc=vpc-1,", "", EnvSelector("prod")))
+}
+
+func TestSelectorMatches(t *testing.T) {
+	selector, _ := ParseSelector("tag:Env=prod|staging,tag:Role!=db,!tag:Ignore,vpc=vpc-1")
+	assert.True(t, selector.Matches(newTestInstance("i-1", "running", "vpc-1", "Env", "prod", "Role", "web")))
+	// step: a missing tag does not have the negated value
+	assert.True(t, selector.Matches(newTestInstance("i-2", "running", "vpc-1", "Env", "staging")))
+	assert.False(t, selector.Matches(newTestInstance("i-3", "running", "vpc-1", "Env", "dev")))
+	assert.False(t, selector.Matches(newTestInstance("i-4", "running", "vpc-1", "Env", "prod", "Role", "db")))
+	assert.False(t, selector.Matches(newTestInstance("i-5", "running", "vpc-1", "Env", "prod", "Ignore", "")))
+	assert.False(t, selector.Matches(newTestInstance("i-6", "running", "vpc-2", "Env", "prod")))
+
+	empty, _ := ParseSelector("")
+	assert.True(t, empty.Matches(newTestInstance("i-7", "stopped", "")))
+}
+
+func TestSelectorTracks(t *testing.T) {
+	selector, _ := ParseSelector("tag:Env=prod")
+	assert.True(t, selector.Tracks(newTestInstance("i-1", "pending", "")))
+	assert.True(t, selector.Tracks(newTestInstance("i-2", "stopped", "")))
+
+	selector, _ = ParseSelector("tag:Env=prod,state!=pending|shutting-down")
+	assert.True(t, selector.Tracks(newTestInstance("i-1", "running", "")))
+	assert.False(t, selector.Tracks(newTestInstance("i-2", "pending", "")))
+	assert.False(t, selector.Tracks(newTestInstance("i-3", "shutting-down", "")))
+
+	// step: the state conditions are left out of the matching, a stopped instance still matches
+	selector, _ = ParseSelector("tag:Env=prod,state=running")
+	assert.True(t, selector.Tracks(newTestInstance("i-1", "running", "")))
+	assert.False(t, selector.Tracks(newTestInstance("i-2", "stopped", "")))
+	assert.True(t, selector.Matches(newTestInstance("i-2", "stopped", "", "Env", "prod")))
+	assert.False(t, selector.Matches(newTestInstance("i-3", "running", "", "Env", "dev")))
+}
+
+func TestDescribeSelector(t *testing.T) {
+	api := fake.NewServer()
+	defer api.Close()
+	api.AddInstance("i-00000001", "10.0.0.1", "running", "Env", "prod", "Role", "web")
+	api.AddInstance("i-00000002", "10.0.0.2", "running", "Env", "prod", "Role", "db")
+	api.AddInstance("i-00000003", "10.0.0.3", "stopped", "Env", "prod")
+	api.AddInstance("i-00000004", "10.0.0.4", "running", "Env", "dev")
+	api.AddInstance("i-00000005", "10.0.0.5", "pending", "Env", "prod").VpcID = "vpc-99"
+
+	client, err := NewEC2Interface("key", "secret", "eu-west-1", api.URL(), "tag:Env=prod,tag:Role!=db,vpc=vpc-1a2b3c4d,state!=pending")
+	if !assert.NoError(t, err) {
+		return
+	}
+	instances, err := client.DescribeAll()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"i-00000001", "i-00000003"}, instanceIDs(instances))
+	// step: the positive conditions are pushed to the api, the negated ones are matched on the results and the
+	// state is left to the poller
+	filters := api.Filters()
+	assert.Equal(t, []string{"prod"}, filters["tag:Env"])
+	assert.Equal(t, []string{"vpc-1a2b3c4d"}, filters["vpc-id"])
+	assert.NotContains(t, filters, "instance-state-name")
+	assert.NotContains(t, filters, "tag:Role")
+
+	instances, err = client.DescribeRunning()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"i-00000001"}, instanceIDs(instances))
+	assert.Equal(t, []string{"running"}, api.Filters()["instance-state-name"])
+
+	instances, err = client.DescribeInstances(ec2.NewFilter())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(instances))
+
+	_, err = NewEC2Interface("key", "secret", "eu-west-1", api.URL(), "Env=prod")
+	assert.Error(t, err)
+}
+
+func instanceIDs(instances []ec2.Instance) []string {
+	list := make([]string, 0)
+	for _, x := range instances {
+		list = append(list, x.InstanceId)
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gambol99/rbd-fence/pkg/membership"
+
+	"github.com/golang/glog"
+	"github.com/mitchellh/goamz/ec2"
+)
+
+const (
+	// the name of the event source
+	sourceName = "ec2"
+)
+
+func init() {
+	membership.Register(sourceName, newEC2Source)
+}
+
+// ec2Source ... adapts the ec2 events interface into a membership event source
+type ec2Source struct {
+	// the ec2 events interface
+	events EC2EventsInterface
+}
+
+// newEC2Source ... creates a membership event source from the ec2 poller
+func newEC2Source() (membership.EventSource, error) {
+	expression := selectorExpression()
+	if expression == "" {
+		return nil, fmt.Errorf("you need to specify the environment tag or a selector for the instances are interested in")
+	}
+	if _, err := ParseSelector(expression); err != nil {
+		return nil, fmt.Errorf("invalid instance selector, error: %s", err)
+	}
+	events, err := NewEC2RegionsInterface(ec2Config.apiKey, ec2Config.apiSecret, splitTags(ec2Config.region), ec2Config.endpoint, expression)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ec2Source{events: events}, nil
+}
+
+// AddEventListener ... add a listener for the node events matching the filter
+func (r *ec2Source) AddEventListener(filter int) membership.EventCh {
+	ch := make(membership.EventCh, 10)
+	events := r.events.AddEventListener(toEC2Filter(filter))
+	go func() {
+		for event := range events {
+			glog.V(5).Infof("Forwarding the ec2 event: %s", event)
+			node := NodeFromInstance(event.Instance)
+			node.Labels["ec2.region"] = event.Region
+			ch <- &membership.NodeEvent{
+				ID:        event.InstanceID,
+				EventType: membership.StateToFilter(event.Instance.State.Name),
+				Source:    sourceName,
+				Node:      node,
+				Detected:  event.Detected,
+			}
+		}
+	}()
+
+	return ch
+}
+
+// GetRunningNodes ... returns the running instances as nodes
+func (r *ec2Source) GetRunningNodes() map[string]membership.Node {
+	return r.toNodes(r.events.GetRunningInstances())
+}
+
+// GetStoppedNodes ... returns the stopped and terminated instances as nodes
+func (r *ec2Source) GetStoppedNodes() map[string]membership.Node {
+	return r.toNodes(r.events.GetStoppedInstances())
+}
+
+// toNodes ... converts the instances into nodes, labelled with the region of the instance as the events are
+func (r *ec2Source) toNodes(instances map[string]ec2.Instance) map[string]membership.Node {
+	regions := r.events.GetInstanceRegions()
+	list := make(map[string]membership.Node, 0)
+	for id, instance := range instances {
+		node := NodeFromInstance(instance)
+		if region, found := regions[id]; found {
+			node.Labels["ec2.region"] = region
+		}
+		list[id] = node
+	}
+	return list
+}
+
+// Health ... returns the health of the ec2 pollers, along with the health of each region
+func (r *ec2Source) Health() membership.Health {
+	health := toHealth(r.events.Health())
+	health.Regions = make(map[string]membership.Health, 0)
+	for _, x := range r.events.RegionHealth() {
+		health.Regions[x.Region] = toHealth(x)
+	}
+	return health
+}
+
+// toHealth ... converts the health of a poller into the health of the source
+func toHealth(health HealthStatus) membership.Health {
+	return membership.Health{
+		Source:    sourceName,
+		Healthy:   health.Healthy,
+		Failures:  health.Failures,
+		LastError: health.LastError,
+		Since:     health.Since,
+	}
+}
+
+// Reconfigure ... changes the polling interval and the selector of the poller, the selector and environments not
+// given keep the value of their command line option
+func (r *ec2Source) Reconfigure(options membership.SourceConfig) error {
+	var expression string
+	if options.Selector != "" || len(options.Environments) > 0 {
+		selector, envTag := options.Selector, strings.Join(options.Environments, ",")
+		if selector == "" {
+			selector = ec2Config.selector
+		}
+		if envTag == "" {
+			envTag = ec2Config.envTag
+		}
+		expression = JoinSelectors(selector, EnvSelector(envTag))
+	}
+	return r.events.Reconfigure(options.Interval, expression)
+}
+
+// NodeFromInstance ... converts an ec2 instance into a membership node
+func NodeFromInstance(instance ec2.Instance) membership.Node {
+	node := membership.Node{
+		ID:        instance.InstanceId,
+		Addresses: make([]string, 0),
+		State:     instance.State.Name,
+		Labels:    make(map[string]string, 0),
+	}
+	if instance.PrivateIpAddress != "" {
+		node.Addresses = append(node.Addresses, instance.PrivateIpAddress)
+	}
+	for _, tag := range instance.Tags {
+		node.Labels[tag.Key] = tag.Value
+	}
+	node.Labels["ec2.availability-zone"] = instance.AvailZone
+	node.Labels["ec2.instance-type"] = instance.InstanceType
+	node.Labels["ec2.vpc-id"] = instance.VpcId
+	node.Labels["ec2.subnet-id"] = instance.SubnetId
+
+	return node
+}
+
+// toEC2Filter ... converts a membership filter to the ec2 event filter
+func toEC2Filter(filter int) int {
+	mapping := map[int]int{
+		membership.STATUS_RUNNING:       STATUS_RUNNING,
+		membership.STATUS_STOPPING:      STATUS_STOPPING,
+		membership.STATUS_STOPPED:       STATUS_STOPPED,
+		membership.STATUS_SHUTTING_DOWN: STATUS_SHUTTING_DOWN,
+		membership.STATUS_TERMINATED:    STATUS_TERMINATED,
+		membership.STATUS_PENDING:       STATUS_PENDING,
+		membership.STATUS_UNKNOWN:       STATUS_UNKNOWN,
+	}
+	var converted int
+	for from, to := range mapping {
+		if filter&from != 0 {
+			converted |= to
+		}
+	}
+	return converted
+}
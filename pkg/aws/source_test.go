@@ -0,0 +1,46 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"testing"
+
+	"github.com/gambol99/rbd-fence/pkg/aws/fake"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourceNodeRegions(t *testing.T) {
+	west, east := fake.NewServer(), fake.NewServer()
+	defer west.Close()
+	defer east.Close()
+	west.AddInstance("i-00000001", "10.0.0.1", "running", "Env", testEnv)
+	east.AddInstance("i-00000002", "10.1.0.1", "running", "Env", testEnv)
+	service := newTestRegions(t, west, east)
+	defer service.stop()
+	source := &ec2Source{events: service}
+
+	// step: the nodes are labelled with their region, as the events are
+	running := source.GetRunningNodes()
+	assert.Equal(t, 2, len(running))
+	assert.Equal(t, "eu-west-1", running["i-00000001"].Labels["ec2.region"])
+	assert.Equal(t, "us-east-1", running["i-00000002"].Labels["ec2.region"])
+
+	east.SetState("i-00000002", "stopped")
+	waitFor(t, func() bool { return len(source.GetStoppedNodes()) == 1 })
+	assert.Equal(t, "us-east-1", source.GetStoppedNodes()["i-00000002"].Labels["ec2.region"])
+}
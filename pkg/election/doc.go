@@ -0,0 +1,37 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package election
+
+import "time"
+
+// LeaseInterface ... a lease which can only be held by a single holder at a time
+type LeaseInterface interface {
+	// Acquire or renew the lease for the holder, returns true if the holder now has the lease
+	Acquire(string, time.Duration) (bool, error)
+	// Release the lease, if it is held by the holder
+	Release(string) error
+}
+
+// ElectionInterface ... the interface to a leader election
+type ElectionInterface interface {
+	// Check if we are presently the leader
+	IsLeader() bool
+	// Get a channel which receives the changes in leadership
+	LeaderCh() <-chan bool
+	// Stop participating in the election, releasing the lease if we have it
+	Stop()
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package election
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// the implementation of a ElectionInterface built on a lease
+type leaseElection struct {
+	sync.RWMutex
+	// the lease we are competing for
+	lease LeaseInterface
+	// our identity
+	holder string
+	// the time to live on the lease
+	ttl time.Duration
+	// are we the leader
+	leader bool
+	// the time we last acquired or renewed the lease
+	renewed time.Time
+	// the channel leadership changes are sent on
+	leaderCh chan bool
+	// the channel used to stop the election
+	stopCh chan struct{}
+	// closed once the election has stopped
+	doneCh chan struct{}
+}
+
+// NewElection ... creates a new leader election competing for the lease
+//
+//	lease:		the lease backing the election
+//	holder:		our unique identity in the election
+//	ttl:		the time to live on the lease, a dead leader is replaced within this time
+func NewElection(lease LeaseInterface, holder string, ttl time.Duration) (ElectionInterface, error) {
+	glog.Infof("Starting the leader election, holder: %s, ttl: %s", holder, ttl)
+	if holder == "" {
+		return nil, fmt.Errorf("you have not specified the identity for the election")
+	}
+	if ttl < time.Second {
+		return nil, fmt.Errorf("the lease ttl must be at least one second")
+	}
+
+	service := &leaseElection{
+		lease:    lease,
+		holder:   holder,
+		ttl:      ttl,
+		leaderCh: make(chan bool, 10),
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+	go service.run()
+
+	return service, nil
+}
+
+// NewStandalone ... creates an election which is always the leader, used when only a single instance is running
+func NewStandalone() ElectionInterface {
+	service := &standalone{leaderCh: make(chan bool, 1)}
+	service.leaderCh <- true
+	return service
+}
+
+// IsLeader ... checks if we are presently the leader
+func (r *leaseElection) IsLeader() bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.leader
+}
+
+// LeaderCh ... returns a channel which receives the changes in leadership
+func (r *leaseElection) LeaderCh() <-chan bool {
+	return r.leaderCh
+}
+
+// Stop ... stops the election and releases the lease
+func (r *leaseElection) Stop() {
+	close(r.stopCh)
+	<-r.doneCh
+}
+
+// run ... the main loop, attempts to acquire or renew the lease a few times within the ttl
+func (r *leaseElection) run() {
+	defer close(r.doneCh)
+	interval := r.ttl / 3
+
+	for {
+		r.campaign()
+
+		select {
+		case <-r.stopCh:
+			if r.IsLeader() {
+				glog.Infof("Releasing the leadership lease, holder: %s", r.holder)
+				if err := r.lease.Release(r.holder); err != nil {
+					glog.Errorf("Failed to release the lease, error: %s", err)
+				}
+				r.setLeader(false)
+			}
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// campaign ... attempts to acquire the lease, stepping down if we can no longer be sure we hold it
+func (r *leaseElection) campaign() {
+	acquired, err := r.lease.Acquire(r.holder, r.ttl)
+	if err != nil {
+		glog.Errorf("Failed to acquire the leadership lease, error: %s", err)
+		// step: if we can't renew we step down before the lease could be taken by another
+		r.RLock()
+		expired := time.Since(r.renewed) > (r.ttl*2)/3
+		r.RUnlock()
+		if expired {
+			r.setLeader(false)
+		}
+		return
+	}
+	if acquired {
+		r.Lock()
+		r.renewed = time.Now()
+		r.Unlock()
+	}
+	r.setLeader(acquired)
+}
+
+// setLeader ... updates our leadership, notifying on any change
+func (r *leaseElection) setLeader(leader bool) {
+	r.Lock()
+	changed := r.leader != leader
+	r.leader = leader
+	r.Unlock()
+
+	if changed {
+		if leader {
+			glog.Infof("We have been elected leader, holder: %s", r.holder)
+		} else {
+			glog.Infof("We are no longer the leader, holder: %s", r.holder)
+		}
+		r.leaderCh <- leader
+	}
+}
+
+// standalone ... an election with a single participant
+type standalone struct {
+	// the channel leadership changes are sent on
+	leaderCh chan bool
+}
+
+func (r *standalone) IsLeader() bool        { return true }
+func (r *standalone) LeaderCh() <-chan bool { return r.leaderCh }
+func (r *standalone) Stop()                 {}
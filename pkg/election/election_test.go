@@ -0,0 +1,199 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package election
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testTTL = time.Duration(1) * time.Second
+
+func newTestLease(t *testing.T) LeaseInterface {
+	lease, err := NewFileLease(filepath.Join(t.TempDir(), "leader"))
+	if err != nil {
+		t.Fatalf("unable to create the lease, error: %s", err)
+	}
+	return lease
+}
+
+func waitForLeadership(t *testing.T, e ElectionInterface, expected bool) {
+	select {
+	case leader := <-e.LeaderCh():
+		assert.Equal(t, expected, leader)
+	case <-time.After(testTTL * 3):
+		t.Fatalf("timed out waiting for the leadership to change to: %t", expected)
+	}
+}
+
+func TestFileLeaseExclusive(t *testing.T) {
+	lease := newTestLease(t)
+
+	acquired, err := lease.Acquire("a", testTTL)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+
+	acquired, err = lease.Acquire("b", testTTL)
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+
+	// step: the holder can renew the lease
+	acquired, err = lease.Acquire("a", testTTL)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+}
+
+func TestFileLeaseExpires(t *testing.T) {
+	lease := newTestLease(t)
+
+	acquired, _ := lease.Acquire("a", time.Duration(100)*time.Millisecond)
+	assert.True(t, acquired)
+	time.Sleep(time.Duration(150) * time.Millisecond)
+
+	acquired, err := lease.Acquire("b", testTTL)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+}
+
+func TestFileLeaseRelease(t *testing.T) {
+	lease := newTestLease(t)
+
+	acquired, _ := lease.Acquire("a", testTTL)
+	assert.True(t, acquired)
+	// step: only the holder can release the lease
+	assert.NoError(t, lease.Release("b"))
+	acquired, _ = lease.Acquire("b", testTTL)
+	assert.False(t, acquired)
+
+	assert.NoError(t, lease.Release("a"))
+	acquired, _ = lease.Acquire("b", testTTL)
+	assert.True(t, acquired)
+}
+
+func TestElectionTakeover(t *testing.T) {
+	lease := newTestLease(t)
+
+	first, err := NewElection(lease, "first", testTTL)
+	assert.NoError(t, err)
+	waitForLeadership(t, first, true)
+
+	second, err := NewElection(lease, "second", testTTL)
+	assert.NoError(t, err)
+	defer second.Stop()
+	assert.False(t, second.IsLeader())
+
+	// step: stopping the leader releases the lease and the follower takes over
+	first.Stop()
+	assert.False(t, first.IsLeader())
+	waitForLeadership(t, second, true)
+	assert.True(t, second.IsLeader())
+}
+
+func TestStandaloneIsLeader(t *testing.T) {
+	e := NewStandalone()
+	assert.True(t, e.IsLeader())
+	waitForLeadership(t, e, true)
+}
+
+// the stub rados command, each call is a new client entity as with the real command. The lock is held by the
+// entity and cookie which took it, so a renewal without breaking the lock first is refused
+const radosStub = `#!/bin/sh
+dir="$RADOS_STUB_DIR"
+echo "$@" >> "$dir/calls"
+count=$(($(cat "$dir/count" 2>/dev/null || echo 0) + 1))
+echo $count > "$dir/count"
+entity="client.$count"
+case "$*" in
+*"lock info"*)
+	if [ -f "$dir/holder" ]; then
+		set -- $(cat "$dir/holder")
+		echo "{\"name\":\"rbd-manager\",\"type\":\"exclusive\",\"lockers\":[{\"name\":\"$1\",\"cookie\":\"$2\",\"addr\":\"10.0.0.1:0/1\"}]}"
+	else
+		echo "{\"name\":\"rbd-manager\",\"type\":\"\",\"lockers\":[]}"
+	fi
+	;;
+*"lock get"*)
+	if [ -f "$dir/fail" ]; then
+		echo "error locking: (110) Connection timed out" >&2
+		exit 1
+	fi
+	if [ -f "$dir/holder" ]; then
+		echo "error locking: (16) Device or resource busy" >&2
+		exit 1
+	fi
+	echo "$entity $8" > "$dir/holder"
+	;;
+*"lock break"*)
+	if [ "$(cat "$dir/holder" 2>/dev/null)" != "$7 $9" ]; then
+		echo "error breaking lock: (2) No such file or directory" >&2
+		exit 1
+	fi
+	rm -f "$dir/holder"
+	;;
+esac
+`
+
+func TestRadosLeaseRenew(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "rados"), []byte(radosStub), 0755); err != nil {
+		t.Fatalf("unable to write the rados stub, error: %s", err)
+	}
+	t.Setenv("RADOS_STUB_DIR", dir)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	lease, err := NewRadosLease("rbd", "leader")
+	if !assert.NoError(t, err) {
+		return
+	}
+	// step: each renewal is made by a new client entity, so it must break our lock and take it again
+	var holders []string
+	for i := 0; i < 3; i++ {
+		acquired, err := lease.Acquire("a", time.Duration(30)*time.Second)
+		assert.NoError(t, err)
+		assert.True(t, acquired)
+		content, _ := ioutil.ReadFile(filepath.Join(dir, "holder"))
+		holders = append(holders, strings.TrimSpace(string(content)))
+	}
+	assert.Equal(t, 3, len(holders))
+	assert.NotEqual(t, holders[0], holders[2], "the lock should be held by the entity of the latest renewal")
+	for _, x := range holders {
+		assert.True(t, strings.HasSuffix(x, " a"))
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, strings.Count(string(content), "lock break leader rbd-manager client."))
+	}
+
+	// step: another holder is refused without an error
+	acquired, err := lease.Acquire("b", time.Duration(30)*time.Second)
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+
+	// step: a failure other than the lock being held is an error, leaving the grace to the election
+	if err := ioutil.WriteFile(filepath.Join(dir, "fail"), []byte{}, 0644); err != nil {
+		t.Fatalf("unable to write the failure marker, error: %s", err)
+	}
+	acquired, err = lease.Acquire("a", time.Duration(30)*time.Second)
+	assert.Error(t, err)
+	assert.False(t, acquired)
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package election
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// the content of the lease file
+type fileLeaseRecord struct {
+	// the holder of the lease
+	Holder string `json:"holder"`
+	// the time the lease expires
+	Expires time.Time `json:"expires"`
+	// the time the lease was last renewed
+	Renewed time.Time `json:"renewed"`
+}
+
+// the implementation of a LeaseInterface using a file on shared storage
+type fileLease struct {
+	// the path to the lease file
+	path string
+}
+
+// NewFileLease ... creates a lease backed by a file, the file must reside on storage shared by all
+// the instances taking part in the election, i.e. nfs or cephfs
+//
+//	path:		the path to the lease file
+func NewFileLease(path string) (LeaseInterface, error) {
+	if path == "" {
+		return nil, fmt.Errorf("you have not specified the path to the lease file")
+	}
+	if _, err := os.Stat(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("unable to access the lease directory, error: %s", err)
+	}
+	return &fileLease{path: path}, nil
+}
+
+// Acquire ... acquires or renews the lease for the holder
+func (r *fileLease) Acquire(holder string, ttl time.Duration) (bool, error) {
+	acquired := false
+	err := r.withLock(func() error {
+		record, err := r.read()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		// step: someone else has a current lease
+		if record != nil && record.Holder != holder && now.Before(record.Expires) {
+			return nil
+		}
+		if err := r.write(&fileLeaseRecord{Holder: holder, Expires: now.Add(ttl), Renewed: now}); err != nil {
+			return err
+		}
+		acquired = true
+
+		return nil
+	})
+
+	return acquired, err
+}
+
+// Release ... releases the lease if it is held by the holder
+func (r *fileLease) Release(holder string) error {
+	return r.withLock(func() error {
+		record, err := r.read()
+		if err != nil {
+			return err
+		}
+		if record == nil || record.Holder != holder {
+			return nil
+		}
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove the lease file, error: %s", err)
+		}
+		return nil
+	})
+}
+
+// withLock ... serializes access to the lease file across the instances using an advisory lock
+func (r *fileLease) withLock(method func() error) error {
+	lock, err := os.OpenFile(r.path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open the lease lock file, error: %s", err)
+	}
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("unable to lock the lease file, error: %s", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	return method()
+}
+
+// read ... reads the current lease, returning nil if there is none
+func (r *fileLease) read() (*fileLeaseRecord, error) {
+	content, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to read the lease file, error: %s", err)
+	}
+	record := new(fileLeaseRecord)
+	if err := json.Unmarshal(content, record); err != nil {
+		return nil, fmt.Errorf("unable to decode the lease file, error: %s", err)
+	}
+
+	return record, nil
+}
+
+// write ... writes the lease to a temporary file and renames it into place
+func (r *fileLease) write(record *fileLeaseRecord) error {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	temp := r.path + ".tmp"
+	if err := ioutil.WriteFile(temp, content, 0644); err != nil {
+		return fmt.Errorf("unable to write the lease file, error: %s", err)
+	}
+	if err := os.Rename(temp, r.path); err != nil {
+		return fmt.Errorf("unable to rename the lease file, error: %s", err)
+	}
+
+	return nil
+}
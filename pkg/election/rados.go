@@ -0,0 +1,152 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package election
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/utils"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// the name of the rados lock on the object
+	radosLockName = "rbd-manager"
+	// the timeout on the rados commands
+	radosTimeout = time.Duration(10) * time.Second
+)
+
+// the json output from a rados lock info
+type radosLockInfo struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Lockers []struct {
+		Name       string `json:"name"`
+		Cookie     string `json:"cookie"`
+		Expiration string `json:"expiration"`
+		Address    string `json:"addr"`
+	} `json:"lockers"`
+}
+
+// the implementation of a LeaseInterface using an exclusive lock on a rados object
+type radosLease struct {
+	// the pool the object resides in
+	pool string
+	// the name of the object
+	object string
+}
+
+// NewRadosLease ... creates a lease backed by an exclusive lock on a rados object, the lock is held
+// with a duration so a dead holder is expired by the cluster
+//
+//	pool:		the pool containing the object
+//	object:		the name of the object to lock
+func NewRadosLease(pool, object string) (LeaseInterface, error) {
+	if pool == "" || object == "" {
+		return nil, fmt.Errorf("you must specify the pool and object for the rados lease")
+	}
+	return &radosLease{pool: pool, object: object}, nil
+}
+
+// Acquire ... acquires or renews the lock on the object for the holder, false is only returned when the lock is
+// held by another, any other failure is returned as an error
+func (r *radosLease) Acquire(holder string, ttl time.Duration) (bool, error) {
+	info, err := r.info()
+	if err != nil {
+		return false, err
+	}
+	// step: a rados lock is held by the client entity which took it, as each command is a new client
+	// we renew by breaking our own lock and taking it again
+	for _, locker := range info.Lockers {
+		if locker.Cookie != holder {
+			continue
+		}
+		if _, err := utils.Execute(radosTimeout, "rados", "-p", r.pool, "lock", "break",
+			r.object, radosLockName, locker.Name, "--lock-cookie", holder); err != nil {
+			return false, fmt.Errorf("unable to break our lock for renewal, error: %s", err)
+		}
+	}
+	// step: the lock is refused while another holder has an unexpired lock
+	if _, err := utils.Execute(radosTimeout, "rados", "-p", r.pool, "lock", "get", r.object, radosLockName,
+		"--lock-cookie", holder, "--lock-duration", fmt.Sprintf("%d", int(ttl.Seconds()))); err != nil {
+		if isLockBusy(err) {
+			glog.V(4).Infof("Unable to acquire the lock on %s/%s, it is held by another, error: %s", r.pool, r.object, err)
+			return false, nil
+		}
+		return false, fmt.Errorf("unable to acquire the lock, error: %s", err)
+	}
+
+	return true, nil
+}
+
+// Release ... releases the lock on the object if it is held by the holder
+func (r *radosLease) Release(holder string) error {
+	info, err := r.info()
+	if err != nil {
+		return err
+	}
+	for _, locker := range info.Lockers {
+		if locker.Cookie != holder {
+			continue
+		}
+		if _, err := utils.Execute(radosTimeout, "rados", "-p", r.pool, "lock", "break",
+			r.object, radosLockName, locker.Name, "--lock-cookie", holder); err != nil {
+			return fmt.Errorf("unable to release the lock, error: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// isLockBusy ... checks the failure to take the lock was because another holder has it, i.e. EBUSY or EEXIST,
+// rather than the command failing or timing out
+func isLockBusy(err error) bool {
+	var execErr *utils.ExecError
+	if !errors.As(err, &execErr) || execErr.TimedOut || execErr.ExitCode < 0 {
+		return false
+	}
+	for _, x := range []string{"(16)", "(17)", "Device or resource busy", "File exists"} {
+		if strings.Contains(execErr.Stderr, x) {
+			return true
+		}
+	}
+	return false
+}
+
+// info ... retrieves the current holders of the lock on the object
+func (r *radosLease) info() (*radosLockInfo, error) {
+	info := new(radosLockInfo)
+	output, err := utils.Execute(radosTimeout, "rados", "-p", r.pool, "lock", "info",
+		r.object, radosLockName, "--format", "json")
+	if err != nil {
+		// step: the object does not exist until the first lock is taken
+		if _, statErr := utils.Execute(radosTimeout, "rados", "-p", r.pool, "stat", r.object); statErr != nil {
+			return info, nil
+		}
+		return nil, fmt.Errorf("unable to retrieve the lock info, error: %s", err)
+	}
+	if err := json.Unmarshal(output, info); err != nil {
+		return nil, fmt.Errorf("unable to decode the lock info, error: %s", err)
+	}
+
+	return info, nil
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fence
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/queue"
+)
+
+// ErrShuttingDown ... returned when a job is submitted after the orchestrator has started draining
+var ErrShuttingDown = errors.New("the orchestrator is shutting down")
+
+// Handler ... fences the node in the job, the context is cancelled when the orchestrator is draining or the
+// jobs are cancelled. An error returned after the context was cancelled marks the job as unfinished
+type Handler func(ctx context.Context, job *queue.FenceJob) error
+
+// Config ... the configuration for the orchestrator
+type Config struct {
+	// the number of workers fencing the nodes concurrently
+	Workers int
+	// the handler called to fence a node
+	Handler Handler
+}
+
+// OrchestratorInterface ... owns the addresses of the running nodes and the fence jobs, ensuring a node
+// only has a single job pending or running at any time
+type OrchestratorInterface interface {
+	// Set the addresses of a running node
+	SetNode(string, []string)
+	// Get the addresses of a node
+	GetNode(string) ([]string, bool)
+	// Remove the node
+	RemoveNode(string)
+	// Get a copy of the nodes and their addresses
+	Nodes() map[string][]string
+	// Check if the address is in use by a node, other than the one given
+	AddressInUse(string, string) (string, bool)
+	// Check if the node has a job pending or running
+	Active(string) bool
+	// Submit a job, returns false if the node already has a job pending or running
+	Submit(*queue.FenceJob) (bool, error)
+	// Update the state of a running job, i.e. the attempts
+	Update(*queue.FenceJob)
+	// Get the jobs waiting for a worker
+	Pending() []queue.FenceJob
+	// Get the jobs being processed, keyed by the instance id
+	Running() map[string]queue.FenceJob
+	// Stop accepting jobs and wait up to the timeout for the running jobs, returning those unfinished
+	Drain(time.Duration) []queue.FenceJob
+	// Drop the pending jobs and cancel those running, waiting up to the timeout, returning those unfinished
+	Cancel(time.Duration) []queue.FenceJob
+}
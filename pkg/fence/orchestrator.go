@@ -0,0 +1,368 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fence
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/queue"
+
+	"github.com/golang/glog"
+)
+
+// the implementation of the OrchestratorInterface
+type orchestrator struct {
+	sync.Mutex
+	// the configuration
+	config Config
+	// the running nodes, the node id to it's addresses
+	nodes map[string][]string
+	// the jobs waiting for a worker, keyed by the instance id
+	pending map[string]*queue.FenceJob
+	// the order the pending jobs were submitted
+	order []string
+	// the jobs being processed, keyed by the instance id
+	running map[string]queue.FenceJob
+	// the cancellation of the jobs being processed, keyed by the instance id
+	handles map[string]*handle
+	// the jobs interrupted by the drain
+	interrupted []queue.FenceJob
+	// set once we are draining
+	draining bool
+	// signals the workers there is work or we are draining
+	cond *sync.Cond
+	// the context handed to the handler, cancelled on drain
+	ctx context.Context
+	// cancels the context
+	cancel context.CancelFunc
+	// the workers
+	workers sync.WaitGroup
+}
+
+// handle ... the cancellation of a job being processed
+type handle struct {
+	// cancels the context of the job
+	cancel context.CancelFunc
+	// closed once the handler has returned
+	done chan struct{}
+	// the job as it was when the handler returned
+	job queue.FenceJob
+	// the error returned by the handler
+	err error
+}
+
+// NewOrchestrator ... creates the orchestrator and starts the workers
+func NewOrchestrator(config Config) (OrchestratorInterface, error) {
+	if config.Workers < 1 {
+		return nil, fmt.Errorf("the orchestrator requires at least one worker")
+	}
+	if config.Handler == nil {
+		return nil, fmt.Errorf("the orchestrator requires a handler")
+	}
+	glog.Infof("Starting the fence orchestrator, workers: %d", config.Workers)
+
+	service := &orchestrator{
+		config:  config,
+		nodes:   make(map[string][]string, 0),
+		pending: make(map[string]*queue.FenceJob, 0),
+		order:   make([]string, 0),
+		running: make(map[string]queue.FenceJob, 0),
+		handles: make(map[string]*handle, 0),
+	}
+	service.cond = sync.NewCond(&service.Mutex)
+	service.ctx, service.cancel = context.WithCancel(context.Background())
+	for i := 0; i < config.Workers; i++ {
+		service.workers.Add(1)
+		go service.worker()
+	}
+
+	return service, nil
+}
+
+// SetNode ... adds or updates the addresses of a running node
+func (r *orchestrator) SetNode(id string, addresses []string) {
+	r.Lock()
+	defer r.Unlock()
+	r.nodes[id] = copyAddresses(addresses)
+}
+
+// GetNode ... retrieves the addresses of a node
+func (r *orchestrator) GetNode(id string) ([]string, bool) {
+	r.Lock()
+	defer r.Unlock()
+	addresses, found := r.nodes[id]
+	return copyAddresses(addresses), found
+}
+
+// RemoveNode ... removes the node
+func (r *orchestrator) RemoveNode(id string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.nodes, id)
+}
+
+// Nodes ... returns a copy of the nodes and their addresses
+func (r *orchestrator) Nodes() map[string][]string {
+	r.Lock()
+	defer r.Unlock()
+	list := make(map[string][]string, len(r.nodes))
+	for id, addresses := range r.nodes {
+		list[id] = copyAddresses(addresses)
+	}
+	return list
+}
+
+// AddressInUse ... checks if the address belongs to a node, other than the one given
+func (r *orchestrator) AddressInUse(address, exclude string) (string, bool) {
+	r.Lock()
+	defer r.Unlock()
+	for id, addresses := range r.nodes {
+		if id == exclude {
+			continue
+		}
+		for _, x := range addresses {
+			if x == address {
+				return id, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Active ... checks if the node has a job pending or running
+func (r *orchestrator) Active(id string) bool {
+	r.Lock()
+	defer r.Unlock()
+	_, pending := r.pending[id]
+	_, running := r.running[id]
+	return pending || running
+}
+
+// Submit ... queues the job for a worker. If the node already has a job pending, the addresses and force of
+// the job are merged into it, if the node is being fenced the job is dropped. Either way false is returned
+func (r *orchestrator) Submit(job *queue.FenceJob) (bool, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.draining {
+		return false, ErrShuttingDown
+	}
+	id := job.InstanceID
+	if _, found := r.running[id]; found {
+		glog.Infof("The instance: %s is presently being fenced, dropping the duplicate job", id)
+		return false, nil
+	}
+	if pending, found := r.pending[id]; found {
+		glog.Infof("The instance: %s already has a fence job pending, merging the jobs", id)
+		pending.Addresses = mergeAddresses(pending.Addresses, job.Addresses)
+		pending.Force = pending.Force || job.Force
+		return false, nil
+	}
+	copied := *job
+	copied.Addresses = copyAddresses(job.Addresses)
+	r.pending[id] = &copied
+	r.order = append(r.order, id)
+	r.cond.Signal()
+
+	return true, nil
+}
+
+// Update ... updates the state of a running job
+func (r *orchestrator) Update(job *queue.FenceJob) {
+	r.Lock()
+	defer r.Unlock()
+	if _, found := r.running[job.InstanceID]; found {
+		r.running[job.InstanceID] = *job
+	}
+}
+
+// Pending ... returns the jobs waiting for a worker, in the order submitted
+func (r *orchestrator) Pending() []queue.FenceJob {
+	r.Lock()
+	defer r.Unlock()
+	list := make([]queue.FenceJob, 0, len(r.order))
+	for _, id := range r.order {
+		list = append(list, *r.pending[id])
+	}
+	return list
+}
+
+// Running ... returns the jobs being processed
+func (r *orchestrator) Running() map[string]queue.FenceJob {
+	r.Lock()
+	defer r.Unlock()
+	list := make(map[string]queue.FenceJob, len(r.running))
+	for id, job := range r.running {
+		list[id] = job
+	}
+	return list
+}
+
+// Drain ... stops accepting jobs, cancels the context of the handlers and waits up to the timeout for the
+// running jobs to finish. The jobs never started, interrupted or still running are returned
+func (r *orchestrator) Drain(timeout time.Duration) []queue.FenceJob {
+	r.Lock()
+	if r.draining {
+		r.Unlock()
+		return nil
+	}
+	r.draining = true
+	unfinished := make([]queue.FenceJob, 0)
+	for _, id := range r.order {
+		unfinished = append(unfinished, *r.pending[id])
+	}
+	r.pending = make(map[string]*queue.FenceJob, 0)
+	r.order = make([]string, 0)
+	glog.Infof("Draining the fence orchestrator, pending: %d, running: %d, timeout: %s", len(unfinished), len(r.running), timeout)
+	r.cond.Broadcast()
+	r.Unlock()
+	r.cancel()
+
+	doneCh := make(chan struct{})
+	go func() {
+		r.workers.Wait()
+		close(doneCh)
+	}()
+
+	timedOut := false
+	select {
+	case <-doneCh:
+	case <-time.After(timeout):
+		timedOut = true
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if timedOut {
+		for _, job := range r.running {
+			glog.Errorf("The fence job for instance: %s did not finish before the deadline", job.InstanceID)
+			unfinished = append(unfinished, job)
+		}
+	}
+
+	return append(unfinished, r.interrupted...)
+}
+
+// Cancel ... drops the pending jobs, cancels the context of the running jobs and waits up to the timeout for
+// them to return, i.e. on losing the leadership. Unlike Drain the orchestrator continues to accept jobs. The jobs
+// dropped, interrupted or still running are returned
+func (r *orchestrator) Cancel(timeout time.Duration) []queue.FenceJob {
+	r.Lock()
+	unfinished := make([]queue.FenceJob, 0)
+	for _, id := range r.order {
+		unfinished = append(unfinished, *r.pending[id])
+	}
+	r.pending = make(map[string]*queue.FenceJob, 0)
+	r.order = make([]string, 0)
+	glog.Infof("Cancelling the fence jobs, pending: %d, running: %d, timeout: %s", len(unfinished), len(r.running), timeout)
+	cancelled := make(map[string]*handle, len(r.handles))
+	for id, x := range r.handles {
+		x.cancel()
+		cancelled[id] = x
+	}
+	r.Unlock()
+
+	deadline := time.After(timeout)
+	for id, x := range cancelled {
+		select {
+		case <-x.done:
+			if x.err != nil {
+				glog.Warningf("The fence job for instance: %s was cancelled, error: %s", id, x.err)
+				unfinished = append(unfinished, x.job)
+			}
+			continue
+		case <-deadline:
+		}
+		// step: the deadline has passed, the job is left running
+		r.Lock()
+		if job, found := r.running[id]; found {
+			glog.Errorf("The fence job for instance: %s did not stop before the deadline", id)
+			unfinished = append(unfinished, job)
+		}
+		r.Unlock()
+	}
+
+	return unfinished
+}
+
+// worker ... takes the pending jobs in order and hands them to the handler
+func (r *orchestrator) worker() {
+	defer r.workers.Done()
+	for {
+		r.Lock()
+		for len(r.order) <= 0 && !r.draining {
+			r.cond.Wait()
+		}
+		if r.draining {
+			r.Unlock()
+			return
+		}
+		id := r.order[0]
+		r.order = r.order[1:]
+		job := r.pending[id]
+		delete(r.pending, id)
+		r.running[id] = *job
+		ctx, cancel := context.WithCancel(r.ctx)
+		x := &handle{cancel: cancel, done: make(chan struct{})}
+		r.handles[id] = x
+		r.Unlock()
+
+		err := r.config.Handler(ctx, job)
+		cancel()
+
+		r.Lock()
+		x.job, x.err = r.running[id], err
+		delete(r.running, id)
+		delete(r.handles, id)
+		if err != nil && r.ctx.Err() != nil {
+			glog.Warningf("The fence job for instance: %s was interrupted by the drain, error: %s", id, err)
+			r.interrupted = append(r.interrupted, *job)
+		}
+		close(x.done)
+		r.Unlock()
+	}
+}
+
+// copyAddresses ... copies the addresses, so the callers never share the slices we hold
+func copyAddresses(addresses []string) []string {
+	if addresses == nil {
+		return nil
+	}
+	list := make([]string, len(addresses))
+	copy(list, addresses)
+	return list
+}
+
+// mergeAddresses ... returns the union of the addresses, in the order given
+func mergeAddresses(addresses, additional []string) []string {
+	list := copyAddresses(addresses)
+	for _, x := range additional {
+		found := false
+		for _, y := range list {
+			if x == y {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, x)
+		}
+	}
+	return list
+}
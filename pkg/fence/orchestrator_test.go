@@ -0,0 +1,371 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fence
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/queue"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingHandler ... a handler which records the jobs and blocks until released
+type blockingHandler struct {
+	sync.Mutex
+	// the jobs handled, in the order started
+	jobs []queue.FenceJob
+	// the number of handlers presently running
+	running int
+	// the most handlers seen running at once
+	peak int
+	// closed to release the handlers
+	releaseCh chan struct{}
+	// the error returned by the handler
+	err error
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{releaseCh: make(chan struct{})}
+}
+
+func (r *blockingHandler) handle(ctx context.Context, job *queue.FenceJob) error {
+	r.Lock()
+	r.jobs = append(r.jobs, *job)
+	r.running++
+	if r.running > r.peak {
+		r.peak = r.running
+	}
+	r.Unlock()
+
+	defer func() {
+		r.Lock()
+		r.running--
+		r.Unlock()
+	}()
+
+	select {
+	case <-r.releaseCh:
+		return r.err
+	case <-ctx.Done():
+		return fmt.Errorf("interrupted")
+	}
+}
+
+func (r *blockingHandler) started() []queue.FenceJob {
+	r.Lock()
+	defer r.Unlock()
+	return append([]queue.FenceJob{}, r.jobs...)
+}
+
+func newTestOrchestrator(t *testing.T, workers int, handler Handler) OrchestratorInterface {
+	service, err := NewOrchestrator(Config{Workers: workers, Handler: handler})
+	if err != nil {
+		t.Fatalf("unable to create the orchestrator, error: %s", err)
+	}
+	return service
+}
+
+// waitFor ... waits for the condition to become true
+func waitFor(t *testing.T, condition func() bool) {
+	timeout := time.After(time.Duration(5) * time.Second)
+	for !condition() {
+		select {
+		case <-timeout:
+			t.Fatalf("timed out waiting for the condition")
+		case <-time.After(time.Duration(5) * time.Millisecond):
+		}
+	}
+}
+
+func newJob(id string, addresses ...string) *queue.FenceJob {
+	return &queue.FenceJob{InstanceID: id, Addresses: addresses}
+}
+
+func TestNewOrchestratorValidation(t *testing.T) {
+	_, err := NewOrchestrator(Config{Workers: 0, Handler: newBlockingHandler().handle})
+	assert.Error(t, err)
+	_, err = NewOrchestrator(Config{Workers: 1})
+	assert.Error(t, err)
+}
+
+func TestNodes(t *testing.T) {
+	service := newTestOrchestrator(t, 1, newBlockingHandler().handle)
+	defer service.Drain(time.Second)
+
+	addresses := []string{"10.0.0.1"}
+	service.SetNode("i-1", addresses)
+	service.SetNode("i-2", []string{"10.0.0.2", "10.0.0.3"})
+	// step: the caller should not be able to change the addresses we hold
+	addresses[0] = "10.0.0.9"
+
+	found, ok := service.GetNode("i-1")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"10.0.0.1"}, found)
+	assert.Equal(t, 2, len(service.Nodes()))
+
+	id, inuse := service.AddressInUse("10.0.0.3", "")
+	assert.True(t, inuse)
+	assert.Equal(t, "i-2", id)
+	_, inuse = service.AddressInUse("10.0.0.3", "i-2")
+	assert.False(t, inuse)
+
+	service.RemoveNode("i-1")
+	_, ok = service.GetNode("i-1")
+	assert.False(t, ok)
+	_, inuse = service.AddressInUse("10.0.0.1", "")
+	assert.False(t, inuse)
+}
+
+func TestSubmitDeduplicates(t *testing.T) {
+	handler := newBlockingHandler()
+	service := newTestOrchestrator(t, 1, handler.handle)
+	defer service.Drain(time.Second)
+
+	// step: occupy the only worker so the following jobs remain pending
+	accepted, err := service.Submit(newJob("i-busy", "10.0.0.9"))
+	assert.NoError(t, err)
+	assert.True(t, accepted)
+	waitFor(t, func() bool { return len(service.Running()) == 1 })
+
+	accepted, _ = service.Submit(newJob("i-1", "10.0.0.1"))
+	assert.True(t, accepted)
+	duplicate := newJob("i-1", "10.0.0.1", "10.0.0.2")
+	duplicate.Force = true
+	accepted, err = service.Submit(duplicate)
+	assert.NoError(t, err)
+	assert.False(t, accepted)
+
+	pending := service.Pending()
+	if assert.Equal(t, 1, len(pending)) {
+		assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, pending[0].Addresses)
+		assert.True(t, pending[0].Force)
+	}
+	assert.True(t, service.Active("i-1"))
+	assert.True(t, service.Active("i-busy"))
+	assert.False(t, service.Active("i-2"))
+
+	// step: a job for a node being fenced is dropped
+	accepted, err = service.Submit(newJob("i-busy", "10.0.0.8"))
+	assert.NoError(t, err)
+	assert.False(t, accepted)
+	assert.Equal(t, 1, len(service.Pending()))
+
+	close(handler.releaseCh)
+	waitFor(t, func() bool { return !service.Active("i-1") && !service.Active("i-busy") })
+	assert.Equal(t, 2, len(handler.started()))
+}
+
+func TestSubmitOrder(t *testing.T) {
+	handler := newBlockingHandler()
+	close(handler.releaseCh)
+	gate := make(chan struct{})
+	service := newTestOrchestrator(t, 1, func(ctx context.Context, job *queue.FenceJob) error {
+		<-gate
+		return handler.handle(ctx, job)
+	})
+	defer service.Drain(time.Second)
+
+	for i := 0; i < 5; i++ {
+		service.Submit(newJob(fmt.Sprintf("i-%d", i)))
+	}
+	close(gate)
+	waitFor(t, func() bool { return len(handler.started()) == 5 })
+
+	for i, job := range handler.started() {
+		assert.Equal(t, fmt.Sprintf("i-%d", i), job.InstanceID)
+	}
+}
+
+func TestWorkersBounded(t *testing.T) {
+	handler := newBlockingHandler()
+	service := newTestOrchestrator(t, 3, handler.handle)
+	defer service.Drain(time.Second)
+
+	for i := 0; i < 10; i++ {
+		service.Submit(newJob(fmt.Sprintf("i-%d", i)))
+	}
+	waitFor(t, func() bool { return len(service.Running()) == 3 })
+	assert.Equal(t, 7, len(service.Pending()))
+
+	close(handler.releaseCh)
+	waitFor(t, func() bool { return len(handler.started()) == 10 && len(service.Running()) == 0 })
+	handler.Lock()
+	defer handler.Unlock()
+	assert.Equal(t, 3, handler.peak)
+}
+
+func TestUpdate(t *testing.T) {
+	handler := newBlockingHandler()
+	service := newTestOrchestrator(t, 1, handler.handle)
+	defer close(handler.releaseCh)
+	defer service.Drain(time.Second)
+
+	service.Submit(newJob("i-1", "10.0.0.1"))
+	waitFor(t, func() bool { return len(service.Running()) == 1 })
+
+	job := newJob("i-1", "10.0.0.1")
+	job.Attempts = 2
+	service.Update(job)
+	assert.Equal(t, 2, service.Running()["i-1"].Attempts)
+
+	// step: updates to jobs which are not running are ignored
+	service.Update(newJob("i-2"))
+	_, found := service.Running()["i-2"]
+	assert.False(t, found)
+}
+
+func TestDrain(t *testing.T) {
+	handler := newBlockingHandler()
+	service := newTestOrchestrator(t, 1, handler.handle)
+
+	service.Submit(newJob("i-1", "10.0.0.1"))
+	waitFor(t, func() bool { return len(service.Running()) == 1 })
+	service.Submit(newJob("i-2", "10.0.0.2"))
+
+	// step: the running job is interrupted and the pending one never started
+	unfinished := service.Drain(time.Second)
+	if assert.Equal(t, 2, len(unfinished)) {
+		assert.Equal(t, "i-2", unfinished[0].InstanceID)
+		assert.Equal(t, "i-1", unfinished[1].InstanceID)
+	}
+	assert.Equal(t, 1, len(handler.started()))
+
+	_, err := service.Submit(newJob("i-3"))
+	assert.Equal(t, ErrShuttingDown, err)
+	assert.Nil(t, service.Drain(time.Second))
+}
+
+func TestDrainFinished(t *testing.T) {
+	handler := newBlockingHandler()
+	service := newTestOrchestrator(t, 1, func(ctx context.Context, job *queue.FenceJob) error {
+		// step: a handler which finishes successfully regardless of the drain
+		<-ctx.Done()
+		return nil
+	})
+
+	service.Submit(newJob("i-1"))
+	waitFor(t, func() bool { return len(service.Running()) == 1 })
+	assert.Equal(t, 0, len(service.Drain(time.Second)))
+	assert.Equal(t, 0, len(handler.started()))
+}
+
+func TestDrainDeadline(t *testing.T) {
+	releaseCh := make(chan struct{})
+	defer close(releaseCh)
+	service := newTestOrchestrator(t, 1, func(ctx context.Context, job *queue.FenceJob) error {
+		// step: a handler which ignores the drain
+		<-releaseCh
+		return nil
+	})
+
+	job := newJob("i-1")
+	service.Submit(job)
+	waitFor(t, func() bool { return len(service.Running()) == 1 })
+	job.Attempts = 3
+	service.Update(job)
+
+	started := time.Now()
+	unfinished := service.Drain(time.Duration(50) * time.Millisecond)
+	assert.True(t, time.Since(started) < time.Second)
+	if assert.Equal(t, 1, len(unfinished)) {
+		assert.Equal(t, "i-1", unfinished[0].InstanceID)
+		assert.Equal(t, 3, unfinished[0].Attempts)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	handler := newBlockingHandler()
+	service := newTestOrchestrator(t, 1, handler.handle)
+
+	service.Submit(newJob("i-1"))
+	waitFor(t, func() bool { return len(service.Running()) == 1 })
+	service.Submit(newJob("i-2"))
+
+	// step: the running job is interrupted and the pending one dropped
+	unfinished := service.Cancel(time.Second)
+	var ids []string
+	for _, x := range unfinished {
+		ids = append(ids, x.InstanceID)
+	}
+	assert.ElementsMatch(t, []string{"i-1", "i-2"}, ids)
+	assert.Equal(t, 0, len(service.Running()))
+	assert.Equal(t, 0, len(service.Pending()))
+	assert.Equal(t, 1, len(handler.started()))
+
+	// step: unlike the drain, we carry on accepting jobs
+	close(handler.releaseCh)
+	submitted, err := service.Submit(newJob("i-3"))
+	assert.NoError(t, err)
+	assert.True(t, submitted)
+	waitFor(t, func() bool { return len(handler.started()) == 2 && len(service.Running()) == 0 })
+	assert.Equal(t, 0, len(service.Cancel(time.Second)))
+}
+
+func TestCancelDeadline(t *testing.T) {
+	releaseCh := make(chan struct{})
+	defer close(releaseCh)
+	service := newTestOrchestrator(t, 1, func(ctx context.Context, job *queue.FenceJob) error {
+		// step: a handler which ignores the cancellation
+		<-releaseCh
+		return nil
+	})
+
+	service.Submit(newJob("i-1"))
+	waitFor(t, func() bool { return len(service.Running()) == 1 })
+	started := time.Now()
+	unfinished := service.Cancel(time.Duration(50) * time.Millisecond)
+	assert.True(t, time.Since(started) < time.Second)
+	if assert.Equal(t, 1, len(unfinished)) {
+		assert.Equal(t, "i-1", unfinished[0].InstanceID)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	handler := newBlockingHandler()
+	close(handler.releaseCh)
+	service := newTestOrchestrator(t, 4, handler.handle)
+
+	var group sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		group.Add(1)
+		go func(n int) {
+			defer group.Done()
+			for j := 0; j < 50; j++ {
+				id := fmt.Sprintf("i-%d", j%10)
+				address := fmt.Sprintf("10.0.%d.%d", n, j)
+				service.SetNode(id, []string{address})
+				service.Submit(newJob(id, address))
+				service.AddressInUse(address, "")
+				service.Nodes()
+				service.Pending()
+				service.Running()
+				service.RemoveNode(id)
+			}
+		}(i)
+	}
+	group.Wait()
+	waitFor(t, func() bool { return len(service.Pending()) == 0 && len(service.Running()) == 0 })
+	assert.Equal(t, 0, len(service.Drain(time.Second)))
+
+	// step: never more than one job for a node at a time, so no more jobs than submitted
+	assert.True(t, len(handler.started()) <= 8*50)
+}
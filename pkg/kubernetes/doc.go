@@ -0,0 +1,118 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Config ... the configuration for the kubernetes node event source
+type Config struct {
+	// the url of the kubernetes api server
+	APIServer string
+	// the path to a file containing the bearer token
+	TokenFile string
+	// the path to the certificate authority of the api server
+	CAFile string
+	// skip the verification of the api server certificate
+	Insecure bool
+	// the duration a node must be not ready before it's considered stopped
+	GracePeriod time.Duration
+	// a label selector used to filter the nodes
+	LabelSelector string
+}
+
+// the types of watch event
+const (
+	watchAdded    = "ADDED"
+	watchModified = "MODIFIED"
+	watchDeleted  = "DELETED"
+	watchError    = "ERROR"
+)
+
+// objectMeta ... the metadata of a kubernetes object
+type objectMeta struct {
+	// the name of the object
+	Name string `json:"name"`
+	// the resource version of the object
+	ResourceVersion string `json:"resourceVersion"`
+	// the labels on the object
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// nodeCondition ... the condition of a node
+type nodeCondition struct {
+	// the type of condition, i.e. Ready
+	Type string `json:"type"`
+	// the status of the condition, True, False or Unknown
+	Status string `json:"status"`
+	// the time the condition last changed
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+}
+
+// nodeAddress ... an address of a node
+type nodeAddress struct {
+	// the type of address, i.e. InternalIP
+	Type string `json:"type"`
+	// the address
+	Address string `json:"address"`
+}
+
+// nodeStatus ... the status of a node
+type nodeStatus struct {
+	// the conditions of the node
+	Conditions []nodeCondition `json:"conditions,omitempty"`
+	// the addresses of the node
+	Addresses []nodeAddress `json:"addresses,omitempty"`
+}
+
+// node ... the structure of a kubernetes node
+type node struct {
+	// the metadata of the node
+	Metadata objectMeta `json:"metadata"`
+	// the status of the node
+	Status nodeStatus `json:"status"`
+}
+
+// nodeList ... the structure of a list of nodes
+type nodeList struct {
+	// the metadata of the list
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	// the nodes
+	Items []node `json:"items"`
+}
+
+// watchEvent ... the structure of an event from a watch
+type watchEvent struct {
+	// the type of event
+	Type string `json:"type"`
+	// the object, a node or a status on error
+	Object json.RawMessage `json:"object"`
+}
+
+// apiStatus ... the structure of an error from the api server
+type apiStatus struct {
+	// the reason for the failure
+	Reason string `json:"reason"`
+	// a message describing the failure
+	Message string `json:"message"`
+	// the http code
+	Code int `json:"code"`
+}
@@ -0,0 +1,575 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/membership"
+	"github.com/gambol99/rbd-fence/pkg/metrics"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// the name of the event source
+	sourceName = "kubernetes"
+	// the location of the service account credentials when running inside a pod
+	serviceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// the timeout we ask the api server to close a watch after
+	watchTimeout = 5 * time.Minute
+)
+
+var kubeConfig Config
+
+func init() {
+	flag.StringVar(&kubeConfig.APIServer, "kube-api", defaultAPIServer(), "the url of the kubernetes api server")
+	flag.StringVar(&kubeConfig.TokenFile, "kube-token-file", defaultServiceAccountFile("token"), "the path to a file containing the bearer token for the api server")
+	flag.StringVar(&kubeConfig.CAFile, "kube-ca-file", defaultServiceAccountFile("ca.crt"), "the path to the certificate authority for the api server")
+	flag.BoolVar(&kubeConfig.Insecure, "kube-insecure", false, "skip the verification of the api server certificate")
+	flag.DurationVar(&kubeConfig.GracePeriod, "kube-grace", time.Duration(5)*time.Minute, "the duration a node must be not ready before it's considered stopped")
+	flag.StringVar(&kubeConfig.LabelSelector, "kube-selector", "", "a label selector used to filter the nodes we are interested in")
+
+	membership.Register(sourceName, func() (membership.EventSource, error) {
+		return NewNodeEventsInterface(kubeConfig)
+	})
+}
+
+// the implementation of a membership event source for kubernetes nodes
+type kubeNodes struct {
+	sync.RWMutex
+	// the configuration
+	config Config
+	// the http client for the api server
+	client *http.Client
+	// the bearer token, if any
+	token string
+	// a list of listeners for node events
+	listeners []*eventListener
+	// the nodes we are tracking
+	nodes map[string]*trackedNode
+	// the resource version we are watching from
+	resourceVersion string
+	// the context for all our requests, cancelled on stop
+	ctx context.Context
+	// cancel the context
+	cancel context.CancelFunc
+}
+
+// eventListener ... a consumer of the events, the events are delivered in the order they occurred
+type eventListener struct {
+	sync.Mutex
+	// the filter on the events
+	filter int
+	// the channel the consumer receives on
+	ch membership.EventCh
+	// the events waiting to be delivered
+	pending []*membership.NodeEvent
+	// signalled when events are added
+	notify chan struct{}
+}
+
+// trackedNode ... the state of a node we are tracking
+type trackedNode struct {
+	// the node as it was last seen
+	node membership.Node
+	// the time the node became not ready, zero if ready
+	notReadySince time.Time
+}
+
+// NewNodeEventsInterface ... creates a new event source which watches the nodes in kubernetes
+func NewNodeEventsInterface(config Config) (membership.EventSource, error) {
+	glog.Infof("Creating a new Kubernetes node events interface, api: %s, grace: %s", config.APIServer, config.GracePeriod)
+	if config.APIServer == "" {
+		return nil, fmt.Errorf("you have not specified the kubernetes api server")
+	}
+	if _, err := url.Parse(config.APIServer); err != nil {
+		return nil, fmt.Errorf("invalid kubernetes api server: %s, error: %s", config.APIServer, err)
+	}
+
+	service := &kubeNodes{
+		config:    config,
+		listeners: make([]*eventListener, 0),
+		nodes:     make(map[string]*trackedNode, 0),
+	}
+	service.ctx, service.cancel = context.WithCancel(context.Background())
+
+	// step: load the credentials
+	if config.TokenFile != "" {
+		content, err := ioutil.ReadFile(config.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the token file: %s, error: %s", config.TokenFile, err)
+		}
+		service.token = strings.TrimSpace(string(content))
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.Insecure}
+	if config.CAFile != "" {
+		content, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the certificate authority: %s, error: %s", config.CAFile, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificates found in the certificate authority: %s", config.CAFile)
+		}
+	}
+	service.client = &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+
+	// step: grab an initial state of the nodes
+	if err := service.bootstrapNodes(3); err != nil {
+		return nil, fmt.Errorf("failed to bootstrap service, unable to retrieve the nodes, error: %s", err)
+	}
+
+	// step: start watching for changes
+	go service.synchronize()
+	go service.checkGracePeriods()
+
+	return service, nil
+}
+
+// AddEventListener ... add a event listener to the list of consumers
+func (r *kubeNodes) AddEventListener(filter int) membership.EventCh {
+	// step: make a buffered channel for them
+	listener := &eventListener{
+		filter:  filter,
+		ch:      make(membership.EventCh, 10),
+		pending: make([]*membership.NodeEvent, 0),
+		notify:  make(chan struct{}, 1),
+	}
+	glog.V(4).Infof("Adding a event listner, channel: %v, filter: %s", listener.ch, membership.FilterToString(filter))
+	go listener.forward()
+
+	r.Lock()
+	defer r.Unlock()
+	r.listeners = append(r.listeners, listener)
+
+	return listener.ch
+}
+
+// GetRunningNodes ... returns the nodes which are running
+func (r *kubeNodes) GetRunningNodes() map[string]membership.Node {
+	r.RLock()
+	defer r.RUnlock()
+	list := make(map[string]membership.Node, 0)
+	for name, x := range r.nodes {
+		if x.node.State == membership.StateRunning {
+			list[name] = x.node
+		}
+	}
+	return list
+}
+
+// stop ... stops watching the api server
+func (r *kubeNodes) stop() {
+	r.cancel()
+}
+
+// bootstrapNodes ... retrieves the current state of the nodes, no events are generated for them
+func (r *kubeNodes) bootstrapNodes(maxAttempts int) error {
+	var err error
+	for i := 0; i < maxAttempts; i++ {
+		glog.V(4).Infof("Attempting to retrieve the current nodes from api, attempt: %d", i)
+		if err = r.listNodes(false); err == nil {
+			return nil
+		}
+		glog.Errorf("Failed to retrieve the nodes, error: %s", err)
+		if i < maxAttempts-1 {
+			<-time.After(time.Duration(2) * time.Second)
+		}
+	}
+	return err
+}
+
+// synchronize ... the main loop, watches the nodes for changes, relisting when the watch fails
+func (r *kubeNodes) synchronize() {
+	for {
+		err := r.watchNodes()
+		if r.ctx.Err() != nil {
+			glog.V(4).Infof("Stopping the kubernetes node watcher")
+			return
+		}
+		if err != nil {
+			glog.Errorf("The watch on the kubernetes nodes failed, error: %s", err)
+			<-time.After(time.Duration(2) * time.Second)
+			// step: relist the nodes so we don't miss anything while we were not watching
+			if err := r.listNodes(true); err != nil {
+				glog.Errorf("Failed to relist the kubernetes nodes, error: %s", err)
+			}
+		}
+	}
+}
+
+// listNodes ... lists the nodes and updates our state, any nodes which have disappeared are deleted
+func (r *kubeNodes) listNodes(notify bool) error {
+	resp, err := r.request(r.nodesURL(false))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	list := new(nodeList)
+	if err := json.NewDecoder(resp.Body).Decode(list); err != nil {
+		return err
+	}
+
+	found := make(map[string]bool, 0)
+	for _, x := range list.Items {
+		found[x.Metadata.Name] = true
+		r.updateNode(x, notify)
+	}
+	// step: remove any nodes which no longer exist
+	for _, name := range r.getNodeNames() {
+		if !found[name] {
+			r.deleteNode(name, notify)
+		}
+	}
+	r.setResourceVersion(list.Metadata.ResourceVersion)
+
+	glog.V(5).Infof("Found %d nodes, resource version: %s", len(list.Items), list.Metadata.ResourceVersion)
+
+	return nil
+}
+
+// watchNodes ... watches the nodes from the last resource version, returning when the watch is closed
+func (r *kubeNodes) watchNodes() error {
+	resp, err := r.request(r.nodesURL(true))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := new(watchEvent)
+		if err := decoder.Decode(event); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		switch event.Type {
+		case watchAdded, watchModified, watchDeleted:
+			item := node{}
+			if err := json.Unmarshal(event.Object, &item); err != nil {
+				return fmt.Errorf("unable to decode the node, error: %s", err)
+			}
+			if event.Type == watchDeleted {
+				r.deleteNode(item.Metadata.Name, true)
+			} else {
+				r.updateNode(item, true)
+			}
+			r.setResourceVersion(item.Metadata.ResourceVersion)
+		case watchError:
+			status := apiStatus{}
+			json.Unmarshal(event.Object, &status)
+			return fmt.Errorf("watch error, code: %d, reason: %s, message: %s", status.Code, status.Reason, status.Message)
+		default:
+			glog.Warningf("Unknown watch event type: %s", event.Type)
+		}
+	}
+}
+
+// checkGracePeriods ... periodically checks for nodes which have been not ready for longer than the grace period
+func (r *kubeNodes) checkGracePeriods() {
+	interval := r.config.GracePeriod / 4
+	if interval > time.Duration(10)*time.Second {
+		interval = time.Duration(10) * time.Second
+	}
+	if interval < time.Duration(50)*time.Millisecond {
+		interval = time.Duration(50) * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			for _, name := range r.getNodeNames() {
+				r.checkNode(name)
+			}
+		}
+	}
+}
+
+// updateNode ... updates the state of the node, sending an event if the state changed
+func (r *kubeNodes) updateNode(item node, notify bool) {
+	name := item.Metadata.Name
+	ready, since := item.readiness()
+
+	r.Lock()
+	tracked, found := r.nodes[name]
+	if !found {
+		tracked = &trackedNode{}
+		r.nodes[name] = tracked
+	}
+	previous := tracked.node.State
+	tracked.node = membership.Node{
+		ID:        name,
+		Addresses: item.internalAddresses(),
+		State:     previous,
+		Labels:    item.Metadata.Labels,
+	}
+
+	switch ready {
+	case true:
+		tracked.notReadySince = time.Time{}
+		tracked.node.State = membership.StateRunning
+	default:
+		if tracked.notReadySince.IsZero() {
+			tracked.notReadySince = since
+		}
+		if tracked.node.State == "" {
+			tracked.node.State = membership.StateRunning
+		}
+		if r.hasExpired(tracked) {
+			tracked.node.State = membership.StateStopped
+		}
+	}
+	current := tracked.node
+	r.Unlock()
+
+	if !found {
+		glog.V(2).Infof("Found a new node: %s, current state: %s", name, current.State)
+	}
+	if previous != current.State {
+		glog.V(3).Infof("State change for node: %s, from: '%s' to: %s", name, previous, current.State)
+		if notify {
+			r.sendEvent(current)
+		}
+	}
+}
+
+// checkNode ... checks if the node has exceeded the grace period
+func (r *kubeNodes) checkNode(name string) {
+	r.Lock()
+	tracked, found := r.nodes[name]
+	if !found || tracked.node.State != membership.StateRunning || !r.hasExpired(tracked) {
+		r.Unlock()
+		return
+	}
+	tracked.node.State = membership.StateStopped
+	current := tracked.node
+	since := tracked.notReadySince
+	r.Unlock()
+
+	glog.Infof("The node: %s has been not ready since: %s, exceeding the grace period", name, since)
+	r.sendEvent(current)
+}
+
+// deleteNode ... removes the node, sending a terminated event
+func (r *kubeNodes) deleteNode(name string, notify bool) {
+	r.Lock()
+	tracked, found := r.nodes[name]
+	if !found {
+		r.Unlock()
+		return
+	}
+	delete(r.nodes, name)
+	tracked.node.State = membership.StateTerminated
+	r.Unlock()
+
+	glog.V(2).Infof("The node: %s has been deleted", name)
+	if notify {
+		r.sendEvent(tracked.node)
+	}
+}
+
+// hasExpired ... checks if a not ready node has exceeded the grace period, the lock must be held
+func (r *kubeNodes) hasExpired(tracked *trackedNode) bool {
+	if tracked.notReadySince.IsZero() {
+		return false
+	}
+	return time.Since(tracked.notReadySince) >= r.config.GracePeriod
+}
+
+// sendEvent ... iterates the listeners and sends the event to those interested
+func (r *kubeNodes) sendEvent(current membership.Node) {
+	state := membership.StateToFilter(current.State)
+	event := &membership.NodeEvent{
+		ID:        current.ID,
+		EventType: state,
+		Source:    sourceName,
+		Node:      current,
+		Detected:  time.Now(),
+	}
+
+	r.RLock()
+	defer r.RUnlock()
+	for _, listener := range r.listeners {
+		if state&listener.filter != 0 {
+			// step: queue the event for the consumer, we never block on a slow consumer
+			listener.enqueue(event)
+			metrics.EventsDelivered.WithLabelValues(sourceName, membership.FilterToString(listener.filter)).Inc()
+		}
+	}
+}
+
+// enqueue ... adds the event to the pending events, the source never blocks on a slow consumer
+func (r *eventListener) enqueue(event *membership.NodeEvent) {
+	r.Lock()
+	r.pending = append(r.pending, event)
+	r.Unlock()
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// forward ... delivers the pending events to the consumer in order
+func (r *eventListener) forward() {
+	for range r.notify {
+		for {
+			r.Lock()
+			if len(r.pending) <= 0 {
+				r.Unlock()
+				break
+			}
+			event := r.pending[0]
+			r.pending = r.pending[1:]
+			r.Unlock()
+
+			glog.V(5).Infof("Sending the event: %s to consumer: %v", event, r.ch)
+			r.ch <- event
+		}
+	}
+}
+
+// getNodeNames ... returns the names of the nodes we are tracking
+func (r *kubeNodes) getNodeNames() []string {
+	r.RLock()
+	defer r.RUnlock()
+	var names []string
+	for name := range r.nodes {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (r *kubeNodes) setResourceVersion(version string) {
+	r.Lock()
+	defer r.Unlock()
+	if version != "" {
+		r.resourceVersion = version
+	}
+}
+
+// nodesURL ... constructs the url for listing or watching the nodes
+func (r *kubeNodes) nodesURL(watch bool) string {
+	params := url.Values{}
+	if r.config.LabelSelector != "" {
+		params.Set("labelSelector", r.config.LabelSelector)
+	}
+	if watch {
+		r.RLock()
+		params.Set("resourceVersion", r.resourceVersion)
+		r.RUnlock()
+		params.Set("watch", "true")
+		params.Set("timeoutSeconds", fmt.Sprintf("%d", int(watchTimeout.Seconds())))
+	}
+	return fmt.Sprintf("%s/api/v1/nodes?%s", strings.TrimSuffix(r.config.APIServer, "/"), params.Encode())
+}
+
+// request ... performs a get request against the api server
+func (r *kubeNodes) request(uri string) (*http.Response, error) {
+	glog.V(5).Infof("Making a request to the api server: %s", uri)
+	request, err := http.NewRequestWithContext(r.ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "application/json")
+	if r.token != "" {
+		request.Header.Set("Authorization", "Bearer "+r.token)
+	}
+
+	resp, err := r.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		status := apiStatus{}
+		json.NewDecoder(resp.Body).Decode(&status)
+		return nil, fmt.Errorf("unexpected response from api server, code: %d, message: %s", resp.StatusCode, status.Message)
+	}
+
+	return resp, nil
+}
+
+// readiness ... returns if the node is ready and when the ready condition last changed
+func (r node) readiness() (bool, time.Time) {
+	for _, x := range r.Status.Conditions {
+		if x.Type == "Ready" {
+			since := x.LastTransitionTime
+			if since.IsZero() {
+				since = time.Now()
+			}
+			return x.Status == "True", since
+		}
+	}
+	return false, time.Now()
+}
+
+// internalAddresses ... returns the internal ip addresses of the node
+func (r node) internalAddresses() []string {
+	list := make([]string, 0)
+	for _, x := range r.Status.Addresses {
+		if x.Type == "InternalIP" {
+			list = append(list, x.Address)
+		}
+	}
+	return list
+}
+
+// defaultAPIServer ... returns the api server when running inside a pod
+func defaultAPIServer() string {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return "http://127.0.0.1:8080"
+	}
+	return "https://" + net.JoinHostPort(host, port)
+}
+
+// defaultServiceAccountFile ... returns the path to the service account file if it exists
+func defaultServiceAccountFile(name string) string {
+	path := serviceAccountPath + "/" + name
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
@@ -0,0 +1,340 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/membership"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testGrace   = time.Duration(200) * time.Millisecond
+	testTimeout = time.Duration(5) * time.Second
+	testToken   = "s3cr3t"
+)
+
+// fakeAPIServer ... a minimal stand-in for the kubernetes api server, serving the node list and watch
+type fakeAPIServer struct {
+	sync.Mutex
+	// the nodes in the cluster
+	nodes map[string]node
+	// the current resource version
+	version int
+	// the active watches
+	watchers []chan watchEvent
+	// signalled each time a watch is established
+	watching chan struct{}
+	// the http server
+	server *httptest.Server
+}
+
+func newFakeAPIServer(nodes ...node) *fakeAPIServer {
+	api := &fakeAPIServer{
+		nodes:    make(map[string]node, 0),
+		watching: make(chan struct{}, 10),
+	}
+	for _, x := range nodes {
+		api.version++
+		x.Metadata.ResourceVersion = fmt.Sprintf("%d", api.version)
+		api.nodes[x.Metadata.Name] = x
+	}
+	api.server = httptest.NewServer(http.HandlerFunc(api.handle))
+	return api
+}
+
+func (r *fakeAPIServer) handle(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != "Bearer "+testToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(apiStatus{Code: http.StatusUnauthorized, Message: "Unauthorized"})
+		return
+	}
+	if req.URL.Path != "/api/v1/nodes" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if req.URL.Query().Get("watch") == "true" {
+		r.watch(w, req)
+		return
+	}
+
+	r.Lock()
+	list := nodeList{}
+	list.Metadata.ResourceVersion = fmt.Sprintf("%d", r.version)
+	for _, x := range r.nodes {
+		list.Items = append(list.Items, x)
+	}
+	r.Unlock()
+	json.NewEncoder(w).Encode(list)
+}
+
+func (r *fakeAPIServer) watch(w http.ResponseWriter, req *http.Request) {
+	ch := make(chan watchEvent, 10)
+	r.Lock()
+	r.watchers = append(r.watchers, ch)
+	r.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	r.watching <- struct{}{}
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case event := <-ch:
+			json.NewEncoder(w).Encode(event)
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+// update ... adds or updates the node, notifying any watchers
+func (r *fakeAPIServer) update(x node) {
+	r.Lock()
+	defer r.Unlock()
+	eventType := watchModified
+	if _, found := r.nodes[x.Metadata.Name]; !found {
+		eventType = watchAdded
+	}
+	r.version++
+	x.Metadata.ResourceVersion = fmt.Sprintf("%d", r.version)
+	r.nodes[x.Metadata.Name] = x
+	r.notify(eventType, x)
+}
+
+// remove ... deletes the node, notifying any watchers
+func (r *fakeAPIServer) remove(name string) {
+	r.Lock()
+	defer r.Unlock()
+	x := r.nodes[name]
+	delete(r.nodes, name)
+	r.version++
+	x.Metadata.ResourceVersion = fmt.Sprintf("%d", r.version)
+	r.notify(watchDeleted, x)
+}
+
+func (r *fakeAPIServer) notify(eventType string, x node) {
+	content, _ := json.Marshal(x)
+	for _, ch := range r.watchers {
+		ch <- watchEvent{Type: eventType, Object: content}
+	}
+}
+
+func (r *fakeAPIServer) waitForWatch(t *testing.T) {
+	select {
+	case <-r.watching:
+	case <-time.After(testTimeout):
+		t.Fatalf("the source never started watching the nodes")
+	}
+}
+
+func newTestNode(name, address string, ready bool, since time.Time) node {
+	status := "False"
+	if ready {
+		status = "True"
+	}
+	x := node{}
+	x.Metadata.Name = name
+	x.Metadata.Labels = map[string]string{"role": "worker"}
+	x.Status.Addresses = []nodeAddress{
+		{Type: "Hostname", Address: name},
+		{Type: "ExternalIP", Address: "203.0.113.10"},
+		{Type: "InternalIP", Address: address},
+	}
+	x.Status.Conditions = []nodeCondition{
+		{Type: "MemoryPressure", Status: "False", LastTransitionTime: since},
+		{Type: "Ready", Status: status, LastTransitionTime: since},
+	}
+	return x
+}
+
+func newTestSource(t *testing.T, api *fakeAPIServer) *kubeNodes {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte(testToken+"\n"), 0600); err != nil {
+		t.Fatalf("unable to write the token file, error: %s", err)
+	}
+	source, err := NewNodeEventsInterface(Config{
+		APIServer:   api.server.URL,
+		TokenFile:   tokenFile,
+		GracePeriod: testGrace,
+	})
+	if err != nil {
+		t.Fatalf("unable to create the event source, error: %s", err)
+	}
+	return source.(*kubeNodes)
+}
+
+func waitForEvent(t *testing.T, ch membership.EventCh) *membership.NodeEvent {
+	select {
+	case event := <-ch:
+		return event
+	case <-time.After(testTimeout):
+		t.Fatalf("timed out waiting for an event")
+	}
+	return nil
+}
+
+func TestBootstrapRunningNodes(t *testing.T) {
+	api := newFakeAPIServer(
+		newTestNode("node1", "10.0.0.1", true, time.Now()),
+		newTestNode("node2", "10.0.0.2", true, time.Now()),
+		newTestNode("node3", "10.0.0.3", false, time.Now().Add(-time.Hour)),
+	)
+	defer api.server.Close()
+	source := newTestSource(t, api)
+	defer source.stop()
+
+	nodes := source.GetRunningNodes()
+	assert.Equal(t, 2, len(nodes))
+	assert.Equal(t, []string{"10.0.0.1"}, nodes["node1"].Addresses)
+	assert.Equal(t, []string{"10.0.0.2"}, nodes["node2"].Addresses)
+	assert.Equal(t, "worker", nodes["node1"].Labels["role"])
+	assert.Equal(t, membership.StateRunning, nodes["node1"].State)
+}
+
+func TestBadCredentials(t *testing.T) {
+	api := newFakeAPIServer(newTestNode("node1", "10.0.0.1", true, time.Now()))
+	defer api.server.Close()
+	_, err := NewNodeEventsInterface(Config{APIServer: api.server.URL, GracePeriod: testGrace})
+	assert.Error(t, err)
+}
+
+func TestNodeNotReadyPastGrace(t *testing.T) {
+	api := newFakeAPIServer(newTestNode("node1", "10.0.0.1", true, time.Now()))
+	defer api.server.Close()
+	source := newTestSource(t, api)
+	defer source.stop()
+	stoppedCh := source.AddEventListener(membership.STATUS_STOPPED)
+	api.waitForWatch(t)
+
+	changed := time.Now()
+	api.update(newTestNode("node1", "10.0.0.1", false, changed))
+
+	event := waitForEvent(t, stoppedCh)
+	assert.True(t, time.Since(changed) >= testGrace, "the node was stopped before the grace period")
+	assert.Equal(t, "node1", event.ID)
+	assert.Equal(t, membership.STATUS_STOPPED, event.EventType)
+	assert.Equal(t, sourceName, event.Source)
+	assert.Equal(t, []string{"10.0.0.1"}, event.Node.Addresses)
+	assert.Equal(t, 0, len(source.GetRunningNodes()))
+}
+
+func TestNodeRecoversWithinGrace(t *testing.T) {
+	api := newFakeAPIServer(newTestNode("node1", "10.0.0.1", true, time.Now()))
+	defer api.server.Close()
+	source := newTestSource(t, api)
+	defer source.stop()
+	stoppedCh := source.AddEventListener(membership.STATUS_STOPPED)
+	api.waitForWatch(t)
+
+	api.update(newTestNode("node1", "10.0.0.1", false, time.Now()))
+	api.update(newTestNode("node1", "10.0.0.1", true, time.Now()))
+
+	select {
+	case event := <-stoppedCh:
+		t.Fatalf("the node should not have been stopped, event: %s", event)
+	case <-time.After(testGrace * 2):
+	}
+	assert.Equal(t, 1, len(source.GetRunningNodes()))
+}
+
+func TestNodeDeleted(t *testing.T) {
+	api := newFakeAPIServer(newTestNode("node1", "10.0.0.1", true, time.Now()))
+	defer api.server.Close()
+	source := newTestSource(t, api)
+	defer source.stop()
+	terminatedCh := source.AddEventListener(membership.STATUS_TERMINATED)
+	api.waitForWatch(t)
+
+	api.remove("node1")
+
+	event := waitForEvent(t, terminatedCh)
+	assert.Equal(t, "node1", event.ID)
+	assert.Equal(t, membership.STATUS_TERMINATED, event.EventType)
+	assert.Equal(t, []string{"10.0.0.1"}, event.Node.Addresses)
+	assert.Equal(t, 0, len(source.GetRunningNodes()))
+}
+
+func TestNodeReadyAgain(t *testing.T) {
+	api := newFakeAPIServer(newTestNode("node1", "10.0.0.1", false, time.Now().Add(-time.Hour)))
+	defer api.server.Close()
+	source := newTestSource(t, api)
+	defer source.stop()
+	runningCh := source.AddEventListener(membership.STATUS_RUNNING)
+	api.waitForWatch(t)
+	assert.Equal(t, 0, len(source.GetRunningNodes()))
+
+	api.update(newTestNode("node1", "10.0.0.1", true, time.Now()))
+
+	event := waitForEvent(t, runningCh)
+	assert.Equal(t, "node1", event.ID)
+	assert.Equal(t, membership.STATUS_RUNNING, event.EventType)
+	assert.Equal(t, 1, len(source.GetRunningNodes()))
+}
+
+func TestNewNodeAdded(t *testing.T) {
+	api := newFakeAPIServer()
+	defer api.server.Close()
+	source := newTestSource(t, api)
+	defer source.stop()
+	runningCh := source.AddEventListener(membership.STATUS_RUNNING)
+	api.waitForWatch(t)
+
+	api.update(newTestNode("node2", "10.0.0.2", true, time.Now()))
+
+	event := waitForEvent(t, runningCh)
+	assert.Equal(t, "node2", event.ID)
+	assert.Equal(t, []string{"10.0.0.2"}, event.Node.Addresses)
+}
+
+func TestSlowConsumer(t *testing.T) {
+	api := newFakeAPIServer()
+	defer api.server.Close()
+	source := newTestSource(t, api)
+	defer source.stop()
+	// step: a listener which never reads, beyond the buffer of the channel
+	stuckCh := source.AddEventListener(membership.STATUS_RUNNING)
+	runningCh := source.AddEventListener(membership.STATUS_RUNNING)
+	api.waitForWatch(t)
+
+	for i := 0; i < 25; i++ {
+		api.update(newTestNode(fmt.Sprintf("node%d", i), fmt.Sprintf("10.0.0.%d", i), true, time.Now()))
+	}
+	// step: the other listener and the tracked nodes should not be held up
+	for i := 0; i < 25; i++ {
+		event := waitForEvent(t, runningCh)
+		assert.Equal(t, fmt.Sprintf("node%d", i), event.ID)
+	}
+	assert.Equal(t, 25, len(source.GetRunningNodes()))
+
+	// step: the stuck listener still receives every event in order once it reads
+	for i := 0; i < 25; i++ {
+		event := waitForEvent(t, stuckCh)
+		assert.Equal(t, fmt.Sprintf("node%d", i), event.ID)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package membership
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// event types
+const (
+	STATUS_RUNNING = 1 << iota
+	STATUS_STOPPING
+	STATUS_STOPPED
+	STATUS_SHUTTING_DOWN
+	STATUS_TERMINATED
+	STATUS_PENDING
+	STATUS_UNKNOWN
+)
+
+// the states of a node
+const (
+	StateRunning      = "running"
+	StateStopping     = "stopping"
+	StateStopped      = "stopped"
+	StateShuttingDown = "shutting-down"
+	StateTerminated   = "terminated"
+	StatePending      = "pending"
+	StateUnknown      = "unknown"
+)
+
+// Node ... the provider neutral identity of a member
+type Node struct {
+	// the unique id of the node
+	ID string `json:"id"`
+	// the addresses the node would hold locks from
+	Addresses []string `json:"addresses"`
+	// the current state of the node
+	State string `json:"state"`
+	// any labels associated to the node
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+func (r Node) String() string {
+	return fmt.Sprintf("id: %s, addresses: %s, state: %s", r.ID, strings.Join(r.Addresses, ","), r.State)
+}
+
+// NodeEvent ... the structure for a node event
+type NodeEvent struct {
+	// the node id
+	ID string
+	// the event type
+	EventType int
+	// the name of the source which produced the event
+	Source string
+	// the node as it is now
+	Node Node
+	// the time the change was detected
+	Detected time.Time
+}
+
+func (r NodeEvent) String() string {
+	return fmt.Sprintf("id: %s, type: %d, source: %s", r.ID, r.EventType, r.Source)
+}
+
+// EventCh ... a channel to receive events upon
+type EventCh chan *NodeEvent
+
+// EventSource ... the interface to a source of membership events
+type EventSource interface {
+	// Add a event listener for nodes matching the filter
+	AddEventListener(int) EventCh
+	// Get the running nodes, keyed by the node id
+	GetRunningNodes() map[string]Node
+}
+
+// NodeHistory ... implemented by the event sources able to list the nodes no longer running, i.e. stopped or
+// recently terminated, which would otherwise be unknown to us after a restart
+type NodeHistory interface {
+	// Get the nodes which are no longer running, keyed by the node id
+	GetStoppedNodes() map[string]Node
+}
+
+// Health ... the health of a event source
+type Health struct {
+	// the name of the source
+	Source string `json:"source"`
+	// whether the source is able to observe the nodes
+	Healthy bool `json:"healthy"`
+	// the number of consecutive failures
+	Failures int `json:"failures"`
+	// the last error encountered
+	LastError string `json:"last_error,omitempty"`
+	// the time the source entered the present state
+	Since time.Time `json:"since"`
+	// the health in each of the regions, for the sources observing several
+	Regions map[string]Health `json:"regions,omitempty"`
+}
+
+// HealthReporter ... implemented by the event sources able to report their health
+type HealthReporter interface {
+	// Get the present health of the source
+	Health() Health
+}
+
+// SourceConfig ... the options of a event source which can be changed while running, any option not given
+// keeps it's present value
+type SourceConfig struct {
+	// the interval between the polls of the source, for those which poll
+	Interval time.Duration
+	// the environments the nodes are filtered on
+	Environments []string
+	// the selector expression the nodes are filtered on, for those sources supporting one
+	Selector string
+}
+
+// Reconfigurable ... implemented by the event sources able to apply changes to their options while running
+type Reconfigurable interface {
+	// Apply the options to the source
+	Reconfigure(SourceConfig) error
+}
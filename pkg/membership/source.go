@@ -0,0 +1,101 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package membership
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Factory ... creates a new event source
+type Factory func() (EventSource, error)
+
+var (
+	sourcesLock sync.Mutex
+	// the registered event sources
+	sources = make(map[string]Factory, 0)
+)
+
+// Register ... registers an event source under the name, the sources are expected to register
+// themselves in their init()
+func Register(name string, factory Factory) {
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	if _, found := sources[name]; found {
+		panic(fmt.Sprintf("the event source: %s has already been registered", name))
+	}
+	sources[name] = factory
+}
+
+// Sources ... returns the names of the registered event sources
+func Sources() []string {
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	var list []string
+	for name := range sources {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// NewEventSource ... creates the event source registered under the name
+func NewEventSource(name string) (EventSource, error) {
+	sourcesLock.Lock()
+	factory, found := sources[name]
+	sourcesLock.Unlock()
+	if !found {
+		return nil, fmt.Errorf("unknown event source: %s, available: %s", name, strings.Join(Sources(), ","))
+	}
+	glog.Infof("Creating the event source: %s", name)
+
+	return factory()
+}
+
+// StateToFilter ... converts the state of a node to the event filter
+func StateToFilter(state string) int {
+	switch state {
+	case StateRunning:
+		return STATUS_RUNNING
+	case StateStopping:
+		return STATUS_STOPPING
+	case StateStopped:
+		return STATUS_STOPPED
+	case StateShuttingDown:
+		return STATUS_SHUTTING_DOWN
+	case StateTerminated:
+		return STATUS_TERMINATED
+	case StatePending:
+		return STATUS_PENDING
+	}
+	return STATUS_UNKNOWN
+}
+
+// FilterToString ... converts the bitwise filter into a list of states
+func FilterToString(filter int) string {
+	var filters []string
+	for _, x := range []string{StateRunning, StateStopping, StateStopped, StateShuttingDown, StateTerminated, StatePending, StateUnknown} {
+		if filter&StateToFilter(x) != 0 {
+			filters = append(filters, x)
+		}
+	}
+	return strings.Join(filters, ",")
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "rbd_manager"
+
+var (
+	// EC2Polls ... the number of polls of the ec2 api, by region and result
+	EC2Polls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ec2",
+		Name:      "polls_total",
+		Help:      "The number of polls of the ec2 api, by region and result",
+	}, []string{"region", "result"})
+
+	// EC2PollDuration ... the time taken to poll the ec2 api, by region
+	EC2PollDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "ec2",
+		Name:      "poll_duration_seconds",
+		Help:      "The time taken to poll the ec2 api, by region",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"region"})
+
+	// EC2Degraded ... whether the ec2 poller of a region is degraded, i.e. unable to retrieve the instances
+	EC2Degraded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "ec2",
+		Name:      "degraded",
+		Help:      "Whether the ec2 poller of a region is degraded, i.e. unable to retrieve the instances",
+	}, []string{"region"})
+
+	// TrackedInstances ... the number of instances being tracked, by region and state
+	TrackedInstances = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "tracked_instances",
+		Help:      "The number of instances being tracked, by region and state",
+	}, []string{"region", "state"})
+
+	// EventsDelivered ... the number of events delivered to the listeners, by source and listener filter
+	EventsDelivered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_delivered_total",
+		Help:      "The number of events delivered, by source and listener filter",
+	}, []string{"source", "listener"})
+
+	// FenceAttempts ... the number of attempts made to fence an instance
+	FenceAttempts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "fence_attempts_total",
+		Help:      "The number of attempts made to fence an instance",
+	})
+
+	// FenceSuccesses ... the number of successful fence attempts
+	FenceSuccesses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "fence_successes_total",
+		Help:      "The number of successful fence attempts",
+	})
+
+	// FenceFailures ... the number of failed fence attempts
+	FenceFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "fence_failures_total",
+		Help:      "The number of failed fence attempts",
+	})
+
+	// LocksRemoved ... the number of locks removed, by pool
+	LocksRemoved = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "locks_removed_total",
+		Help:      "The number of image locks removed, by pool",
+	}, []string{"pool"})
+
+	// FenceLatency ... the time from detecting the state change of an instance to its locks being removed
+	FenceLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "fence_latency_seconds",
+		Help:      "The time from detecting the state change of an instance to its locks being removed",
+		Buckets:   []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800},
+	})
+
+	// OrphanedLocks ... the number of locks held by addresses of nodes no longer running
+	OrphanedLocks = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "orphaned_locks",
+		Help:      "The number of locks held by addresses of nodes no longer running, as of the last scan",
+	})
+
+	// UnknownLocks ... the number of locks held by addresses never seen in the environment
+	UnknownLocks = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "unknown_locks",
+		Help:      "The number of locks held by addresses never seen in the environment, as of the last scan",
+	})
+
+	// CommandDuration ... the time taken by the ceph cli invocations, by command
+	CommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "command_duration_seconds",
+		Help:      "The time taken by the ceph cli invocations, by command",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"command"})
+
+	// Notifications ... the number of notifications, by event and result, delivered, failed or dropped
+	Notifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_total",
+		Help:      "The number of notifications, by event and result, delivered, failed or dropped",
+	}, []string{"event", "result"})
+
+	// CommandErrors ... the number of failed ceph cli invocations, by command
+	CommandErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "command_errors_total",
+		Help:      "The number of failed ceph cli invocations, by command",
+	}, []string{"command"})
+)
+
+func init() {
+	prometheus.MustRegister(EC2Polls, EC2PollDuration, EC2Degraded, TrackedInstances, EventsDelivered,
+		FenceAttempts, FenceSuccesses, FenceFailures, LocksRemoved, FenceLatency,
+		OrphanedLocks, UnknownLocks, CommandDuration, CommandErrors, Notifications)
+}
+
+// Handler ... returns the http handler exposing the metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notify
+
+import (
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+)
+
+// the events we notify on
+const (
+	// a node is about to be fenced
+	EventFenceStarted = "fence_started"
+	// the locks held by a node were removed
+	EventFenceSucceeded = "fence_succeeded"
+	// the node could not be fenced after all the attempts
+	EventFenceFailed = "fence_failed"
+	// a lock held by a node no longer running was found
+	EventOrphanFound = "orphan_found"
+)
+
+// Events ... returns the events we notify on
+func Events() []string {
+	return []string{EventFenceStarted, EventFenceSucceeded, EventFenceFailed, EventOrphanFound}
+}
+
+// SignatureHeader ... the header carrying the hmac sha256 of the payload, i.e. sha256=<hex>
+const SignatureHeader = "X-RBD-Manager-Signature"
+
+// EventHeader ... the header carrying the type of event
+const EventHeader = "X-RBD-Manager-Event"
+
+// Event ... an event sent to the webhooks
+type Event struct {
+	// the type of event
+	Type string `json:"type"`
+	// the time of the event
+	Time time.Time `json:"time"`
+	// the instance being fenced, or the node which last owned an orphaned lock
+	InstanceID string `json:"instance_id,omitempty"`
+	// the addresses being fenced
+	Addresses []string `json:"addresses,omitempty"`
+	// the state of the node, i.e. stopped, terminated or manual
+	State string `json:"state,omitempty"`
+	// the number of attempts made to fence the node
+	Attempts int `json:"attempts,omitempty"`
+	// the error of a failed fence
+	Error string `json:"error,omitempty"`
+	// the images examined when fencing the node
+	Images []rbd.ImageResult `json:"images,omitempty"`
+	// the orphaned lock
+	Lock *rbd.ImageLock `json:"lock,omitempty"`
+}
+
+// Webhook ... a url the events are posted to
+type Webhook struct {
+	// the url the events are posted to
+	URL string `json:"url" yaml:"url"`
+	// the secret used to sign the payload, no signature is sent if empty
+	Secret string `json:"secret" yaml:"secret"`
+	// the events sent to the webhook, all of them if empty
+	Events []string `json:"events" yaml:"events"`
+	// a go template rendering the payload, which must be json, the event is encoded as is if empty
+	Template string `json:"template" yaml:"template"`
+	// the timeout on the request
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+}
+
+// Config ... the configuration for the notifier
+type Config struct {
+	// the webhooks the events are sent to
+	Webhooks []Webhook
+	// the retrying of the failed deliveries
+	Retry rbd.Backoff
+	// the number of events which can be waiting for delivery, any more are dropped
+	QueueSize int
+}
+
+// NotifierInterface ... sends the events to the webhooks in the background
+type NotifierInterface interface {
+	// Queue the event for delivery, it's dropped if the queue is full
+	Notify(Event)
+	// Replace the webhooks and retrying of the notifier
+	Reconfigure(Config) error
+	// Stop the notifier, waiting up to the timeout for the queued events to be delivered
+	Stop(time.Duration)
+}
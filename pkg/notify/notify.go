@@ -0,0 +1,324 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/metrics"
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// the number of events waiting for delivery when not configured
+	defaultQueueSize = 100
+	// the timeout on the requests when not configured
+	defaultTimeout = time.Duration(10) * time.Second
+)
+
+// webhook ... a webhook with the template parsed and the events it wants
+type webhook struct {
+	Webhook
+	// the parsed template, nil if the event is encoded as is
+	template *template.Template
+	// the events sent to the webhook, all if empty
+	events map[string]bool
+}
+
+// the implementation of the NotifierInterface
+type notifier struct {
+	sync.RWMutex
+	// the webhooks the events are sent to
+	hooks []*webhook
+	// the retrying of the failed deliveries
+	retry rbd.Backoff
+	// the events waiting for delivery
+	queue chan Event
+	// the client used to post the events
+	client *http.Client
+	// closed when we are stopping, the queued events are still delivered
+	stopCh chan struct{}
+	// closed when the stop deadline has passed, aborting any retries
+	abortCh chan struct{}
+	// closed when the delivery loop has finished
+	doneCh chan struct{}
+	// ensures we are only stopped the once
+	stopOnce sync.Once
+}
+
+// Validate ... checks the webhooks and retrying of the configuration
+func Validate(config Config) error {
+	if _, err := newWebhooks(config.Webhooks); err != nil {
+		return err
+	}
+	if err := config.Retry.Validate(); err != nil {
+		return fmt.Errorf("invalid retry, error: %s", err)
+	}
+	return nil
+}
+
+// NewNotifier ... creates the notifier and starts delivering the events
+func NewNotifier(config Config) (NotifierInterface, error) {
+	if err := Validate(config); err != nil {
+		return nil, err
+	}
+	hooks, _ := newWebhooks(config.Webhooks)
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultQueueSize
+	}
+	glog.Infof("Starting the notifier, webhooks: %d, attempts: %d", len(hooks), config.Retry.Attempts)
+
+	service := &notifier{
+		hooks:   hooks,
+		retry:   config.Retry,
+		queue:   make(chan Event, config.QueueSize),
+		client:  &http.Client{},
+		stopCh:  make(chan struct{}),
+		abortCh: make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	go service.run()
+
+	return service, nil
+}
+
+// Notify ... queues the event for delivery, the event is dropped rather than blocking the caller
+func (r *notifier) Notify(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	select {
+	case <-r.stopCh:
+		glog.Warningf("Dropping the %s event for instance: %s, the notifier is stopped", event.Type, event.InstanceID)
+		metrics.Notifications.WithLabelValues(event.Type, "dropped").Inc()
+		return
+	default:
+	}
+	select {
+	case r.queue <- event:
+	default:
+		glog.Warningf("Dropping the %s event for instance: %s, the notification queue is full", event.Type, event.InstanceID)
+		metrics.Notifications.WithLabelValues(event.Type, "dropped").Inc()
+	}
+}
+
+// Reconfigure ... replaces the webhooks and the retrying, the queued events are sent to the new webhooks
+func (r *notifier) Reconfigure(config Config) error {
+	if err := Validate(config); err != nil {
+		return err
+	}
+	hooks, _ := newWebhooks(config.Webhooks)
+	glog.Infof("Reconfiguring the notifier, webhooks: %d, attempts: %d", len(hooks), config.Retry.Attempts)
+	r.Lock()
+	defer r.Unlock()
+	r.hooks = hooks
+	r.retry = config.Retry
+
+	return nil
+}
+
+// Stop ... stops accepting events and waits up to the timeout for those queued to be delivered
+func (r *notifier) Stop(timeout time.Duration) {
+	r.stopOnce.Do(func() {
+		close(r.stopCh)
+		select {
+		case <-r.doneCh:
+		case <-time.After(timeout):
+			glog.Warningf("Timed out waiting for the notifications to be delivered, abandoning them")
+			close(r.abortCh)
+			<-r.doneCh
+		}
+	})
+}
+
+// run ... delivers the events until stopped, then delivers any left in the queue
+func (r *notifier) run() {
+	defer close(r.doneCh)
+	for {
+		select {
+		case event := <-r.queue:
+			r.deliver(event)
+		case <-r.stopCh:
+			for {
+				select {
+				case event := <-r.queue:
+					r.deliver(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver ... sends the event to each of the webhooks wanting it
+func (r *notifier) deliver(event Event) {
+	hooks, retry := r.getHooks()
+	for _, hook := range hooks {
+		if len(hook.events) > 0 && !hook.events[event.Type] {
+			continue
+		}
+		payload, err := hook.render(event)
+		if err != nil {
+			glog.Errorf("Failed to render the %s event for webhook: %s, error: %s", event.Type, hook.URL, err)
+			metrics.Notifications.WithLabelValues(event.Type, "failed").Inc()
+			continue
+		}
+		if err := r.send(hook, event.Type, payload, retry); err != nil {
+			glog.Errorf("Failed to deliver the %s event to webhook: %s, error: %s", event.Type, hook.URL, err)
+			metrics.Notifications.WithLabelValues(event.Type, "failed").Inc()
+			continue
+		}
+		glog.V(4).Infof("Delivered the %s event to webhook: %s", event.Type, hook.URL)
+		metrics.Notifications.WithLabelValues(event.Type, "delivered").Inc()
+	}
+}
+
+// send ... posts the payload to the webhook, retrying any failures with the backoff
+func (r *notifier) send(hook *webhook, eventType string, payload []byte, retry rbd.Backoff) error {
+	for attempt := 1; ; attempt++ {
+		err := r.post(hook, eventType, payload)
+		if err == nil {
+			return nil
+		}
+		if attempt >= retry.Attempts {
+			return fmt.Errorf("%d attempts, error: %s", attempt, err)
+		}
+		delay := retry.Duration(attempt)
+		glog.Warningf("Failed to deliver the %s event to webhook: %s, retrying in %s, error: %s", eventType, hook.URL, delay, err)
+		select {
+		case <-r.abortCh:
+			return fmt.Errorf("abandoned on shutdown, error: %s", err)
+		case <-time.After(delay):
+		}
+	}
+}
+
+// post ... makes a single request to the webhook, anything other than a 2xx is a failure
+func (r *notifier) post(hook *webhook, eventType string, payload []byte) error {
+	request, err := http.NewRequest("POST", hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(EventHeader, eventType)
+	if hook.Secret != "" {
+		request.Header.Set(SignatureHeader, Sign(hook.Secret, payload))
+	}
+	client := *r.client
+	client.Timeout = hook.Timeout
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// getHooks ... returns the webhooks and retrying presently configured
+func (r *notifier) getHooks() ([]*webhook, rbd.Backoff) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.hooks, r.retry
+}
+
+// render ... returns the payload for the event, the template must produce valid json
+func (r *webhook) render(event Event) ([]byte, error) {
+	if r.template == nil {
+		return json.Marshal(event)
+	}
+	buffer := new(bytes.Buffer)
+	if err := r.template.Execute(buffer, event); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buffer.Bytes()) {
+		return nil, fmt.Errorf("the template did not produce valid json")
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// Sign ... returns the signature of the payload, as sent in the signature header
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhooks ... validates the webhooks, parsing their templates
+func newWebhooks(list []Webhook) ([]*webhook, error) {
+	known := make(map[string]bool, 0)
+	for _, x := range Events() {
+		known[x] = true
+	}
+
+	var hooks []*webhook
+	for _, x := range list {
+		location, err := url.Parse(x.URL)
+		if err != nil || (location.Scheme != "http" && location.Scheme != "https") || location.Host == "" {
+			return nil, fmt.Errorf("invalid webhook url: '%s'", x.URL)
+		}
+		hook := &webhook{Webhook: x, events: make(map[string]bool, 0)}
+		for _, name := range x.Events {
+			if !known[name] {
+				return nil, fmt.Errorf("unknown event: '%s' on webhook: %s", name, x.URL)
+			}
+			hook.events[name] = true
+		}
+		if x.Template != "" {
+			hook.template, err = template.New(x.URL).Funcs(templateFuncs).Parse(x.Template)
+			if err != nil {
+				return nil, fmt.Errorf("invalid template on webhook: %s, error: %s", x.URL, err)
+			}
+		}
+		if hook.Timeout <= 0 {
+			hook.Timeout = defaultTimeout
+		}
+		hooks = append(hooks, hook)
+	}
+
+	return hooks, nil
+}
+
+// templateFuncs ... the functions available to the templates
+var templateFuncs = template.FuncMap{
+	// json encodes the value, i.e. {{ json .Error }} produces a quoted and escaped string
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+}
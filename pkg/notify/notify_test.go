@@ -0,0 +1,266 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// request ... a request received by the receiver
+type request struct {
+	// the headers of the request
+	header http.Header
+	// the body of the request
+	body []byte
+}
+
+// receiver ... a local webhook recording the requests, failing the first of them if asked
+type receiver struct {
+	sync.Mutex
+	*httptest.Server
+	// the requests received
+	requests []request
+	// the number of requests to fail
+	failures int
+}
+
+func newReceiver(t *testing.T) *receiver {
+	hook := &receiver{}
+	hook.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		hook.Lock()
+		defer hook.Unlock()
+		hook.requests = append(hook.requests, request{header: req.Header, body: body})
+		if hook.failures > 0 {
+			hook.failures--
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(hook.Close)
+	return hook
+}
+
+func (r *receiver) received() []request {
+	r.Lock()
+	defer r.Unlock()
+	return append([]request{}, r.requests...)
+}
+
+func (r *receiver) fail(count int) {
+	r.Lock()
+	defer r.Unlock()
+	r.failures = count
+}
+
+var testRetry = rbd.Backoff{Attempts: 3, Delay: time.Millisecond}
+
+func newTestNotifier(t *testing.T, hooks ...Webhook) NotifierInterface {
+	service, err := NewNotifier(Config{Webhooks: hooks, Retry: testRetry})
+	if err != nil {
+		t.Fatalf("unable to create the notifier, error: %s", err)
+	}
+	t.Cleanup(func() { service.Stop(time.Second) })
+	return service
+}
+
+func waitForRequests(t *testing.T, hook *receiver, count int) []request {
+	timeout := time.After(time.Duration(5) * time.Second)
+	for len(hook.received()) < count {
+		select {
+		case <-timeout:
+			t.Fatalf("timed out waiting for %d requests, received: %d", count, len(hook.received()))
+		case <-time.After(time.Duration(5) * time.Millisecond):
+		}
+	}
+	return hook.received()
+}
+
+func TestNotify(t *testing.T) {
+	hook := newReceiver(t)
+	service := newTestNotifier(t, Webhook{URL: hook.URL, Secret: "secret"})
+
+	service.Notify(Event{
+		Type:       EventFenceFailed,
+		InstanceID: "i-dead",
+		Addresses:  []string{"10.0.0.1"},
+		Attempts:   3,
+		Error:      "connection timed out",
+		Images:     []rbd.ImageResult{{Pool: "rbd", Image: "vol1", Result: rbd.ResultFailed, Attempts: 2}},
+	})
+	requests := waitForRequests(t, hook, 1)
+
+	assert.Equal(t, EventFenceFailed, requests[0].header.Get(EventHeader))
+	assert.Equal(t, "application/json", requests[0].header.Get("Content-Type"))
+	assert.Equal(t, Sign("secret", requests[0].body), requests[0].header.Get(SignatureHeader))
+	var event Event
+	if assert.NoError(t, json.Unmarshal(requests[0].body, &event)) {
+		assert.Equal(t, "i-dead", event.InstanceID)
+		assert.Equal(t, 3, event.Attempts)
+		assert.False(t, event.Time.IsZero())
+		assert.Equal(t, "vol1", event.Images[0].Image)
+	}
+}
+
+func TestNotifyUnsigned(t *testing.T) {
+	hook := newReceiver(t)
+	service := newTestNotifier(t, Webhook{URL: hook.URL})
+
+	service.Notify(Event{Type: EventFenceStarted, InstanceID: "i-dead"})
+	requests := waitForRequests(t, hook, 1)
+	assert.Empty(t, requests[0].header.Get(SignatureHeader))
+}
+
+func TestSign(t *testing.T) {
+	// step: the hmac sha256 test vector
+	assert.Equal(t, "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8",
+		Sign("key", []byte("The quick brown fox jumps over the lazy dog")))
+}
+
+func TestNotifyRetries(t *testing.T) {
+	hook := newReceiver(t)
+	hook.fail(2)
+	service := newTestNotifier(t, Webhook{URL: hook.URL})
+
+	service.Notify(Event{Type: EventFenceSucceeded, InstanceID: "i-dead"})
+	requests := waitForRequests(t, hook, 3)
+	// step: the same payload should have been sent on each attempt
+	assert.Equal(t, requests[0].body, requests[2].body)
+
+	// step: no more attempts than configured
+	hook.fail(10)
+	service.Notify(Event{Type: EventFenceSucceeded, InstanceID: "i-other"})
+	waitForRequests(t, hook, 6)
+	time.Sleep(time.Duration(50) * time.Millisecond)
+	assert.Equal(t, 6, len(hook.received()))
+}
+
+func TestNotifyFilters(t *testing.T) {
+	failures := newReceiver(t)
+	everything := newReceiver(t)
+	service := newTestNotifier(t,
+		Webhook{URL: failures.URL, Events: []string{EventFenceFailed, EventOrphanFound}},
+		Webhook{URL: everything.URL},
+	)
+
+	service.Notify(Event{Type: EventFenceStarted, InstanceID: "i-dead"})
+	service.Notify(Event{Type: EventFenceFailed, InstanceID: "i-dead"})
+	service.Notify(Event{Type: EventOrphanFound, InstanceID: "i-old", Lock: &rbd.ImageLock{Pool: "rbd", Image: "vol1"}})
+	waitForRequests(t, everything, 3)
+
+	requests := waitForRequests(t, failures, 2)
+	assert.Equal(t, EventFenceFailed, requests[0].header.Get(EventHeader))
+	assert.Equal(t, EventOrphanFound, requests[1].header.Get(EventHeader))
+}
+
+func TestNotifyTemplate(t *testing.T) {
+	hook := newReceiver(t)
+	service := newTestNotifier(t, Webhook{
+		URL:      hook.URL,
+		Template: `{"text": {{ json (printf "%s: instance %s, error: %s" .Type .InstanceID .Error) }}}`,
+	})
+
+	service.Notify(Event{Type: EventFenceFailed, InstanceID: "i-dead", Error: `unable to "unlock"`})
+	requests := waitForRequests(t, hook, 1)
+	var payload map[string]string
+	if assert.NoError(t, json.Unmarshal(requests[0].body, &payload)) {
+		assert.Equal(t, `fence_failed: instance i-dead, error: unable to "unlock"`, payload["text"])
+	}
+}
+
+func TestNotifyTemplateInvalidJSON(t *testing.T) {
+	broken := newReceiver(t)
+	hook := newReceiver(t)
+	service := newTestNotifier(t, Webhook{URL: broken.URL, Template: `{"text": "{{ .Error }}"}`}, Webhook{URL: hook.URL})
+
+	// step: the quotes in the error break the json, the event is not sent to the webhook
+	service.Notify(Event{Type: EventFenceFailed, Error: `unable to "unlock"`})
+	waitForRequests(t, hook, 1)
+	service.Stop(time.Second)
+	assert.Equal(t, 0, len(broken.received()))
+}
+
+func TestNotifyStop(t *testing.T) {
+	hook := newReceiver(t)
+	service := newTestNotifier(t, Webhook{URL: hook.URL})
+
+	for i := 0; i < 5; i++ {
+		service.Notify(Event{Type: EventFenceStarted})
+	}
+	// step: the queued events should be delivered before we stop
+	service.Stop(time.Duration(5) * time.Second)
+	assert.Equal(t, 5, len(hook.received()))
+
+	service.Notify(Event{Type: EventFenceStarted})
+	time.Sleep(time.Duration(20) * time.Millisecond)
+	assert.Equal(t, 5, len(hook.received()))
+}
+
+func TestNotifyStopDeadline(t *testing.T) {
+	hook := newReceiver(t)
+	hook.fail(1000)
+	service, err := NewNotifier(Config{
+		Webhooks: []Webhook{{URL: hook.URL}},
+		Retry:    rbd.Backoff{Attempts: 10, Delay: time.Hour},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	service.Notify(Event{Type: EventFenceStarted})
+	waitForRequests(t, hook, 1)
+	started := time.Now()
+	service.Stop(time.Duration(50) * time.Millisecond)
+	assert.True(t, time.Since(started) < time.Second, "the stop should abandon the retries")
+}
+
+func TestReconfigure(t *testing.T) {
+	first := newReceiver(t)
+	second := newReceiver(t)
+	service := newTestNotifier(t, Webhook{URL: first.URL})
+
+	assert.Error(t, service.Reconfigure(Config{Webhooks: []Webhook{{URL: "not a url"}}}))
+	assert.NoError(t, service.Reconfigure(Config{Webhooks: []Webhook{{URL: second.URL}}, Retry: testRetry}))
+	service.Notify(Event{Type: EventFenceStarted})
+	waitForRequests(t, second, 1)
+	assert.Equal(t, 0, len(first.received()))
+}
+
+func TestNewNotifierInvalid(t *testing.T) {
+	for _, hook := range []Webhook{
+		{URL: ""},
+		{URL: "ftp://example.com"},
+		{URL: "http://example.com", Events: []string{"fence_exploded"}},
+		{URL: "http://example.com", Template: "{{ .Missing"},
+	} {
+		_, err := NewNotifier(Config{Webhooks: []Webhook{hook}})
+		assert.Error(t, err, "webhook: %v", hook)
+	}
+	_, err := NewNotifier(Config{Retry: rbd.Backoff{Jitter: 2}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+)
+
+// FenceJob ... the structure of a pending fence operation
+type FenceJob struct {
+	// the instance id we are fencing
+	InstanceID string `json:"instance_id"`
+	// the addresses the instance held locks from
+	Addresses []string `json:"addresses"`
+	// the pools we should be checking
+	Pools rbd.PoolSelector `json:"pools"`
+	// the state of the instance which triggered the fence
+	State string `json:"state"`
+	// what triggered the fence, i.e. an instance event, the admin api or the reconciler
+	Trigger string `json:"trigger,omitempty"`
+	// fence the addresses even if they belong to a running node
+	Force bool `json:"force,omitempty"`
+	// the number of attempts made so far
+	Attempts int `json:"attempts"`
+	// the last error we encountered
+	LastError string `json:"last_error,omitempty"`
+	// the job was interrupted by a shutdown before it finished
+	Incomplete bool `json:"incomplete,omitempty"`
+	// the job was recorded while we were a follower, the leader at the time was expected to handle it
+	Follower bool `json:"follower,omitempty"`
+	// the time the state change of the instance was detected
+	Detected time.Time `json:"detected,omitempty"`
+	// the time the job was created
+	Created time.Time `json:"created"`
+	// the time the job was last updated
+	Updated time.Time `json:"updated"`
+}
+
+func (r FenceJob) String() string {
+	return fmt.Sprintf("instanceId: %s, addresses: %v, pools: %s, state: %s, attempts: %d",
+		r.InstanceID, r.Addresses, r.Pools, r.State, r.Attempts)
+}
+
+// QueueInterface ... the interface to a durable queue of fence jobs
+type QueueInterface interface {
+	// Add or update a job in the queue
+	Put(*FenceJob) error
+	// Remove a job from the queue
+	Remove(string) error
+	// Get a list of the jobs in the queue
+	List() ([]*FenceJob, error)
+}
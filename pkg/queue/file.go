@@ -0,0 +1,180 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// the file extension for a job
+	jobExtension = ".job"
+)
+
+// the implementation of a QueueInterface, each job is kept in a file of it's own
+type fileQueue struct {
+	sync.Mutex
+	// the directory the jobs live in
+	directory string
+}
+
+// NewQueueInterface ... create a new durable queue backed by the directory
+func NewQueueInterface(directory string) (QueueInterface, error) {
+	glog.Infof("Creating a new fence queue, directory: %s", directory)
+	if directory == "" {
+		return nil, fmt.Errorf("you have not specified a directory for the queue")
+	}
+
+	// step: ensure the directory exists
+	if err := os.MkdirAll(directory, 0750); err != nil {
+		return nil, fmt.Errorf("unable to create the queue directory: %s, error: %s", directory, err)
+	}
+
+	return &fileQueue{directory: directory}, nil
+}
+
+// Put ... writes the job to disk, replacing any previous version
+func (r *fileQueue) Put(job *FenceJob) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if job.InstanceID == "" {
+		return fmt.Errorf("the job does not have an instance id")
+	}
+	// step: update the timestamps
+	now := time.Now()
+	if job.Created.IsZero() {
+		job.Created = now
+	}
+	job.Updated = now
+
+	content, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// step: write to a temporary file and rename into place, so we never leave a partial job
+	tmpfile, err := ioutil.TempFile(r.directory, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmpfile.Write(content); err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	if err := tmpfile.Sync(); err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	if err := os.Rename(tmpfile.Name(), r.jobPath(job.InstanceID)); err != nil {
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	glog.V(4).Infof("Persisted the fence job: %s", job)
+
+	return r.syncDirectory()
+}
+
+// Remove ... deletes the job from the queue
+func (r *fileQueue) Remove(id string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	glog.V(4).Infof("Removing the fence job for instance: %s", id)
+	if err := os.Remove(r.jobPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return r.syncDirectory()
+}
+
+// List ... retrieves all the jobs in the queue, oldest first
+func (r *fileQueue) List() ([]*FenceJob, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	files, err := ioutil.ReadDir(r.directory)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*FenceJob, 0)
+	for _, x := range files {
+		if x.IsDir() || !strings.HasSuffix(x.Name(), jobExtension) {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(r.directory, x.Name()))
+		if err != nil {
+			return nil, err
+		}
+		job := new(FenceJob)
+		if err := json.Unmarshal(content, job); err != nil {
+			glog.Errorf("Skipping the invalid fence job: %s, error: %s", x.Name(), err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Sort(jobsByCreated(jobs))
+
+	return jobs, nil
+}
+
+// jobPath ... returns the path to the file holding the job
+func (r *fileQueue) jobPath(id string) string {
+	return filepath.Join(r.directory, url.QueryEscape(id)+jobExtension)
+}
+
+// syncDirectory ... flushes the directory entries to disk
+func (r *fileQueue) syncDirectory() error {
+	dir, err := os.Open(r.directory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// jobsByCreated ... sorts the jobs oldest first
+type jobsByCreated []*FenceJob
+
+func (r jobsByCreated) Len() int      { return len(r) }
+func (r jobsByCreated) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r jobsByCreated) Less(i, j int) bool {
+	// note: the jobs created at the same time are ordered by the instance, so the order is stable between lists
+	if r[i].Created.Equal(r[j].Created) {
+		return r[i].InstanceID < r[j].InstanceID
+	}
+	return r[i].Created.Before(r[j].Created)
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestQueue(t *testing.T) (*fileQueue, string) {
+	directory := filepath.Join(t.TempDir(), "queue")
+	service, err := NewQueueInterface(directory)
+	if err != nil {
+		t.Fatalf("unable to create the queue, error: %s", err)
+	}
+	return service.(*fileQueue), directory
+}
+
+func listJobs(t *testing.T, service QueueInterface) []*FenceJob {
+	jobs, err := service.List()
+	if err != nil {
+		t.Fatalf("unable to list the queue, error: %s", err)
+	}
+	return jobs
+}
+
+func TestNewQueueInterface(t *testing.T) {
+	_, err := NewQueueInterface("")
+	assert.Error(t, err)
+	_, directory := newTestQueue(t)
+	info, err := os.Stat(directory)
+	if assert.NoError(t, err) {
+		assert.True(t, info.IsDir())
+	}
+}
+
+func TestPutListRemove(t *testing.T) {
+	service, _ := newTestQueue(t)
+	pools, _ := rbd.NewPoolSelector("rbd,volumes", "", "")
+	job := &FenceJob{InstanceID: "i-00000001", Addresses: []string{"10.0.0.1"}, Pools: pools, State: "terminated", Trigger: "instance_event"}
+	assert.NoError(t, service.Put(job))
+	assert.False(t, job.Created.IsZero())
+	assert.False(t, job.Updated.IsZero())
+	assert.Error(t, service.Put(&FenceJob{}))
+
+	jobs := listJobs(t, service)
+	if assert.Equal(t, 1, len(jobs)) {
+		assert.Equal(t, "i-00000001", jobs[0].InstanceID)
+		assert.Equal(t, []string{"10.0.0.1"}, jobs[0].Addresses)
+		assert.Equal(t, []string{"rbd", "volumes"}, jobs[0].Pools.Names)
+		assert.Equal(t, "terminated", jobs[0].State)
+		assert.Equal(t, "instance_event", jobs[0].Trigger)
+		assert.True(t, job.Created.Equal(jobs[0].Created))
+	}
+
+	assert.NoError(t, service.Remove("i-00000001"))
+	assert.Equal(t, 0, len(listJobs(t, service)))
+}
+
+func TestPutOverwrites(t *testing.T) {
+	service, directory := newTestQueue(t)
+	job := &FenceJob{InstanceID: "i-00000001", Addresses: []string{"10.0.0.1"}}
+	assert.NoError(t, service.Put(job))
+	created := job.Created
+
+	job.Attempts = 2
+	job.LastError = "connection timed out"
+	assert.NoError(t, service.Put(job))
+
+	jobs := listJobs(t, service)
+	if assert.Equal(t, 1, len(jobs)) {
+		assert.Equal(t, 2, jobs[0].Attempts)
+		assert.Equal(t, "connection timed out", jobs[0].LastError)
+		assert.True(t, created.Equal(jobs[0].Created))
+		assert.False(t, jobs[0].Updated.Before(jobs[0].Created))
+	}
+	// step: the rename into place should leave no temporary files behind
+	files, err := ioutil.ReadDir(directory)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(files)) {
+		assert.Equal(t, "i-00000001"+jobExtension, files[0].Name())
+	}
+}
+
+func TestListSkipsInvalidFiles(t *testing.T) {
+	service, directory := newTestQueue(t)
+	assert.NoError(t, service.Put(&FenceJob{InstanceID: "i-00000001"}))
+	for name, content := range map[string]string{
+		"i-00000002" + jobExtension: "{not json",
+		".tmp-123456":               `{"instance_id": "i-00000003"}`,
+		"README":                    "not a job",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(directory, name), []byte(content), 0640); err != nil {
+			t.Fatalf("unable to write the file, error: %s", err)
+		}
+	}
+	assert.NoError(t, os.Mkdir(filepath.Join(directory, "i-00000004"+jobExtension), 0750))
+
+	jobs := listJobs(t, service)
+	if assert.Equal(t, 1, len(jobs)) {
+		assert.Equal(t, "i-00000001", jobs[0].InstanceID)
+	}
+}
+
+func TestListOrder(t *testing.T) {
+	service, _ := newTestQueue(t)
+	now := time.Now()
+	for i, id := range []string{"i-00000003", "i-00000001", "i-00000004", "i-00000002"} {
+		// step: the last two jobs are created at the same time
+		created := now.Add(time.Duration(i) * time.Second)
+		if i == 3 {
+			created = now.Add(time.Duration(2) * time.Second)
+		}
+		assert.NoError(t, service.Put(&FenceJob{InstanceID: id, Created: created}))
+	}
+
+	for i := 0; i < 3; i++ {
+		var ids []string
+		for _, x := range listJobs(t, service) {
+			ids = append(ids, x.InstanceID)
+		}
+		assert.Equal(t, []string{"i-00000003", "i-00000001", "i-00000002", "i-00000004"}, ids)
+	}
+}
+
+func TestRemoveMissing(t *testing.T) {
+	service, _ := newTestQueue(t)
+	assert.NoError(t, service.Remove("i-00000009"))
+	// step: an id needing escaping maps to the same file on put and remove
+	assert.NoError(t, service.Put(&FenceJob{InstanceID: "node/a b"}))
+	assert.Equal(t, 1, len(listJobs(t, service)))
+	assert.NoError(t, service.Remove("node/a b"))
+	assert.Equal(t, 0, len(listJobs(t, service)))
+}
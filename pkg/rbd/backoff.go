@@ -0,0 +1,88 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// DefaultBackoff ... the retrying of the images which failed to unlock, when none is configured
+var DefaultBackoff = Backoff{
+	Attempts: 3,
+	Delay:    time.Duration(1) * time.Second,
+	MaxDelay: time.Duration(30) * time.Second,
+	Jitter:   0.2,
+}
+
+// Validate ... checks the backoff is usable
+func (r Backoff) Validate() error {
+	if r.Attempts < 0 {
+		return fmt.Errorf("the attempts cannot be negative")
+	}
+	if r.Delay < 0 || r.MaxDelay < 0 {
+		return fmt.Errorf("the delays cannot be negative")
+	}
+	if r.Jitter < 0 || r.Jitter > 1 {
+		return fmt.Errorf("the jitter must be between zero and one")
+	}
+	return nil
+}
+
+// Duration ... returns the delay before the next attempt, following the number of attempts made. The delay
+// doubles on each attempt up to the maximum, and is randomly varied by the jitter
+func (r Backoff) Duration(attempts int) time.Duration {
+	delay := r.Delay
+	for i := 1; i < attempts; i++ {
+		delay = delay * 2
+		if r.MaxDelay > 0 && delay >= r.MaxDelay {
+			break
+		}
+	}
+	if r.MaxDelay > 0 && delay > r.MaxDelay {
+		delay = r.MaxDelay
+	}
+	if r.Jitter > 0 && delay > 0 {
+		delta := float64(delay) * r.Jitter
+		delay = time.Duration(float64(delay) - delta + rand.Float64()*2*delta)
+	}
+
+	return delay
+}
+
+// Cancelled ... returns the error of the context once the fence has been cancelled, else nil
+func (r FenceOptions) Cancelled() error {
+	if r.Context == nil {
+		return nil
+	}
+	return r.Context.Err()
+}
+
+// Wait ... waits for the duration, returning early with the error of the context if the fence is cancelled
+func (r FenceOptions) Wait(duration time.Duration) error {
+	if r.Context == nil {
+		time.Sleep(duration)
+		return nil
+	}
+	select {
+	case <-r.Context.Done():
+		return r.Context.Err()
+	case <-time.After(duration):
+		return nil
+	}
+}
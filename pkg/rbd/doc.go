@@ -16,7 +16,12 @@ limitations under the License.
 
 package rbd
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
 
 // CephPool ... the structure of a ceph pool
 type CephPool struct {
@@ -34,13 +39,19 @@ type RbdImage struct {
 	Size int64 `json:"size"`
 	// the format version
 	Format int `json:"format"`
-	// a exclusive lock
+	// the type of lock, exclusive or shared
 	LockType string `json:"lock_type"`
 }
 
-// IsLocked ... checks to see if the image is locked
+// the types of lock on an image
+const (
+	LockExclusive = "exclusive"
+	LockShared    = "shared"
+)
+
+// IsLocked ... checks to see if the image is locked, either exclusively or shared
 func (r RbdImage) IsLocked() bool {
-	if r.LockType == "exclusive" {
+	if r.LockType == LockExclusive || r.LockType == LockShared {
 		return true
 	}
 	return false
@@ -49,30 +60,236 @@ func (r RbdImage) IsLocked() bool {
 // RbdOwner ... the structure of a lock owner
 type RbdOwner struct {
 	// the lockId on the device
-	LockID string
+	LockID string `json:"lock_id"`
 	// the client id
-	ClientID string
+	ClientID string `json:"client_id"`
 	// the address of the owner
-	Address string
+	Address string `json:"address"`
 	// the session
-	Session string
+	Session string `json:"session"`
+	// the full address of the client as reported by ceph
+	EntityAddress string `json:"entity_address"`
+	// the type of lock, exclusive or shared
+	LockType string `json:"lock_type"`
+	// the tag of a shared lock
+	Tag string `json:"tag,omitempty"`
 }
 
 func (r RbdOwner) String() string {
-	return fmt.Sprintf("lockID: '%s', clientID: '%s', address: '%s', session: '%s'",
-		r.LockID, r.ClientID, r.Address, r.Session)
+	return fmt.Sprintf("lockID: '%s', clientID: '%s', address: '%s', session: '%s', type: '%s', tag: '%s'",
+		r.LockID, r.ClientID, r.Address, r.Session, r.LockType, r.Tag)
+}
+
+// ImageLock ... a lock held on an image in the cluster
+type ImageLock struct {
+	// the pool the image resides in
+	Pool string `json:"pool"`
+	// the name of the image
+	Image string `json:"image"`
+	// the holder of the lock
+	Owner RbdOwner `json:"owner"`
+}
+
+// FenceOptions ... the options used when fencing a client
+type FenceOptions struct {
+	// blacklist the client address before breaking any locks
+	Blacklist bool
+	// refuse to break any locks unless the client was blacklisted
+	RequireBlacklist bool
+	// the duration the blacklist entry should remain in place
+	BlacklistExpiry time.Duration
+	// the retrying of the images which failed to unlock
+	Retry Backoff
+	// called after every attempt to remove a lock, i.e. to audit the removals, optional
+	OnUnlock func(UnlockEvent)
+	// once done no further locks are removed and the remaining images are skipped, optional
+	Context context.Context
+}
+
+// UnlockEvent ... an attempt to remove a lock from an image
+type UnlockEvent struct {
+	// the pool the image lives in
+	Pool string
+	// the name of the image
+	Image string
+	// the owner of the lock
+	Owner RbdOwner
+	// the command used to remove the lock
+	Command []string
+	// the attempt at removing the lock
+	Attempt int
+	// the time the attempt started
+	Started time.Time
+	// the time taken
+	Duration time.Duration
+	// the error if the lock was not removed
+	Error error
+}
+
+// Backoff ... the retrying of a failed operation, the delay doubles on each attempt up to the maximum
+type Backoff struct {
+	// the number of attempts made, zero or one disables the retries
+	Attempts int `json:"attempts"`
+	// the delay before the first retry
+	Delay time.Duration `json:"delay"`
+	// the maximum delay between the attempts
+	MaxDelay time.Duration `json:"max_delay"`
+	// the fraction of the delay randomly added or removed, i.e. 0.2 is +/- 20%
+	Jitter float64 `json:"jitter"`
+}
+
+// BlacklistEntry ... the structure of a client blacklisted in the osd map
+type BlacklistEntry struct {
+	// the address which was blacklisted
+	Address string `json:"address"`
+	// the ceph command used, i.e. blacklist or blocklist
+	Command string `json:"command"`
+	// the duration of the entry
+	Expiry time.Duration `json:"expiry"`
+	// the time the entry expires
+	Expires time.Time `json:"expires"`
+}
+
+func (r BlacklistEntry) String() string {
+	return fmt.Sprintf("address: '%s', command: '%s', expires: '%s'", r.Address, r.Command, r.Expires)
+}
+
+// FenceResult ... the result of fencing a client
+type FenceResult struct {
+	// the address of the client
+	Address string `json:"address"`
+	// the blacklist entry if the client was blacklisted
+	Blacklist *BlacklistEntry `json:"blacklist,omitempty"`
+	// the images which were unlocked, pool/image
+	Unlocked []string `json:"unlocked"`
+	// the images locked by the client, or which could not be checked, and what happened to each
+	Images []ImageResult `json:"images"`
+}
+
+// the outcome for an image when fencing a client
+const (
+	// the lock held by the client was removed
+	ResultUnlocked = "unlocked"
+	// the lock could not be removed after all the attempts
+	ResultFailed = "failed"
+	// the image was not unlocked, i.e. the owners could not be listed or the blacklist was required
+	ResultSkipped = "skipped"
+)
+
+// ImageResult ... the outcome of unlocking an image, or a pool which could not be checked
+type ImageResult struct {
+	// the pool the image lives in
+	Pool string `json:"pool"`
+	// the name of the image, empty if the pool could not be listed
+	Image string `json:"image,omitempty"`
+	// the lockId on the image
+	LockID string `json:"lock_id,omitempty"`
+	// the client id holding the lock
+	ClientID string `json:"client_id,omitempty"`
+	// the outcome, unlocked, failed or skipped
+	Result string `json:"result"`
+	// the number of attempts made to remove the lock
+	Attempts int `json:"attempts"`
+	// the last error, if the image is still locked
+	Error string `json:"error,omitempty"`
+}
+
+func (r ImageResult) String() string {
+	name := r.Pool
+	if r.Image != "" {
+		name = r.Pool + "/" + r.Image
+	}
+	if r.Error != "" {
+		return fmt.Sprintf("%s: %s, attempts: %d, error: %s", name, r.Result, r.Attempts, r.Error)
+	}
+	return fmt.Sprintf("%s: %s, attempts: %d", name, r.Result, r.Attempts)
+}
+
+// Failed ... returns the images left locked, or which could not be checked
+func (r FenceResult) Failed() []ImageResult {
+	var list []ImageResult
+	for _, x := range r.Images {
+		if x.Result != ResultUnlocked {
+			list = append(list, x)
+		}
+	}
+	return list
+}
+
+// FenceError ... returned when fencing a client left any image locked, or unchecked
+type FenceError struct {
+	// the address of the client
+	Address string
+	// the images left locked
+	Failed []ImageResult
+}
+
+func (r *FenceError) Error() string {
+	var list []string
+	for _, x := range r.Failed {
+		list = append(list, x.String())
+	}
+	return fmt.Sprintf("%d image(s) held by client: %s may still be locked, %s", len(r.Failed), r.Address, strings.Join(list, "; "))
+}
+
+// the actions which can be taken when fencing a client
+const (
+	// the client would be blacklisted
+	ActionBlacklist = "blacklist"
+	// the lock would be removed from the image
+	ActionUnlock = "unlock"
+	// the image would be skipped
+	ActionSkip = "skip"
+)
+
+// PlanAction ... an action which would be taken when fencing a client
+type PlanAction struct {
+	// the action to be taken
+	Action string `json:"action"`
+	// the pool the image lives in
+	Pool string `json:"pool,omitempty"`
+	// the name of the image
+	Image string `json:"image,omitempty"`
+	// the lockId on the image
+	LockID string `json:"lock_id,omitempty"`
+	// the client id holding the lock
+	ClientID string `json:"client_id,omitempty"`
+	// the address of the client
+	Address string `json:"address"`
+	// the type of lock, exclusive or shared
+	LockType string `json:"lock_type,omitempty"`
+	// the tag of a shared lock
+	Tag string `json:"tag,omitempty"`
+	// the reason for the action
+	Reason string `json:"reason,omitempty"`
+}
+
+// FencePlan ... the actions which would be taken when fencing a client
+type FencePlan struct {
+	// the address of the client
+	Address string `json:"address"`
+	// the pools which were scanned
+	Pools []string `json:"pools"`
+	// the actions which would be taken, in order
+	Actions []PlanAction `json:"actions"`
 }
 
 // RBDInterface ... the interface to RBD commands
 type RBDInterface interface {
 	// Get a list of the pool
 	GetPools() ([]CephPool, error)
-	// Get the owner of the lock
-	GetLockOwner(RbdImage, CephPool) (RbdOwner, error)
+	// Get every locker of the image
+	GetLockOwners(RbdImage, CephPool) ([]RbdOwner, error)
 	// Get a list of the images
 	GetImages(CephPool) ([]RbdImage, error)
-	// Unlock a image
-	UnlockImage(RbdImage, CephPool) error
-	// Unlock a client
-	UnlockClient(string) error
+	// Remove the lock held by the owner on the image
+	UnlockImage(RbdImage, CephPool, RbdOwner) error
+	// Blacklist a client address for the duration
+	BlacklistClient(string, time.Duration) (*BlacklistEntry, error)
+	// Unlock a client in the selected pools
+	UnlockClient(string, PoolSelector, FenceOptions) (*FenceResult, error)
+	// Plan the unlocking of a client without removing any locks
+	PlanClient(string, PoolSelector, FenceOptions) (*FencePlan, error)
+	// List the locks held on the images in the selected pools
+	ListLocks(PoolSelector) ([]ImageLock, error)
 }
@@ -0,0 +1,390 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// the environment variable naming the command the process should emulate
+	commandEnv = "RBD_FAKE_COMMAND"
+	// the environment variable holding the path to the cluster state
+	stateEnv = "RBD_FAKE_STATE"
+	// the environment variable holding the path to the call log
+	callsEnv = "RBD_FAKE_CALLS"
+)
+
+// Commands ... the fake ceph and rbd executables installed in a directory
+type Commands struct {
+	// the directory containing the executables
+	Directory string
+	// the path to the cluster state
+	state string
+	// the path to the call log
+	calls string
+}
+
+// Main ... runs the fake command and exits if the process was invoked as one of the fake executables,
+// otherwise it returns immediately. It should be called from TestMain before the tests are run
+func Main() {
+	name := os.Getenv(commandEnv)
+	if name == "" {
+		return
+	}
+	os.Exit(runFromState(name, os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// Install ... writes the cluster state and the fake ceph and rbd executables into the directory, the
+// executables re-invoke the current process, which must call Main on start up
+//
+//	directory:	the directory to install the executables into
+//	cluster:	the initial state of the cluster
+func Install(directory string, cluster *Cluster) (*Commands, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("unable to find the current executable, error: %s", err)
+	}
+	commands := &Commands{
+		Directory: directory,
+		state:     filepath.Join(directory, "cluster.json"),
+		calls:     filepath.Join(directory, "calls.json"),
+	}
+	if err := writeState(commands.state, cluster); err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"ceph", "rbd"} {
+		// note: the race detector otherwise sleeps for a second on exit
+		script := fmt.Sprintf("#!/bin/sh\nexport %s=%s %s='%s' %s='%s' GORACE=atexit_sleep_ms=0\nexec '%s' \"$@\"\n",
+			commandEnv, name, stateEnv, commands.state, callsEnv, commands.calls, executable)
+		if err := ioutil.WriteFile(filepath.Join(directory, name), []byte(script), 0755); err != nil {
+			return nil, fmt.Errorf("unable to write the fake command: %s, error: %s", name, err)
+		}
+	}
+
+	return commands, nil
+}
+
+// Path ... returns the PATH with the fake executables first
+func (r *Commands) Path() string {
+	return r.Directory + string(os.PathListSeparator) + os.Getenv("PATH")
+}
+
+// Cluster ... reads the current state of the cluster
+func (r *Commands) Cluster() (*Cluster, error) {
+	return readState(r.state)
+}
+
+// Calls ... returns the command lines the executables were invoked with
+func (r *Commands) Calls() ([][]string, error) {
+	content, err := ioutil.ReadFile(r.calls)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var calls [][]string
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	for decoder.More() {
+		var call []string
+		if err := decoder.Decode(&call); err != nil {
+			return nil, err
+		}
+		calls = append(calls, call)
+	}
+	return calls, nil
+}
+
+// Run ... emulates the ceph or rbd command against the cluster, returning the exit code
+//
+//	cluster:	the cluster state, which is updated by the command
+//	name:		the command, ceph or rbd
+//	args:		the arguments to the command
+func Run(cluster *Cluster, name string, args []string, stdout, stderr io.Writer) int {
+	if cluster.Warning != "" {
+		fmt.Fprintln(stderr, cluster.Warning)
+	}
+	switch name {
+	case "ceph":
+		return runCeph(cluster, args, stdout, stderr)
+	case "rbd":
+		return runRBD(cluster, args, stdout, stderr)
+	}
+	fmt.Fprintf(stderr, "%s: command not found\n", name)
+	return 127
+}
+
+// runFromState ... runs the command against the cluster state held on disk
+func runFromState(name string, args []string, stdout, stderr io.Writer) int {
+	path := os.Getenv(stateEnv)
+
+	// step: serialize the commands, they update the state
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		fmt.Fprintf(stderr, "fake: unable to open the state lock, error: %s\n", err)
+		return 1
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		fmt.Fprintf(stderr, "fake: unable to lock the state, error: %s\n", err)
+		return 1
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	if err := recordCall(os.Getenv(callsEnv), append([]string{name}, args...)); err != nil {
+		fmt.Fprintf(stderr, "fake: unable to record the call, error: %s\n", err)
+		return 1
+	}
+	cluster, err := readState(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "fake: %s\n", err)
+		return 1
+	}
+	code := Run(cluster, name, args, stdout, stderr)
+	if err := writeState(path, cluster); err != nil {
+		fmt.Fprintf(stderr, "fake: %s\n", err)
+		return 1
+	}
+
+	return code
+}
+
+// runCeph ... emulates the ceph commands
+func runCeph(cluster *Cluster, args []string, stdout, stderr io.Writer) int {
+	command := strings.Join(args, " ")
+	switch {
+	case len(args) >= 2 && args[0] == "osd" && args[1] == "lspools":
+		type pool struct {
+			PoolNum  int    `json:"poolnum"`
+			PoolName string `json:"poolname"`
+		}
+		pools := make([]pool, 0)
+		for _, x := range cluster.Pools {
+			pools = append(pools, pool{PoolNum: x.ID, PoolName: x.Name})
+		}
+		return writeJSON(stdout, pools)
+
+	case len(args) >= 4 && args[0] == "osd" && (args[1] == "blacklist" || args[1] == "blocklist") && args[2] == "add":
+		// step: the blocklist command only arrived in pacific
+		if args[1] == "blocklist" && !cluster.AtLeast("pacific") {
+			fmt.Fprintf(stderr, "no valid command found; 10 closest matches:\nosd blacklist add|rm <addr> {<float[0.0-]>}\nError EINVAL: invalid command\n")
+			return 22
+		}
+		if !cluster.IsBlacklisted(args[3]) {
+			cluster.Blacklist = append(cluster.Blacklist, args[3])
+		}
+		expiry := "3600"
+		if len(args) >= 5 {
+			expiry = args[4]
+		}
+		fmt.Fprintf(stderr, "%sing %s until %s (%s sec)\n", args[1], args[3], time.Now().UTC().Format("2006-01-02T15:04:05.000000+0000"), expiry)
+		return 0
+	}
+
+	fmt.Fprintf(stderr, "no valid command found; 10 closest matches:\n%s\nError EINVAL: invalid command\n", command)
+	return 22
+}
+
+// runRBD ... emulates the rbd commands
+func runRBD(cluster *Cluster, args []string, stdout, stderr io.Writer) int {
+	var poolName string
+	var format string
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-p", "--pool":
+			if i+1 < len(args) {
+				poolName = args[i+1]
+				i++
+			}
+		case "--format":
+			if i+1 < len(args) {
+				format = args[i+1]
+				i++
+			}
+		case "-l":
+		default:
+			positional = append(positional, args[i])
+		}
+	}
+	if poolName == "" {
+		poolName = "rbd"
+	}
+	pool, found := cluster.GetPool(poolName)
+	if !found {
+		fmt.Fprintf(stderr, "rbd: error opening pool '%s': (2) No such file or directory\n", poolName)
+		return 2
+	}
+
+	switch {
+	case len(positional) == 1 && positional[0] == "ls":
+		type image struct {
+			Image    string `json:"image"`
+			Size     int64  `json:"size"`
+			Format   int    `json:"format"`
+			LockType string `json:"lock_type,omitempty"`
+		}
+		images := make([]image, 0)
+		for _, x := range pool.Images {
+			images = append(images, image{Image: x.Name, Size: x.Size, Format: x.Format, LockType: x.LockType()})
+		}
+		return writeJSON(stdout, images)
+
+	case len(positional) == 3 && positional[0] == "lock" && (positional[1] == "list" || positional[1] == "ls"):
+		image, found := pool.GetImage(positional[2])
+		if !found {
+			fmt.Fprintf(stderr, "rbd: error opening image %s: (2) No such file or directory\n", positional[2])
+			return 2
+		}
+		if format == "json" {
+			return writeLockListJSON(cluster, image, stdout)
+		}
+		writeLockListText(cluster, image, stdout)
+		return 0
+
+	case len(positional) == 5 && positional[0] == "lock" && (positional[1] == "remove" || positional[1] == "rm"):
+		image, found := pool.GetImage(positional[2])
+		if !found {
+			fmt.Fprintf(stderr, "rbd: error opening image %s: (2) No such file or directory\n", positional[2])
+			return 2
+		}
+		if image.Failures > 0 {
+			image.Failures--
+			fmt.Fprintf(stderr, "rbd: releasing lock failed: (16) Device or resource busy\n")
+			return 16
+		}
+		if !image.Unlock(positional[3], positional[4]) {
+			fmt.Fprintf(stderr, "rbd: releasing lock failed: (2) No such file or directory\n")
+			return 2
+		}
+		return 0
+	}
+
+	fmt.Fprintf(stderr, "rbd: error parsing command '%s'; -h or --help for usage\n", strings.Join(positional, " "))
+	return 1
+}
+
+// writeLockListJSON ... writes the lockers as json, releases before nautilus produce an object keyed
+// by the lock id
+func writeLockListJSON(cluster *Cluster, image *Image, stdout io.Writer) int {
+	type locker struct {
+		ID      string `json:"id,omitempty"`
+		Locker  string `json:"locker"`
+		Address string `json:"address"`
+	}
+	if !cluster.AtLeast("nautilus") {
+		locks := make(map[string]locker, 0)
+		for _, x := range image.Lockers {
+			locks[x.LockID] = locker{Locker: x.ClientID, Address: x.EntityAddress(cluster.Release)}
+		}
+		return writeJSON(stdout, locks)
+	}
+	locks := make([]locker, 0)
+	for _, x := range image.Lockers {
+		locks = append(locks, locker{ID: x.LockID, Locker: x.ClientID, Address: x.EntityAddress(cluster.Release)})
+	}
+	return writeJSON(stdout, locks)
+}
+
+// writeLockListText ... writes the lockers as the plain text output, nothing is written if there are none
+func writeLockListText(cluster *Cluster, image *Image, stdout io.Writer) {
+	if len(image.Lockers) <= 0 {
+		return
+	}
+	switch len(image.Lockers) {
+	case 1:
+		fmt.Fprintf(stdout, "There is 1 %s lock on this image.\n", image.LockType())
+	default:
+		fmt.Fprintf(stdout, "There are %d %s locks on this image.\n", len(image.Lockers), image.LockType())
+	}
+	if image.Shared {
+		fmt.Fprintf(stdout, "Lock tag: %s\n", image.Tag)
+	}
+	lockers := make([]*Locker, len(image.Lockers))
+	copy(lockers, image.Lockers)
+	sort.Sort(lockersByID(lockers))
+
+	w := tabwriter.NewWriter(stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(w, "Locker\tID\tAddress")
+	for _, x := range lockers {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", x.ClientID, x.LockID, x.EntityAddress(cluster.Release))
+	}
+	w.Flush()
+}
+
+// writeJSON ... writes the value as json, returning the exit code
+func writeJSON(stdout io.Writer, value interface{}) int {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s\n", content)
+	return 0
+}
+
+// readState ... reads the cluster state from the file
+func readState(path string) (*Cluster, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the cluster state, error: %s", err)
+	}
+	cluster := new(Cluster)
+	if err := json.Unmarshal(content, cluster); err != nil {
+		return nil, fmt.Errorf("unable to decode the cluster state, error: %s", err)
+	}
+	return cluster, nil
+}
+
+// writeState ... writes the cluster state to the file
+func writeState(path string, cluster *Cluster) error {
+	content, err := json.Marshal(cluster)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("unable to write the cluster state, error: %s", err)
+	}
+	return nil
+}
+
+// recordCall ... appends the command line to the call log
+func recordCall(path string, call []string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewEncoder(file).Encode(call)
+}
+
+type lockersByID []*Locker
+
+func (r lockersByID) Len() int           { return len(r) }
+func (r lockersByID) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r lockersByID) Less(i, j int) bool { return r[i].LockID < r[j].LockID }
@@ -0,0 +1,228 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package fake provides an in-memory ceph cluster for tests. The cluster can be used directly through
+FakeRBD, an implementation of the rbd.RBDInterface which records every call, or through fake ceph and
+rbd executables which emulate the output of the real commands, exercising the parsing in the rbd package.
+*/
+package fake
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// the ceph releases in order, the release changes the output formats and available commands
+var releases = []string{"hammer", "jewel", "kraken", "luminous", "mimic", "nautilus", "octopus", "pacific", "quincy", "reef"}
+
+// DefaultRelease ... the release emulated when none is specified
+const DefaultRelease = "quincy"
+
+// Cluster ... the state of a fake ceph cluster
+type Cluster struct {
+	// the release of ceph being emulated
+	Release string `json:"release"`
+	// the pools in the cluster
+	Pools []*Pool `json:"pools"`
+	// the client addresses which have been blacklisted
+	Blacklist []string `json:"blacklist"`
+	// a warning written to the standard error by every command, i.e. a deprecated configuration option
+	Warning string `json:"warning,omitempty"`
+}
+
+// Pool ... a pool in the fake cluster
+type Pool struct {
+	// the pool number
+	ID int `json:"id"`
+	// the name of the pool
+	Name string `json:"name"`
+	// the images in the pool
+	Images []*Image `json:"images"`
+}
+
+// Image ... a rbd image in the fake cluster
+type Image struct {
+	// the name of the image
+	Name string `json:"name"`
+	// the size of the image in bytes
+	Size int64 `json:"size"`
+	// the image format
+	Format int `json:"format"`
+	// the locks are shared rather than exclusive
+	Shared bool `json:"shared"`
+	// the tag on the shared locks
+	Tag string `json:"tag"`
+	// the holders of the locks
+	Lockers []*Locker `json:"lockers"`
+	// the number of the following lock removals which fail, i.e. an unresponsive osd
+	Failures int `json:"failures,omitempty"`
+}
+
+// Locker ... a holder of a lock on an image
+type Locker struct {
+	// the lock id
+	LockID string `json:"lock_id"`
+	// the client id, i.e. client.4123
+	ClientID string `json:"client_id"`
+	// the ip address of the client
+	Address string `json:"address"`
+	// the nonce of the client session
+	Nonce string `json:"nonce"`
+	// if set, the entity address reported verbatim, i.e. a msgr2 address vector
+	Entity string `json:"entity,omitempty"`
+}
+
+// NewCluster ... creates an empty cluster emulating the release
+func NewCluster(release string) *Cluster {
+	if release == "" {
+		release = DefaultRelease
+	}
+	return &Cluster{Release: release, Pools: make([]*Pool, 0), Blacklist: make([]string, 0)}
+}
+
+// AddPool ... adds a pool to the cluster
+func (r *Cluster) AddPool(name string) *Pool {
+	pool := &Pool{ID: len(r.Pools) + 1, Name: name, Images: make([]*Image, 0)}
+	r.Pools = append(r.Pools, pool)
+	return pool
+}
+
+// GetPool ... retrieves the pool by name
+func (r *Cluster) GetPool(name string) (*Pool, bool) {
+	for _, x := range r.Pools {
+		if x.Name == name {
+			return x, true
+		}
+	}
+	return nil, false
+}
+
+// GetImage ... retrieves the image from the pool
+func (r *Cluster) GetImage(pool, name string) (*Image, bool) {
+	if p, found := r.GetPool(pool); found {
+		return p.GetImage(name)
+	}
+	return nil, false
+}
+
+// IsBlacklisted ... checks if the address has been blacklisted
+func (r *Cluster) IsBlacklisted(address string) bool {
+	for _, x := range r.Blacklist {
+		if x == address {
+			return true
+		}
+	}
+	return false
+}
+
+// AtLeast ... checks if the emulated release is the release given or later
+func (r *Cluster) AtLeast(release string) bool {
+	return releaseIndex(r.Release) >= releaseIndex(release)
+}
+
+// AddImage ... adds an image to the pool
+func (r *Pool) AddImage(name string) *Image {
+	image := &Image{Name: name, Size: 10737418240, Format: 2, Lockers: make([]*Locker, 0)}
+	r.Images = append(r.Images, image)
+	return image
+}
+
+// GetImage ... retrieves the image by name
+func (r *Pool) GetImage(name string) (*Image, bool) {
+	for _, x := range r.Images {
+		if x.Name == name {
+			return x, true
+		}
+	}
+	return nil, false
+}
+
+// Lock ... adds an exclusive lock held by the client
+//
+//	lockID:		the id of the lock
+//	clientID:	the client holding the lock, i.e. client.4123
+//	address:	the ip address of the client
+func (r *Image) Lock(lockID, clientID, address string) *Image {
+	r.Lockers = append(r.Lockers, &Locker{LockID: lockID, ClientID: clientID, Address: address, Nonce: "1014129"})
+	return r
+}
+
+// LockShared ... adds a shared lock with the tag held by the client
+func (r *Image) LockShared(tag, lockID, clientID, address string) *Image {
+	r.Shared = true
+	r.Tag = tag
+	return r.Lock(lockID, clientID, address)
+}
+
+// FailUnlock ... fails the following lock removals on the image
+func (r *Image) FailUnlock(count int) *Image {
+	r.Failures = count
+	return r
+}
+
+// LockType ... returns the type of lock on the image, if any
+func (r *Image) LockType() string {
+	switch {
+	case len(r.Lockers) <= 0:
+		return ""
+	case r.Shared:
+		return "shared"
+	}
+	return "exclusive"
+}
+
+// Unlock ... removes the lock held by the client, returning false if no such lock exists
+func (r *Image) Unlock(lockID, clientID string) bool {
+	for i, x := range r.Lockers {
+		if x.LockID == lockID && x.ClientID == clientID {
+			r.Lockers = append(r.Lockers[:i], r.Lockers[i+1:]...)
+			if len(r.Lockers) <= 0 {
+				r.Shared = false
+				r.Tag = ""
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// EntityAddress ... returns the address of the client as reported by ceph
+func (r *Locker) EntityAddress(release string) string {
+	if r.Entity != "" {
+		return r.Entity
+	}
+	address := fmt.Sprintf("%s:0/%s", r.Address, r.Nonce)
+	if strings.Contains(r.Address, ":") && net.ParseIP(r.Address) != nil {
+		address = fmt.Sprintf("[%s]:0/%s", r.Address, r.Nonce)
+	}
+	// step: from pacific the msgr2 addresses are prefixed with their type
+	if releaseIndex(release) >= releaseIndex("pacific") {
+		address = "v2:" + address
+	}
+	return address
+}
+
+// releaseIndex ... returns the position of the release, unknown releases are taken as the latest
+func releaseIndex(release string) int {
+	for i, x := range releases {
+		if x == release {
+			return i
+		}
+	}
+	return len(releases)
+}
@@ -0,0 +1,361 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+)
+
+// Call ... a recorded call on the FakeRBD
+type Call struct {
+	// the method called
+	Method string
+	// the arguments passed
+	Args []string
+}
+
+// FakeRBD ... an in-memory implementation of the rbd.RBDInterface, every call is recorded
+type FakeRBD struct {
+	sync.Mutex
+	// the cluster state
+	cluster *Cluster
+	// the calls made on the interface
+	calls []Call
+	// the errors to return from the methods
+	errors map[string]error
+}
+
+// NewFakeRBD ... creates a fake rbd interface over the cluster
+func NewFakeRBD(cluster *Cluster) *FakeRBD {
+	return &FakeRBD{cluster: cluster, calls: make([]Call, 0), errors: make(map[string]error, 0)}
+}
+
+// Calls ... returns the calls made on the interface
+func (r *FakeRBD) Calls() []Call {
+	r.Lock()
+	defer r.Unlock()
+	list := make([]Call, len(r.calls))
+	copy(list, r.calls)
+	return list
+}
+
+// CallsTo ... returns the calls made to the method
+func (r *FakeRBD) CallsTo(method string) []Call {
+	var list []Call
+	for _, x := range r.Calls() {
+		if x.Method == method {
+			list = append(list, x)
+		}
+	}
+	return list
+}
+
+// FailOn ... makes the method return the error, a nil error clears it
+func (r *FakeRBD) FailOn(method string, err error) {
+	r.Lock()
+	defer r.Unlock()
+	if err == nil {
+		delete(r.errors, method)
+		return
+	}
+	r.errors[method] = err
+}
+
+// Locks ... returns the lockers on the image
+func (r *FakeRBD) Locks(pool, image string) []rbd.RbdOwner {
+	r.Lock()
+	defer r.Unlock()
+	owners := make([]rbd.RbdOwner, 0)
+	if x, found := r.cluster.GetImage(pool, image); found {
+		owners = r.owners(x)
+	}
+	return owners
+}
+
+// IsBlacklisted ... checks if the address has been blacklisted
+func (r *FakeRBD) IsBlacklisted(address string) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.cluster.IsBlacklisted(address)
+}
+
+// GetPools ... returns the pools in the cluster
+func (r *FakeRBD) GetPools() ([]rbd.CephPool, error) {
+	r.Lock()
+	defer r.Unlock()
+	if err := r.record("GetPools"); err != nil {
+		return nil, err
+	}
+	pools := make([]rbd.CephPool, 0)
+	for _, x := range r.cluster.Pools {
+		pools = append(pools, rbd.CephPool{PoolNum: x.ID, Name: x.Name})
+	}
+	return pools, nil
+}
+
+// GetImages ... returns the images in the pool
+func (r *FakeRBD) GetImages(pool rbd.CephPool) ([]rbd.RbdImage, error) {
+	r.Lock()
+	defer r.Unlock()
+	if err := r.record("GetImages", pool.Name); err != nil {
+		return nil, err
+	}
+	p, found := r.cluster.GetPool(pool.Name)
+	if !found {
+		return nil, fmt.Errorf("the pool: %s does not exist", pool.Name)
+	}
+	images := make([]rbd.RbdImage, 0)
+	for _, x := range p.Images {
+		images = append(images, rbd.RbdImage{Name: x.Name, Size: x.Size, Format: x.Format, LockType: x.LockType()})
+	}
+	return images, nil
+}
+
+// GetLockOwners ... returns the lockers of the image
+func (r *FakeRBD) GetLockOwners(image rbd.RbdImage, pool rbd.CephPool) ([]rbd.RbdOwner, error) {
+	r.Lock()
+	defer r.Unlock()
+	if err := r.record("GetLockOwners", pool.Name, image.Name); err != nil {
+		return nil, err
+	}
+	x, found := r.cluster.GetImage(pool.Name, image.Name)
+	if !found {
+		return nil, fmt.Errorf("the image: %s/%s does not exist", pool.Name, image.Name)
+	}
+	return r.owners(x), nil
+}
+
+// UnlockImage ... removes the lock held by the owner
+func (r *FakeRBD) UnlockImage(image rbd.RbdImage, pool rbd.CephPool, owner rbd.RbdOwner) error {
+	r.Lock()
+	defer r.Unlock()
+	if err := r.record("UnlockImage", pool.Name, image.Name, owner.LockID, owner.ClientID); err != nil {
+		return err
+	}
+	x, found := r.cluster.GetImage(pool.Name, image.Name)
+	if !found {
+		return fmt.Errorf("the image: %s/%s does not exist", pool.Name, image.Name)
+	}
+	if x.Failures > 0 {
+		x.Failures--
+		return fmt.Errorf("the lock on image: %s/%s could not be released, device or resource busy", pool.Name, image.Name)
+	}
+	if !x.Unlock(owner.LockID, owner.ClientID) {
+		return fmt.Errorf("the image: %s/%s is not locked by: %s", pool.Name, image.Name, owner.ClientID)
+	}
+	return nil
+}
+
+// BlacklistClient ... adds the address to the blacklist
+func (r *FakeRBD) BlacklistClient(address string, expiry time.Duration) (*rbd.BlacklistEntry, error) {
+	r.Lock()
+	defer r.Unlock()
+	if err := r.record("BlacklistClient", address, expiry.String()); err != nil {
+		return nil, err
+	}
+	if !r.cluster.IsBlacklisted(address) {
+		r.cluster.Blacklist = append(r.cluster.Blacklist, address)
+	}
+	entry := &rbd.BlacklistEntry{Address: address, Command: "blocklist", Expiry: expiry}
+	if expiry > 0 {
+		entry.Expires = time.Now().Add(expiry)
+	}
+	return entry, nil
+}
+
+// UnlockClient ... removes the locks held by the address in the selected pools, retrying the failures
+func (r *FakeRBD) UnlockClient(address string, selector rbd.PoolSelector, options rbd.FenceOptions) (*rbd.FenceResult, error) {
+	r.Lock()
+	err := r.record("UnlockClient", address, selector.String())
+	r.Unlock()
+	result := &rbd.FenceResult{Address: address, Unlocked: make([]string, 0), Images: make([]rbd.ImageResult, 0)}
+	if err != nil {
+		return result, err
+	}
+
+	locks := r.clientLocks(address, selector)
+	if len(locks) <= 0 {
+		return result, nil
+	}
+	if options.Blacklist || options.RequireBlacklist {
+		entry, err := r.BlacklistClient(address, options.BlacklistExpiry)
+		if err != nil && options.RequireBlacklist {
+			return result, fmt.Errorf("refusing to break the locks, unable to blacklist client: %s, error: %s", address, err)
+		}
+		result.Blacklist = entry
+	}
+	images := make([]rbd.ImageResult, len(locks))
+	for i, x := range locks {
+		images[i] = rbd.ImageResult{Pool: x.Pool, Image: x.Image, LockID: x.Owner.LockID, ClientID: x.Owner.ClientID, Result: rbd.ResultFailed}
+	}
+	var cancelled error
+	for attempt := 1; cancelled == nil; attempt++ {
+		failed := 0
+		for i, x := range locks {
+			if images[i].Result == rbd.ResultUnlocked {
+				continue
+			}
+			if cancelled = options.Cancelled(); cancelled != nil {
+				break
+			}
+			images[i].Attempts = attempt
+			started := time.Now()
+			err := r.UnlockImage(rbd.RbdImage{Name: x.Image}, rbd.CephPool{Name: x.Pool}, x.Owner)
+			if options.OnUnlock != nil {
+				options.OnUnlock(rbd.UnlockEvent{
+					Pool:     x.Pool,
+					Image:    x.Image,
+					Owner:    x.Owner,
+					Command:  rbd.UnlockCommand(x.Pool, x.Image, x.Owner),
+					Attempt:  attempt,
+					Started:  started,
+					Duration: time.Since(started),
+					Error:    err,
+				})
+			}
+			if err != nil {
+				images[i].Error = err.Error()
+				failed++
+				continue
+			}
+			images[i].Result = rbd.ResultUnlocked
+			images[i].Error = ""
+			result.Unlocked = append(result.Unlocked, x.Pool+"/"+x.Image)
+		}
+		if cancelled != nil || failed <= 0 || attempt >= options.Retry.Attempts {
+			break
+		}
+		cancelled = options.Wait(options.Retry.Duration(attempt))
+	}
+	result.Images = images
+	if cancelled != nil {
+		for i := range images {
+			if images[i].Result != rbd.ResultUnlocked {
+				images[i].Result, images[i].Error = rbd.ResultSkipped, "the fence was cancelled"
+			}
+		}
+		return result, fmt.Errorf("the fence of client: %s was cancelled, error: %s", address, cancelled)
+	}
+	if failed := result.Failed(); len(failed) > 0 {
+		return result, &rbd.FenceError{Address: address, Failed: failed}
+	}
+
+	return result, nil
+}
+
+// PlanClient ... returns the actions UnlockClient would take
+func (r *FakeRBD) PlanClient(address string, selector rbd.PoolSelector, options rbd.FenceOptions) (*rbd.FencePlan, error) {
+	r.Lock()
+	err := r.record("PlanClient", address, selector.String())
+	r.Unlock()
+	plan := &rbd.FencePlan{Address: address, Pools: make([]string, 0), Actions: make([]rbd.PlanAction, 0)}
+	if err != nil {
+		return plan, err
+	}
+
+	locks := r.clientLocks(address, selector)
+	r.Lock()
+	for _, x := range r.cluster.Pools {
+		if selector.Matches(x.Name) {
+			plan.Pools = append(plan.Pools, x.Name)
+		}
+	}
+	r.Unlock()
+	if len(locks) > 0 && (options.Blacklist || options.RequireBlacklist) {
+		plan.Actions = append(plan.Actions, rbd.PlanAction{Action: rbd.ActionBlacklist, Address: address})
+	}
+	for _, x := range locks {
+		plan.Actions = append(plan.Actions, rbd.PlanAction{
+			Action:   rbd.ActionUnlock,
+			Pool:     x.Pool,
+			Image:    x.Image,
+			LockID:   x.Owner.LockID,
+			ClientID: x.Owner.ClientID,
+			Address:  x.Owner.Address,
+			LockType: x.Owner.LockType,
+			Tag:      x.Owner.Tag,
+		})
+	}
+
+	return plan, nil
+}
+
+// ListLocks ... returns every lock in the selected pools
+func (r *FakeRBD) ListLocks(selector rbd.PoolSelector) ([]rbd.ImageLock, error) {
+	r.Lock()
+	defer r.Unlock()
+	if err := r.record("ListLocks", selector.String()); err != nil {
+		return nil, err
+	}
+	return r.locks(selector), nil
+}
+
+// clientLocks ... returns the locks held by the address in the selected pools
+func (r *FakeRBD) clientLocks(address string, selector rbd.PoolSelector) []rbd.ImageLock {
+	r.Lock()
+	defer r.Unlock()
+	var list []rbd.ImageLock
+	for _, x := range r.locks(selector) {
+		if x.Owner.Address == address {
+			list = append(list, x)
+		}
+	}
+	return list
+}
+
+// locks ... returns the locks in the selected pools, the lock must be held
+func (r *FakeRBD) locks(selector rbd.PoolSelector) []rbd.ImageLock {
+	list := make([]rbd.ImageLock, 0)
+	for _, pool := range r.cluster.Pools {
+		if !selector.Matches(pool.Name) {
+			continue
+		}
+		for _, image := range pool.Images {
+			for _, owner := range r.owners(image) {
+				list = append(list, rbd.ImageLock{Pool: pool.Name, Image: image.Name, Owner: owner})
+			}
+		}
+	}
+	return list
+}
+
+// owners ... converts the lockers of the image, the lock must be held
+func (r *FakeRBD) owners(image *Image) []rbd.RbdOwner {
+	owners := make([]rbd.RbdOwner, 0)
+	for _, x := range image.Lockers {
+		owners = append(owners, rbd.RbdOwner{
+			LockID:        x.LockID,
+			ClientID:      x.ClientID,
+			Address:       x.Address,
+			Session:       x.Nonce,
+			EntityAddress: x.EntityAddress(r.cluster.Release),
+			LockType:      image.LockType(),
+			Tag:           image.Tag,
+		})
+	}
+	return owners
+}
+
+// record ... records the call and returns any error set for the method, the lock must be held
+func (r *FakeRBD) record(method string, args ...string) error {
+	r.calls = append(r.calls, Call{Method: method, Args: args})
+	return r.errors[method]
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// the client id of a locker, i.e. client.4123
+	clientRegex = regexp.MustCompile(`^client\.[0-9]+$`)
+	// the summary line of the text output, i.e. There are 2 shared locks on this image.
+	summaryRegex = regexp.MustCompile(`^There (?:is|are) [0-9]+ (exclusive|shared) locks? on this image\.?$`)
+	// the address type prefixes used by msgr2
+	addressTypes = []string{"any:", "v1:", "v2:", "none:"}
+)
+
+// lockEntry ... the structure of a lock in the json output
+type lockEntry struct {
+	// the lock id, only present in the list format
+	ID string `json:"id"`
+	// the client holding the lock
+	Locker string `json:"locker"`
+	// the address of the client
+	Address string `json:"address"`
+}
+
+// parseLockListJSON ... parses the output of 'rbd lock list --format json'. Releases prior to nautilus
+// produce a object keyed by the lock id, later releases produce a list of locks
+func parseLockListJSON(content []byte) ([]RbdOwner, error) {
+	content = bytes.TrimSpace(content)
+	if len(content) <= 0 {
+		return nil, fmt.Errorf("the lock list output is empty")
+	}
+
+	var entries []lockEntry
+	switch content[0] {
+	case '[':
+		if err := json.Unmarshal(content, &entries); err != nil {
+			return nil, err
+		}
+	case '{':
+		locks := make(map[string]lockEntry, 0)
+		if err := json.Unmarshal(content, &locks); err != nil {
+			return nil, err
+		}
+		for id, x := range locks {
+			x.ID = id
+			entries = append(entries, x)
+		}
+		sort.Sort(lockEntriesByID(entries))
+	default:
+		return nil, fmt.Errorf("unexpected lock list output: %s", content)
+	}
+
+	owners := make([]RbdOwner, 0)
+	for _, x := range entries {
+		owner, err := newLockOwner(x.ID, x.Locker, x.Address)
+		if err != nil {
+			return nil, err
+		}
+		owners = append(owners, owner)
+	}
+
+	return owners, nil
+}
+
+// parseLockListText ... parses the plain text output of 'rbd lock list', any line which is not a header
+// and cannot be parsed is returned as an error
+func parseLockListText(content []byte) ([]RbdOwner, error) {
+	var lockType, tag string
+	owners := make([]RbdOwner, 0)
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "There is") || strings.HasPrefix(line, "There are"):
+			matches := summaryRegex.FindStringSubmatch(line)
+			if matches == nil {
+				return nil, fmt.Errorf("unable to parse the lock summary: '%s'", line)
+			}
+			lockType = matches[1]
+			continue
+		case strings.HasPrefix(line, "Lock tag:"):
+			tag = strings.TrimSpace(strings.TrimPrefix(line, "Lock tag:"))
+			continue
+		case strings.HasPrefix(line, "Locker"):
+			continue
+		}
+
+		// step: the line is: locker, lock id (which may contain spaces) and the address
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("unable to parse the lock line: '%s'", line)
+		}
+		owner, err := newLockOwner(strings.Join(fields[1:len(fields)-1], " "), fields[0], fields[len(fields)-1])
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse the lock line: '%s', error: %s", line, err)
+		}
+		owner.LockType = lockType
+		owner.Tag = tag
+		owners = append(owners, owner)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return owners, nil
+}
+
+// newLockOwner ... creates a lock owner from the fields of a lock
+func newLockOwner(lockID, locker, address string) (RbdOwner, error) {
+	if !clientRegex.MatchString(locker) {
+		return RbdOwner{}, fmt.Errorf("invalid locker: '%s'", locker)
+	}
+	ip, nonce, err := parseEntityAddress(address)
+	if err != nil {
+		return RbdOwner{}, err
+	}
+
+	return RbdOwner{
+		LockID:        lockID,
+		ClientID:      locker,
+		Address:       ip,
+		Session:       nonce,
+		EntityAddress: address,
+	}, nil
+}
+
+// parseEntityAddress ... parses a ceph entity address and returns the ip address and nonce. The address
+// can be a legacy address (10.0.0.1:0/1234), a typed msgr2 address (v2:10.0.0.1:0/1234), a ipv6 address
+// ([fe80::1]:0/1234) or an address vector ([v2:10.0.0.1:3300/1234,v1:10.0.0.1:6789/1234])
+func parseEntityAddress(address string) (string, string, error) {
+	addr := strings.TrimSpace(address)
+
+	// step: if this is a address vector we take the first address
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		addr = strings.Split(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), ",")[0]
+	}
+	// step: remove any address type
+	for _, x := range addressTypes {
+		addr = strings.TrimPrefix(addr, x)
+	}
+
+	// step: split off the nonce
+	nonce := ""
+	if i := strings.LastIndex(addr, "/"); i >= 0 {
+		nonce = addr[i+1:]
+		addr = addr[:i]
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid address: '%s', error: %s", address, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", "", fmt.Errorf("invalid address: '%s', '%s' is not an ip address", address, host)
+	}
+
+	return ip.String(), nonce, nil
+}
+
+type lockEntriesByID []lockEntry
+
+func (r lockEntriesByID) Len() int           { return len(r) }
+func (r lockEntriesByID) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r lockEntriesByID) Less(i, j int) bool { return r[i].ID < r[j].ID }
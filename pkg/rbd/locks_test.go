@@ -0,0 +1,166 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	content, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("unable to read the fixture: %s, error: %s", name, err)
+	}
+	return content
+}
+
+func TestParseLockListJSON(t *testing.T) {
+	tests := []struct {
+		Fixture string
+		Owners  []RbdOwner
+	}{
+		{
+			Fixture: "hammer-exclusive.json",
+			Owners: []RbdOwner{
+				{LockID: "auto 139643345791728", ClientID: "client.4161", Address: "192.168.1.10", Session: "1014129", EntityAddress: "192.168.1.10:0/1014129"},
+			},
+		},
+		{
+			Fixture: "jewel-shared.json",
+			Owners: []RbdOwner{
+				{LockID: "kubelet_lock_magic_node1", ClientID: "client.24117", Address: "10.50.0.21", Session: "3126153725", EntityAddress: "10.50.0.21:0/3126153725"},
+				{LockID: "kubelet_lock_magic_node2", ClientID: "client.24230", Address: "10.50.0.22", Session: "1947012286", EntityAddress: "10.50.0.22:0/1947012286"},
+			},
+		},
+		{
+			Fixture: "luminous-unlocked.json",
+			Owners:  []RbdOwner{},
+		},
+		{
+			Fixture: "nautilus-exclusive.json",
+			Owners: []RbdOwner{
+				{LockID: "auto 18446462598732840961", ClientID: "client.44182", Address: "10.50.0.31", Session: "2859311427", EntityAddress: "10.50.0.31:0/2859311427"},
+			},
+		},
+		{
+			Fixture: "octopus-ipv6.json",
+			Owners: []RbdOwner{
+				{LockID: "auto 94813652211712", ClientID: "client.84251", Address: "2001:db8::31", Session: "1871299472", EntityAddress: "[2001:db8::31]:0/1871299472"},
+			},
+		},
+		{
+			Fixture: "pacific-msgr2.json",
+			Owners: []RbdOwner{
+				{LockID: "auto 140128112197632", ClientID: "client.95312", Address: "10.50.0.41", Session: "2134893347", EntityAddress: "v2:10.50.0.41:0/2134893347"},
+				{LockID: "auto 140128112197888", ClientID: "client.95318", Address: "10.50.0.42", Session: "880922116", EntityAddress: "[v2:10.50.0.42:3300/880922116,v1:10.50.0.42:6789/880922116]"},
+			},
+		},
+		{
+			Fixture: "quincy-unlocked.json",
+			Owners:  []RbdOwner{},
+		},
+	}
+	for _, x := range tests {
+		owners, err := parseLockListJSON(readFixture(t, x.Fixture))
+		if !assert.NoError(t, err, "fixture: %s", x.Fixture) {
+			continue
+		}
+		assert.Equal(t, x.Owners, owners, "fixture: %s", x.Fixture)
+	}
+}
+
+func TestParseLockListText(t *testing.T) {
+	tests := []struct {
+		Fixture string
+		Owners  []RbdOwner
+	}{
+		{
+			Fixture: "hammer-exclusive.txt",
+			Owners: []RbdOwner{
+				{LockID: "auto 139643345791728", ClientID: "client.4161", Address: "192.168.1.10", Session: "1014129", EntityAddress: "192.168.1.10:0/1014129", LockType: "exclusive"},
+			},
+		},
+		{
+			Fixture: "jewel-shared.txt",
+			Owners: []RbdOwner{
+				{LockID: "kubelet_lock_magic_node1", ClientID: "client.24117", Address: "10.50.0.21", Session: "3126153725", EntityAddress: "10.50.0.21:0/3126153725", LockType: "shared", Tag: "kubernetes"},
+				{LockID: "kubelet_lock_magic_node2", ClientID: "client.24230", Address: "10.50.0.22", Session: "1947012286", EntityAddress: "10.50.0.22:0/1947012286", LockType: "shared", Tag: "kubernetes"},
+			},
+		},
+		{
+			Fixture: "pacific-msgr2.txt",
+			Owners: []RbdOwner{
+				{LockID: "auto 140128112197632", ClientID: "client.95312", Address: "10.50.0.41", Session: "2134893347", EntityAddress: "v2:10.50.0.41:0/2134893347", LockType: "exclusive"},
+			},
+		},
+	}
+	for _, x := range tests {
+		owners, err := parseLockListText(readFixture(t, x.Fixture))
+		if !assert.NoError(t, err, "fixture: %s", x.Fixture) {
+			continue
+		}
+		assert.Equal(t, x.Owners, owners, "fixture: %s", x.Fixture)
+	}
+}
+
+func TestParseLockListTextBadLine(t *testing.T) {
+	_, err := parseLockListText(readFixture(t, "broken.txt"))
+	assert.Error(t, err)
+}
+
+func TestParseLockListJSONBadOutput(t *testing.T) {
+	for _, x := range []string{"", "rbd: error opening image", `[{"id":"auto 1","locker":"client.1","address":"garbage"}]`} {
+		_, err := parseLockListJSON([]byte(x))
+		assert.Error(t, err, "output: %s", x)
+	}
+}
+
+func TestParseEntityAddress(t *testing.T) {
+	tests := []struct {
+		Address string
+		IP      string
+		Nonce   string
+		Error   bool
+	}{
+		{Address: "10.0.0.1:0/1234", IP: "10.0.0.1", Nonce: "1234"},
+		{Address: "v1:10.0.0.1:6789/1234", IP: "10.0.0.1", Nonce: "1234"},
+		{Address: "v2:10.0.0.1:3300/1234", IP: "10.0.0.1", Nonce: "1234"},
+		{Address: "any:10.0.0.1:0/1234", IP: "10.0.0.1", Nonce: "1234"},
+		{Address: "[fe80::1]:0/1234", IP: "fe80::1", Nonce: "1234"},
+		{Address: "v2:[2001:db8:0:0::5]:3300/99", IP: "2001:db8::5", Nonce: "99"},
+		{Address: "[v2:10.0.0.2:3300/5,v1:10.0.0.2:6789/5]", IP: "10.0.0.2", Nonce: "5"},
+		{Address: "[v2:[fe80::2]:3300/5,v1:[fe80::2]:6789/5]", IP: "fe80::2", Nonce: "5"},
+		{Address: "10.0.0.1", Error: true},
+		{Address: "hostname:0/1234", Error: true},
+		{Address: "", Error: true},
+	}
+	for _, x := range tests {
+		ip, nonce, err := parseEntityAddress(x.Address)
+		if x.Error {
+			assert.Error(t, err, "address: %s", x.Address)
+			continue
+		}
+		if assert.NoError(t, err, "address: %s", x.Address) {
+			assert.Equal(t, x.IP, ip, "address: %s", x.Address)
+			assert.Equal(t, x.Nonce, nonce, "address: %s", x.Address)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+)
+
+// the output formats for a plan
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// IsValidFormat ... checks the output format is supported
+func IsValidFormat(format string) bool {
+	return format == FormatText || format == FormatJSON
+}
+
+// Render ... renders the plan in the requested format, either text or json
+func (r FencePlan) Render(format string) (string, error) {
+	switch format {
+	case FormatJSON:
+		content, err := json.Marshal(r)
+		if err != nil {
+			return "", err
+		}
+		return string(content), nil
+	case FormatText:
+		return r.String(), nil
+	}
+
+	return "", fmt.Errorf("unsupported output format: %s", format)
+}
+
+func (r FencePlan) String() string {
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "Fence plan for client: %s, pools: %s, actions: %d\n", r.Address, strings.Join(r.Pools, ","), len(r.Actions))
+
+	w := tabwriter.NewWriter(b, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ACTION\tIMAGE\tLOCK ID\tTYPE\tCLIENT ID\tADDRESS\tREASON")
+	for _, x := range r.Actions {
+		image := ""
+		if x.Pool != "" {
+			image = x.Pool + "/" + x.Image
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", x.Action, image, x.LockID, x.LockType, x.ClientID, x.Address, x.Reason)
+	}
+	w.Flush()
+
+	return b.String()
+}
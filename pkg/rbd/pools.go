@@ -0,0 +1,128 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	// the keyword used to select all the pools
+	allPools = "all"
+)
+
+// PoolSelector ... selects which of the pools in the cluster should be scanned. An empty selector, or
+// one with All set, selects every pool, less any which match the exclude patterns
+type PoolSelector struct {
+	// select all the pools
+	All bool `json:"all,omitempty"`
+	// the exact names of the pools
+	Names []string `json:"names,omitempty"`
+	// glob patterns of the pools to include
+	Include []string `json:"include,omitempty"`
+	// glob patterns of the pools to exclude
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// NewPoolSelector ... creates a pool selector from comma separated lists of names and patterns
+//	names:		the names of the pools, 'all' or empty selects all pools
+//	include:	glob patterns of pools to include
+//	exclude:	glob patterns of pools to exclude
+func NewPoolSelector(names, include, exclude string) (PoolSelector, error) {
+	selector := PoolSelector{
+		Names:   splitList(names),
+		Include: splitList(include),
+		Exclude: splitList(exclude),
+	}
+
+	// step: check if we are selecting all the pools
+	for _, x := range selector.Names {
+		if x == allPools {
+			selector.All = true
+			selector.Names = nil
+			break
+		}
+	}
+	if len(selector.Names) <= 0 && len(selector.Include) <= 0 {
+		selector.All = true
+	}
+
+	// step: validate the patterns
+	for _, x := range append(selector.Include, selector.Exclude...) {
+		if _, err := path.Match(x, ""); err != nil {
+			return PoolSelector{}, fmt.Errorf("invalid pool pattern: '%s', error: %s", x, err)
+		}
+	}
+
+	return selector, nil
+}
+
+// Matches ... checks if the pool is selected
+func (r PoolSelector) Matches(name string) bool {
+	// step: check the exclusions first
+	if matchesAny(r.Exclude, name) {
+		return false
+	}
+	if r.All || (len(r.Names) <= 0 && len(r.Include) <= 0) {
+		return true
+	}
+	for _, x := range r.Names {
+		if x == name {
+			return true
+		}
+	}
+
+	return matchesAny(r.Include, name)
+}
+
+func (r PoolSelector) String() string {
+	var items []string
+	if r.All || (len(r.Names) <= 0 && len(r.Include) <= 0) {
+		items = append(items, allPools)
+	}
+	items = append(items, r.Names...)
+	for _, x := range r.Include {
+		items = append(items, "+"+x)
+	}
+	for _, x := range r.Exclude {
+		items = append(items, "-"+x)
+	}
+	return strings.Join(items, ",")
+}
+
+// matchesAny ... checks if the name matches any of the glob patterns
+func matchesAny(patterns []string, name string) bool {
+	for _, x := range patterns {
+		if matched, _ := path.Match(x, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList ... splits a comma separated list, removing any empty items
+func splitList(list string) []string {
+	var items []string
+	for _, x := range strings.Split(list, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			items = append(items, x)
+		}
+	}
+	return items
+}
@@ -17,12 +17,12 @@ limitations under the License.
 package rbd
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gambol99/rbd-fence/pkg/utils"
@@ -30,11 +30,16 @@ import (
 	"github.com/golang/glog"
 )
 
-type rbdUtil struct{}
+type rbdUtil struct {
+	sync.Mutex
+	// the osd command used to blacklist clients, blocklist on newer releases
+	blacklistCommand string
+}
 
 var (
-	lockRegex      = regexp.MustCompile("^(client\\.[0-9]+)\\s+([[:alnum:]\\._-]*)\\s+([0-9]{1,3}\\.[0-9]{1,3}\\.[0-9]{1,3}\\.[0-9]{1,3}):[0-9]+/([0-9]+)\\s+$")
 	defaultTimeout = time.Duration(15) * time.Second
+	// the osd commands used to blacklist, newest first
+	blacklistCommands = []string{"blocklist", "blacklist"}
 )
 
 // NewRBDInterface ... create a new service interface for rbd operations
@@ -42,10 +47,20 @@ func NewRBDInterface() (RBDInterface, error) {
 	return &rbdUtil{}, nil
 }
 
+// execute ... runs the ceph command with the default timeout, returning the standard output only, as
+// ceph can write warnings to the standard error which would break the parsing of the output
+func (r *rbdUtil) execute(command string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	stdout, _, err := utils.ExecuteContext(ctx, command, args...)
+	return stdout, err
+}
+
 // Get a list of the pool
-func (r rbdUtil) GetPools() ([]CephPool, error) {
+func (r *rbdUtil) GetPools() ([]CephPool, error) {
 	// step: get the pool output
-	result, err := utils.Execute(defaultTimeout, "ceph", "osd", "lspools", "-f", "json")
+	result, err := r.execute("ceph", "osd", "lspools", "-f", "json")
 	if err != nil {
 		return nil, err
 	}
@@ -59,9 +74,9 @@ func (r rbdUtil) GetPools() ([]CephPool, error) {
 	return pools, nil
 }
 
-func (r rbdUtil) GetImages(pool CephPool) ([]RbdImage, error) {
+func (r *rbdUtil) GetImages(pool CephPool) ([]RbdImage, error) {
 	// step: get the pool output
-	result, err := utils.Execute(defaultTimeout, "rbd", "-p", pool.Name, "ls", "-l", "--format", "json")
+	result, err := r.execute("rbd", "-p", pool.Name, "ls", "-l", "--format", "json")
 	if err != nil {
 		return nil, err
 	}
@@ -75,66 +90,314 @@ func (r rbdUtil) GetImages(pool CephPool) ([]RbdImage, error) {
 	return images, nil
 }
 
-func (r rbdUtil) GetLockOwner(image RbdImage, pool CephPool) (RbdOwner, error) {
-	var owner RbdOwner
+// GetLockOwners ... retrieves every locker of the image, the json output is used where the rbd command
+// supports it, falling back to parsing the plain text output
+func (r *rbdUtil) GetLockOwners(image RbdImage, pool CephPool) ([]RbdOwner, error) {
+	// step: attempt to use the json output first
+	owners, err := r.getLockOwnersJSON(image, pool)
+	if err != nil {
+		glog.V(4).Infof("Unable to use the json lock output for image: %s/%s, falling back to text, error: %s", pool.Name, image.Name, err)
+		return r.getLockOwnersText(image, pool)
+	}
 
-	// step: construct the command
-	output, err := utils.Execute(defaultTimeout, "rbd", "-p", pool.Name, "lock", "list", image.Name)
+	return owners, nil
+}
+
+// getLockOwnersJSON ... retrieves the lock owners from the json output of the rbd command. The json output
+// does not carry the lock type or tag, so we take the type from the image and, for shared locks, the tag
+// from the text output
+func (r *rbdUtil) getLockOwnersJSON(image RbdImage, pool CephPool) ([]RbdOwner, error) {
+	output, err := r.execute("rbd", "-p", pool.Name, "lock", "list", "--format", "json", image.Name)
 	if err != nil {
-		return owner, fmt.Errorf("%s, output: %s", err, output)
+		return nil, err
 	}
 
-	// step: parse the output
-	reader := bufio.NewReader(strings.NewReader(string(output)))
-	for {
-		line, err := reader.ReadString('\n')
-		if err == io.EOF {
-			break
-		}
-		if matched := lockRegex.Match([]byte(line)); matched {
-			matches := lockRegex.FindAllStringSubmatch(line, -1)
-			owner.ClientID = matches[0][1]
-			owner.LockID = matches[0][2]
-			owner.Address = matches[0][3]
-			owner.Session = matches[0][4]
+	owners, err := parseLockListJSON(output)
+	if err != nil {
+		return nil, err
+	}
+	if len(owners) <= 0 {
+		return owners, nil
+	}
+
+	var tag string
+	if image.LockType == LockShared {
+		lockers, err := r.getLockOwnersText(image, pool)
+		if err != nil {
+			glog.Warningf("Unable to retrieve the lock tag for image: %s/%s, error: %s", pool.Name, image.Name, err)
+		} else if len(lockers) > 0 {
+			tag = lockers[0].Tag
 		}
 	}
+	for i := range owners {
+		owners[i].LockType = image.LockType
+		owners[i].Tag = tag
+	}
 
-	return owner, nil
+	return owners, nil
 }
 
-// UnlockImage ... removes a rbd lock from the image
+// getLockOwnersText ... retrieves the lock owners from the plain text output of the rbd command
+func (r *rbdUtil) getLockOwnersText(image RbdImage, pool CephPool) ([]RbdOwner, error) {
+	output, err := r.execute("rbd", "-p", pool.Name, "lock", "list", image.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLockListText(output)
+}
+
+// UnlockImage ... removes a lock held by the owner from the image
 //	image:	the details of the image (name/pool) etc that you wish to remove the lock
-func (r rbdUtil) UnlockImage(image RbdImage, cephPool CephPool) error {
+//	owner:	the locker whom lock should be removed
+func (r *rbdUtil) UnlockImage(image RbdImage, cephPool CephPool, owner RbdOwner) error {
 	var name = image.Name
 	var pool = cephPool.Name
 
-	glog.Infof("Removing the lock on image: %s/%s", pool, name)
-	// step: we get the owner of the image
-	owner, err := r.GetLockOwner(image, cephPool)
-	if err != nil {
-		glog.V(4).Infof("Failed to get the lock owner of image: %s/%s, error: %s", pool, name, err)
+	glog.Infof("Removing the lock on image: %s/%s, %s", pool, name, owner)
+
+	// step: construct the command
+	command := UnlockCommand(pool, name, owner)
+	if _, err := r.execute(command[0], command[1:]...); err != nil {
 		return err
 	}
 
-	// step: construct the command
-	output, err := utils.Execute(defaultTimeout, "rbd", "-p", pool, "lock", "remove", name, owner.LockID, owner.ClientID)
+	return nil
+}
+
+// UnlockCommand ... returns the command line used to remove the lock held by the owner from the image
+func UnlockCommand(pool, image string, owner RbdOwner) []string {
+	return []string{"rbd", "-p", pool, "lock", "remove", image, owner.LockID, owner.ClientID}
+}
+
+// BlacklistClient ... adds the client address to the osd blacklist, ensuring it can no longer write to the cluster
+func (r *rbdUtil) BlacklistClient(address string, expiry time.Duration) (*BlacklistEntry, error) {
+	glog.Infof("Blacklisting the client: %s, expiry: %s", address, expiry)
+
+	// step: use the command which worked before, else try each of them in turn
+	commands := blacklistCommands
+	if command := r.getBlacklistCommand(); command != "" {
+		commands = []string{command}
+	}
+
+	var lastErr error
+	for _, command := range commands {
+		args := []string{"osd", command, "add", address}
+		if expiry > 0 {
+			args = append(args, strconv.FormatFloat(expiry.Seconds(), 'f', -1, 64))
+		}
+		if _, err := r.execute("ceph", args...); err != nil {
+			glog.V(4).Infof("Failed to blacklist client: %s using the %s command, error: %s", address, command, err)
+			lastErr = err
+			continue
+		}
+		r.setBlacklistCommand(command)
+
+		entry := &BlacklistEntry{
+			Address: address,
+			Command: command,
+			Expiry:  expiry,
+		}
+		if expiry > 0 {
+			entry.Expires = time.Now().Add(expiry)
+		}
+
+		return entry, nil
+	}
+
+	return nil, lastErr
+}
+
+// UnlockClient ... find any images in the selected pools which have been locked by the client ip address and removes them.
+// The images which fail to unlock are retried with the backoff, a FenceError is returned if any are left locked
+func (r *rbdUtil) UnlockClient(address string, selector PoolSelector, options FenceOptions) (*FenceResult, error) {
+	glog.V(3).Infof("Attemping to remove any lock for client: %s, pools: %s", address, selector)
+	result := &FenceResult{Address: address, Unlocked: make([]string, 0), Images: make([]ImageResult, 0)}
+
+	// step: get the pools we are interested in
+	pools, err := r.selectPools(selector)
 	if err != nil {
-		return fmt.Errorf("%s, output: %s", err, output)
+		return result, err
+	}
+
+	// step: find the images locked by the client, anything we could not check may still be locked
+	locked, skipped := r.findClientLocks(address, pools)
+	for _, x := range skipped {
+		result.Images = append(result.Images, ImageResult{Pool: x.Pool, Image: x.Image, Result: ResultSkipped, Error: x.Reason})
+	}
+	if len(locked) <= 0 {
+		glog.V(3).Infof("Client: %s does not hold any locks", address)
+		return result, newFenceError(result)
 	}
 
+	// step: fence the client before we break any of the locks
+	if options.Blacklist || options.RequireBlacklist {
+		entry, err := r.BlacklistClient(address, options.BlacklistExpiry)
+		if err != nil {
+			if options.RequireBlacklist {
+				for _, x := range locked {
+					result.Images = append(result.Images, x.result(ResultSkipped, "the client was not blacklisted"))
+				}
+				return result, fmt.Errorf("refusing to break the locks, unable to blacklist client: %s, error: %s", address, err)
+			}
+			glog.Errorf("Failed to blacklist the client: %s, continuing to remove locks, error: %s", address, err)
+		}
+		result.Blacklist = entry
+	}
+
+	// step: remove the locks, retrying those which failed
+	images := make([]ImageResult, len(locked))
+	for i, x := range locked {
+		images[i] = x.result(ResultFailed, "")
+	}
+	var cancelled error
+	for attempt := 1; cancelled == nil; attempt++ {
+		failed := 0
+		for i, x := range locked {
+			if images[i].Result == ResultUnlocked {
+				continue
+			}
+			// step: once cancelled we leave the remaining images locked
+			if cancelled = options.Cancelled(); cancelled != nil {
+				break
+			}
+			glog.V(4).Infof("Client: %s has image: %s/%s locked, attempting to remove lock: %s, attempt: %d", address, x.pool.Name, x.image.Name, x.owner.LockID, attempt)
+			images[i].Attempts = attempt
+			started := time.Now()
+			err := r.UnlockImage(x.image, x.pool, x.owner)
+			if options.OnUnlock != nil {
+				options.OnUnlock(UnlockEvent{
+					Pool:     x.pool.Name,
+					Image:    x.image.Name,
+					Owner:    x.owner,
+					Command:  UnlockCommand(x.pool.Name, x.image.Name, x.owner),
+					Attempt:  attempt,
+					Started:  started,
+					Duration: time.Since(started),
+					Error:    err,
+				})
+			}
+			if err != nil {
+				glog.Errorf("Failed to unlock the image: %s/%s, attempt: %d, error: %s", x.pool.Name, x.image.Name, attempt, err)
+				images[i].Error = err.Error()
+				failed++
+				continue
+			}
+			glog.Infof("Successfully removed the lock on %s/%s from client: %s", x.pool.Name, x.image.Name, address)
+			images[i].Result = ResultUnlocked
+			images[i].Error = ""
+			result.Unlocked = append(result.Unlocked, fmt.Sprintf("%s/%s", x.pool.Name, x.image.Name))
+		}
+		if cancelled != nil || failed <= 0 || attempt >= options.Retry.Attempts {
+			break
+		}
+		delay := options.Retry.Duration(attempt)
+		glog.Warningf("Failed to unlock %d image(s) held by client: %s, retrying in %s", failed, address, delay)
+		cancelled = options.Wait(delay)
+	}
+	if cancelled != nil {
+		glog.Warningf("The fence of client: %s was cancelled, leaving the remaining images locked", address)
+		skipCancelled(images)
+	}
+	result.Images = append(result.Images, images...)
+	if cancelled != nil {
+		return result, fmt.Errorf("the fence of client: %s was cancelled, error: %s", address, cancelled)
+	}
+
+	return result, newFenceError(result)
+}
+
+// skipCancelled ... marks the images we did not unlock as skipped by the cancellation
+func skipCancelled(images []ImageResult) {
+	for i := range images {
+		if images[i].Result != ResultUnlocked {
+			images[i].Result = ResultSkipped
+			images[i].Error = "the fence was cancelled"
+		}
+	}
+}
+
+// newFenceError ... returns a FenceError if any of the images in the result were left locked
+func newFenceError(result *FenceResult) error {
+	if failed := result.Failed(); len(failed) > 0 {
+		return &FenceError{Address: result.Address, Failed: failed}
+	}
 	return nil
 }
 
-// UnlockClient ... find any images which have been locked by the client ip address and removes them
-func (r rbdUtil) UnlockClient(address string) error {
-	glog.V(3).Infof("Attemping to remove any lock for client: %s", address)
+// PlanClient ... performs the same discovery as UnlockClient, but rather than removing the locks returns
+// the actions which would have been taken
+func (r *rbdUtil) PlanClient(address string, selector PoolSelector, options FenceOptions) (*FencePlan, error) {
+	glog.V(3).Infof("Planning the removal of any locks for client: %s, pools: %s", address, selector)
+	plan := &FencePlan{Address: address, Pools: make([]string, 0), Actions: make([]PlanAction, 0)}
 
-	// step: this is horrid, but will suffice for now
-	pools, err := r.GetPools()
+	// step: get the pools we are interested in
+	pools, err := r.selectPools(selector)
 	if err != nil {
-		return err
+		return plan, err
+	}
+	for _, pool := range pools {
+		plan.Pools = append(plan.Pools, pool.Name)
+	}
+
+	// step: find the images locked by the client
+	locked, skipped := r.findClientLocks(address, pools)
+
+	if len(locked) > 0 && (options.Blacklist || options.RequireBlacklist) {
+		action := PlanAction{
+			Action:  ActionBlacklist,
+			Address: address,
+			Reason:  fmt.Sprintf("expiry: %s", options.BlacklistExpiry),
+		}
+		if options.RequireBlacklist {
+			action.Reason += ", locks are only removed if this succeeds"
+		}
+		plan.Actions = append(plan.Actions, action)
 	}
+	for _, x := range locked {
+		plan.Actions = append(plan.Actions, PlanAction{
+			Action:   ActionUnlock,
+			Pool:     x.pool.Name,
+			Image:    x.image.Name,
+			LockID:   x.owner.LockID,
+			ClientID: x.owner.ClientID,
+			Address:  x.owner.Address,
+			LockType: x.owner.LockType,
+			Tag:      x.owner.Tag,
+		})
+	}
+	plan.Actions = append(plan.Actions, skipped...)
+
+	return plan, nil
+}
+
+// clientLock ... a lock on a image held by a client
+type clientLock struct {
+	// the pool the image lives in
+	pool CephPool
+	// the image which is locked
+	image RbdImage
+	// the owner of the lock
+	owner RbdOwner
+}
+
+// result ... returns the outcome of unlocking the image
+func (r clientLock) result(outcome, reason string) ImageResult {
+	return ImageResult{
+		Pool:     r.pool.Name,
+		Image:    r.image.Name,
+		LockID:   r.owner.LockID,
+		ClientID: r.owner.ClientID,
+		Result:   outcome,
+		Error:    reason,
+	}
+}
+
+// findClientLocks ... iterates the pools looking for images locked by the client address, along with
+// any images which had to be skipped
+func (r *rbdUtil) findClientLocks(address string, pools []CephPool) ([]clientLock, []PlanAction) {
+	var locked []clientLock
+	var skipped []PlanAction
 
 	// step: iterate the pool and looks for images
 	for _, pool := range pools {
@@ -142,6 +405,13 @@ func (r rbdUtil) UnlockClient(address string) error {
 		// step: get all the images for this pool
 		images, err := r.GetImages(pool)
 		if err != nil {
+			glog.Errorf("Failed to get the images in pool: %s, error: %s", pool.Name, err)
+			skipped = append(skipped, PlanAction{
+				Action:  ActionSkip,
+				Pool:    pool.Name,
+				Address: address,
+				Reason:  fmt.Sprintf("unable to list the images, error: %s", err),
+			})
 			continue
 		}
 
@@ -153,25 +423,103 @@ func (r rbdUtil) UnlockClient(address string) error {
 				continue
 			}
 
-			// step: get the owner
-			owner, err := r.GetLockOwner(image, pool)
+			// step: get the lockers
+			owners, err := r.GetLockOwners(image, pool)
 			if err != nil {
-				glog.Errorf("Failed to get the owner of the image: %s/%s, error: %s", pool.Name, image.Name, err)
+				glog.Errorf("Failed to get the owners of the image: %s/%s, error: %s", pool.Name, image.Name, err)
+				skipped = append(skipped, PlanAction{
+					Action:  ActionSkip,
+					Pool:    pool.Name,
+					Image:   image.Name,
+					Address: address,
+					Reason:  fmt.Sprintf("unable to get the lock owners, error: %s", err),
+				})
 				continue
 			}
-			// step: is the owner us?
-			if owner.Address == address {
-				glog.V(4).Infof("Client: %s has image: %s/%s locked, attempting to remove lock", address, pool.Name, image.Name)
-				// we need to unlock the image
-				err := r.UnlockImage(image, pool)
-				if err != nil {
-					glog.Errorf("Failed to unable the image: %s/%s, error: %s", pool.Name, image.Name, err)
+			// step: we only want the locks held by the client, any other lockers are left alone
+			for _, owner := range owners {
+				if owner.Address != address {
+					glog.V(5).Infof("Skipping the lock on image: %s/%s held by another client, %s", pool.Name, image.Name, owner)
 					continue
 				}
-				glog.Infof("Successfully removed the lock on %s/%s from client: %s", pool.Name, image.Name, address)
+				glog.V(4).Infof("Client: %s has image: %s/%s locked, %s", address, pool.Name, image.Name, owner)
+				locked = append(locked, clientLock{pool: pool, image: image, owner: owner})
 			}
 		}
 	}
 
-	return nil
+	return locked, skipped
+}
+
+// ListLocks ... retrieves every lock held on the images in the selected pools
+//	selector:	the pools we should be checking
+func (r *rbdUtil) ListLocks(selector PoolSelector) ([]ImageLock, error) {
+	pools, err := r.selectPools(selector)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve the pools, error: %s", err)
+	}
+
+	locks := make([]ImageLock, 0)
+	for _, pool := range pools {
+		images, err := r.GetImages(pool)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get the images in pool: %s, error: %s", pool.Name, err)
+		}
+		for _, image := range images {
+			if !image.IsLocked() {
+				continue
+			}
+			owners, err := r.GetLockOwners(image, pool)
+			if err != nil {
+				return nil, fmt.Errorf("unable to get the owners of the image: %s/%s, error: %s", pool.Name, image.Name, err)
+			}
+			for _, owner := range owners {
+				locks = append(locks, ImageLock{Pool: pool.Name, Image: image.Name, Owner: owner})
+			}
+		}
+	}
+
+	return locks, nil
+}
+
+// selectPools ... retrieves the pools in the cluster and filters them by the selector
+func (r *rbdUtil) selectPools(selector PoolSelector) ([]CephPool, error) {
+	pools, err := r.GetPools()
+	if err != nil {
+		return nil, err
+	}
+
+	var list []CephPool
+	found := make(map[string]bool, 0)
+	for _, pool := range pools {
+		found[pool.Name] = true
+		if !selector.Matches(pool.Name) {
+			glog.V(5).Infof("Skipping the pool: %s as it is not selected", pool.Name)
+			continue
+		}
+		list = append(list, pool)
+	}
+
+	// step: warn about any pools which were asked for but do not exist
+	for _, name := range selector.Names {
+		if !found[name] {
+			glog.Warningf("The pool: %s does not exist in the cluster", name)
+		}
+	}
+
+	return list, nil
+}
+
+// getBlacklistCommand ... returns the blacklist command known to work
+func (r *rbdUtil) getBlacklistCommand() string {
+	r.Lock()
+	defer r.Unlock()
+	return r.blacklistCommand
+}
+
+// setBlacklistCommand ... records the blacklist command which worked
+func (r *rbdUtil) setBlacklistCommand(command string) {
+	r.Lock()
+	defer r.Unlock()
+	r.blacklistCommand = command
 }
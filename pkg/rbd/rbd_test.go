@@ -0,0 +1,358 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+	"github.com/gambol99/rbd-fence/pkg/rbd/fake"
+	"github.com/gambol99/rbd-fence/pkg/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	// step: the fake ceph and rbd executables re-invoke the test binary
+	fake.Main()
+	os.Exit(m.Run())
+}
+
+// newTestCluster ... creates a cluster with two pools, the client 10.0.0.1 holds locks in both
+func newTestCluster(release string) *fake.Cluster {
+	cluster := fake.NewCluster(release)
+	pool := cluster.AddPool("rbd")
+	pool.AddImage("vol1").Lock("auto 139643345791728", "client.4161", "10.0.0.1")
+	pool.AddImage("vol2").Lock("auto 139643345791729", "client.4162", "10.0.0.2")
+	pool.AddImage("vol3")
+	pool.AddImage("shared").
+		LockShared("kubernetes", "kubelet_lock_magic_node1", "client.4161", "10.0.0.1").
+		LockShared("kubernetes", "kubelet_lock_magic_node2", "client.4162", "10.0.0.2")
+	cluster.AddPool("volumes").AddImage("data1").Lock("auto 94813652211712", "client.4161", "10.0.0.1")
+
+	return cluster
+}
+
+func newTestClient(t *testing.T, cluster *fake.Cluster) (rbd.RBDInterface, *fake.Commands) {
+	commands, err := fake.Install(t.TempDir(), cluster)
+	if err != nil {
+		t.Fatalf("unable to install the fake commands, error: %s", err)
+	}
+	t.Setenv("PATH", commands.Path())
+	client, err := rbd.NewRBDInterface()
+	if err != nil {
+		t.Fatalf("unable to create the rbd interface, error: %s", err)
+	}
+	return client, commands
+}
+
+func allPools(t *testing.T) rbd.PoolSelector {
+	selector, err := rbd.NewPoolSelector("all", "", "")
+	if err != nil {
+		t.Fatalf("unable to create the pool selector, error: %s", err)
+	}
+	return selector
+}
+
+func TestGetPools(t *testing.T) {
+	client, _ := newTestClient(t, newTestCluster(""))
+	pools, err := client.GetPools()
+	assert.NoError(t, err)
+	assert.Equal(t, []rbd.CephPool{{PoolNum: 1, Name: "rbd"}, {PoolNum: 2, Name: "volumes"}}, pools)
+}
+
+func TestGetImages(t *testing.T) {
+	client, _ := newTestClient(t, newTestCluster(""))
+	images, err := client.GetImages(rbd.CephPool{Name: "rbd"})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(images))
+	assert.Equal(t, "vol1", images[0].Name)
+	assert.Equal(t, rbd.LockExclusive, images[0].LockType)
+	assert.False(t, images[2].IsLocked())
+	assert.Equal(t, rbd.LockShared, images[3].LockType)
+
+	_, err = client.GetImages(rbd.CephPool{Name: "missing"})
+	assert.Error(t, err)
+}
+
+func TestCommandWarnings(t *testing.T) {
+	cluster := newTestCluster("")
+	cluster.Warning = "2023-06-01T10:00:00.000+0000 7f1c warning: unable to load the keyring"
+	client, _ := newTestClient(t, cluster)
+
+	// step: the warnings on the standard error should not break the parsing of the output
+	pools, err := client.GetPools()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(pools))
+	images, err := client.GetImages(rbd.CephPool{Name: "rbd"})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(images))
+	owners, err := client.GetLockOwners(images[0], rbd.CephPool{Name: "rbd"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(owners))
+}
+
+func TestCommandErrors(t *testing.T) {
+	client, _ := newTestClient(t, newTestCluster(""))
+
+	_, err := client.GetImages(rbd.CephPool{Name: "missing"})
+	var execErr *utils.ExecError
+	if assert.True(t, errors.As(err, &execErr)) {
+		assert.Equal(t, "rbd -p missing ls -l --format json", execErr.Command)
+		assert.NotEqual(t, 0, execErr.ExitCode)
+		assert.Contains(t, execErr.Stderr, "error opening pool 'missing'")
+		assert.False(t, execErr.TimedOut)
+	}
+}
+
+func TestGetLockOwners(t *testing.T) {
+	for _, release := range []string{"hammer", "luminous", "nautilus", "pacific", "quincy"} {
+		client, _ := newTestClient(t, newTestCluster(release))
+		pool := rbd.CephPool{Name: "rbd"}
+
+		owners, err := client.GetLockOwners(rbd.RbdImage{Name: "vol1", LockType: rbd.LockExclusive}, pool)
+		assert.NoError(t, err, "release: %s", release)
+		if assert.Equal(t, 1, len(owners), "release: %s", release) {
+			assert.Equal(t, "auto 139643345791728", owners[0].LockID)
+			assert.Equal(t, "client.4161", owners[0].ClientID)
+			assert.Equal(t, "10.0.0.1", owners[0].Address)
+			assert.Equal(t, "1014129", owners[0].Session)
+			assert.Equal(t, rbd.LockExclusive, owners[0].LockType)
+		}
+
+		owners, err = client.GetLockOwners(rbd.RbdImage{Name: "shared", LockType: rbd.LockShared}, pool)
+		assert.NoError(t, err, "release: %s", release)
+		if assert.Equal(t, 2, len(owners), "release: %s", release) {
+			assert.Equal(t, "kubelet_lock_magic_node1", owners[0].LockID)
+			assert.Equal(t, "10.0.0.2", owners[1].Address)
+			assert.Equal(t, "kubernetes", owners[0].Tag)
+			assert.Equal(t, rbd.LockShared, owners[1].LockType)
+		}
+	}
+}
+
+func TestUnlockClient(t *testing.T) {
+	client, commands := newTestClient(t, newTestCluster(""))
+
+	result, err := client.UnlockClient("10.0.0.1", allPools(t), rbd.FenceOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, result.Blacklist)
+	assert.Equal(t, []string{"rbd/vol1", "rbd/shared", "volumes/data1"}, result.Unlocked)
+	if assert.Equal(t, 3, len(result.Images)) {
+		assert.Equal(t, rbd.ImageResult{
+			Pool:     "rbd",
+			Image:    "vol1",
+			LockID:   "auto 139643345791728",
+			ClientID: "client.4161",
+			Result:   rbd.ResultUnlocked,
+			Attempts: 1,
+		}, result.Images[0])
+	}
+	assert.Equal(t, 0, len(result.Failed()))
+
+	// step: only the locks held by the client should have been removed
+	cluster, err := commands.Cluster()
+	assert.NoError(t, err)
+	vol2, _ := cluster.GetImage("rbd", "vol2")
+	assert.Equal(t, 1, len(vol2.Lockers))
+	shared, _ := cluster.GetImage("rbd", "shared")
+	if assert.Equal(t, 1, len(shared.Lockers)) {
+		assert.Equal(t, "client.4162", shared.Lockers[0].ClientID)
+	}
+	data1, _ := cluster.GetImage("volumes", "data1")
+	assert.Equal(t, 0, len(data1.Lockers))
+}
+
+func TestUnlockClientRetries(t *testing.T) {
+	cluster := newTestCluster("")
+	vol1, _ := cluster.GetImage("rbd", "vol1")
+	vol1.FailUnlock(2)
+	client, commands := newTestClient(t, cluster)
+
+	options := rbd.FenceOptions{Retry: rbd.Backoff{Attempts: 3, Delay: time.Millisecond}}
+	result, err := client.UnlockClient("10.0.0.1", allPools(t), options)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"rbd/shared", "volumes/data1", "rbd/vol1"}, result.Unlocked)
+	if assert.Equal(t, 3, len(result.Images)) {
+		assert.Equal(t, rbd.ResultUnlocked, result.Images[0].Result)
+		assert.Equal(t, 3, result.Images[0].Attempts)
+		assert.Empty(t, result.Images[0].Error)
+		// step: only the failed image should have been retried
+		assert.Equal(t, 1, result.Images[1].Attempts)
+	}
+	cluster, _ = commands.Cluster()
+	vol1, _ = cluster.GetImage("rbd", "vol1")
+	assert.Equal(t, 0, len(vol1.Lockers))
+}
+
+func TestUnlockClientFailures(t *testing.T) {
+	cluster := newTestCluster("")
+	vol1, _ := cluster.GetImage("rbd", "vol1")
+	vol1.FailUnlock(5)
+	client, _ := newTestClient(t, cluster)
+
+	options := rbd.FenceOptions{Retry: rbd.Backoff{Attempts: 2, Delay: time.Millisecond}}
+	result, err := client.UnlockClient("10.0.0.1", allPools(t), options)
+	var fenceErr *rbd.FenceError
+	if assert.True(t, errors.As(err, &fenceErr)) {
+		assert.Equal(t, "10.0.0.1", fenceErr.Address)
+		if assert.Equal(t, 1, len(fenceErr.Failed)) {
+			assert.Equal(t, "vol1", fenceErr.Failed[0].Image)
+			assert.Equal(t, rbd.ResultFailed, fenceErr.Failed[0].Result)
+			assert.Equal(t, 2, fenceErr.Failed[0].Attempts)
+			assert.Contains(t, fenceErr.Failed[0].Error, "Device or resource busy")
+		}
+		assert.Contains(t, err.Error(), "rbd/vol1")
+	}
+	// step: the other images should still have been unlocked
+	assert.Equal(t, []string{"rbd/shared", "volumes/data1"}, result.Unlocked)
+}
+
+func TestUnlockClientCancelled(t *testing.T) {
+	cluster := newTestCluster("")
+	vol1, _ := cluster.GetImage("rbd", "vol1")
+	vol1.FailUnlock(100)
+	client, commands := newTestClient(t, cluster)
+
+	// step: the retry of the failed image is cut short by the cancellation
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(3)*time.Second)
+	defer cancel()
+	options := rbd.FenceOptions{Retry: rbd.Backoff{Attempts: 3, Delay: time.Minute}, Context: ctx}
+	started := time.Now()
+	result, err := client.UnlockClient("10.0.0.1", allPools(t), options)
+	assert.True(t, time.Since(started) < time.Duration(30)*time.Second)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "cancelled")
+	}
+	assert.Equal(t, []string{"rbd/shared", "volumes/data1"}, result.Unlocked)
+	if assert.Equal(t, 1, len(result.Failed())) {
+		assert.Equal(t, rbd.ResultSkipped, result.Failed()[0].Result)
+	}
+
+	// step: a fence cancelled before it starts leaves every lock in place
+	cluster = newTestCluster("")
+	client, commands = newTestClient(t, cluster)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err = client.UnlockClient("10.0.0.1", allPools(t), rbd.FenceOptions{Context: cancelled})
+	assert.Error(t, err)
+	assert.Equal(t, 0, len(result.Unlocked))
+	assert.Equal(t, 3, len(result.Failed()))
+	cluster, _ = commands.Cluster()
+	vol1, _ = cluster.GetImage("rbd", "vol1")
+	assert.Equal(t, 1, len(vol1.Lockers))
+}
+
+func TestBackoffDuration(t *testing.T) {
+	backoff := rbd.Backoff{Delay: time.Second, MaxDelay: time.Duration(5) * time.Second}
+	assert.Equal(t, time.Second, backoff.Duration(1))
+	assert.Equal(t, time.Duration(2)*time.Second, backoff.Duration(2))
+	assert.Equal(t, time.Duration(4)*time.Second, backoff.Duration(3))
+	assert.Equal(t, time.Duration(5)*time.Second, backoff.Duration(4))
+	assert.Equal(t, time.Duration(5)*time.Second, backoff.Duration(100))
+
+	backoff.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := backoff.Duration(2)
+		assert.True(t, delay >= time.Second && delay <= time.Duration(3)*time.Second, "delay: %s", delay)
+	}
+
+	assert.NoError(t, rbd.DefaultBackoff.Validate())
+	assert.Error(t, rbd.Backoff{Jitter: 1.5}.Validate())
+	assert.Error(t, rbd.Backoff{Delay: -time.Second}.Validate())
+}
+
+func TestUnlockClientSelectedPools(t *testing.T) {
+	client, commands := newTestClient(t, newTestCluster(""))
+	selector, _ := rbd.NewPoolSelector("volumes", "", "")
+
+	result, err := client.UnlockClient("10.0.0.1", selector, rbd.FenceOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"volumes/data1"}, result.Unlocked)
+
+	// step: the rbd pool should never have been listed
+	calls, err := commands.Calls()
+	assert.NoError(t, err)
+	for _, call := range calls {
+		assert.NotEqual(t, []string{"rbd", "-p", "rbd", "ls", "-l", "--format", "json"}, call)
+	}
+}
+
+func TestUnlockClientBlacklist(t *testing.T) {
+	client, commands := newTestClient(t, newTestCluster("quincy"))
+
+	result, err := client.UnlockClient("10.0.0.1", allPools(t), rbd.FenceOptions{Blacklist: true, BlacklistExpiry: time.Hour})
+	assert.NoError(t, err)
+	if assert.NotNil(t, result.Blacklist) {
+		assert.Equal(t, "blocklist", result.Blacklist.Command)
+	}
+	cluster, _ := commands.Cluster()
+	assert.True(t, cluster.IsBlacklisted("10.0.0.1"))
+}
+
+func TestUnlockClientBlacklistFallback(t *testing.T) {
+	client, commands := newTestClient(t, newTestCluster("luminous"))
+
+	entry, err := client.BlacklistClient("10.0.0.1", time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, "blacklist", entry.Command)
+	_, err = client.BlacklistClient("10.0.0.2", time.Hour)
+	assert.NoError(t, err)
+
+	// step: the working command should be remembered
+	calls, _ := commands.Calls()
+	assert.Equal(t, [][]string{
+		{"ceph", "osd", "blocklist", "add", "10.0.0.1", "3600"},
+		{"ceph", "osd", "blacklist", "add", "10.0.0.1", "3600"},
+		{"ceph", "osd", "blacklist", "add", "10.0.0.2", "3600"},
+	}, calls)
+}
+
+func TestPlanClient(t *testing.T) {
+	client, commands := newTestClient(t, newTestCluster(""))
+
+	plan, err := client.PlanClient("10.0.0.1", allPools(t), rbd.FenceOptions{RequireBlacklist: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"rbd", "volumes"}, plan.Pools)
+	if assert.Equal(t, 4, len(plan.Actions)) {
+		assert.Equal(t, rbd.ActionBlacklist, plan.Actions[0].Action)
+		assert.Equal(t, rbd.ActionUnlock, plan.Actions[1].Action)
+		assert.Equal(t, "vol1", plan.Actions[1].Image)
+	}
+
+	// step: nothing should have changed
+	calls, _ := commands.Calls()
+	for _, call := range calls {
+		assert.NotContains(t, call, "remove")
+		assert.NotContains(t, call, "blocklist")
+	}
+}
+
+func TestListLocks(t *testing.T) {
+	client, _ := newTestClient(t, newTestCluster(""))
+
+	locks, err := client.ListLocks(allPools(t))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(locks))
+	assert.Equal(t, "volumes", locks[4].Pool)
+	assert.Equal(t, "data1", locks[4].Image)
+	assert.Equal(t, "client.4161", locks[4].Owner.ClientID)
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconcile
+
+import (
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/membership"
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+)
+
+// Config ... the configuration for the reconciler
+type Config struct {
+	// the interval between the scans
+	Interval time.Duration
+	// the number of consecutive scans a lock must be orphaned before it is fenced
+	Threshold int
+	// the pools to scan
+	Pools rbd.PoolSelector
+	// the rbd interface used to list the locks
+	Client rbd.RBDInterface
+	// the source of the running nodes
+	Source membership.EventSource
+	// returns the nodes no longer running which we still know of, i.e. stopped in the source or awaiting a
+	// fence, so the addresses of the nodes which died before a restart are not taken as unknown, optional
+	History func() []membership.Node
+	// returns true if we should be scanning, i.e. we are the leader
+	Active func() bool
+	// called to fence an orphaned address, along with the node which last owned it
+	Fence func(node membership.Node, address string) error
+	// called when a lock is first found orphaned, optional
+	Orphaned func(Orphan)
+}
+
+// Orphan ... a lock held by an address which belonged to a node no longer running
+type Orphan struct {
+	// the lock on the image
+	Lock rbd.ImageLock `json:"lock"`
+	// the node which last owned the address
+	NodeID string `json:"node_id"`
+	// the number of consecutive scans the address has been orphaned
+	Scans int `json:"scans"`
+}
+
+// Report ... the outcome of a scan of the locks
+type Report struct {
+	// the time of the scan
+	Scanned time.Time `json:"scanned"`
+	// the number of locks found
+	Locks int `json:"locks"`
+	// the locks held by addresses of nodes no longer running
+	Orphans []Orphan `json:"orphans"`
+	// the locks held by addresses we have never seen in the environment, these are never broken
+	Unknown []rbd.ImageLock `json:"unknown"`
+	// the addresses we fenced on this scan
+	Fenced []string `json:"fenced"`
+}
+
+// ReconcilerInterface ... the interface to the orphaned lock reconciler
+type ReconcilerInterface interface {
+	// Scan the locks now, fencing any addresses which have exceeded the threshold
+	Scan() (*Report, error)
+	// Get the report from the last scan
+	LastReport() *Report
+	// Change the interval, threshold and pools of the reconciler
+	Reconfigure(Config) error
+	// Stop the reconciler
+	Stop()
+}
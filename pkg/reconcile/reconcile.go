@@ -0,0 +1,245 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconcile
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/membership"
+	"github.com/gambol99/rbd-fence/pkg/metrics"
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+
+	"github.com/golang/glog"
+)
+
+// the implementation of the ReconcilerInterface
+type reconciler struct {
+	sync.Mutex
+	// the configuration
+	config Config
+	// the addresses we have seen in use by the nodes, the address to the node
+	known map[string]membership.Node
+	// the number of consecutive scans an address has been orphaned
+	orphaned map[string]int
+	// the last report
+	report *Report
+	// the channel used to stop the loop
+	stopCh chan struct{}
+}
+
+// NewReconciler ... creates a new reconciler, scanning the locks on the interval
+func NewReconciler(config Config) (ReconcilerInterface, error) {
+	glog.Infof("Starting the orphaned lock reconciler, interval: %s, threshold: %d, pools: %s",
+		config.Interval, config.Threshold, config.Pools)
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("the reconcile interval must be positive")
+	}
+	if config.Threshold < 1 {
+		return nil, fmt.Errorf("the reconcile threshold must be at least one scan")
+	}
+	if config.Client == nil || config.Source == nil || config.Fence == nil {
+		return nil, fmt.Errorf("the reconciler requires a rbd client, event source and fence method")
+	}
+	if config.Active == nil {
+		config.Active = func() bool { return true }
+	}
+
+	service := &reconciler{
+		config:   config,
+		known:    make(map[string]membership.Node, 0),
+		orphaned: make(map[string]int, 0),
+		stopCh:   make(chan struct{}),
+	}
+	service.observe(config.Source.GetRunningNodes())
+	go service.run()
+
+	return service, nil
+}
+
+// Scan ... scans the locks, fencing any address orphaned beyond the threshold
+func (r *reconciler) Scan() (*Report, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	running := r.config.Source.GetRunningNodes()
+	r.observe(running)
+
+	locks, err := r.config.Client.ListLocks(r.config.Pools)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the locks, error: %s", err)
+	}
+
+	// step: build a list of the addresses in use
+	inuse := make(map[string]bool, 0)
+	for _, node := range running {
+		for _, address := range node.Addresses {
+			inuse[address] = true
+		}
+	}
+
+	report := &Report{
+		Scanned: time.Now(),
+		Locks:   len(locks),
+		Orphans: make([]Orphan, 0),
+		Unknown: make([]rbd.ImageLock, 0),
+		Fenced:  make([]string, 0),
+	}
+	// step: an address we have not seen could belong to a node which died before we started
+	for _, lock := range locks {
+		if _, found := r.known[lock.Owner.Address]; !found && !inuse[lock.Owner.Address] {
+			r.recall()
+			break
+		}
+	}
+
+	orphaned := make(map[string]int, 0)
+	for _, lock := range locks {
+		address := lock.Owner.Address
+		if inuse[address] {
+			continue
+		}
+		node, found := r.known[address]
+		if !found {
+			glog.Warningf("The lock on image: %s/%s is held by an unknown owner, %s", lock.Pool, lock.Image, lock.Owner)
+			report.Unknown = append(report.Unknown, lock)
+			continue
+		}
+		if _, counted := orphaned[address]; !counted {
+			orphaned[address] = r.orphaned[address] + 1
+		}
+		orphan := Orphan{Lock: lock, NodeID: node.ID, Scans: orphaned[address]}
+		if orphan.Scans == 1 && r.config.Orphaned != nil {
+			r.config.Orphaned(orphan)
+		}
+		report.Orphans = append(report.Orphans, orphan)
+	}
+	r.orphaned = orphaned
+
+	// step: fence any addresses which have been orphaned long enough
+	for address, scans := range orphaned {
+		if scans < r.config.Threshold {
+			glog.Infof("The address: %s of node: %s holds orphaned locks, scans: %d/%d", address, r.known[address].ID, scans, r.config.Threshold)
+			continue
+		}
+		node := r.known[address]
+		glog.Infof("The address: %s of node: %s has held orphaned locks for %d scans, fencing", address, node.ID, scans)
+		if err := r.config.Fence(node, address); err != nil {
+			glog.Errorf("Failed to fence the orphaned address: %s, error: %s", address, err)
+			continue
+		}
+		report.Fenced = append(report.Fenced, address)
+		delete(r.orphaned, address)
+	}
+
+	metrics.OrphanedLocks.Set(float64(len(report.Orphans)))
+	metrics.UnknownLocks.Set(float64(len(report.Unknown)))
+	r.report = report
+
+	return report, nil
+}
+
+// LastReport ... returns the report from the last scan
+func (r *reconciler) LastReport() *Report {
+	r.Lock()
+	defer r.Unlock()
+	return r.report
+}
+
+// Reconfigure ... changes the interval, threshold and pools, the other options are ignored. The consecutive
+// scans of the orphaned addresses are kept
+func (r *reconciler) Reconfigure(config Config) error {
+	if config.Interval <= 0 {
+		return fmt.Errorf("the reconcile interval must be positive")
+	}
+	if config.Threshold < 1 {
+		return fmt.Errorf("the reconcile threshold must be at least one scan")
+	}
+	r.Lock()
+	defer r.Unlock()
+	glog.Infof("Reconfiguring the orphaned lock reconciler, interval: %s, threshold: %d, pools: %s",
+		config.Interval, config.Threshold, config.Pools)
+	r.config.Interval = config.Interval
+	r.config.Threshold = config.Threshold
+	r.config.Pools = config.Pools
+
+	return nil
+}
+
+// Stop ... stops the reconciler
+func (r *reconciler) Stop() {
+	close(r.stopCh)
+}
+
+// run ... scans the locks on the interval while we are active
+func (r *reconciler) run() {
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-time.After(r.getInterval()):
+		}
+		if !r.config.Active() {
+			glog.V(4).Infof("Skipping the reconcile scan as we are not active")
+			r.reset()
+			continue
+		}
+		if _, err := r.Scan(); err != nil {
+			glog.Errorf("Failed to reconcile the locks, error: %s", err)
+		}
+	}
+}
+
+// getInterval ... returns the interval between the scans
+func (r *reconciler) getInterval() time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	return r.config.Interval
+}
+
+// reset ... forgets the consecutive scans, they are only valid while we are scanning
+func (r *reconciler) reset() {
+	r.Lock()
+	defer r.Unlock()
+	r.orphaned = make(map[string]int, 0)
+}
+
+// recall ... records the addresses of the nodes in the history, the addresses of the running nodes are kept as
+// they are the more recent, the lock must be held
+func (r *reconciler) recall() {
+	if r.config.History == nil {
+		return
+	}
+	for _, node := range r.config.History() {
+		for _, address := range node.Addresses {
+			if _, found := r.known[address]; !found {
+				glog.V(4).Infof("Recalled the address: %s of the node: %s from the history", address, node.ID)
+				r.known[address] = node
+			}
+		}
+	}
+}
+
+// observe ... records the addresses in use by the running nodes, the lock must be held
+func (r *reconciler) observe(nodes map[string]membership.Node) {
+	for _, node := range nodes {
+		for _, address := range node.Addresses {
+			r.known[address] = node
+		}
+	}
+}
@@ -0,0 +1,339 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconcile
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gambol99/rbd-fence/pkg/membership"
+	"github.com/gambol99/rbd-fence/pkg/rbd"
+	"github.com/gambol99/rbd-fence/pkg/rbd/fake"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	nodeA   = membership.Node{ID: "i-a", Addresses: []string{"10.0.0.1"}, State: membership.StateRunning}
+	nodeB   = membership.Node{ID: "i-b", Addresses: []string{"10.0.0.2"}, State: membership.StateRunning}
+	nodeOld = membership.Node{ID: "i-old", Addresses: []string{"10.0.0.2"}, State: membership.StateTerminated}
+)
+
+// testSource ... a event source with a settable list of running nodes
+type testSource struct {
+	sync.Mutex
+	// the running nodes
+	nodes map[string]membership.Node
+}
+
+func (r *testSource) AddEventListener(int) membership.EventCh { return nil }
+
+func (r *testSource) GetRunningNodes() map[string]membership.Node {
+	r.Lock()
+	defer r.Unlock()
+	list := make(map[string]membership.Node, 0)
+	for id, node := range r.nodes {
+		list[id] = node
+	}
+	return list
+}
+
+// setRunning ... replaces the running nodes
+func (r *testSource) setRunning(nodes ...membership.Node) {
+	r.Lock()
+	defer r.Unlock()
+	r.nodes = make(map[string]membership.Node, 0)
+	for _, node := range nodes {
+		r.nodes[node.ID] = node
+	}
+}
+
+// newTestReconciler ... creates a reconciler over a cluster where 10.0.0.1 and 10.0.0.2 hold a lock each and the
+// address 10.0.0.9 holds a lock but was never seen, returning the addresses fenced and the node they were fenced for
+func newTestReconciler(t *testing.T, config Config, source *testSource) (ReconcilerInterface, *fake.FakeRBD, map[string]string) {
+	cluster := fake.NewCluster("")
+	pool := cluster.AddPool("rbd")
+	pool.AddImage("vol1").Lock("auto 1", "client.4161", "10.0.0.1")
+	pool.AddImage("vol2").Lock("auto 2", "client.4162", "10.0.0.2")
+	pool.AddImage("vol3").Lock("auto 3", "client.4163", "10.0.0.9")
+	client := fake.NewFakeRBD(cluster)
+
+	pools, err := rbd.NewPoolSelector("all", "", "")
+	if err != nil {
+		t.Fatalf("unable to create the pool selector, error: %s", err)
+	}
+	fenced := make(map[string]string, 0)
+	config.Pools = pools
+	config.Client = client
+	config.Source = source
+	config.Fence = func(node membership.Node, address string) error {
+		fenced[address] = node.ID
+		return nil
+	}
+	if config.Interval == 0 {
+		config.Interval = time.Hour
+	}
+	service, err := NewReconciler(config)
+	if err != nil {
+		t.Fatalf("unable to create the reconciler, error: %s", err)
+	}
+	t.Cleanup(service.Stop)
+
+	return service, client, fenced
+}
+
+// orphanScans ... returns the consecutive scans of the orphaned addresses in the report
+func orphanScans(report *Report) map[string]int {
+	list := make(map[string]int, 0)
+	for _, x := range report.Orphans {
+		list[x.Lock.Owner.Address] = x.Scans
+	}
+	return list
+}
+
+// unknownAddresses ... returns the sorted addresses of the unknown locks in the report
+func unknownAddresses(report *Report) []string {
+	list := make([]string, 0)
+	for _, x := range report.Unknown {
+		list = append(list, x.Owner.Address)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func TestNewReconciler(t *testing.T) {
+	client := fake.NewFakeRBD(fake.NewCluster(""))
+	fence := func(membership.Node, string) error { return nil }
+	cases := []Config{
+		{Threshold: 1, Client: client, Source: &testSource{}, Fence: fence},
+		{Interval: time.Hour, Client: client, Source: &testSource{}, Fence: fence},
+		{Interval: time.Hour, Threshold: 1, Source: &testSource{}, Fence: fence},
+		{Interval: time.Hour, Threshold: 1, Client: client, Fence: fence},
+		{Interval: time.Hour, Threshold: 1, Client: client, Source: &testSource{}},
+	}
+	for i, c := range cases {
+		_, err := NewReconciler(c)
+		assert.Error(t, err, "case %d should have failed", i)
+	}
+}
+
+func TestScan(t *testing.T) {
+	// step describes the running nodes on a scan and the expected outcome
+	type step struct {
+		running []membership.Node
+		orphans map[string]int
+		unknown []string
+		fenced  map[string]string
+	}
+	cases := []struct {
+		name      string
+		threshold int
+		started   []membership.Node
+		history   []membership.Node
+		steps     []step
+	}{
+		{
+			name:      "running nodes hold no orphans",
+			threshold: 1,
+			started:   []membership.Node{nodeA, nodeB},
+			steps: []step{
+				{running: []membership.Node{nodeA, nodeB}, unknown: []string{"10.0.0.9"}},
+			},
+		},
+		{
+			name:      "consecutive scans are counted until the threshold",
+			threshold: 3,
+			started:   []membership.Node{nodeA, nodeB},
+			steps: []step{
+				{running: []membership.Node{nodeB}, orphans: map[string]int{"10.0.0.1": 1}, unknown: []string{"10.0.0.9"}},
+				{running: []membership.Node{nodeB}, orphans: map[string]int{"10.0.0.1": 2}, unknown: []string{"10.0.0.9"}},
+				{running: []membership.Node{nodeB}, orphans: map[string]int{"10.0.0.1": 3}, unknown: []string{"10.0.0.9"},
+					fenced: map[string]string{"10.0.0.1": "i-a"}},
+				// step: the count starts again once fenced, the locks were left by the fake fence
+				{running: []membership.Node{nodeB}, orphans: map[string]int{"10.0.0.1": 1}, unknown: []string{"10.0.0.9"},
+					fenced: map[string]string{"10.0.0.1": "i-a"}},
+			},
+		},
+		{
+			name:      "a threshold of one fences on the first scan",
+			threshold: 1,
+			started:   []membership.Node{nodeA, nodeB},
+			steps: []step{
+				{running: []membership.Node{}, orphans: map[string]int{"10.0.0.1": 1, "10.0.0.2": 1}, unknown: []string{"10.0.0.9"},
+					fenced: map[string]string{"10.0.0.1": "i-a", "10.0.0.2": "i-b"}},
+			},
+		},
+		{
+			name:      "the count is reset when the node is running again",
+			threshold: 3,
+			started:   []membership.Node{nodeA, nodeB},
+			steps: []step{
+				{running: []membership.Node{nodeB}, orphans: map[string]int{"10.0.0.1": 1}, unknown: []string{"10.0.0.9"}},
+				{running: []membership.Node{nodeB}, orphans: map[string]int{"10.0.0.1": 2}, unknown: []string{"10.0.0.9"}},
+				{running: []membership.Node{nodeA, nodeB}, unknown: []string{"10.0.0.9"}},
+				{running: []membership.Node{nodeB}, orphans: map[string]int{"10.0.0.1": 1}, unknown: []string{"10.0.0.9"}},
+			},
+		},
+		{
+			name:      "addresses never seen are unknown and never fenced",
+			threshold: 1,
+			steps: []step{
+				{running: []membership.Node{}, unknown: []string{"10.0.0.1", "10.0.0.2", "10.0.0.9"}},
+				{running: []membership.Node{}, unknown: []string{"10.0.0.1", "10.0.0.2", "10.0.0.9"}},
+			},
+		},
+		{
+			name:      "a node seen running after the start is known",
+			threshold: 2,
+			steps: []step{
+				{running: []membership.Node{nodeA}, unknown: []string{"10.0.0.2", "10.0.0.9"}},
+				{running: []membership.Node{}, orphans: map[string]int{"10.0.0.1": 1}, unknown: []string{"10.0.0.2", "10.0.0.9"}},
+			},
+		},
+		{
+			name:      "the history seeds the addresses of nodes which died before the start",
+			threshold: 2,
+			history:   []membership.Node{{ID: "i-a", Addresses: []string{"10.0.0.1"}, State: membership.StateStopped}},
+			steps: []step{
+				{running: []membership.Node{}, orphans: map[string]int{"10.0.0.1": 1}, unknown: []string{"10.0.0.2", "10.0.0.9"}},
+				{running: []membership.Node{}, orphans: map[string]int{"10.0.0.1": 2}, unknown: []string{"10.0.0.2", "10.0.0.9"},
+					fenced: map[string]string{"10.0.0.1": "i-a"}},
+			},
+		},
+		{
+			name:      "the running nodes are preferred over the history",
+			threshold: 1,
+			started:   []membership.Node{nodeB},
+			history:   []membership.Node{nodeOld},
+			steps: []step{
+				{running: []membership.Node{}, orphans: map[string]int{"10.0.0.2": 1}, unknown: []string{"10.0.0.1", "10.0.0.9"},
+					fenced: map[string]string{"10.0.0.2": "i-b"}},
+			},
+		},
+	}
+	for _, c := range cases {
+		source := &testSource{}
+		source.setRunning(c.started...)
+		config := Config{Threshold: c.threshold}
+		if c.history != nil {
+			history := c.history
+			config.History = func() []membership.Node { return history }
+		}
+		service, _, fenced := newTestReconciler(t, config, source)
+
+		for i, x := range c.steps {
+			source.setRunning(x.running...)
+			report, err := service.Scan()
+			if !assert.NoError(t, err, "case: %s, step: %d", c.name, i) {
+				break
+			}
+			if x.orphans == nil {
+				x.orphans = map[string]int{}
+			}
+			if x.fenced == nil {
+				x.fenced = map[string]string{}
+			}
+			assert.Equal(t, 3, report.Locks, "case: %s, step: %d", c.name, i)
+			assert.Equal(t, x.orphans, orphanScans(report), "case: %s, step: %d", c.name, i)
+			assert.Equal(t, x.unknown, unknownAddresses(report), "case: %s, step: %d", c.name, i)
+			assert.Equal(t, x.fenced, fenced, "case: %s, step: %d", c.name, i)
+			assert.Equal(t, report, service.LastReport())
+		}
+	}
+}
+
+func TestScanOrphanedNotification(t *testing.T) {
+	source := &testSource{}
+	source.setRunning(nodeA, nodeB)
+	var notified []Orphan
+	service, _, _ := newTestReconciler(t, Config{Threshold: 3, Orphaned: func(x Orphan) { notified = append(notified, x) }}, source)
+
+	// step: the notification is only sent on the first scan an address is orphaned
+	source.setRunning(nodeB)
+	for i := 0; i < 2; i++ {
+		_, err := service.Scan()
+		assert.NoError(t, err)
+	}
+	if assert.Equal(t, 1, len(notified)) {
+		assert.Equal(t, "i-a", notified[0].NodeID)
+		assert.Equal(t, "vol1", notified[0].Lock.Image)
+		assert.Equal(t, 1, notified[0].Scans)
+	}
+}
+
+func TestScanListFailure(t *testing.T) {
+	source := &testSource{}
+	source.setRunning(nodeB)
+	service, client, fenced := newTestReconciler(t, Config{Threshold: 1}, source)
+	client.FailOn("ListLocks", fmt.Errorf("connection timed out"))
+
+	_, err := service.Scan()
+	assert.Error(t, err)
+	assert.Nil(t, service.LastReport())
+	assert.Equal(t, 0, len(fenced))
+}
+
+func TestResetWhenInactive(t *testing.T) {
+	source := &testSource{}
+	source.setRunning(nodeA, nodeB)
+	// step: each check of the leadership waits on the test, so we control the loop
+	activeCh := make(chan bool)
+	service, _, fenced := newTestReconciler(t, Config{
+		Interval:  time.Duration(5) * time.Millisecond,
+		Threshold: 3,
+		Active:    func() bool { return <-activeCh },
+	}, source)
+	t.Cleanup(func() { close(activeCh) })
+
+	source.setRunning(nodeB)
+	for i := 1; i <= 2; i++ {
+		report, err := service.Scan()
+		if assert.NoError(t, err) {
+			assert.Equal(t, map[string]int{"10.0.0.1": i}, orphanScans(report))
+		}
+	}
+
+	// step: losing the leadership forgets the count, the next scan as the leader starts again
+	activeCh <- false
+	activeCh <- true
+	// step: wait for the loop to finish the scan
+	activeCh <- false
+	assert.Equal(t, map[string]int{"10.0.0.1": 1}, orphanScans(service.LastReport()))
+	assert.Equal(t, 0, len(fenced))
+}
+
+func TestReconfigure(t *testing.T) {
+	source := &testSource{}
+	source.setRunning(nodeA, nodeB)
+	service, _, fenced := newTestReconciler(t, Config{Threshold: 3}, source)
+
+	assert.Error(t, service.Reconfigure(Config{Interval: time.Hour}))
+	assert.Error(t, service.Reconfigure(Config{Threshold: 1}))
+
+	// step: the count is kept across the change of threshold
+	source.setRunning(nodeB)
+	_, err := service.Scan()
+	assert.NoError(t, err)
+	pools, _ := rbd.NewPoolSelector("all", "", "")
+	assert.NoError(t, service.Reconfigure(Config{Interval: time.Hour, Threshold: 2, Pools: pools}))
+	_, err = service.Scan()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"10.0.0.1": "i-a"}, fenced)
+}
@@ -18,46 +18,118 @@ package utils
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/gambol99/rbd-fence/pkg/metrics"
+
 	"github.com/golang/glog"
 )
 
-// Execute ... executes a command and returns the output
+// the timeout used when none is given
+var defaultTimeout = time.Duration(10) * time.Second
+
+// ExecError ... the error returned when a command could not be run or exited with a failure
+type ExecError struct {
+	// the full command line
+	Command string
+	// the exit code of the command, -1 if the command did not exit
+	ExitCode int
+	// the standard error of the command
+	Stderr string
+	// whether the command was killed on reaching the deadline
+	TimedOut bool
+	// the underlying error
+	Err error
+}
+
+func (r *ExecError) Error() string {
+	var message string
+	switch {
+	case r.TimedOut:
+		message = fmt.Sprintf("command: '%s' timed out", r.Command)
+	case r.ExitCode >= 0:
+		message = fmt.Sprintf("command: '%s' failed with exit code: %d", r.Command, r.ExitCode)
+	default:
+		message = fmt.Sprintf("command: '%s' failed, error: %s", r.Command, r.Err)
+	}
+	if r.Stderr != "" {
+		message = fmt.Sprintf("%s, stderr: %s", message, r.Stderr)
+	}
+	return message
+}
+
+// Unwrap ... returns the underlying error
+func (r *ExecError) Unwrap() error {
+	return r.Err
+}
+
+// Execute ... executes a command and returns the standard output
+// 	timeout:	a time.Duration to wait before killing off the command
 // 	command:	the command you wish to execute
 //	args:		an array of argument to pass to the command
-// 	timeout:	a time.Duration to wait before killing off the command
 func Execute(timeout time.Duration, command string, args ...string) ([]byte, error) {
-	var b bytes.Buffer
-
 	if timeout.Seconds() <= 0 {
-		timeout = time.Duration(10) * time.Second
+		timeout = defaultTimeout
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	glog.V(4).Infof("Attempting to execute the command: %s, args: [%s], timeout: %s", command,
-		strings.Join(args, ","), timeout.String())
-
-	cmd := exec.Command(command, args...)
-	cmd.Stdout = &b
-	cmd.Stderr = &b
-	cmd.Start()
-	timer := time.AfterFunc(timeout, func() {
-		err := cmd.Process.Kill()
-		if err != nil {
-			panic(err)
-		}
-	})
-	err := cmd.Wait()
+	stdout, _, err := ExecuteContext(ctx, command, args...)
+	return stdout, err
+}
+
+// ExecuteContext ... executes a command until it completes or the context is done, returning the standard
+// output and error separately. A failure is returned as a *ExecError
+// 	command:	the command you wish to execute
+//	args:		an array of argument to pass to the command
+func ExecuteContext(ctx context.Context, command string, args ...string) ([]byte, []byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	commandLine := strings.Join(append([]string{command}, args...), " ")
+	glog.V(4).Infof("Attempting to execute the command: %s", commandLine)
+
+	// step: record the latency of the command
+	name := filepath.Base(command)
+	started := time.Now()
+	defer func() {
+		metrics.CommandDuration.WithLabelValues(name).Observe(time.Since(started).Seconds())
+	}()
+
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
 	if err != nil {
-		glog.Errorf("Failed to execute the command, error: %s", err)
-		return []byte{}, err
-	}
-	// stop the timer
-	timer.Stop()
+		execErr := &ExecError{
+			Command:  commandLine,
+			ExitCode: -1,
+			Stderr:   strings.TrimSpace(stderr.String()),
+			TimedOut: errors.Is(ctx.Err(), context.DeadlineExceeded),
+			Err:      err,
+		}
+		// step: a command killed by the context exits by signal, so we only take the code of a real exit
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.Exited() {
+			execErr.ExitCode = exitErr.ExitCode()
+		}
+		if ctx.Err() != nil {
+			execErr.Err = ctx.Err()
+		}
+		glog.Errorf("Failed to execute the command, error: %s", execErr)
+		metrics.CommandErrors.WithLabelValues(name).Inc()
 
-	glog.V(5).Infof("Command output: %s", b.String())
+		return stdout.Bytes(), stderr.Bytes(), execErr
+	}
+	if stderr.Len() > 0 {
+		glog.V(4).Infof("The command: %s, wrote to stderr: %s", commandLine, strings.TrimSpace(stderr.String()))
+	}
+	glog.V(5).Infof("Command output: %s", stdout.String())
 
-	return b.Bytes(), nil
+	return stdout.Bytes(), stderr.Bytes(), nil
 }
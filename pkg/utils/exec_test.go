@@ -0,0 +1,77 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecuteContext(t *testing.T) {
+	stdout, stderr, err := ExecuteContext(context.Background(), "/bin/sh", "-c", "echo '[]'; echo warning >&2")
+	assert.NoError(t, err)
+	assert.Equal(t, "[]\n", string(stdout))
+	assert.Equal(t, "warning\n", string(stderr))
+}
+
+func TestExecuteContextExitCode(t *testing.T) {
+	stdout, _, err := ExecuteContext(context.Background(), "/bin/sh", "-c", "echo partial; echo 'Error EINVAL' >&2; exit 22")
+	var execErr *ExecError
+	if assert.True(t, errors.As(err, &execErr)) {
+		assert.Equal(t, "/bin/sh -c echo partial; echo 'Error EINVAL' >&2; exit 22", execErr.Command)
+		assert.Equal(t, 22, execErr.ExitCode)
+		assert.Equal(t, "Error EINVAL", execErr.Stderr)
+		assert.False(t, execErr.TimedOut)
+		assert.Contains(t, execErr.Error(), "exit code: 22")
+	}
+	assert.Equal(t, "partial\n", string(stdout))
+}
+
+func TestExecuteContextTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(100)*time.Millisecond)
+	defer cancel()
+	_, _, err := ExecuteContext(ctx, "/bin/sh", "-c", "exec sleep 5")
+	var execErr *ExecError
+	if assert.True(t, errors.As(err, &execErr)) {
+		assert.True(t, execErr.TimedOut)
+		assert.Equal(t, -1, execErr.ExitCode)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	}
+}
+
+func TestExecuteContextMissingCommand(t *testing.T) {
+	_, _, err := ExecuteContext(context.Background(), "/does/not/exist", "arg")
+	var execErr *ExecError
+	if assert.True(t, errors.As(err, &execErr)) {
+		assert.Equal(t, -1, execErr.ExitCode)
+		assert.False(t, execErr.TimedOut)
+		assert.Contains(t, execErr.Error(), "/does/not/exist arg")
+	}
+}
+
+func TestExecute(t *testing.T) {
+	stdout, err := Execute(0, "/bin/sh", "-c", "echo out; echo err >&2")
+	assert.NoError(t, err)
+	assert.Equal(t, "out\n", string(stdout))
+
+	_, err = Execute(time.Duration(100)*time.Millisecond, "/bin/sh", "-c", "exec sleep 5")
+	assert.Error(t, err)
+}